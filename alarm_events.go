@@ -0,0 +1,365 @@
+// Copyright: 2024 Dragos Vingarzan vingarzan -at- gmail -dot- com
+// License: AGPL-3.0
+//
+// This file is part of sun2000-modbus.
+//
+// sun2000-modbus is free software: you can redistribute it and/or modify it under the terms of the GNU Affero General
+// Public License Version 3 (AGPL-3.0) as published by the Free Software Foundation.
+//
+// sun2000-modbus is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY; without even the implied
+// warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the AGPL-3.0 along with sun2000-modbus. If not,
+// see <https://www.gnu.org/licenses/>.
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/vingarzan/sun2000-modbus/sun2000"
+)
+
+// The alarm events: each alarm raised or cleared, as seen between two reads of the alarm bitfields. They are kept in a
+// ring, optionally appended to a file, and sent to the webhooks.
+
+// How many events are kept in memory, and loaded back from the file on start.
+const alarmEventRingSize = 1000
+
+const (
+	alarmRaised  = "raised"
+	alarmCleared = "cleared"
+)
+
+type alarmEvent struct {
+	Time   time.Time `json:"time"`
+	Device string    `json:"device"`
+	SN     string    `json:"sn,omitempty"`
+	// alarmRaised or alarmCleared
+	Event string `json:"event"`
+	ID    uint16 `json:"id"`
+	Name  string `json:"name"`
+	Level string `json:"level"`
+}
+
+func parseAlarmLevel(s string) (sun2000.AlarmLevel, error) {
+	for _, l := range []sun2000.AlarmLevel{sun2000.AlarmLevelWarning, sun2000.AlarmLevelMinor, sun2000.AlarmLevelMajor} {
+		if strings.EqualFold(s, l.String()) {
+			return l, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown alarm level %q, not one of Warning, Minor or Major", s)
+}
+
+// alarmWebhook POSTs the events of at least minLevel to the URL, as JSON, one by one and in order. Failed ones are
+// retried, waiting backoff, then doubling it each time.
+type alarmWebhook struct {
+	url      string
+	minLevel sun2000.AlarmLevel
+	retries  int
+	backoff  time.Duration
+	client   *http.Client
+	queue    chan alarmEvent
+	// closed on shutdown, to stop waiting for the retries
+	stop chan struct{}
+}
+
+const (
+	// The longest wait between the retries of a webhook.
+	alarmWebhookMaxBackoff = 5 * time.Minute
+	// How long the shutdown waits for the webhooks to send what they have queued.
+	alarmWebhookCloseTimeout = 10 * time.Second
+)
+
+// parseAlarmWebhooks parses a comma separated list of URLs, each optionally prefixed by the minimum level of the alarms
+// to send to it, e.g.:
+//
+//	https://example.com/all,major:https://example.com/pager
+func parseAlarmWebhooks(in string) (out []*alarmWebhook, err error) {
+	for _, entry := range strings.Split(in, ",") {
+		entry = strings.TrimSpace(entry)
+		if len(entry) == 0 {
+			continue
+		}
+		w := &alarmWebhook{url: entry, minLevel: sun2000.AlarmLevelWarning, retries: 5, backoff: time.Second}
+		if prefix, url, found := strings.Cut(entry, ":"); found {
+			if level, err := parseAlarmLevel(prefix); err == nil {
+				w.url, w.minLevel = url, level
+			}
+		}
+		if !strings.HasPrefix(w.url, "http://") && !strings.HasPrefix(w.url, "https://") {
+			return nil, fmt.Errorf("webhook %q is not in the [level:]http(s)://... format", entry)
+		}
+		out = append(out, w)
+	}
+	return out, nil
+}
+
+func (w *alarmWebhook) run() {
+	for e := range w.queue {
+		w.send(e)
+	}
+}
+
+func (w *alarmWebhook) send(e alarmEvent) {
+	body, _ := json.Marshal(e)
+	backoff := w.backoff
+	for attempt := 0; ; attempt++ {
+		err := w.post(body)
+		if err == nil {
+			return
+		}
+		if attempt >= w.retries {
+			lError.Printf("Alarm webhook %s failed %d times, dropping the %s event of %s: %v", w.url, attempt+1, e.Event, e.Name, err)
+			return
+		}
+		select {
+		case <-w.stop:
+			lError.Printf("Alarm webhook %s failed while shutting down, dropping the %s event of %s: %v", w.url, e.Event, e.Name, err)
+			return
+		default:
+		}
+		lWarning.Printf("Alarm webhook %s failed, retrying in %s: %v", w.url, backoff, err)
+		select {
+		case <-w.stop:
+		case <-time.After(backoff):
+		}
+		backoff = min(2*backoff, alarmWebhookMaxBackoff)
+	}
+}
+
+func (w *alarmWebhook) post(body []byte) error {
+	resp, err := w.client.Post(w.url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("status %s", resp.Status)
+	}
+	return nil
+}
+
+// alarmTracker turns the alarm bitfields read into events, as a blockListener.
+type alarmTracker struct {
+	sync.Mutex
+	// the names of the active alarms, by device name
+	active map[string]map[string]bool
+	events []alarmEvent
+	file   *os.File
+
+	webhooks []*alarmWebhook
+	senders  sync.WaitGroup
+}
+
+// The alarm events of all the devices, set up by main().
+var alarmEvents = newAlarmTracker()
+
+func newAlarmTracker() *alarmTracker {
+	return &alarmTracker{active: make(map[string]map[string]bool)}
+}
+
+// open loads the events from the file, if it exists, then appends the new ones to it. The active alarms are restored
+// from it too, so a restart does not raise them again.
+func (x *alarmTracker) open(path string) error {
+	x.Lock()
+	defer x.Unlock()
+	if in, err := os.Open(path); err == nil {
+		scanner := bufio.NewScanner(in)
+		for scanner.Scan() {
+			var e alarmEvent
+			if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+				lWarning.Printf("Skipping an invalid line of %s: %v", path, err)
+				continue
+			}
+			x.record(e)
+		}
+		in.Close()
+		if err := scanner.Err(); err != nil {
+			return err
+		}
+	}
+	var err error
+	x.file, err = os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o640)
+	return err
+}
+
+// addWebhooks starts sending the events to the webhooks.
+func (x *alarmTracker) addWebhooks(webhooks []*alarmWebhook) {
+	x.Lock()
+	defer x.Unlock()
+	for _, w := range webhooks {
+		if w.client == nil {
+			w.client = &http.Client{Timeout: 10 * time.Second}
+		}
+		w.queue = make(chan alarmEvent, 100)
+		w.stop = make(chan struct{})
+		x.senders.Add(1)
+		go func() {
+			defer x.senders.Done()
+			w.run()
+		}()
+		x.webhooks = append(x.webhooks, w)
+	}
+}
+
+// close closes the file, and stops the webhooks after they send what they have queued, waiting at most
+// alarmWebhookCloseTimeout for them. The failed events are not retried anymore, but dropped.
+func (x *alarmTracker) close() {
+	x.Lock()
+	webhooks := x.webhooks
+	x.webhooks = nil
+	if x.file != nil {
+		x.file.Close()
+		x.file = nil
+	}
+	x.Unlock()
+	if len(webhooks) == 0 {
+		return
+	}
+	for _, w := range webhooks {
+		close(w.stop)
+		close(w.queue)
+	}
+	done := make(chan struct{})
+	go func() {
+		x.senders.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(alarmWebhookCloseTimeout):
+		lWarning.Printf("Alarm webhooks not done after %s, dropping the events left", alarmWebhookCloseTimeout)
+	}
+}
+
+// record adds the event to the ring and to the active alarms. The caller must hold the lock.
+func (x *alarmTracker) record(e alarmEvent) {
+	active := x.active[e.Device]
+	if active == nil {
+		active = make(map[string]bool)
+		x.active[e.Device] = active
+	}
+	if e.Event == alarmRaised {
+		active[e.Name] = true
+	} else {
+		delete(active, e.Name)
+	}
+	x.events = append(x.events, e)
+	if len(x.events) > alarmEventRingSize {
+		x.events = append([]alarmEvent{}, x.events[len(x.events)-alarmEventRingSize:]...)
+	}
+}
+
+// emit records the event, writes it to the file and queues it to the webhooks. The caller must hold the lock.
+func (x *alarmTracker) emit(e alarmEvent, level sun2000.AlarmLevel) {
+	x.record(e)
+	line, _ := json.Marshal(e)
+	lWarning.Printf("Alarm %s on %s: %s", e.Event, e.Device, line)
+	if x.file != nil {
+		if _, err := x.file.Write(append(line, '\n')); err != nil {
+			lError.Printf("Error writing the alarm event log: %v", err)
+		}
+	}
+	for _, w := range x.webhooks {
+		if level < w.minLevel {
+			continue
+		}
+		select {
+		case w.queue <- e:
+		default:
+			lError.Printf("Alarm webhook %s is too far behind, dropping the %s event of %s", w.url, e.Event, e.Name)
+		}
+	}
+}
+
+// blockParsed compares the alarms just read with the ones active before, and emits the transitions.
+func (x *alarmTracker) blockParsed(d *device, r *modbusInterval) {
+	alarm, ok := r.target.(*alarmData1)
+	if !ok {
+		return
+	}
+	alarm.RLock()
+	current := sun2000.ActiveAlarms(alarm.Bits)
+	now := alarm.lastRead
+	alarm.RUnlock()
+	d.data.identification.RLock()
+	sn := d.data.identification.SN
+	d.data.identification.RUnlock()
+
+	x.Lock()
+	defer x.Unlock()
+	previous := make(map[string]bool)
+	for name := range x.active[d.name] {
+		previous[name] = true
+	}
+	for _, a := range current {
+		if !previous[a.Name] {
+			x.emit(alarmEvent{Time: now, Device: d.name, SN: sn, Event: alarmRaised, ID: a.ID, Name: a.Name, Level: a.Level.String()}, a.Level)
+		}
+		delete(previous, a.Name)
+	}
+	// what is left was cleared
+	for _, a := range sun2000.KnownAlarms {
+		if previous[a.Name] {
+			x.emit(alarmEvent{Time: now, Device: d.name, SN: sn, Event: alarmCleared, ID: a.ID, Name: a.Name, Level: a.Level.String()}, a.Level)
+		}
+	}
+}
+
+// query returns the events of the device (all if empty), of at least minLevel, after since, the newest limit ones.
+func (x *alarmTracker) query(device string, minLevel sun2000.AlarmLevel, since time.Time, limit int) []alarmEvent {
+	x.Lock()
+	defer x.Unlock()
+	out := []alarmEvent{}
+	for _, e := range x.events {
+		level, _ := parseAlarmLevel(e.Level)
+		if (len(device) > 0 && e.Device != device) || level < minLevel || !e.Time.After(since) {
+			continue
+		}
+		out = append(out, e)
+	}
+	if limit > 0 && len(out) > limit {
+		out = out[len(out)-limit:]
+	}
+	return out
+}
+
+// handleAlarmEvents serves the alarm events, oldest first, filtered by ?device=, ?level= (the minimum), ?since= (as
+// RFC3339) and ?limit=.
+func handleAlarmEvents(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	minLevel := sun2000.AlarmLevelWarning
+	since := time.Time{}
+	limit := 0
+	var err error
+	if s := q.Get("level"); len(s) > 0 {
+		if minLevel, err = parseAlarmLevel(s); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	if s := q.Get("since"); len(s) > 0 {
+		if since, err = time.Parse(time.RFC3339, s); err != nil {
+			http.Error(w, fmt.Sprintf("invalid since: %v", err), http.StatusBadRequest)
+			return
+		}
+	}
+	if s := q.Get("limit"); len(s) > 0 {
+		if limit, err = strconv.Atoi(s); err != nil || limit < 0 {
+			http.Error(w, fmt.Sprintf("invalid limit %q", s), http.StatusBadRequest)
+			return
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(alarmEvents.query(q.Get("device"), minLevel, since, limit))
+}
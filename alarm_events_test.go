@@ -0,0 +1,186 @@
+// Copyright: 2024 Dragos Vingarzan vingarzan -at- gmail -dot- com
+// License: AGPL-3.0
+//
+// This file is part of sun2000-modbus.
+//
+// sun2000-modbus is free software: you can redistribute it and/or modify it under the terms of the GNU Affero General
+// Public License Version 3 (AGPL-3.0) as published by the Free Software Foundation.
+//
+// sun2000-modbus is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY; without even the implied
+// warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the AGPL-3.0 along with sun2000-modbus. If not,
+// see <https://www.gnu.org/licenses/>.
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/vingarzan/sun2000-modbus/sun2000"
+)
+
+// webhookReceiver records the events POSTed to it, after failing the first ones.
+type webhookReceiver struct {
+	sync.Mutex
+	failures int
+	events   []alarmEvent
+	received chan struct{}
+}
+
+func (x *webhookReceiver) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	x.Lock()
+	defer x.Unlock()
+	if x.failures > 0 {
+		x.failures--
+		http.Error(w, "try again", http.StatusServiceUnavailable)
+		return
+	}
+	var e alarmEvent
+	if err := json.NewDecoder(r.Body).Decode(&e); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	x.events = append(x.events, e)
+	x.received <- struct{}{}
+}
+
+func (x *webhookReceiver) wait(t *testing.T, n int) []alarmEvent {
+	t.Helper()
+	for i := 0; i < n; i++ {
+		select {
+		case <-x.received:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("received only %d events of %d", i, n)
+		}
+	}
+	x.Lock()
+	defer x.Unlock()
+	return append([]alarmEvent{}, x.events...)
+}
+
+func TestAlarmEvents(t *testing.T) {
+	all := &webhookReceiver{failures: 2, received: make(chan struct{}, 10)}
+	major := &webhookReceiver{received: make(chan struct{}, 10)}
+	mux := http.NewServeMux()
+	mux.Handle("/all", all)
+	mux.Handle("/major", major)
+	receiver := httptest.NewServer(mux)
+	defer receiver.Close()
+
+	webhooks, err := parseAlarmWebhooks(receiver.URL + "/all, major:" + receiver.URL + "/major")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if webhooks[0].minLevel != sun2000.AlarmLevelWarning || webhooks[1].minLevel != sun2000.AlarmLevelMajor || webhooks[1].url != receiver.URL+"/major" {
+		t.Fatalf("unexpected webhooks %+v %+v", webhooks[0], webhooks[1])
+	}
+	for _, w := range webhooks {
+		w.backoff = 10 * time.Millisecond
+	}
+	if _, err := parseAlarmWebhooks("critical:http://localhost/"); err == nil {
+		t.Errorf("an unknown level was accepted")
+	}
+
+	path := filepath.Join(t.TempDir(), "alarms.log")
+	tracker := newAlarmTracker()
+	if err := tracker.open(path); err != nil {
+		t.Fatal(err)
+	}
+	tracker.addWebhooks(webhooks)
+
+	d := newDevices([]deviceConfig{{name: "test", ip: "127.0.0.1", port: 502, slaveID: 1}})[0]
+	r := d.findRange("alarm1")
+	read := func(x *alarmTracker, alarm [sun2000.AlarmCount]uint16) {
+		d.data.alarm1.Lock()
+		d.data.alarm1.Bits = alarm
+		d.data.alarm1.lastRead = time.Now()
+		d.data.alarm1.Unlock()
+		x.blockParsed(d, r)
+	}
+
+	// Churn Output Overload is Major, Optimizer Fault a Warning
+	read(tracker, [sun2000.AlarmCount]uint16{})
+	read(tracker, [sun2000.AlarmCount]uint16{0, 0b10, 0x8000})
+	read(tracker, [sun2000.AlarmCount]uint16{0, 0b10, 0x8000})
+	read(tracker, [sun2000.AlarmCount]uint16{0, 0, 0x8000})
+
+	events := all.wait(t, 3)
+	if len(events) != 3 || events[0].Event != alarmRaised || events[2].Event != alarmCleared || events[2].Name != "Churn Output Overload" ||
+		events[2].ID != 2077 || events[2].Level != "Major" || events[2].Device != "test" {
+		t.Errorf("unexpected events %+v", events)
+	}
+	events = major.wait(t, 2)
+	if len(events) != 2 || events[0].Name != "Churn Output Overload" || events[1].Event != alarmCleared {
+		t.Errorf("unexpected Major events %+v", events)
+	}
+	tracker.close()
+
+	// the events and the active alarms are loaded back
+	tracker = newAlarmTracker()
+	if err := tracker.open(path); err != nil {
+		t.Fatal(err)
+	}
+	defer tracker.close()
+	read(tracker, [sun2000.AlarmCount]uint16{0, 0, 0x8000})
+	if events := tracker.query("", sun2000.AlarmLevelWarning, time.Time{}, 0); len(events) != 3 {
+		t.Errorf("unexpected events after loading %+v", events)
+	}
+
+	alarmEvents = tracker
+	defer func() { alarmEvents = newAlarmTracker() }()
+	for query, expected := range map[string]int{"": 3, "?level=major": 2, "?device=other": 0, "?limit=1": 1, "?since=2100-01-01T00:00:00Z": 0} {
+		w := httptest.NewRecorder()
+		handleAlarmEvents(w, httptest.NewRequest(http.MethodGet, "/api/v1/alarms/events"+query, nil))
+		var out []alarmEvent
+		if err := json.Unmarshal(w.Body.Bytes(), &out); err != nil || len(out) != expected {
+			t.Errorf("%q: %d events instead of %d: %s", query, len(out), expected, w.Body)
+		}
+	}
+	w := httptest.NewRecorder()
+	handleAlarmEvents(w, httptest.NewRequest(http.MethodGet, "/api/v1/alarms/events?level=critical", nil))
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("an unknown level was accepted: %d", w.Code)
+	}
+}
+
+func TestAlarmWebhooksClose(t *testing.T) {
+	ok := &webhookReceiver{received: make(chan struct{}, 10)}
+	failing := &webhookReceiver{failures: 1000, received: make(chan struct{}, 10)}
+	mux := http.NewServeMux()
+	mux.Handle("/ok", ok)
+	mux.Handle("/failing", failing)
+	receiver := httptest.NewServer(mux)
+	defer receiver.Close()
+	webhooks, err := parseAlarmWebhooks(receiver.URL + "/ok," + receiver.URL + "/failing")
+	if err != nil {
+		t.Fatal(err)
+	}
+	webhooks[1].backoff = time.Hour
+
+	tracker := newAlarmTracker()
+	tracker.addWebhooks(webhooks)
+	tracker.Lock()
+	for i := 0; i < 3; i++ {
+		tracker.emit(alarmEvent{Device: "test", Event: alarmRaised, Name: "Test", ID: uint16(i)}, sun2000.AlarmLevelMajor)
+	}
+	tracker.Unlock()
+
+	// what is queued is sent before close returns, and the retries are not waited for
+	start := time.Now()
+	tracker.close()
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("close took %s", elapsed)
+	}
+	ok.Lock()
+	defer ok.Unlock()
+	if len(ok.events) != 3 {
+		t.Errorf("%d events sent before closing, want 3", len(ok.events))
+	}
+}
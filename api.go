@@ -0,0 +1,205 @@
+// Copyright: 2024 Dragos Vingarzan vingarzan -at- gmail -dot- com
+// License: AGPL-3.0
+//
+// This file is part of sun2000-modbus.
+//
+// sun2000-modbus is free software: you can redistribute it and/or modify it under the terms of the GNU Affero General
+// Public License Version 3 (AGPL-3.0) as published by the Free Software Foundation.
+//
+// sun2000-modbus is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY; without even the implied
+// warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the AGPL-3.0 along with sun2000-modbus. If not,
+// see <https://www.gnu.org/licenses/>.
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/vingarzan/sun2000-modbus/sun2000"
+)
+
+// The JSON API, with the decoded values of the blocks of each device, as in the register map, next to their units and
+// to when they were read.
+
+// apiCategories are the blocks returned by each endpoint, by target. "blocks" returns all of them, and "alarms" the
+// decoded alarms instead.
+var apiCategories = map[string][]string{
+	"identification": {"identification", "product", "hardware1", "hardware2", "hardware3", "hardware4", "hardware5", "hardware6"},
+	"inverter": {"inverter", "pv", "mppt1", "mppt2", "stringAccess", "internalTemperature", "remoteSignalling",
+		"cumulative1", "cumulative2", "cumulative3"},
+	"meter":   {"meter"},
+	"battery": {"esu1", "esu2", "esu1Pack1", "esu1Pack2", "esu1Pack3", "esu2Pack1", "esu2Pack2", "esu2Pack3", "esuTemperatures"},
+}
+
+type apiValue struct {
+	// a number, or the text for STR, E16 and Epoch
+	Value any `json:"value"`
+	// the raw number of an E16, next to its text
+	Code        *int   `json:"code,omitempty"`
+	Unit        string `json:"unit,omitempty"`
+	Description string `json:"description,omitempty"`
+}
+
+// apiFreshness tells when the values were read, and if they are stale: not read yet, or not read again in time (see
+// modbusInterval.staleAfter).
+type apiFreshness struct {
+	LastRead   string   `json:"lastRead,omitempty"`
+	NextRead   string   `json:"nextRead,omitempty"`
+	AgeSeconds *float64 `json:"ageSeconds,omitempty"`
+	Stale      bool     `json:"stale"`
+}
+
+func newAPIFreshness(x *genericData, staleAfter time.Duration, now time.Time) (out apiFreshness) {
+	if x.lastRead.IsZero() {
+		out.Stale = true
+		return out
+	}
+	age := now.Sub(x.lastRead)
+	ageSeconds := age.Seconds()
+	out.LastRead = x.lastRead.Format(time.RFC3339)
+	out.NextRead = x.nextRead.Format(time.RFC3339)
+	out.AgeSeconds = &ageSeconds
+	out.Stale = staleAfter > 0 && age > staleAfter
+	return out
+}
+
+type apiBlock struct {
+	Name string `json:"name"`
+	apiFreshness
+	Values map[string]apiValue `json:"values"`
+}
+
+// alarmJSON is an active alarm, as in the API and on MQTT.
+type alarmJSON struct {
+	ID    uint16 `json:"id"`
+	Name  string `json:"name"`
+	Level string `json:"level"`
+}
+
+func alarmsJSON(alarms []sun2000.Alarm) []alarmJSON {
+	out := []alarmJSON{}
+	for _, a := range alarms {
+		out = append(out, alarmJSON{ID: a.ID, Name: a.Name, Level: a.Level.String()})
+	}
+	return out
+}
+
+type apiAlarms struct {
+	apiFreshness
+	Count  int         `json:"count"`
+	Active []alarmJSON `json:"active"`
+}
+
+type apiDevice struct {
+	Device string `json:"device"`
+	Model  string `json:"model,omitempty"`
+	SN     string `json:"sn,omitempty"`
+	// by target, or by the name of the block for the ones without one
+	Blocks map[string]*apiBlock `json:"blocks,omitempty"`
+	Alarms *apiAlarms           `json:"alarms,omitempty"`
+}
+
+// apiBlock returns the values of the block, or nil if there is nothing to show, like for missing battery packs.
+func (r *modbusInterval) apiBlock(caps *capabilities, now time.Time) *apiBlock {
+	if pack, ok := r.target.(*batteryData); ok && !pack.isPresent() {
+		return nil
+	}
+	x := r.values
+	x.RLock()
+	defer x.RUnlock()
+	out := &apiBlock{Name: r.name, apiFreshness: newAPIFreshness(&x.genericData, r.staleAfter, now), Values: make(map[string]apiValue)}
+	for i := range x.values {
+		v := &x.values[i]
+		if !caps.hasValue(v) {
+			continue
+		}
+		value := apiValue{Value: v.jsonValue(), Unit: v.field.Unit, Description: v.field.Description}
+		if v.field.Type == registerTypeE16 {
+			code := int(v.number)
+			value.Code = &code
+		}
+		out.Values[v.key()] = value
+	}
+	return out
+}
+
+func (d *device) apiAlarms(now time.Time) *apiAlarms {
+	x := &d.data.alarm1
+	staleAfter := time.Duration(0)
+	if r := d.findRange("alarm1"); r != nil {
+		staleAfter = r.staleAfter
+	}
+	x.RLock()
+	defer x.RUnlock()
+	out := &apiAlarms{apiFreshness: newAPIFreshness(&x.genericData, staleAfter, now), Active: []alarmJSON{}}
+	if !x.lastRead.IsZero() {
+		out.Active = alarmsJSON(sun2000.ActiveAlarms(x.Bits))
+		out.Count = len(out.Active)
+	}
+	return out
+}
+
+// apiDevice returns the device with the blocks of the category.
+func (d *device) apiDevice(category string, now time.Time) *apiDevice {
+	id := &d.data.identification
+	id.RLock()
+	out := &apiDevice{Device: d.name, Model: id.Model, SN: id.SN}
+	id.RUnlock()
+
+	if category == "alarms" {
+		out.Alarms = d.apiAlarms(now)
+		return out
+	}
+	targets := make(map[string]bool)
+	for _, t := range apiCategories[category] {
+		targets[t] = true
+	}
+	out.Blocks = make(map[string]*apiBlock)
+	for i := range d.addrRanges {
+		r := &d.addrRanges[i]
+		key := r.values.block.Target
+		if category != "blocks" && !targets[key] || !d.caps.polls(key) {
+			continue
+		}
+		if len(key) == 0 {
+			key = mqttSlug(r.name)
+		}
+		if b := r.apiBlock(&d.caps, now); b != nil {
+			out.Blocks[key] = b
+		}
+	}
+	return out
+}
+
+// handleAPI serves /api/v1/{category}, for all the devices, or only the one given with ?device=name.
+func handleAPI(w http.ResponseWriter, r *http.Request) {
+	category := r.PathValue("category")
+	if _, ok := apiCategories[category]; !ok && category != "blocks" && category != "alarms" {
+		http.Error(w, fmt.Sprintf("unknown category %q", category), http.StatusNotFound)
+		return
+	}
+	selected := devices
+	if name := r.URL.Query().Get("device"); len(name) > 0 {
+		d, err := findDevice(devices, name)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		selected = []*device{d}
+	}
+
+	now := time.Now()
+	out := []*apiDevice{}
+	for _, d := range selected {
+		out = append(out, d.apiDevice(category, now))
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(out); err != nil {
+		lWarning.Printf("Error writing the API response: %v", err)
+	}
+}
@@ -0,0 +1,95 @@
+// Copyright: 2024 Dragos Vingarzan vingarzan -at- gmail -dot- com
+// License: AGPL-3.0
+//
+// This file is part of sun2000-modbus.
+//
+// sun2000-modbus is free software: you can redistribute it and/or modify it under the terms of the GNU Affero General
+// Public License Version 3 (AGPL-3.0) as published by the Free Software Foundation.
+//
+// sun2000-modbus is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY; without even the implied
+// warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the AGPL-3.0 along with sun2000-modbus. If not,
+// see <https://www.gnu.org/licenses/>.
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestAPI(t *testing.T) {
+	server := startSimulator(t, nil)
+	testDevices := simulatorDevices(t, server, 1, 2)
+	// the first read after connecting is not answered
+	testDevices[0].readModbusFromTo("dummy read", 30000, 30015)
+	for _, d := range testDevices {
+		d.readExpiredRanges(context.Background())
+	}
+	devices = testDevices
+	t.Cleanup(func() { devices = nil })
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /api/v1/{category}", handleAPI)
+	get := func(path string) (int, []apiDevice) {
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, httptest.NewRequest(http.MethodGet, path, nil))
+		var out []apiDevice
+		if w.Code == http.StatusOK {
+			if err := json.Unmarshal(w.Body.Bytes(), &out); err != nil {
+				t.Fatalf("%s: %v in %s", path, err, w.Body)
+			}
+		}
+		return w.Code, out
+	}
+
+	code, out := get("/api/v1/inverter")
+	if code != http.StatusOK || len(out) != 2 {
+		t.Fatalf("unexpected response %d %+v", code, out)
+	}
+	inverter := out[0].Blocks["inverter"]
+	if out[0].Device != "sim1" || out[0].SN != "SIM0000001" || inverter == nil {
+		t.Fatalf("unexpected device %+v", out[0])
+	}
+	if inverter.Stale || inverter.AgeSeconds == nil || len(inverter.LastRead) == 0 || len(inverter.NextRead) == 0 {
+		t.Errorf("unexpected freshness %+v", inverter.apiFreshness)
+	}
+	power := inverter.Values["activePower"]
+	if p, ok := power.Value.(float64); !ok || p <= 0 || power.Unit != "kW" || power.Description != "Active Power" {
+		t.Errorf("unexpected activePower %+v", power)
+	}
+	status := inverter.Values["deviceStatus"]
+	if status.Value != "On-grid: running" || status.Code == nil || *status.Code != 512 {
+		t.Errorf("unexpected deviceStatus %+v", status)
+	}
+	if _, ok := out[0].Blocks["pv"].Values["pv_voltage_1"]; !ok {
+		t.Errorf("no pv_voltage_1 in %+v", out[0].Blocks["pv"])
+	}
+	if _, ok := out[0].Blocks["meter"]; ok {
+		t.Errorf("the meter is not part of the inverter")
+	}
+
+	code, out = get("/api/v1/battery?device=sim2")
+	if code != http.StatusOK || len(out) != 1 || out[0].Device != "sim2" {
+		t.Fatalf("unexpected response %d %+v", code, out)
+	}
+	if out[0].Blocks["esu1"] == nil || out[0].Blocks["esu1Pack1"] == nil || out[0].Blocks["esu1Pack2"] != nil {
+		t.Errorf("unexpected battery blocks %v", out[0].Blocks)
+	}
+
+	code, out = get("/api/v1/alarms")
+	if code != http.StatusOK || out[0].Alarms == nil || out[0].Alarms.Count != 0 || out[0].Alarms.Stale {
+		t.Errorf("unexpected alarms %d %+v", code, out)
+	}
+
+	if code, _ := get("/api/v1/nothing"); code != http.StatusNotFound {
+		t.Errorf("unknown category: %d", code)
+	}
+	if code, _ := get("/api/v1/meter?device=other"); code != http.StatusNotFound {
+		t.Errorf("unknown device: %d", code)
+	}
+}
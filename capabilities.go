@@ -0,0 +1,197 @@
+// Copyright: 2024 Dragos Vingarzan vingarzan -at- gmail -dot- com
+// License: AGPL-3.0
+//
+// This file is part of sun2000-modbus.
+//
+// sun2000-modbus is free software: you can redistribute it and/or modify it under the terms of the GNU Affero General
+// Public License Version 3 (AGPL-3.0) as published by the Free Software Foundation.
+//
+// sun2000-modbus is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY; without even the implied
+// warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the AGPL-3.0 along with sun2000-modbus. If not,
+// see <https://www.gnu.org/licenses/>.
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/vingarzan/sun2000-modbus/sun2000"
+)
+
+// The register map covers the largest inverters, with 20 PV strings, 10 MPPTs, two batteries and a meter, and the
+// smaller ones just answer zeroes for what they don't have. So at startup, each device is asked what it has, and then
+// the blocks of the missing hardware are not polled anymore, and the values of the missing strings and MPPTs are not
+// exported.
+
+// subdeviceFlagOptimizer is the bit of the Subdevice Support / In Position Flags (30207 and 30209) for the PV
+// optimizers, which have no block of their own in the register map.
+const subdeviceFlagOptimizer = 1 << 0
+
+// capabilities is the hardware of a device, as detected at startup. Until then, everything is polled.
+type capabilities struct {
+	sync.RWMutex
+
+	detected bool
+	// from the identification, 0 if unknown
+	strings, mppts int
+	// ESU1 and ESU2
+	battery    [2]bool
+	meter      bool
+	optimizers bool
+}
+
+func (x *capabilities) isDetected() bool {
+	x.RLock()
+	defer x.RUnlock()
+	return x.detected
+}
+
+// polls tells if the block with this built-in target is to be polled. The blocks without a target always are.
+func (x *capabilities) polls(target string) bool {
+	x.RLock()
+	defer x.RUnlock()
+	if !x.detected {
+		return true
+	}
+	switch {
+	case target == "meter":
+		return x.meter
+	case target == "esuTemperatures":
+		return x.battery[0] || x.battery[1]
+	case strings.HasPrefix(target, "esu1"):
+		return x.battery[0]
+	case strings.HasPrefix(target, "esu2"):
+		return x.battery[1]
+	}
+	return true
+}
+
+// hasIndex tells if the value with this label and index (from 1) is of existing hardware, i.e. not of a PV string
+// or MPPT beyond the ones of the inverter.
+func (x *capabilities) hasIndex(label string, index int) bool {
+	x.RLock()
+	defer x.RUnlock()
+	switch label {
+	case "pv", "string":
+		return x.strings == 0 || index <= x.strings
+	case "mppt":
+		return x.mppts == 0 || index <= x.mppts
+	}
+	return true
+}
+
+// hasLabels is hasIndex for the labels of a metric.
+func (x *capabilities) hasLabels(labels []metricLabel) bool {
+	for _, l := range labels {
+		index, err := strconv.Atoi(l.value)
+		if err == nil && !x.hasIndex(l.name, index) {
+			return false
+		}
+	}
+	return true
+}
+
+// hasValue is hasIndex for a decoded value.
+func (x *capabilities) hasValue(v *registerValue) bool {
+	return v.field.Repeat == 0 || x.hasIndex(v.field.Label, v.index)
+}
+
+func (x *capabilities) String() string {
+	x.RLock()
+	defer x.RUnlock()
+	return fmt.Sprintf("%d strings, %d MPPTs, battery %v/%v, meter %v, optimizers %v", x.strings, x.mppts,
+		x.battery[0], x.battery[1], x.meter, x.optimizers)
+}
+
+// probeBlock reads the block of the target, if polled, only to look at it. present is false if the device does not
+// answer it (a Modbus exception), err is set if it could not be asked.
+func (d *device) probeBlock(target string) (data []byte, present bool, err error) {
+	r := d.findRange(target)
+	if r == nil {
+		return nil, false, nil
+	}
+	data, err = d.readModbusFromTo(r.name+" detection", r.from, r.to)
+	if !d.handleReadModbusResults(data, err) {
+		if classifyError(err) == errorClassException {
+			return nil, false, nil
+		}
+		return nil, false, err
+	}
+	return data, true, nil
+}
+
+// detectCapabilities finds out what hardware the device has, from the identification, the hardware flags and the
+// status registers of the meter and of the batteries. Returns false if it could not, to be tried again later.
+func (d *device) detectCapabilities() bool {
+	id := d.findRange("identification")
+	if id == nil || !d.readRange(id) {
+		return false
+	}
+	var found capabilities
+	d.data.identification.RLock()
+	found.strings = int(d.data.identification.NumberOfStrings)
+	found.mppts = int(d.data.identification.NumberOfMPPTs)
+	d.data.identification.RUnlock()
+
+	if hw := d.findRange("hardware1"); hw != nil && d.readRange(hw) {
+		x := &d.data.hardware1
+		x.RLock()
+		found.optimizers = x.subdeviceSupportFlag&x.subdeviceInPositionFlag&subdeviceFlagOptimizer != 0
+		x.RUnlock()
+	}
+
+	// the flags don't tell reliably about the meter and batteries on all the firmwares, but their registers do: all
+	// zeroes, or an exception, when there are none
+	data, present, err := d.probeBlock("meter")
+	if err != nil {
+		return false
+	}
+	if present {
+		meter, err := sun2000.DecodeMeter(data)
+		found.meter = err == nil && meter.MeterStatus != 0
+	}
+	for i, decode := range []func([]byte) (sun2000.ESU, error){sun2000.DecodeESU1, sun2000.DecodeESU2} {
+		data, present, err := d.probeBlock(fmt.Sprintf("esu%d", i+1))
+		if err != nil {
+			return false
+		}
+		if present {
+			esu, err := decode(data)
+			found.battery[i] = err == nil && (esu.RunningStatus != 0 || len(esu.SN) > 0)
+		}
+	}
+
+	d.caps.Lock()
+	d.caps.detected = true
+	d.caps.strings, d.caps.mppts = found.strings, found.mppts
+	d.caps.battery, d.caps.meter, d.caps.optimizers = found.battery, found.meter, found.optimizers
+	d.caps.Unlock()
+	lInfo.Printf("Detected on %s: %s", d.name, &d.caps)
+	return true
+}
+
+// collectMetrics adds the detected hardware of the device.
+func (x *capabilities) collectMetrics(r *metricsRegistry, labels []metricLabel) {
+	x.RLock()
+	defer x.RUnlock()
+	if !x.detected {
+		return
+	}
+	for _, hw := range []struct {
+		name    string
+		present bool
+	}{
+		{"esu1", x.battery[0]},
+		{"esu2", x.battery[1]},
+		{"meter", x.meter},
+		{"optimizers", x.optimizers},
+	} {
+		r.gauge("sun2000_hardware_present", "Hardware detected on the inverter at startup, 1 if present",
+			bool2float(hw.present), append(append([]metricLabel{}, labels...), metricLabel{"hardware", hw.name})...)
+	}
+}
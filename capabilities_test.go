@@ -0,0 +1,86 @@
+// Copyright: 2024 Dragos Vingarzan vingarzan -at- gmail -dot- com
+// License: AGPL-3.0
+//
+// This file is part of sun2000-modbus.
+//
+// sun2000-modbus is free software: you can redistribute it and/or modify it under the terms of the GNU Affero General
+// Public License Version 3 (AGPL-3.0) as published by the Free Software Foundation.
+//
+// sun2000-modbus is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY; without even the implied
+// warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the AGPL-3.0 along with sun2000-modbus. If not,
+// see <https://www.gnu.org/licenses/>.
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+)
+
+func TestDetectCapabilities(t *testing.T) {
+	server := startSimulator(t, func(c *simulatorConfig) { c.batteryPacks = 0 })
+	d := simulatorDevices(t, server, 1)[0]
+	d.readModbusFromTo("dummy read", 30000, 30015)
+
+	if !d.caps.polls("esu1") || !d.caps.hasIndex("pv", 20) {
+		t.Errorf("everything should be polled before the detection")
+	}
+	if !d.detectCapabilities() {
+		t.Fatalf("detectCapabilities() failed")
+	}
+	if d.caps.strings != 2 || d.caps.mppts != 2 || d.caps.battery[0] || d.caps.battery[1] || !d.caps.meter || d.caps.optimizers {
+		t.Errorf("unexpected capabilities %s", &d.caps)
+	}
+	for target, polled := range map[string]bool{"esu1": false, "esu1Pack1": false, "esuTemperatures": false, "meter": true, "pv": true, "": true} {
+		if d.caps.polls(target) != polled {
+			t.Errorf("polls(%q) != %v", target, polled)
+		}
+	}
+
+	d.readExpiredRanges(context.Background())
+	if r := d.findRange("esu1"); !r.values.lastRead.IsZero() {
+		t.Errorf("the battery was polled")
+	}
+	registry := newMetricsRegistry()
+	d.collectMetrics(registry)
+	var sb strings.Builder
+	if err := registry.write(&sb, false); err != nil {
+		t.Fatal(err)
+	}
+	metrics := sb.String()
+	for _, s := range []string{`pv="2"`, `mppt="2"`, `sun2000_grid_active_power_kilowatts`,
+		`sun2000_hardware_present{device="sim1",model="SUN2000-5KTL-M1",sn="SIM0000001",hardware="esu1"} 0`,
+		`sun2000_hardware_present{device="sim1",model="SUN2000-5KTL-M1",sn="SIM0000001",hardware="meter"} 1`} {
+		if !strings.Contains(metrics, s) {
+			t.Errorf("no %s in the metrics", s)
+		}
+	}
+	for _, s := range []string{`pv="3"`, `mppt="3"`, `sun2000_ess_soc`} {
+		if strings.Contains(metrics, s) {
+			t.Errorf("%s in the metrics", s)
+		}
+	}
+
+	pv := d.apiDevice("inverter", d.getStats().lastSuccessTime).Blocks["pv"]
+	if _, ok := pv.Values["pv_voltage_2"]; !ok {
+		t.Errorf("no pv_voltage_2 in %v", pv.Values)
+	}
+	if _, ok := pv.Values["pv_voltage_3"]; ok {
+		t.Errorf("pv_voltage_3 in %v", pv.Values)
+	}
+}
+
+func TestDetectBattery(t *testing.T) {
+	server := startSimulator(t, nil)
+	d := simulatorDevices(t, server, 1)[0]
+	d.readModbusFromTo("dummy read", 30000, 30015)
+	if !d.detectCapabilities() {
+		t.Fatalf("detectCapabilities() failed")
+	}
+	if !d.caps.battery[0] || d.caps.battery[1] || !d.caps.polls("esu1Pack1") || !d.caps.polls("esuTemperatures") {
+		t.Errorf("unexpected capabilities %s", &d.caps)
+	}
+}
@@ -0,0 +1,168 @@
+// Copyright: 2024 Dragos Vingarzan vingarzan -at- gmail -dot- com
+// License: AGPL-3.0
+//
+// This file is part of sun2000-modbus.
+//
+// sun2000-modbus is free software: you can redistribute it and/or modify it under the terms of the GNU Affero General
+// Public License Version 3 (AGPL-3.0) as published by the Free Software Foundation.
+//
+// sun2000-modbus is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY; without even the implied
+// warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the AGPL-3.0 along with sun2000-modbus. If not,
+// see <https://www.gnu.org/licenses/>.
+package main
+
+import (
+	"bufio"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+// The captures are the raw responses of the reads, as JSON lines, so that a misbehaving parser can be reproduced
+// offline: MODBUS_CAPTURE records them, and MODBUS_MODE=replay answers the reads from them, instead of from an
+// inverter. They are also the fixtures of the parser tests, in testdata/.
+
+// captureRecord is one line of a capture.
+type captureRecord struct {
+	Time    time.Time `json:"time"`
+	Device  string    `json:"device"`
+	SlaveID byte      `json:"slave"`
+	// the name of the range, e.g. "Grid Data"
+	Name  string `json:"name"`
+	From  uint16 `json:"from"`
+	Count uint16 `json:"count"`
+	// the registers, in hex
+	Data string `json:"data"`
+}
+
+// captureWriter appends the records to the capture file.
+type captureWriter struct {
+	sync.Mutex
+	file *os.File
+}
+
+// The capture of all the reads. main() points it to a file, if MODBUS_CAPTURE is set.
+var captures = &captureWriter{}
+
+func (x *captureWriter) open(path string) (err error) {
+	x.Lock()
+	defer x.Unlock()
+	x.file, err = os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o640)
+	return err
+}
+
+func (x *captureWriter) close() {
+	x.Lock()
+	defer x.Unlock()
+	if x.file != nil {
+		x.file.Close()
+		x.file = nil
+	}
+}
+
+func (x *captureWriter) write(d *device, what string, from, to uint16, data []byte) {
+	x.Lock()
+	defer x.Unlock()
+	if x.file == nil {
+		return
+	}
+	r := captureRecord{
+		Time:    time.Now(),
+		Device:  d.name,
+		SlaveID: d.slaveID,
+		Name:    what,
+		From:    from,
+		Count:   to - from,
+		Data:    hex.EncodeToString(data),
+	}
+	line, _ := json.Marshal(r)
+	if _, err := x.file.Write(append(line, '\n')); err != nil {
+		lError.Printf("Error writing the capture: %v", err)
+	}
+}
+
+// loadCapture reads all the records of a capture file.
+func loadCapture(path string) (out []captureRecord, err error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	// the biggest read is of 125 registers, 250 bytes in hex, but be generous
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	line := 0
+	for scanner.Scan() {
+		line++
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+		var r captureRecord
+		if err := json.Unmarshal(scanner.Bytes(), &r); err != nil {
+			return nil, fmt.Errorf("%s:%d: %w", path, line, err)
+		}
+		data, err := hex.DecodeString(r.Data)
+		if err != nil || len(data) != 2*int(r.Count) {
+			return nil, fmt.Errorf("%s:%d: bad data of %d registers %q", path, line, r.Count, r.Data)
+		}
+		out = append(out, r)
+	}
+	return out, scanner.Err()
+}
+
+type captureKey struct {
+	slaveID  byte
+	from, to uint16
+}
+
+// captureReplay is the transport of MODBUS_MODE=replay. It answers each read with the next response captured for the
+// same slave and registers, in order, then keeps repeating the last one, so that the exporters keep their values.
+type captureReplay struct {
+	slaveID   byte
+	responses map[captureKey][][]byte
+}
+
+func newCaptureReplay(records []captureRecord) *captureReplay {
+	x := &captureReplay{responses: make(map[captureKey][][]byte)}
+	for _, r := range records {
+		key := captureKey{r.SlaveID, r.From, r.From + r.Count}
+		data, _ := hex.DecodeString(r.Data)
+		x.responses[key] = append(x.responses[key], data)
+	}
+	return x
+}
+
+func (x *captureReplay) SetSlaveID(slaveID byte) {
+	x.slaveID = slaveID
+}
+
+func (x *captureReplay) ReadRegisters(from, to uint16) ([]byte, error) {
+	key := captureKey{x.slaveID, from, to}
+	responses := x.responses[key]
+	if len(responses) == 0 {
+		return nil, fmt.Errorf("no capture of %d..%d for slave %d", from, to, x.slaveID)
+	}
+	if len(responses) > 1 {
+		x.responses[key] = responses[1:]
+	}
+	return responses[0], nil
+}
+
+func (x *captureReplay) WriteRegisters(address uint16, values []uint16) error {
+	return errors.New("writes are not possible when replaying a capture")
+}
+
+func (x *captureReplay) WriteMultipleRegisters(address uint16, values []uint16) error {
+	return x.WriteRegisters(address, values)
+}
+
+func (x *captureReplay) Close() error {
+	return nil
+}
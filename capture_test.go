@@ -0,0 +1,105 @@
+// Copyright: 2024 Dragos Vingarzan vingarzan -at- gmail -dot- com
+// License: AGPL-3.0
+//
+// This file is part of sun2000-modbus.
+//
+// sun2000-modbus is free software: you can redistribute it and/or modify it under the terms of the GNU Affero General
+// Public License Version 3 (AGPL-3.0) as published by the Free Software Foundation.
+//
+// sun2000-modbus is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY; without even the implied
+// warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the AGPL-3.0 along with sun2000-modbus. If not,
+// see <https://www.gnu.org/licenses/>.
+package main
+
+import (
+	"context"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// replayDevices returns the devices answered from the capture, with the connection opened.
+func replayDevices(t *testing.T, path string, dcs ...deviceConfig) []*device {
+	cfg.setDefaults()
+	cfg.modbusMode = "replay"
+	cfg.replayFile = path
+	t.Cleanup(func() { cfg.setDefaults() })
+	testDevices := newDevices(dcs)
+	if err := openConnections(testDevices); err != nil {
+		t.Fatalf("openConnections() failed: %v", err)
+	}
+	t.Cleanup(func() { closeConnections(testDevices) })
+	return testDevices
+}
+
+// TestReplayCapture decodes a capture of the simulator, as the regression test of the parsers.
+func TestReplayCapture(t *testing.T) {
+	d := replayDevices(t, "testdata/simulator.capture.jsonl", deviceConfig{name: "sun2000", slaveID: 1})[0]
+	d.readExpiredRanges(context.Background())
+
+	id := &d.data.identification
+	if id.Model != "SUN2000-5KTL-M1" || id.SN != "SIM0000001" || id.NumberOfStrings != 2 || id.MaxActivePowerPmax != 5.5 {
+		t.Errorf("unexpected identification %+v", id.Identification)
+	}
+	inverter := &d.data.inverter
+	if inverter.DeviceStatus.String() != "On-grid: running" || inverter.ActivePower <= 0 || inverter.InverterFrequency < 49 {
+		t.Errorf("unexpected inverter %+v", inverter.Inverter)
+	}
+	if len(d.data.esu1.SN) == 0 || !d.data.esu1.pack[0].isPresent() || d.data.esu1.pack[1].isPresent() {
+		t.Errorf("unexpected battery %+v", d.data.esu1.ESU)
+	}
+
+	registry := newMetricsRegistry()
+	d.collectMetrics(registry)
+	var sb strings.Builder
+	if err := registry.write(&sb, false); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(sb.String(), `sun2000_inverter_active_power_kilowatts{device="sun2000",model="SUN2000-5KTL-M1",sn="SIM0000001"}`) {
+		t.Errorf("no active power in the metrics:\n%s", sb.String())
+	}
+
+	if err := d.writeModbusRegisters("test", 47100, []uint16{1}); err == nil {
+		t.Errorf("a write to a capture succeeded")
+	}
+	if _, err := d.readModbusFromTo("not captured", 40000, 40010); err == nil {
+		t.Errorf("a read which was not captured succeeded")
+	}
+}
+
+// TestCaptureReplay captures the reads of the simulator, then replays them, to the same values.
+func TestCaptureReplay(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "capture.jsonl")
+	server := startSimulator(t, nil)
+	live := simulatorDevices(t, server, 1, 2)
+	if err := captures.open(path); err != nil {
+		t.Fatal(err)
+	}
+	live[0].readModbusFromTo("dummy read", 30000, 30015)
+	for _, d := range live {
+		d.readExpiredRanges(context.Background())
+	}
+	captures.close()
+
+	records, err := loadCapture(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) == 0 || records[0].Device != "sim1" || records[0].Name != "Identification Data" || records[0].Count != 87 {
+		t.Fatalf("unexpected capture of %d records: %+v", len(records), records)
+	}
+
+	replayed := replayDevices(t, path, deviceConfig{name: "sim1", slaveID: 1}, deviceConfig{name: "sim2", slaveID: 2})
+	for i, d := range replayed {
+		d.readExpiredRanges(context.Background())
+		if d.data.identification.Identification != live[i].data.identification.Identification {
+			t.Errorf("%s: replayed identification %+v, captured %+v", d.name, d.data.identification.Identification, live[i].data.identification.Identification)
+		}
+		if d.data.inverter.Inverter != live[i].data.inverter.Inverter {
+			t.Errorf("%s: replayed inverter %+v, captured %+v", d.name, d.data.inverter.Inverter, live[i].data.inverter.Inverter)
+		}
+	}
+}
@@ -15,80 +15,760 @@
 package main
 
 import (
-	"log"
+	"errors"
+	"flag"
+	"fmt"
 	"os"
 	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
 )
 
+// deviceConfig is one inverter to poll. Multiple devices can share the same IP:port (e.g. cascaded inverters behind
+// the SDongle of the master inverter) or the same serial line, in which case they share one connection.
+type deviceConfig struct {
+	name    string
+	ip      string
+	port    uint16
+	slaveID byte
+}
+
 type config struct {
+	// the config file, if any, from -config or CONFIG_FILE
+	configFile string
+
 	httpIP        string
 	httpPort      string
+	logLevel      string
 	modbusIP      string
 	modbusPort    uint16
 	modbusTimeout uint
 	modbusSleep   uint
 	modbusSlaveID byte
+
+	// when to reconnect after errors, and when to give up for a while
+	supervisor supervisorConfig
+
+	// "tcp" (default), "rtu" for a RS485 adapter wired to the COM port of the inverter, or "replay" of a capture
+	modbusMode     string
+	serialDevice   string
+	serialBaudRate int
+	serialDataBits int
+	serialParity   string
+	serialStopBits int
+
+	// the capture to append the raw responses to, and the one to answer from in the "replay" mode
+	captureFile string
+	replayFile  string
+
+	// MODBUS_DEVICES, or else the devices of the config file, resolved into devices once all is loaded
+	devicesList string
+	fileDevices []deviceConfig
+	devices     []deviceConfig
+
+	// optional user register map, merged over the built-in one
+	registerMap string
+	// optional device profiles written by the "scan" command, to poll only the blocks the devices answer
+	deviceProfile string
+	// detect the hardware of the devices at startup, to skip the blocks and values of what they don't have
+	detectCapabilities bool
+	// poll interval overrides, and enabled/disabled blocks of the register map, by name
+	blocks map[string]blockOverride
+
+	// "prometheus" (default) for the typed exposition, "legacy" for the old format, with units in labels
+	metricsFormat string
+	// the values not read again in this many intervals (plus MODBUS_SLEEP) are stale, 0 for never
+	staleFactor uint
+	// "omit" (default) to leave the stale values out of the metrics, "keep" to only mark them
+	staleMetrics string
+	// the samples of the blocks read within the Prometheus lookback carry the time of their read
+	metricsTimestamps bool
+
+	// MQTT publishing, off without a broker
+	mqtt mqttConfig
+
+	influx influxConfig
+
+	// the SQLite history, off without a database
+	history historyConfig
+
+	// the battery control HTTP API is off by default, since it writes to the inverter
+	controlEnabled  bool
+	controlToken    string
+	controlAuditLog string
+
+	// the schedule of the active power limits, off if empty, and how often to apply it, in seconds
+	powerLimitSchedule []powerLimitWindow
+	powerLimitInterval uint
+
+	// optional file of the alarm events, and where to POST them
+	alarmEventLog       string
+	alarmWebhooks       []*alarmWebhook
+	alarmWebhookRetries int
+
+	// optional file to keep the energy totals in, and how often to save it
+	energyStateFile    string
+	energySaveInterval time.Duration
+
+	// the Modbus TCP gateway, off if no address to listen on
+	gatewayListen     string
+	gatewayMaxAge     time.Duration
+	gatewayWriteAllow []registerSpan
 }
 
 func (c *config) setDefaults() {
+	*c = config{}
 	c.httpIP = "0.0.0.0"
 	c.httpPort = "8080"
+	c.logLevel = "debug"
 	c.modbusIP = ""
 	c.modbusPort = 502
 	c.modbusTimeout = 5
 	c.modbusSleep = 5
+	c.detectCapabilities = true
 	c.modbusSlaveID = 1
+
+	c.supervisor = supervisorConfig{
+		backoffMin:              1 * time.Second,
+		backoffMax:              3 * time.Minute,
+		circuitFailures:         5,
+		circuitOpenTime:         5 * time.Minute,
+		timeoutsBeforeReconnect: 3,
+	}
+
+	c.modbusMode = "tcp"
+	c.serialDevice = "/dev/ttyUSB0"
+	c.serialBaudRate = 9600
+	c.serialDataBits = 8
+	c.serialParity = "N"
+	c.serialStopBits = 1
+
+	c.metricsFormat = "prometheus"
+	c.staleFactor = 3
+	c.staleMetrics = "omit"
+	c.metricsTimestamps = true
+	c.energySaveInterval = time.Minute
+
+	c.mqtt.clientID = "sun2000-modbus"
+	c.mqtt.topicPrefix = "sun2000"
+	c.mqtt.discoveryPrefix = "homeassistant"
+
+	c.influx.batchSize = 500
+	c.influx.flushInterval = 10 * time.Second
+	c.influx.bufferMaxPoints = 20000
+
+	c.history.fields = []string{"inverter.dcPower", "inverter.activePower", "inverter.internalTemperature",
+		"meter.gridActivePower", "esu1.chargeAndDischargePower", "esu1.batterySOC"}
+
+	c.powerLimitInterval = 60
+	c.alarmWebhookRetries = 5
 }
 
-func (c *config) getFromEnv() {
-	x := os.Getenv("HTTP_IP")
-	if len(x) > 0 {
-		c.httpIP = x
+// setting is one configuration value, which comes from the config file (by its key), the environment or the command
+// line (the environment variable in lower case, with dashes, e.g. -modbus-ip), the latter overriding the former.
+type setting struct {
+	// in the config file, e.g. modbus.timeout for "modbus: {timeout: 5}"
+	key   string
+	env   string
+	usage string
+	// bool settings can be given as a flag without a value
+	isBool bool
+	// set, but empty, is a value too, e.g. to turn something off. Otherwise empty is as if not set.
+	allowEmpty bool
+	set        func(c *config, value string) error
+}
+
+func (x *setting) flagName() string {
+	return strings.ToLower(strings.ReplaceAll(x.env, "_", "-"))
+}
+
+func setString(apply func(c *config, v string)) func(c *config, value string) error {
+	return func(c *config, value string) error {
+		apply(c, value)
+		return nil
 	}
-	x = os.Getenv("HTTP_PORT")
-	if len(x) > 0 {
-		c.httpPort = x
+}
+
+func setUint(min, max uint64, apply func(c *config, v uint64)) func(c *config, value string) error {
+	return func(c *config, value string) error {
+		v, err := strconv.ParseUint(value, 10, 64)
+		if err != nil || v < min || v > max {
+			return fmt.Errorf("must be a number from %d to %d, not %q", min, max, value)
+		}
+		apply(c, v)
+		return nil
 	}
+}
 
-	x = os.Getenv("MODBUS_IP")
-	if len(x) > 0 {
-		c.modbusIP = x
-	} else {
-		log.Fatal("MODBUS_IP is required! Please export it as an environment variable.")
+func setSeconds(min uint64, apply func(c *config, v time.Duration)) func(c *config, value string) error {
+	return func(c *config, value string) error {
+		v, err := strconv.ParseUint(value, 10, 16)
+		if err != nil || v < min {
+			return fmt.Errorf("must be a number of seconds, from %d, not %q", min, value)
+		}
+		apply(c, time.Duration(v)*time.Second)
+		return nil
 	}
-	x = os.Getenv("MODBUS_PORT")
-	if len(x) > 0 {
-		modbusPortUint, err := strconv.ParseUint(x, 10, 16)
+}
+
+func setBool(apply func(c *config, v bool)) func(c *config, value string) error {
+	return func(c *config, value string) error {
+		v, err := strconv.ParseBool(value)
 		if err != nil {
-			log.Fatal(err)
+			return fmt.Errorf("must be true or false, not %q", value)
 		}
-		c.modbusPort = uint16(modbusPortUint)
+		apply(c, v)
+		return nil
 	}
+}
+
+// setChoice takes one of the choices, case insensitive, as written in the choices.
+func setChoice(choices []string, apply func(c *config, v string)) func(c *config, value string) error {
+	return func(c *config, value string) error {
+		for _, choice := range choices {
+			if strings.EqualFold(value, choice) {
+				apply(c, choice)
+				return nil
+			}
+		}
+		return fmt.Errorf("must be one of %s, not %q", strings.Join(choices, ", "), value)
+	}
+}
+
+// settings are all the configuration values, except for the devices and blocks lists of the config file.
+var settings = []setting{
+	{key: "http.ip", env: "HTTP_IP", usage: "IP address to listen on for HTTP",
+		set: setString(func(c *config, v string) { c.httpIP = v })},
+	{key: "http.port", env: "HTTP_PORT", usage: "port to listen on for HTTP",
+		set: setUint(1, 65535, func(c *config, v uint64) { c.httpPort = strconv.FormatUint(v, 10) })},
+	{key: "log.level", env: "LOG_LEVEL", usage: "debug, info, warning or error",
+		set: setChoice([]string{"debug", "info", "warning", "error"}, func(c *config, v string) { c.logLevel = v })},
+
+	{key: "modbus.mode", env: "MODBUS_MODE", usage: "tcp, rtu or replay",
+		set: setChoice([]string{"tcp", "rtu", "replay"}, func(c *config, v string) { c.modbusMode = v })},
+	{key: "modbus.ip", env: "MODBUS_IP", usage: "IP address of the SDongle or inverter",
+		set: setString(func(c *config, v string) { c.modbusIP = v })},
+	{key: "modbus.port", env: "MODBUS_PORT", usage: "Modbus TCP port",
+		set: setUint(1, 65535, func(c *config, v uint64) { c.modbusPort = uint16(v) })},
+	{key: "modbus.slaveID", env: "MODBUS_SLAVE_ID", usage: "Modbus slave ID",
+		set: setUint(0, 255, func(c *config, v uint64) { c.modbusSlaveID = byte(v) })},
+	{key: "modbus.timeout", env: "MODBUS_TIMEOUT", usage: "Modbus timeout, in seconds",
+		set: setUint(1, 3600, func(c *config, v uint64) { c.modbusTimeout = uint(v) })},
+	{key: "modbus.sleep", env: "MODBUS_SLEEP", usage: "sleep after a round of reads, in seconds",
+		set: setUint(0, 3600, func(c *config, v uint64) { c.modbusSleep = uint(v) })},
+	{key: "modbus.backoffMin", env: "MODBUS_BACKOFF_MIN", usage: "first wait before reconnecting, in seconds",
+		set: setSeconds(1, func(c *config, v time.Duration) { c.supervisor.backoffMin = v })},
+	{key: "modbus.backoffMax", env: "MODBUS_BACKOFF_MAX", usage: "longest wait before reconnecting, in seconds",
+		set: setSeconds(1, func(c *config, v time.Duration) { c.supervisor.backoffMax = v })},
+	{key: "modbus.circuitFailures", env: "MODBUS_CIRCUIT_FAILURES", usage: "failed reconnects which open the circuit, 0 for never",
+		set: setUint(0, 65535, func(c *config, v uint64) { c.supervisor.circuitFailures = uint(v) })},
+	{key: "modbus.circuitOpen", env: "MODBUS_CIRCUIT_OPEN", usage: "how long the circuit stays open, in seconds",
+		set: setSeconds(0, func(c *config, v time.Duration) { c.supervisor.circuitOpenTime = v })},
+	{key: "modbus.timeoutsBeforeReconnect", env: "MODBUS_TIMEOUTS_BEFORE_RECONNECT", usage: "timeouts in a row which break the session",
+		set: setUint(1, 65535, func(c *config, v uint64) { c.supervisor.timeoutsBeforeReconnect = uint(v) })},
+	{key: "modbus.capture", env: "MODBUS_CAPTURE", usage: "file to append the raw responses to",
+		set: setString(func(c *config, v string) { c.captureFile = v })},
+	{key: "modbus.replayFile", env: "MODBUS_REPLAY_FILE", usage: "capture to answer from, in replay mode",
+		set: setString(func(c *config, v string) { c.replayFile = v })},
+	{key: "modbus.serial.device", env: "MODBUS_SERIAL_DEVICE", usage: "serial device, in rtu mode",
+		set: setString(func(c *config, v string) { c.serialDevice = v })},
+	{key: "modbus.serial.baudRate", env: "MODBUS_SERIAL_BAUD_RATE", usage: "baud rate, in rtu mode",
+		set: setUint(1, 4000000, func(c *config, v uint64) { c.serialBaudRate = int(v) })},
+	{key: "modbus.serial.dataBits", env: "MODBUS_SERIAL_DATA_BITS", usage: "data bits, in rtu mode",
+		set: setUint(5, 8, func(c *config, v uint64) { c.serialDataBits = int(v) })},
+	{key: "modbus.serial.parity", env: "MODBUS_SERIAL_PARITY", usage: "parity (N, E or O), in rtu mode",
+		set: setChoice([]string{"N", "E", "O"}, func(c *config, v string) { c.serialParity = v })},
+	{key: "modbus.serial.stopBits", env: "MODBUS_SERIAL_STOP_BITS", usage: "stop bits, in rtu mode",
+		set: setUint(1, 2, func(c *config, v uint64) { c.serialStopBits = int(v) })},
+	{env: "MODBUS_DEVICES", usage: "devices to poll, as name=[host[:port]]/slaveID,...",
+		set: setString(func(c *config, v string) { c.devicesList = v })},
+
+	{key: "registerMap", env: "REGISTER_MAP", usage: "register map file, merged over the built-in one",
+		set: setString(func(c *config, v string) { c.registerMap = v })},
+	{key: "deviceProfile", env: "DEVICE_PROFILE", usage: "device profiles written by the scan command",
+		set: setString(func(c *config, v string) { c.deviceProfile = v })},
+	{key: "detectCapabilities", env: "DETECT_CAPABILITIES", usage: "detect the hardware of the devices at startup", isBool: true,
+		set: setBool(func(c *config, v bool) { c.detectCapabilities = v })},
+	{env: "BLOCKS", usage: "overrides of the blocks, as name=interval|on|off,...",
+		set: func(c *config, v string) error { return c.parseBlockOverrides(v) }},
+
+	{key: "metrics.format", env: "METRICS_FORMAT", usage: "prometheus or legacy",
+		set: setChoice([]string{"prometheus", "legacy"}, func(c *config, v string) { c.metricsFormat = v })},
+	{key: "metrics.staleFactor", env: "STALE_FACTOR", usage: "intervals without a read after which the values are stale, 0 for never",
+		set: setUint(0, 1000, func(c *config, v uint64) { c.staleFactor = uint(v) })},
+	{key: "metrics.stale", env: "METRICS_STALE", usage: "omit or keep the stale values in the metrics",
+		set: setChoice([]string{"omit", "keep"}, func(c *config, v string) { c.staleMetrics = v })},
+	{key: "metrics.timestamps", env: "METRICS_TIMESTAMPS", usage: "put the time of the read on the samples of the blocks read more often than every 5 minutes", isBool: true,
+		set: setBool(func(c *config, v bool) { c.metricsTimestamps = v })},
+
+	{key: "mqtt.broker", env: "MQTT_BROKER", usage: "MQTT broker, as tcp://host:1883 or ssl://host:8883",
+		set: setString(func(c *config, v string) { c.mqtt.broker = v })},
+	{key: "mqtt.username", env: "MQTT_USERNAME", usage: "username on the MQTT broker",
+		set: setString(func(c *config, v string) { c.mqtt.username = v })},
+	{key: "mqtt.password", env: "MQTT_PASSWORD", usage: "password on the MQTT broker",
+		set: setString(func(c *config, v string) { c.mqtt.password = v })},
+	{key: "mqtt.clientID", env: "MQTT_CLIENT_ID", usage: "MQTT client ID",
+		set: setString(func(c *config, v string) { c.mqtt.clientID = v })},
+	{key: "mqtt.topicPrefix", env: "MQTT_TOPIC_PREFIX", usage: "prefix of the MQTT topics",
+		set: setString(func(c *config, v string) { c.mqtt.topicPrefix = strings.TrimSuffix(v, "/") })},
+	{key: "mqtt.discoveryPrefix", env: "MQTT_DISCOVERY_PREFIX", usage: "prefix of the Home Assistant discovery topics, empty for none", allowEmpty: true,
+		set: setString(func(c *config, v string) { c.mqtt.discoveryPrefix = strings.TrimSuffix(v, "/") })},
+
+	{key: "influx.url", env: "INFLUX_URL", usage: "InfluxDB v2 to write the values to, as http(s)://host:8086",
+		set: setString(func(c *config, v string) { c.influx.url = v })},
+	{key: "influx.token", env: "INFLUX_TOKEN", usage: "InfluxDB API token",
+		set: setString(func(c *config, v string) { c.influx.token = v })},
+	{key: "influx.org", env: "INFLUX_ORG", usage: "InfluxDB organization",
+		set: setString(func(c *config, v string) { c.influx.org = v })},
+	{key: "influx.bucket", env: "INFLUX_BUCKET", usage: "InfluxDB bucket",
+		set: setString(func(c *config, v string) { c.influx.bucket = v })},
+	{key: "influx.batchSize", env: "INFLUX_BATCH_SIZE", usage: "points per InfluxDB write",
+		set: setUint(1, 5000, func(c *config, v uint64) { c.influx.batchSize = int(v) })},
+	{key: "influx.flushInterval", env: "INFLUX_FLUSH_INTERVAL", usage: "seconds between the InfluxDB writes, at most",
+		set: setSeconds(1, func(c *config, v time.Duration) { c.influx.flushInterval = v })},
+	{key: "influx.bufferFile", env: "INFLUX_BUFFER_FILE", usage: "file to keep the points in while InfluxDB is unreachable",
+		set: setString(func(c *config, v string) { c.influx.bufferFile = v })},
+	{key: "influx.bufferMaxPoints", env: "INFLUX_BUFFER_MAX_POINTS", usage: "points kept while InfluxDB is unreachable, at most",
+		set: setUint(1, 10000000, func(c *config, v uint64) { c.influx.bufferMaxPoints = int(v) })},
+
+	{key: "history.db", env: "HISTORY_DB", usage: "SQLite database to keep the history of the values in",
+		set: setString(func(c *config, v string) { c.history.path = v })},
+	{key: "history.fields", env: "HISTORY_FIELDS", usage: "values to keep in the history, as target.key,...",
+		set: func(c *config, v string) error {
+			c.history.fields = nil
+			for _, f := range strings.Split(v, ",") {
+				if f = strings.TrimSpace(f); len(f) > 0 {
+					if !strings.Contains(f, ".") {
+						return fmt.Errorf("%q is not in the target.key format", f)
+					}
+					c.history.fields = append(c.history.fields, f)
+				}
+			}
+			return nil
+		}},
+
+	{key: "control.enabled", env: "CONTROL_ENABLED", usage: "serve the battery control API, which writes to the inverter", isBool: true,
+		set: setBool(func(c *config, v bool) { c.controlEnabled = v })},
+	{key: "control.token", env: "CONTROL_TOKEN", usage: "bearer token required by the control API",
+		set: setString(func(c *config, v string) { c.controlToken = v })},
+	{key: "control.auditLog", env: "CONTROL_AUDIT_LOG", usage: "file to append the writes to",
+		set: setString(func(c *config, v string) { c.controlAuditLog = v })},
+	{key: "control.powerLimitSchedule", env: "POWER_LIMIT_SCHEDULE", usage: "schedule of the power limits, as from-to=kind:power,...",
+		set: func(c *config, v string) (err error) {
+			c.powerLimitSchedule, err = parsePowerLimitSchedule(v)
+			return err
+		}},
+	{key: "control.powerLimitInterval", env: "POWER_LIMIT_INTERVAL", usage: "how often to apply the power limits, in seconds",
+		set: setUint(1, 65535, func(c *config, v uint64) { c.powerLimitInterval = uint(v) })},
+
+	{key: "alarms.eventLog", env: "ALARM_EVENT_LOG", usage: "file to append the alarm events to",
+		set: setString(func(c *config, v string) { c.alarmEventLog = v })},
+	{key: "alarms.webhooks", env: "ALARM_WEBHOOKS", usage: "URLs to POST the alarm events to, as [level:]url,...",
+		set: func(c *config, v string) (err error) {
+			c.alarmWebhooks, err = parseAlarmWebhooks(v)
+			return err
+		}},
+	{key: "alarms.webhookRetries", env: "ALARM_WEBHOOK_RETRIES", usage: "retries of a failed webhook call",
+		set: setUint(0, 255, func(c *config, v uint64) { c.alarmWebhookRetries = int(v) })},
 
-	x = os.Getenv("MODBUS_TIMEOUT")
-	if len(x) > 0 {
-		modbusTimeoutUint, err := strconv.ParseUint(x, 10, 16)
+	{key: "energy.stateFile", env: "ENERGY_STATE_FILE", usage: "file to keep the daily and monthly energy totals in, across restarts",
+		set: setString(func(c *config, v string) { c.energyStateFile = v })},
+	{key: "energy.saveInterval", env: "ENERGY_SAVE_INTERVAL", usage: "how often to save the energy totals, in seconds",
+		set: setSeconds(1, func(c *config, v time.Duration) { c.energySaveInterval = v })},
+
+	{key: "gateway.listen", env: "GATEWAY_LISTEN", usage: "address to serve the Modbus TCP gateway on, e.g. :5020",
+		set: setString(func(c *config, v string) { c.gatewayListen = v })},
+	{key: "gateway.maxAge", env: "GATEWAY_MAX_AGE", usage: "seconds to answer the gateway reads from the polled registers, 0 while not stale",
+		set: setSeconds(0, func(c *config, v time.Duration) { c.gatewayMaxAge = v })},
+	{key: "gateway.writeAllow", env: "GATEWAY_WRITE_ALLOW", usage: "registers the gateway clients may write, as first[-last],...",
+		set: func(c *config, v string) (err error) {
+			c.gatewayWriteAllow, err = parseRegisterSpans(v)
+			return err
+		}},
+}
+
+// fileDevice is a device in the config file.
+type fileDevice struct {
+	Name    string `yaml:"name"`
+	IP      string `yaml:"ip"`
+	Port    uint16 `yaml:"port"`
+	SlaveID *byte  `yaml:"slave"`
+}
+
+// blockOverride changes the poll interval or staleness of a block of the register map, or enables/disables it.
+type blockOverride struct {
+	Interval   time.Duration `yaml:"interval,omitempty"`
+	StaleAfter time.Duration `yaml:"staleAfter,omitempty"`
+	Enabled    *bool         `yaml:"enabled,omitempty"`
+}
+
+// parseBlockOverrides parses a comma separated list of name=interval, name=on or name=off, e.g.:
+//
+//	PV Data=5s,ESU2 Data=on
+func (c *config) parseBlockOverrides(in string) error {
+	for _, entry := range strings.Split(in, ",") {
+		entry = strings.TrimSpace(entry)
+		if len(entry) == 0 {
+			continue
+		}
+		name, value, found := strings.Cut(entry, "=")
+		if !found || len(name) == 0 {
+			return fmt.Errorf("block %q is not in the name=interval|on|off format", entry)
+		}
+		o := c.blocks[name]
+		switch strings.ToLower(value) {
+		case "on", "off":
+			enabled := strings.ToLower(value) == "on"
+			o.Enabled = &enabled
+		default:
+			interval, err := time.ParseDuration(value)
+			if err != nil || interval <= 0 {
+				return fmt.Errorf("block %q has an invalid interval %q", name, value)
+			}
+			o.Interval = interval
+		}
+		if c.blocks == nil {
+			c.blocks = make(map[string]blockOverride)
+		}
+		c.blocks[name] = o
+	}
+	return nil
+}
+
+// applyBlockOverrides returns a copy of the register map, with the blocks overridden by the configuration.
+func (c *config) applyBlockOverrides(m *registerMap) (*registerMap, error) {
+	if len(c.blocks) == 0 {
+		return m, nil
+	}
+	out := &registerMap{Blocks: append([]registerBlock{}, m.Blocks...)}
+	var errs []error
+	for name, o := range c.blocks {
+		found := false
+		for i := range out.Blocks {
+			b := &out.Blocks[i]
+			if b.Name != name {
+				continue
+			}
+			found = true
+			if o.Interval > 0 {
+				b.Interval = o.Interval
+			}
+			if o.StaleAfter > 0 {
+				b.StaleAfter = o.StaleAfter
+			}
+			if o.Enabled != nil {
+				enabled := *o.Enabled
+				b.Enabled = &enabled
+			}
+		}
+		if !found {
+			errs = append(errs, fmt.Errorf("blocks: there is no block %q in the register map", name))
+		}
+	}
+	return out, errors.Join(errs...)
+}
+
+// loadFile applies the config file. All the problems found are returned, not only the first one.
+func (c *config) loadFile(path string) error {
+	in, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	var root yaml.Node
+	if err := yaml.Unmarshal(in, &root); err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+	if len(root.Content) == 0 {
+		return nil
+	}
+	var errs []error
+	fail := func(n *yaml.Node, key string, err error) {
+		errs = append(errs, fmt.Errorf("%s:%d: %s: %w", path, n.Line, key, err))
+	}
+	keys := make(map[string]*setting)
+	for i := range settings {
+		if len(settings[i].key) > 0 {
+			keys[settings[i].key] = &settings[i]
+		}
+	}
+
+	var walk func(prefix string, n *yaml.Node)
+	walk = func(prefix string, n *yaml.Node) {
+		if n.Kind != yaml.MappingNode {
+			fail(n, prefix, errors.New("must be a mapping"))
+			return
+		}
+		for i := 0; i+1 < len(n.Content); i += 2 {
+			key, value := n.Content[i].Value, n.Content[i+1]
+			if len(prefix) > 0 {
+				key = prefix + "." + key
+			}
+			switch {
+			case key == "devices":
+				var list []fileDevice
+				if err := value.Decode(&list); err != nil {
+					fail(value, key, err)
+					continue
+				}
+				for _, d := range list {
+					if len(d.Name) == 0 || d.SlaveID == nil {
+						fail(value, key, fmt.Errorf("device %+v needs at least a name and a slave", d))
+						continue
+					}
+					c.fileDevices = append(c.fileDevices, deviceConfig{name: d.Name, ip: d.IP, port: d.Port, slaveID: *d.SlaveID})
+				}
+			case key == "blocks":
+				var blocks map[string]blockOverride
+				if err := value.Decode(&blocks); err != nil {
+					fail(value, key, err)
+					continue
+				}
+				if c.blocks == nil {
+					c.blocks = make(map[string]blockOverride)
+				}
+				for name, o := range blocks {
+					c.blocks[name] = o
+				}
+			case keys[key] != nil:
+				if value.Kind != yaml.ScalarNode {
+					fail(value, key, errors.New("must be a single value"))
+					continue
+				}
+				if len(value.Value) == 0 && !keys[key].allowEmpty {
+					continue
+				}
+				if err := keys[key].set(c, value.Value); err != nil {
+					fail(value, key, err)
+				}
+			case value.Kind == yaml.MappingNode:
+				walk(key, value)
+			default:
+				fail(value, key, errors.New("unknown setting"))
+			}
+		}
+	}
+	walk("", root.Content[0])
+	return errors.Join(errs...)
+}
+
+// load sets up the configuration: the defaults, then the config file (-config or CONFIG_FILE), the environment
+// variables and the command line flags, each overriding the previous. All the problems found are returned at once.
+func (c *config) load(args []string) error {
+	c.setDefaults()
+
+	fs := flag.NewFlagSet("sun2000-modbus", flag.ContinueOnError)
+	configFile := fs.String("config", os.Getenv("CONFIG_FILE"), "config file, in YAML")
+	type flagValue struct {
+		s     *setting
+		value string
+	}
+	var flags []flagValue
+	for i := range settings {
+		s := &settings[i]
+		record := func(value string) error {
+			flags = append(flags, flagValue{s, value})
+			return nil
+		}
+		if s.isBool {
+			fs.BoolFunc(s.flagName(), s.usage, record)
+		} else {
+			fs.Func(s.flagName(), s.usage, record)
+		}
+	}
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() > 0 {
+		return fmt.Errorf("unexpected arguments %q", fs.Args())
+	}
+
+	var errs []error
+	c.configFile = *configFile
+	if len(c.configFile) > 0 {
+		if err := c.loadFile(c.configFile); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	for i := range settings {
+		s := &settings[i]
+		x, ok := os.LookupEnv(s.env)
+		if !ok || len(x) == 0 && !s.allowEmpty {
+			continue
+		}
+		if err := s.set(c, x); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", s.env, err))
+		}
+	}
+	for _, f := range flags {
+		if err := f.s.set(c, f.value); err != nil {
+			errs = append(errs, fmt.Errorf("-%s: %w", f.s.flagName(), err))
+		}
+	}
+	errs = append(errs, c.finish())
+	return errors.Join(errs...)
+}
+
+// finish sets up what depends on more than one setting, and checks them together.
+func (c *config) finish() error {
+	var errs []error
+	if c.supervisor.backoffMax < c.supervisor.backoffMin {
+		errs = append(errs, fmt.Errorf("MODBUS_BACKOFF_MAX (%s) must not be less than MODBUS_BACKOFF_MIN (%s)", c.supervisor.backoffMax, c.supervisor.backoffMin))
+	}
+	if c.modbusMode == "replay" && len(c.replayFile) == 0 {
+		errs = append(errs, errors.New("MODBUS_REPLAY_FILE is required for MODBUS_MODE=replay"))
+	}
+	if len(c.powerLimitSchedule) > 0 && !c.controlEnabled {
+		errs = append(errs, errors.New("POWER_LIMIT_SCHEDULE writes to the inverter, so it needs CONTROL_ENABLED=true"))
+	}
+	if len(c.gatewayWriteAllow) > 0 && !c.controlEnabled {
+		errs = append(errs, errors.New("GATEWAY_WRITE_ALLOW writes to the inverter, so it needs CONTROL_ENABLED=true"))
+	}
+	for _, w := range c.alarmWebhooks {
+		w.retries = c.alarmWebhookRetries
+	}
+
+	switch {
+	case len(c.devicesList) > 0:
+		devices, err := parseDevices(c.devicesList, c.modbusIP, c.modbusPort)
 		if err != nil {
-			log.Fatal(err)
+			errs = append(errs, fmt.Errorf("MODBUS_DEVICES: %w", err))
 		}
-		c.modbusTimeout = uint(modbusTimeoutUint)
+		c.devices = devices
+	case len(c.fileDevices) > 0:
+		names := make(map[string]bool)
+		c.devices = nil
+		for _, d := range c.fileDevices {
+			if names[d.name] {
+				errs = append(errs, fmt.Errorf("devices: device name %q is used more than once", d.name))
+			}
+			names[d.name] = true
+			if len(d.ip) == 0 {
+				d.ip = c.modbusIP
+			}
+			if d.port == 0 {
+				d.port = c.modbusPort
+			}
+			c.devices = append(c.devices, d)
+		}
+	default:
+		c.devices = []deviceConfig{{
+			name:    "sun2000",
+			ip:      c.modbusIP,
+			port:    c.modbusPort,
+			slaveID: c.modbusSlaveID,
+		}}
 	}
+	if c.modbusMode == "tcp" {
+		for _, d := range c.devices {
+			if len(d.ip) == 0 {
+				errs = append(errs, fmt.Errorf("MODBUS_IP is required for device %q", d.name))
+			}
+		}
+	}
+
+	if err := setLogLevel(c.logLevel); err != nil {
+		errs = append(errs, err)
+	}
+	return errors.Join(errs...)
+}
 
-	x = os.Getenv("MODBUS_SLEEP")
-	if len(x) > 0 {
-		modbusSleepUint, err := strconv.ParseUint(x, 10, 16)
+// loadRegisterMap returns the register map to poll: the built-in one, merged with REGISTER_MAP, with the BLOCKS
+// overrides.
+func (c *config) loadRegisterMap() (m *registerMap, err error) {
+	m = regMap
+	if len(c.registerMap) > 0 {
+		m, err = loadRegisterMap(c.registerMap)
 		if err != nil {
-			log.Fatal(err)
+			return nil, fmt.Errorf("REGISTER_MAP: %w", err)
 		}
-		c.modbusSleep = uint(modbusSleepUint)
 	}
+	return c.applyBlockOverrides(m)
+}
 
-	x = os.Getenv("MODBUS_SLAVE_ID")
-	if len(x) > 0 {
-		modbusSlaveIDUint, err := strconv.ParseUint(x, 10, 8)
+// runConfig is the "config check" command, loading the configuration as the exporter would, and reporting all the
+// problems in it.
+func runConfig(args []string) error {
+	if len(args) == 0 || args[0] != "check" {
+		return errors.New("usage: sun2000-modbus config check [-config file] [flags]")
+	}
+	err := cfg.load(args[1:])
+	if errors.Is(err, flag.ErrHelp) {
+		return err
+	}
+	var errs []error
+	if err != nil {
+		errs = append(errs, err)
+	}
+	if _, err := cfg.loadRegisterMap(); err != nil {
+		errs = append(errs, err)
+	}
+	if len(cfg.deviceProfile) > 0 {
+		if _, err := loadDeviceProfiles(cfg.deviceProfile); err != nil {
+			errs = append(errs, fmt.Errorf("DEVICE_PROFILE: %w", err))
+		}
+	}
+	if err := errors.Join(errs...); err != nil {
+		return err
+	}
+	fmt.Printf("The configuration is fine, with %d device(s):\n", len(cfg.devices))
+	for _, d := range cfg.devices {
+		switch cfg.modbusMode {
+		case "tcp":
+			fmt.Printf("  %s: %s:%d/%d\n", d.name, d.ip, d.port, d.slaveID)
+		default:
+			fmt.Printf("  %s: slave %d\n", d.name, d.slaveID)
+		}
+	}
+	return nil
+}
+
+// parseDevices parses a comma separated list of devices, each in the form name=[host[:port]]/slaveID. The host and
+// port default to MODBUS_IP and MODBUS_PORT, e.g.:
+//
+//	master=192.168.0.250:502/1,second=/2,third=/3
+func parseDevices(in string, defaultIP string, defaultPort uint16) (out []deviceConfig, err error) {
+	names := make(map[string]bool)
+	for _, entry := range strings.Split(in, ",") {
+		entry = strings.TrimSpace(entry)
+		if len(entry) == 0 {
+			continue
+		}
+		name, target, found := strings.Cut(entry, "=")
+		if !found || len(name) == 0 {
+			return nil, fmt.Errorf("device %q is not in the name=[host[:port]]/slaveID format", entry)
+		}
+		if names[name] {
+			return nil, fmt.Errorf("device name %q is used more than once", name)
+		}
+		names[name] = true
+
+		d := deviceConfig{name: name, ip: defaultIP, port: defaultPort}
+		hostPort, slave, found := strings.Cut(target, "/")
+		if !found {
+			return nil, fmt.Errorf("device %q is missing the /slaveID", entry)
+		}
+		slaveID, err := strconv.ParseUint(slave, 10, 8)
 		if err != nil {
-			log.Fatal(err)
+			return nil, fmt.Errorf("device %q has an invalid slave ID: %v", entry, err)
 		}
-		c.modbusSlaveID = byte(modbusSlaveIDUint)
+		d.slaveID = byte(slaveID)
+		if len(hostPort) > 0 {
+			host, port, found := strings.Cut(hostPort, ":")
+			d.ip = host
+			if found {
+				portUint, err := strconv.ParseUint(port, 10, 16)
+				if err != nil {
+					return nil, fmt.Errorf("device %q has an invalid port: %v", entry, err)
+				}
+				d.port = uint16(portUint)
+			}
+		}
+		out = append(out, d)
+	}
+	if len(out) == 0 {
+		return nil, fmt.Errorf("no devices in %q", in)
 	}
+	return out, nil
 }
@@ -0,0 +1,154 @@
+// Copyright: 2024 Dragos Vingarzan vingarzan -at- gmail -dot- com
+// License: AGPL-3.0
+//
+// This file is part of sun2000-modbus.
+//
+// sun2000-modbus is free software: you can redistribute it and/or modify it under the terms of the GNU Affero General
+// Public License Version 3 (AGPL-3.0) as published by the Free Software Foundation.
+//
+// sun2000-modbus is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY; without even the implied
+// warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the AGPL-3.0 along with sun2000-modbus. If not,
+// see <https://www.gnu.org/licenses/>.
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func writeConfigFile(t *testing.T, content string) string {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { setLogLevel("debug") })
+	return path
+}
+
+func TestConfigPrecedence(t *testing.T) {
+	path := writeConfigFile(t, `
+http: {port: 9090}
+log: {level: warning}
+modbus:
+  ip: 192.168.0.250
+  timeout: 7
+  sleep: 2
+devices:
+  - {name: master, slave: 1}
+  - {name: second, ip: 192.168.0.251, port: 6607, slave: 2}
+blocks:
+  PV Data: {interval: 5s}
+  ESU2 Data: {enabled: true}
+mqtt:
+  discoveryPrefix: ""
+`)
+	t.Setenv("MODBUS_TIMEOUT", "8")
+	t.Setenv("MODBUS_SLEEP", "3")
+	var c config
+	if err := c.load([]string{"-config", path, "-modbus-sleep", "4", "-control-enabled"}); err != nil {
+		t.Fatal(err)
+	}
+	// the file, then the environment, then the flags
+	if c.httpPort != "9090" || c.logLevel != "warning" || c.modbusTimeout != 8 || c.modbusSleep != 4 || !c.controlEnabled {
+		t.Errorf("unexpected config %+v", c)
+	}
+	if c.mqtt.discoveryPrefix != "" || c.mqtt.topicPrefix != "sun2000" {
+		t.Errorf("unexpected MQTT config %+v", c.mqtt)
+	}
+	if len(c.devices) != 2 || c.devices[0] != (deviceConfig{"master", "192.168.0.250", 502, 1}) ||
+		c.devices[1] != (deviceConfig{"second", "192.168.0.251", 6607, 2}) {
+		t.Errorf("unexpected devices %+v", c.devices)
+	}
+
+	m, err := c.loadRegisterMap()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, b := range m.Blocks {
+		switch b.Name {
+		case "PV Data":
+			if b.Interval != 5*time.Second {
+				t.Errorf("unexpected PV Data interval %s", b.Interval)
+			}
+		case "ESU2 Data":
+			if !b.isEnabled() {
+				t.Errorf("ESU2 Data was not enabled")
+			}
+		}
+	}
+	// the built-in map is left alone
+	if regMap.findTarget("esu2").isEnabled() || regMap.findTarget("pv").Interval != 10*time.Second {
+		t.Errorf("the built-in register map was changed")
+	}
+
+	// MODBUS_DEVICES overrides the devices of the file
+	t.Setenv("MODBUS_DEVICES", "only=/3")
+	if err := c.load([]string{"-config", path}); err != nil {
+		t.Fatal(err)
+	}
+	if len(c.devices) != 1 || c.devices[0] != (deviceConfig{"only", "192.168.0.250", 502, 3}) {
+		t.Errorf("unexpected devices %+v", c.devices)
+	}
+}
+
+func TestConfigErrors(t *testing.T) {
+	path := writeConfigFile(t, `
+modbus:
+  timeout: soon
+  serial: {parity: X}
+  unknown: 1
+devices:
+  - {name: master}
+blocks:
+  No Such Data: {enabled: false}
+`)
+	t.Setenv("MODBUS_PORT", "99999")
+	t.Setenv("POWER_LIMIT_SCHEDULE", "10:00-16:00=export:0kW")
+	var c config
+	err := c.load([]string{"-config", path, "-metrics-format", "xml", "-modbus-mode", "replay"})
+	if err == nil {
+		t.Fatal("load() did not fail")
+	}
+	_, mapErr := c.loadRegisterMap()
+	if mapErr == nil {
+		t.Fatal("loadRegisterMap() did not fail")
+	}
+	// all the problems are reported at once
+	all := err.Error() + "\n" + mapErr.Error()
+	for _, s := range []string{
+		"config.yaml:3: modbus.timeout",
+		"config.yaml:4: modbus.serial.parity",
+		"config.yaml:5: modbus.unknown: unknown setting",
+		"needs at least a name and a slave",
+		"MODBUS_PORT: must be a number from 1 to 65535",
+		"-metrics-format: must be one of prometheus, legacy",
+		"MODBUS_REPLAY_FILE is required",
+		"POWER_LIMIT_SCHEDULE writes to the inverter",
+		`no block "No Such Data"`,
+	} {
+		if !strings.Contains(all, s) {
+			t.Errorf("no %q in:\n%s", s, all)
+		}
+	}
+}
+
+func TestParseBlockOverrides(t *testing.T) {
+	var c config
+	if err := c.parseBlockOverrides("PV Data=5s, ESU2 Data=on,Meter Data=off"); err != nil {
+		t.Fatal(err)
+	}
+	if c.blocks["PV Data"].Interval != 5*time.Second || !*c.blocks["ESU2 Data"].Enabled || *c.blocks["Meter Data"].Enabled {
+		t.Errorf("unexpected overrides %+v", c.blocks)
+	}
+	for _, bad := range []string{"PV Data", "=5s", "PV Data=soon", "PV Data=-5s"} {
+		if err := c.parseBlockOverrides(bad); err == nil {
+			t.Errorf("%q was accepted", bad)
+		}
+	}
+}
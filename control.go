@@ -0,0 +1,471 @@
+// Copyright: 2024 Dragos Vingarzan vingarzan -at- gmail -dot- com
+// License: AGPL-3.0
+//
+// This file is part of sun2000-modbus.
+//
+// sun2000-modbus is free software: you can redistribute it and/or modify it under the terms of the GNU Affero General
+// Public License Version 3 (AGPL-3.0) as published by the Free Software Foundation.
+//
+// sun2000-modbus is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY; without even the implied
+// warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the AGPL-3.0 along with sun2000-modbus. If not,
+// see <https://www.gnu.org/licenses/>.
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/vingarzan/sun2000-modbus/sun2000"
+)
+
+// Control of the LUNA2000 battery: forcible charge/discharge, the working mode and the charge/discharge power caps.
+// Every request is checked against what the battery reports it can do, each write is read back, and everything is
+// written to the audit log, as for all the writes to the inverter.
+
+// The writable registers of the battery settings.
+const (
+	// U32 W
+	regESSMaxChargePower    = 47075
+	regESSMaxDischargePower = 47077
+	// U16 mins
+	regESSForcibleChargeDischargePeriod = 47083
+	// U16, see essWorkingModeSettings
+	regESSWorkingModeSettings = 47086
+	// U16 0: stop, 1: charge, 2: discharge
+	regESSForcibleChargeDischarge = 47100
+	// U16 0: for a duration, 1: up to a SOC
+	regESSForcibleSettingMode = 47246
+	// U32 W
+	regESSForcibleChargePower    = 47247
+	regESSForcibleDischargePower = 47249
+)
+
+const (
+	essForcibleStop      = 0
+	essForcibleCharge    = 1
+	essForcibleDischarge = 2
+
+	essForcibleMaxDuration = 24 * time.Hour
+)
+
+// essWorkingModeSettings maps the working modes as read in sun2000.ESUWorkingMode, to the values to write in the
+// settings register. The others (e.g. forcible charge/discharge, or the remote scheduling ones) can't be set this way.
+var essWorkingModeSettings = map[sun2000.ESUWorkingMode]uint16{
+	2: 3, // Time of Use(LG)
+	3: 1, // Fixed charge/discharge
+	4: 2, // Maximise selfconsumption
+	5: 4, // Fully fed to grid
+	6: 5, // Time of Use(LUNA2000)
+}
+
+// batteryControlRequest is what the HTTP API and the battery command can ask for. Unset fields are left alone.
+type batteryControlRequest struct {
+	Device string `json:"device,omitempty"`
+	// "charge", "discharge" or "stop"
+	Forcible string `json:"forcible,omitempty"`
+	// forcible charge/discharge power, in W
+	Power uint32 `json:"power,omitempty"`
+	// forcible charge/discharge duration, e.g. "30m"
+	Duration string `json:"duration,omitempty"`
+	// one of the sun2000.ESUWorkingMode values
+	WorkingMode *uint16 `json:"workingMode,omitempty"`
+	// caps of the charge/discharge power, in W
+	MaxChargePower    *uint32 `json:"maxChargePower,omitempty"`
+	MaxDischargePower *uint32 `json:"maxDischargePower,omitempty"`
+}
+
+// batteryLimits is what the battery reports it can do.
+type batteryLimits struct {
+	ratedChargePower      uint32
+	ratedDischargePower   uint32
+	maximumChargePower    uint32
+	maximumDischargePower uint32
+}
+
+func (d *device) batteryLimits() (out batteryLimits, err error) {
+	x := &d.data.esu1
+	x.RLock()
+	defer x.RUnlock()
+	if x.lastRead.IsZero() {
+		return out, fmt.Errorf("no battery data was read from %s yet", d.name)
+	}
+	if len(x.SN) == 0 || x.RatedChargePower == 0 {
+		return out, fmt.Errorf("%s has no battery", d.name)
+	}
+	out.ratedChargePower = x.RatedChargePower
+	out.ratedDischargePower = x.RatedDischargePower
+	out.maximumChargePower = x.MaximumChargePower
+	out.maximumDischargePower = x.MaximumDischargePower
+	return out, nil
+}
+
+// minNonZero returns the smallest of the limits, ignoring the ones not reported (0).
+func minNonZero(limits ...uint32) (out uint32) {
+	for _, l := range limits {
+		if l > 0 && (out == 0 || l < out) {
+			out = l
+		}
+	}
+	return out
+}
+
+// registerWrite is one write-multiple-registers, of the plan for a request.
+type registerWrite struct {
+	what    string
+	address uint16
+	values  []uint16
+}
+
+func u32Registers(v uint32) []uint16 {
+	return []uint16{uint16(v >> 16), uint16(v)}
+}
+
+// plan checks the request against the limits and returns the writes to do, in order. All the problems are reported at
+// once, and nothing is to be written if there is any.
+func (x *batteryControlRequest) plan(limits batteryLimits) (out []registerWrite, err error) {
+	var errs []error
+
+	if x.MaxChargePower != nil {
+		if *x.MaxChargePower > limits.ratedChargePower {
+			errs = append(errs, fmt.Errorf("maxChargePower %d W is above the rated charge power of %d W", *x.MaxChargePower, limits.ratedChargePower))
+		} else {
+			out = append(out, registerWrite{"maximum charge power", regESSMaxChargePower, u32Registers(*x.MaxChargePower)})
+		}
+	}
+	if x.MaxDischargePower != nil {
+		if *x.MaxDischargePower > limits.ratedDischargePower {
+			errs = append(errs, fmt.Errorf("maxDischargePower %d W is above the rated discharge power of %d W", *x.MaxDischargePower, limits.ratedDischargePower))
+		} else {
+			out = append(out, registerWrite{"maximum discharge power", regESSMaxDischargePower, u32Registers(*x.MaxDischargePower)})
+		}
+	}
+
+	if x.WorkingMode != nil {
+		setting, ok := essWorkingModeSettings[sun2000.ESUWorkingMode(*x.WorkingMode)]
+		if !ok {
+			var modes []string
+			for m := range essWorkingModeSettings {
+				modes = append(modes, fmt.Sprintf("%d (%s)", m, m))
+			}
+			sort.Strings(modes)
+			errs = append(errs, fmt.Errorf("workingMode %d can't be set, only %s", *x.WorkingMode, strings.Join(modes, ", ")))
+		} else {
+			out = append(out, registerWrite{"working mode", regESSWorkingModeSettings, []uint16{setting}})
+		}
+	}
+
+	switch x.Forcible {
+	case "":
+		if x.Power != 0 || len(x.Duration) > 0 {
+			errs = append(errs, errors.New("power and duration are only for a forcible charge or discharge"))
+		}
+	case "stop":
+		out = append(out, registerWrite{"forcible stop", regESSForcibleChargeDischarge, []uint16{essForcibleStop}})
+	case "charge", "discharge":
+		command := uint16(essForcibleCharge)
+		limit := minNonZero(limits.ratedChargePower, limits.maximumChargePower)
+		if x.MaxChargePower != nil {
+			limit = minNonZero(limit, *x.MaxChargePower)
+		}
+		if x.Forcible == "discharge" {
+			command = essForcibleDischarge
+			limit = minNonZero(limits.ratedDischargePower, limits.maximumDischargePower)
+			if x.MaxDischargePower != nil {
+				limit = minNonZero(limit, *x.MaxDischargePower)
+			}
+		}
+		if x.Power == 0 {
+			errs = append(errs, fmt.Errorf("a forcible %s needs the power", x.Forcible))
+		} else if x.Power > limit {
+			errs = append(errs, fmt.Errorf("power %d W is above the maximum %s power of %d W", x.Power, x.Forcible, limit))
+		}
+		duration, err := time.ParseDuration(x.Duration)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("a forcible %s needs a duration, like 30m: %v", x.Forcible, err))
+		} else if duration < time.Minute || duration > essForcibleMaxDuration {
+			errs = append(errs, fmt.Errorf("duration %s must be between 1m and %s", duration, essForcibleMaxDuration))
+		}
+		// both powers are in one go, the other one is left at 0
+		powers := make([]uint16, 5)
+		powers[0] = 0
+		if command == essForcibleCharge {
+			copy(powers[1:3], u32Registers(x.Power))
+		} else {
+			copy(powers[3:5], u32Registers(x.Power))
+		}
+		out = append(out,
+			registerWrite{"forcible charge/discharge power", regESSForcibleSettingMode, powers},
+			registerWrite{"forcible charge/discharge period", regESSForcibleChargeDischargePeriod, []uint16{uint16(duration / time.Minute)}},
+			registerWrite{"forcible " + x.Forcible, regESSForcibleChargeDischarge, []uint16{command}})
+	default:
+		errs = append(errs, fmt.Errorf("forcible must be charge, discharge or stop, not %q", x.Forcible))
+	}
+
+	if len(errs) > 0 {
+		return nil, errors.Join(errs...)
+	}
+	if len(out) == 0 {
+		return nil, errors.New("nothing to do")
+	}
+	return out, nil
+}
+
+// controlBattery checks and executes the request on the device. The source (e.g. the HTTP client) goes in the audit log.
+func (d *device) controlBattery(req *batteryControlRequest, source string) (err error) {
+	limits, err := d.batteryLimits()
+	if err == nil {
+		var writes []registerWrite
+		writes, err = req.plan(limits)
+		if err == nil {
+			err = d.executeWrites(writes, source)
+		}
+	}
+	if err != nil {
+		auditLog.write(auditEntry{Device: d.name, Source: source, Action: "battery control", Request: req, Error: errorString(err)})
+		return err
+	}
+	// read the battery again on the next round, to show the effect
+	if r := d.findRange("esu1"); r != nil {
+		r.values.setNextRead(time.Time{})
+		r.target.setNextRead(time.Time{})
+	}
+	return nil
+}
+
+// executeWrites does the writes in order, recording each in the audit log, and stops at the first one failing.
+func (d *device) executeWrites(writes []registerWrite, source string) error {
+	for _, w := range writes {
+		err := d.writeModbusRegisters(w.what, w.address, w.values)
+		auditLog.write(auditEntry{Device: d.name, Source: source, Action: w.what, Address: w.address, Values: w.values, Error: errorString(err)})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func errorString(err error) string {
+	if err == nil {
+		return ""
+	}
+	return err.Error()
+}
+
+// auditEntry is one line of the audit log, in JSON.
+type auditEntry struct {
+	Time    time.Time              `json:"time"`
+	Device  string                 `json:"device"`
+	Source  string                 `json:"source"`
+	Action  string                 `json:"action"`
+	Address uint16                 `json:"address,omitempty"`
+	Values  []uint16               `json:"values,omitempty"`
+	Request *batteryControlRequest `json:"request,omitempty"`
+	// empty if it went fine
+	Error string `json:"error,omitempty"`
+}
+
+// controlAuditLog records the writes, and the refused requests, to the log and optionally to a file.
+type controlAuditLog struct {
+	sync.Mutex
+	file *os.File
+}
+
+// The audit log of all the writes. main() points it to a file, if CONTROL_AUDIT_LOG is set.
+var auditLog = &controlAuditLog{}
+
+func (x *controlAuditLog) open(path string) (err error) {
+	x.Lock()
+	defer x.Unlock()
+	x.file, err = os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o640)
+	return err
+}
+
+func (x *controlAuditLog) close() {
+	x.Lock()
+	defer x.Unlock()
+	if x.file != nil {
+		x.file.Close()
+		x.file = nil
+	}
+}
+
+func (x *controlAuditLog) write(e auditEntry) {
+	e.Time = time.Now()
+	line, _ := json.Marshal(e)
+	if len(e.Error) > 0 {
+		lWarning.Printf("AUDIT %s", line)
+	} else {
+		lInfo.Printf("AUDIT %s", line)
+	}
+
+	x.Lock()
+	defer x.Unlock()
+	if x.file == nil {
+		return
+	}
+	if _, err := x.file.Write(append(line, '\n')); err != nil {
+		lError.Printf("Error writing the audit log: %v", err)
+	}
+}
+
+// checkControlToken checks the bearer token of the control APIs, if CONTROL_TOKEN is set, and answers 401 if it's wrong.
+func checkControlToken(w http.ResponseWriter, r *http.Request, action string) bool {
+	if len(cfg.controlToken) == 0 {
+		return true
+	}
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if subtle.ConstantTimeCompare([]byte(token), []byte(cfg.controlToken)) != 1 {
+		auditLog.write(auditEntry{Source: r.RemoteAddr, Action: action, Error: "unauthorized"})
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return false
+	}
+	return true
+}
+
+// batteryState is what GET returns, per device.
+type batteryState struct {
+	Device                  string  `json:"device"`
+	WorkingMode             uint16  `json:"workingMode"`
+	WorkingModeText         string  `json:"workingModeText"`
+	SOC                     float32 `json:"soc"`
+	ChargeAndDischargePower float32 `json:"chargeAndDischargePower"`
+	RatedChargePower        uint32  `json:"ratedChargePower"`
+	RatedDischargePower     uint32  `json:"ratedDischargePower"`
+	MaximumChargePower      uint32  `json:"maximumChargePower"`
+	MaximumDischargePower   uint32  `json:"maximumDischargePower"`
+	LastRead                string  `json:"lastRead"`
+}
+
+// handleBatteryControl is the HTTP API: GET for the state of the batteries, POST a batteryControlRequest to change it.
+func handleBatteryControl(w http.ResponseWriter, r *http.Request) {
+	if !checkControlToken(w, r, "battery control") {
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		var out []batteryState
+		for _, d := range devices {
+			x := &d.data.esu1
+			x.RLock()
+			out = append(out, batteryState{
+				Device:                  d.name,
+				WorkingMode:             uint16(x.WorkingMode),
+				WorkingModeText:         x.WorkingMode.String(),
+				SOC:                     x.BatterySOC,
+				ChargeAndDischargePower: x.ChargeAndDischargePower,
+				RatedChargePower:        x.RatedChargePower,
+				RatedDischargePower:     x.RatedDischargePower,
+				MaximumChargePower:      x.MaximumChargePower,
+				MaximumDischargePower:   x.MaximumDischargePower,
+				LastRead:                x.lastRead.Format(time.RFC3339),
+			})
+			x.RUnlock()
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(out)
+	case http.MethodPost:
+		var req batteryControlRequest
+		decoder := json.NewDecoder(http.MaxBytesReader(w, r.Body, 4096))
+		decoder.DisallowUnknownFields()
+		if err := decoder.Decode(&req); err != nil {
+			http.Error(w, fmt.Sprintf("invalid request: %v", err), http.StatusBadRequest)
+			return
+		}
+		d, err := findDevice(devices, req.Device)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		if err := d.controlBattery(&req, r.RemoteAddr); err != nil {
+			http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.Header().Set("Allow", "GET, POST")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// runBattery is the "battery" command, doing one request from the command line, with the Modbus settings from the
+// environment, as for the exporter.
+func runBattery(args []string) error {
+	var req batteryControlRequest
+	fs := flag.NewFlagSet("battery", flag.ContinueOnError)
+	fs.StringVar(&req.Device, "device", "", "name of the device, from MODBUS_DEVICES (if there is more than one)")
+	fs.StringVar(&req.Forcible, "forcible", "", "forcible charge, discharge or stop")
+	fs.Func("power", "forcible charge/discharge power, in W", func(s string) error {
+		_, err := fmt.Sscan(s, &req.Power)
+		return err
+	})
+	fs.StringVar(&req.Duration, "duration", "", "forcible charge/discharge duration, e.g. 30m")
+	fs.Func("mode", "working mode to switch to, as in the ess working mode metric (2, 3, 4, 5 or 6)", func(s string) error {
+		req.WorkingMode = new(uint16)
+		_, err := fmt.Sscan(s, req.WorkingMode)
+		return err
+	})
+	fs.Func("max-charge-power", "cap of the charge power, in W", func(s string) error {
+		req.MaxChargePower = new(uint32)
+		_, err := fmt.Sscan(s, req.MaxChargePower)
+		return err
+	})
+	fs.Func("max-discharge-power", "cap of the discharge power, in W", func(s string) error {
+		req.MaxDischargePower = new(uint32)
+		_, err := fmt.Sscan(s, req.MaxDischargePower)
+		return err
+	})
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	err := cfg.load(nil)
+	if err != nil {
+		return err
+	}
+	// the overrides may disable the ESU1 Data block
+	if regMap, err = cfg.loadRegisterMap(); err != nil {
+		return err
+	}
+	if len(cfg.controlAuditLog) > 0 {
+		if err := auditLog.open(cfg.controlAuditLog); err != nil {
+			return fmt.Errorf("CONTROL_AUDIT_LOG: %w", err)
+		}
+		defer auditLog.close()
+	}
+	d, err := findDevice(newDevices(cfg.devices), req.Device)
+	if err != nil {
+		return err
+	}
+	if err := d.conn.open(); err != nil {
+		return err
+	}
+	defer d.conn.close()
+
+	// dummy read, since the first call always seems to fail, then what we need for the checks
+	d.readModbusFromTo("dummy read", 30000, 30015)
+	r := d.findRange("esu1")
+	if r == nil {
+		return errors.New("the ESU1 Data block is disabled in the register map")
+	}
+	if !d.readRange(r) {
+		return fmt.Errorf("failed to read the battery data from %s", d.name)
+	}
+	user := os.Getenv("USER")
+	if len(user) == 0 {
+		user = "unknown"
+	}
+	return d.controlBattery(&req, "cli:"+user)
+}
@@ -0,0 +1,202 @@
+// Copyright: 2024 Dragos Vingarzan vingarzan -at- gmail -dot- com
+// License: AGPL-3.0
+//
+// This file is part of sun2000-modbus.
+//
+// sun2000-modbus is free software: you can redistribute it and/or modify it under the terms of the GNU Affero General
+// Public License Version 3 (AGPL-3.0) as published by the Free Software Foundation.
+//
+// sun2000-modbus is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY; without even the implied
+// warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the AGPL-3.0 along with sun2000-modbus. If not,
+// see <https://www.gnu.org/licenses/>.
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// batteryDevice returns a device polling the simulator, with the battery data read.
+func batteryDevice(t *testing.T) *device {
+	server := startSimulator(t, nil)
+	d := simulatorDevices(t, server, 1)[0]
+	// the first read after connecting is not answered
+	d.readModbusFromTo("dummy read", 30000, 30015)
+	if !d.readRange(d.findRange("esu1")) {
+		t.Fatal("failed to read the battery data")
+	}
+	return d
+}
+
+func TestBatteryControlPlan(t *testing.T) {
+	limits := batteryLimits{ratedChargePower: 2500, ratedDischargePower: 2500, maximumChargePower: 2000, maximumDischargePower: 2500}
+	mode, capPower := uint16(7), uint32(3000)
+	for _, tc := range []struct {
+		name   string
+		req    batteryControlRequest
+		errors []string
+		writes int
+	}{
+		{"charge", batteryControlRequest{Forcible: "charge", Power: 1500, Duration: "30m"}, nil, 3},
+		{"stop", batteryControlRequest{Forcible: "stop"}, nil, 1},
+		{"above maximum", batteryControlRequest{Forcible: "charge", Power: 2100, Duration: "30m"}, []string{"above the maximum charge power of 2000 W"}, 0},
+		{"all errors", batteryControlRequest{Forcible: "discharge", Duration: "25h", WorkingMode: &mode, MaxChargePower: &capPower},
+			[]string{"needs the power", "must be between 1m", "workingMode 7 can't be set", "above the rated charge power"}, 0},
+		{"power without forcible", batteryControlRequest{Power: 100}, []string{"only for a forcible"}, 0},
+		{"nothing", batteryControlRequest{}, []string{"nothing to do"}, 0},
+	} {
+		writes, err := tc.req.plan(limits)
+		for _, e := range tc.errors {
+			if err == nil || !strings.Contains(err.Error(), e) {
+				t.Errorf("%s: expected %q in the error, got %v", tc.name, e, err)
+			}
+		}
+		if len(tc.errors) == 0 && err != nil {
+			t.Errorf("%s: unexpected error %v", tc.name, err)
+		}
+		if len(writes) != tc.writes {
+			t.Errorf("%s: %d writes instead of %d", tc.name, len(writes), tc.writes)
+		}
+	}
+}
+
+func TestBatteryControl(t *testing.T) {
+	d := batteryDevice(t)
+	path := filepath.Join(t.TempDir(), "audit.log")
+	if err := auditLog.open(path); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		auditLog.file.Close()
+		auditLog.file = nil
+	})
+
+	if err := d.controlBattery(&batteryControlRequest{Forcible: "charge", Power: 1500, Duration: "1h"}, "test"); err != nil {
+		t.Fatalf("controlBattery() failed: %v", err)
+	}
+	if !d.readRange(d.findRange("esu1")) {
+		t.Fatal("failed to read the battery data")
+	}
+	d.data.esu1.RLock()
+	workingMode, power := d.data.esu1.WorkingMode, d.data.esu1.ChargeAndDischargePower
+	d.data.esu1.RUnlock()
+	if workingMode != 1 || power != 1.5 {
+		t.Errorf("the battery is not charging: mode %s, power %v", workingMode, power)
+	}
+
+	// refused, before writing anything
+	if err := d.controlBattery(&batteryControlRequest{Forcible: "discharge", Power: 5000, Duration: "1h"}, "test"); err == nil {
+		t.Errorf("a discharge above the maximum power was accepted")
+	}
+
+	if err := d.controlBattery(&batteryControlRequest{Forcible: "stop"}, "test"); err != nil {
+		t.Fatalf("controlBattery() failed: %v", err)
+	}
+
+	audit, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var entries []auditEntry
+	for _, line := range strings.Split(strings.TrimSpace(string(audit)), "\n") {
+		var e auditEntry
+		if err := json.Unmarshal([]byte(line), &e); err != nil {
+			t.Fatalf("%v in %s", err, line)
+		}
+		entries = append(entries, e)
+	}
+	if len(entries) != 5 {
+		t.Fatalf("unexpected audit log:\n%s", audit)
+	}
+	if entries[2].Action != "forcible charge" || entries[2].Address != regESSForcibleChargeDischarge || entries[2].Error != "" {
+		t.Errorf("unexpected audit entry %+v", entries[2])
+	}
+	if entries[3].Request == nil || !strings.Contains(entries[3].Error, "above the maximum discharge power") {
+		t.Errorf("unexpected audit entry %+v", entries[3])
+	}
+}
+
+func TestHandleBatteryControl(t *testing.T) {
+	d := batteryDevice(t)
+	devices = []*device{d}
+	cfg.controlToken = "secret"
+	t.Cleanup(func() {
+		devices = nil
+		cfg.controlToken = ""
+	})
+
+	do := func(method, token, body string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, "/api/v1/control/battery", strings.NewReader(body))
+		if len(token) > 0 {
+			r.Header.Set("Authorization", "Bearer "+token)
+		}
+		w := httptest.NewRecorder()
+		handleBatteryControl(w, r)
+		return w
+	}
+
+	if w := do(http.MethodGet, "wrong", ""); w.Code != http.StatusUnauthorized {
+		t.Errorf("GET with a wrong token: %d", w.Code)
+	}
+	w := do(http.MethodGet, "secret", "")
+	var state []batteryState
+	if err := json.Unmarshal(w.Body.Bytes(), &state); err != nil || len(state) != 1 {
+		t.Fatalf("GET: %d %s", w.Code, w.Body)
+	}
+	if state[0].Device != "sim1" || state[0].RatedChargePower != 2500 || state[0].WorkingModeText != "Maximise selfconsumption" {
+		t.Errorf("unexpected state %+v", state[0])
+	}
+
+	for _, tc := range []struct {
+		body string
+		code int
+	}{
+		{`{"forcible":"discharge","power":1000,"duration":"15m"}`, http.StatusNoContent},
+		{`{"workingMode":5}`, http.StatusNoContent},
+		{`{"forcible":"discharge","power":1000,"duration":"15m","force":true}`, http.StatusBadRequest},
+		{`{"device":"other","forcible":"stop"}`, http.StatusNotFound},
+		{`{"workingMode":1}`, http.StatusUnprocessableEntity},
+	} {
+		if w := do(http.MethodPost, "secret", tc.body); w.Code != tc.code {
+			t.Errorf("POST %s: %d instead of %d: %s", tc.body, w.Code, tc.code, w.Body)
+		}
+	}
+}
+
+func TestBatteryCommand(t *testing.T) {
+	server := startSimulator(t, nil)
+	defaultMap := regMap
+	t.Cleanup(func() {
+		regMap = defaultMap
+		cfg.setDefaults()
+	})
+	t.Setenv("MODBUS_DEVICES", "sim1="+server.addr()+"/1")
+	t.Setenv("MODBUS_TIMEOUT", "1")
+	t.Setenv("CONTROL_AUDIT_LOG", filepath.Join(t.TempDir(), "audit.log"))
+
+	// the blocks are the ones of the register map, with the overrides
+	t.Setenv("BLOCKS", "ESU1 Data=off")
+	if err := runBattery([]string{"-forcible", "stop"}); err == nil || !strings.Contains(err.Error(), "disabled in the register map") {
+		t.Errorf("unexpected error with the battery data disabled: %v", err)
+	}
+	if auditLog.file != nil {
+		t.Errorf("the audit log was left open")
+	}
+
+	t.Setenv("BLOCKS", "")
+	regMap = defaultMap
+	if err := runBattery([]string{"-forcible", "stop"}); err != nil {
+		t.Errorf("battery -forcible stop failed: %v", err)
+	}
+	if auditLog.file != nil {
+		t.Errorf("the audit log was left open")
+	}
+}
@@ -0,0 +1,246 @@
+// Copyright: 2024 Dragos Vingarzan vingarzan -at- gmail -dot- com
+// License: AGPL-3.0
+//
+// This file is part of sun2000-modbus.
+//
+// sun2000-modbus is free software: you can redistribute it and/or modify it under the terms of the GNU Affero General
+// Public License Version 3 (AGPL-3.0) as published by the Free Software Foundation.
+//
+// sun2000-modbus is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY; without even the implied
+// warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the AGPL-3.0 along with sun2000-modbus. If not,
+// see <https://www.gnu.org/licenses/>.
+package main
+
+import (
+	_ "embed"
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/vingarzan/sun2000-modbus/sun2000"
+)
+
+// The dashboard is a single page served at /, for a quick look on site without Grafana. It polls /api/v1/dashboard,
+// which has only what it shows, from the built-in parsers, for all the devices.
+
+//go:embed dashboard.html
+var dashboardHTML []byte
+
+type dashboardString struct {
+	Index   int     `json:"index"`
+	Voltage float32 `json:"voltage"`
+	Current float32 `json:"current"`
+	// kW
+	Power float32 `json:"power"`
+}
+
+type dashboardMPPT struct {
+	Index int `json:"index"`
+	// kW and kWh
+	Power  float32 `json:"power"`
+	Energy float32 `json:"energy"`
+}
+
+type dashboardPhase struct {
+	Phase       string  `json:"phase"`
+	Voltage     float32 `json:"voltage"`
+	Current     float32 `json:"current"`
+	ActivePower float32 `json:"activePower"`
+}
+
+type dashboardMeter struct {
+	Stale bool `json:"stale"`
+	// >0 feed-in to the grid, <0 supply from the grid
+	ActivePower float32          `json:"activePower"`
+	Frequency   float32          `json:"frequency"`
+	Phases      []dashboardPhase `json:"phases"`
+}
+
+type dashboardPack struct {
+	Pack   int     `json:"pack"`
+	SN     string  `json:"sn"`
+	Status uint16  `json:"status"`
+	SOC    float32 `json:"soc"`
+	// >0 charging, <0 discharging, in kW
+	Power   float32 `json:"power"`
+	Voltage float32 `json:"voltage"`
+}
+
+type dashboardBattery struct {
+	ESU         int             `json:"esu"`
+	Stale       bool            `json:"stale"`
+	Status      string          `json:"status"`
+	WorkingMode string          `json:"workingMode,omitempty"`
+	SOC         float32         `json:"soc"`
+	Power       float32         `json:"power"`
+	Packs       []dashboardPack `json:"packs"`
+}
+
+type dashboardDevice struct {
+	Device string `json:"device"`
+	Model  string `json:"model,omitempty"`
+	SN     string `json:"sn,omitempty"`
+	// of the inverter values
+	LastRead    string  `json:"lastRead,omitempty"`
+	Stale       bool    `json:"stale"`
+	Status      string  `json:"status"`
+	StatusCode  uint16  `json:"statusCode"`
+	ActivePower float32 `json:"activePower"`
+	DCPower     float32 `json:"dcPower"`
+	Efficiency  float32 `json:"efficiency"`
+	Temperature float32 `json:"temperature"`
+	DayYield    float32 `json:"dayYield"`
+
+	Strings   []dashboardString  `json:"strings"`
+	MPPTs     []dashboardMPPT    `json:"mppts"`
+	Meter     *dashboardMeter    `json:"meter,omitempty"`
+	Batteries []dashboardBattery `json:"batteries"`
+	Alarms    []alarmJSON        `json:"alarms"`
+	Energy    *energyStatus      `json:"energy,omitempty"`
+}
+
+// isStale tells if the values of the block of the target are stale, or were never read.
+func (d *device) isStale(target string, now time.Time) bool {
+	r := d.findRange(target)
+	if r == nil {
+		return true
+	}
+	_, stale := r.age(now)
+	return stale
+}
+
+// dashboard returns what the dashboard shows of the device, skipping the hardware it does not have.
+func (d *device) dashboard(now time.Time) *dashboardDevice {
+	id := &d.data.identification
+	id.RLock()
+	out := &dashboardDevice{Device: d.name, Model: id.Model, SN: id.SN, Strings: []dashboardString{}, MPPTs: []dashboardMPPT{},
+		Batteries: []dashboardBattery{}, Alarms: []alarmJSON{}}
+	id.RUnlock()
+
+	inv := &d.data.inverter
+	inv.RLock()
+	if !inv.lastRead.IsZero() {
+		out.LastRead = inv.lastRead.Format(time.RFC3339)
+	}
+	out.Status, out.StatusCode = inv.DeviceStatus.String(), uint16(inv.DeviceStatus)
+	out.ActivePower, out.DCPower = inv.ActivePower, inv.DCPower
+	out.Efficiency, out.Temperature = inv.InverterEfficiency, inv.InternalTemperature
+	inv.RUnlock()
+	out.Stale = d.isStale("inverter", now)
+
+	cumulative := &d.data.cumulative1
+	cumulative.RLock()
+	out.DayYield = cumulative.electricityGeneratedInCurrentDay
+	cumulative.RUnlock()
+
+	pv := &d.data.pv
+	pv.RLock()
+	for i := range pv.pv {
+		if !d.caps.hasIndex("pv", i+1) || (pv.pv[i].voltage == 0 && pv.pv[i].current == 0 && !d.caps.isDetected()) {
+			continue
+		}
+		s := pv.pv[i]
+		out.Strings = append(out.Strings, dashboardString{Index: i + 1, Voltage: s.voltage, Current: s.current, Power: s.voltage * s.current / 1000})
+	}
+	pv.RUnlock()
+
+	mpptPower, mpptEnergy := &d.data.mppt2, &d.data.mppt1
+	mpptPower.RLock()
+	mpptEnergy.RLock()
+	for i := range mpptPower.mpptTotalInputPower {
+		if !d.caps.hasIndex("mppt", i+1) || (mpptEnergy.cumulativeDCEnergyYieldOfMPPT[i] == 0 && !d.caps.isDetected()) {
+			continue
+		}
+		out.MPPTs = append(out.MPPTs, dashboardMPPT{Index: i + 1, Power: mpptPower.mpptTotalInputPower[i], Energy: mpptEnergy.cumulativeDCEnergyYieldOfMPPT[i]})
+	}
+	mpptEnergy.RUnlock()
+	mpptPower.RUnlock()
+
+	if d.caps.polls("meter") {
+		m := &d.data.meter
+		m.RLock()
+		if !m.lastRead.IsZero() {
+			out.Meter = &dashboardMeter{ActivePower: m.GridActivePower, Frequency: m.GridFrequency, Phases: []dashboardPhase{
+				{"A", m.GridPhaseAVoltage, m.GridPhaseACurrent, m.GridPhaseAActivePower},
+				{"B", m.GridPhaseBVoltage, m.GridPhaseBCurrent, m.GridPhaseBActivePower},
+				{"C", m.GridPhaseCVoltage, m.GridPhaseCCurrent, m.GridPhaseCActivePower},
+			}}
+		}
+		m.RUnlock()
+		if out.Meter != nil {
+			out.Meter.Stale = d.isStale("meter", now)
+		}
+	}
+
+	for _, esu := range []struct {
+		id     int
+		target string
+		data   *genericData
+		esu    *sun2000.ESU
+		packs  *[3]batteryData
+		// ESU2 has the power in W
+		powerGain float32
+	}{
+		{1, "esu1", &d.data.esu1.genericData, &d.data.esu1.ESU, &d.data.esu1.pack, 1},
+		{2, "esu2", &d.data.esu2.genericData, &d.data.esu2.ESU, &d.data.esu2.pack, 1000},
+	} {
+		if !d.caps.polls(esu.target) {
+			continue
+		}
+		esu.data.RLock()
+		if esu.data.lastRead.IsZero() || (esu.esu.RunningStatus == 0 && !d.caps.isDetected()) {
+			// not read, or likely not there
+			esu.data.RUnlock()
+			continue
+		}
+		b := dashboardBattery{ESU: esu.id, Status: esu.esu.RunningStatus.String(), SOC: esu.esu.BatterySOC,
+			Power: esu.esu.ChargeAndDischargePower / esu.powerGain, Packs: []dashboardPack{}}
+		if esu.id == 1 {
+			b.WorkingMode = esu.esu.WorkingMode.String()
+		}
+		esu.data.RUnlock()
+		b.Stale = d.isStale(esu.target, now)
+		for i := range esu.packs {
+			p := &esu.packs[i]
+			if !p.isPresent() {
+				continue
+			}
+			p.RLock()
+			b.Packs = append(b.Packs, dashboardPack{Pack: p.id, SN: p.SN, Status: p.WorkingStatus, SOC: p.SOC, Power: p.ChargeDischargePower, Voltage: p.Voltage})
+			p.RUnlock()
+		}
+		out.Batteries = append(out.Batteries, b)
+	}
+
+	if alarms := d.apiAlarms(now); alarms != nil {
+		out.Alarms = alarms.Active
+	}
+	for _, s := range energy.status(now) {
+		if s.Device == d.name {
+			out.Energy = &s
+		}
+	}
+	return out
+}
+
+// handleDashboard serves the page of the dashboard.
+func handleDashboard(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Write(dashboardHTML)
+}
+
+// handleDashboardData serves what the dashboard shows, for all the devices.
+func handleDashboardData(w http.ResponseWriter, r *http.Request) {
+	now := time.Now()
+	out := []*dashboardDevice{}
+	for _, d := range devices {
+		out = append(out, d.dashboard(now))
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(out); err != nil {
+		lWarning.Printf("Error writing the dashboard data: %v", err)
+	}
+}
@@ -0,0 +1,70 @@
+// Copyright: 2024 Dragos Vingarzan vingarzan -at- gmail -dot- com
+// License: AGPL-3.0
+//
+// This file is part of sun2000-modbus.
+//
+// sun2000-modbus is free software: you can redistribute it and/or modify it under the terms of the GNU Affero General
+// Public License Version 3 (AGPL-3.0) as published by the Free Software Foundation.
+//
+// sun2000-modbus is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY; without even the implied
+// warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the AGPL-3.0 along with sun2000-modbus. If not,
+// see <https://www.gnu.org/licenses/>.
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDashboard(t *testing.T) {
+	server := startSimulator(t, nil)
+	d := simulatorDevices(t, server, 1)[0]
+	d.readModbusFromTo("dummy read", 30000, 30015)
+	if !d.detectCapabilities() {
+		t.Fatalf("detectCapabilities() failed")
+	}
+	d.readExpiredRanges(context.Background())
+	devices = []*device{d}
+	defer func() { devices = nil }()
+
+	rec := httptest.NewRecorder()
+	handleDashboard(rec, httptest.NewRequest("GET", "/", nil))
+	if page := rec.Body.String(); !strings.HasPrefix(page, "<!DOCTYPE html>") || !strings.Contains(page, "api/v1/dashboard") {
+		t.Errorf("unexpected page %.100s", page)
+	}
+
+	rec = httptest.NewRecorder()
+	handleDashboardData(rec, httptest.NewRequest("GET", "/api/v1/dashboard", nil))
+	var out []dashboardDevice
+	if err := json.Unmarshal(rec.Body.Bytes(), &out); err != nil || len(out) != 1 {
+		t.Fatalf("unexpected dashboard data %s: %v", rec.Body.String(), err)
+	}
+	x := out[0]
+	if x.Device != "sim1" || x.SN != "SIM0000001" || x.Stale || x.Status != "On-grid: running" || x.StatusCode != 512 || x.ActivePower <= 0 {
+		t.Errorf("unexpected inverter %+v", x)
+	}
+	if len(x.Strings) != 2 || x.Strings[1].Index != 2 || x.Strings[0].Voltage <= 0 || len(x.MPPTs) != 2 {
+		t.Errorf("unexpected strings %+v and MPPTs %+v", x.Strings, x.MPPTs)
+	}
+	if x.Meter == nil || len(x.Meter.Phases) != 3 || x.Meter.Phases[0].Voltage <= 0 || x.Meter.Frequency != 50 {
+		t.Errorf("unexpected meter %+v", x.Meter)
+	}
+	if len(x.Batteries) != 1 || x.Batteries[0].Status != "running" || len(x.Batteries[0].Packs) != 1 || x.Batteries[0].Packs[0].SOC <= 0 {
+		t.Errorf("unexpected batteries %+v", x.Batteries)
+	}
+	if x.Alarms == nil || len(x.Alarms) != 0 {
+		t.Errorf("unexpected alarms %+v", x.Alarms)
+	}
+
+	// without reads for a while, the values are marked stale
+	if later := d.dashboard(time.Now().Add(time.Hour)); !later.Stale || !later.Meter.Stale || !later.Batteries[0].Stale {
+		t.Errorf("the values are not stale an hour later")
+	}
+}
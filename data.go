@@ -19,6 +19,8 @@ import (
 	"strings"
 	"sync"
 	"time"
+
+	"github.com/vingarzan/sun2000-modbus/sun2000"
 )
 
 type sun2000DataStruct struct {
@@ -50,23 +52,21 @@ type sun2000DataStruct struct {
 	esuTemperatures     esuTemperaturesData
 }
 
-func init() {
+func (x *sun2000DataStruct) init(device string) {
+	x.identification.device = device
 	for i := 0; i < 3; i++ {
-		parsedData.esu1.pack[i].esuId = 1
-		parsedData.esu1.pack[i].id = i + 1
-		parsedData.esu2.pack[i].esuId = 2
-		parsedData.esu2.pack[i].id = i + 1
+		x.esu1.pack[i].parent = x
+		x.esu1.pack[i].esuId = 1
+		x.esu1.pack[i].id = i + 1
+		x.esu2.pack[i].parent = x
+		x.esu2.pack[i].esuId = 2
+		x.esu2.pack[i].id = i + 1
 	}
+	x.esuTemperatures.parent = x
 }
 
 func (x *sun2000DataStruct) metricsString() string {
 	sb := strings.Builder{}
-	sb.WriteString("# Huawei Sun2000 inverter scraped data from ModBus TCP\n#\n")
-	sb.WriteString(fmt.Sprintf("#  - last read success at %s\n", lastSuccessTime.Format(time.RFC3339)))
-	sb.WriteString(fmt.Sprintf("#  - consecutive read errors %d\n", errorCount))
-	sb.WriteString(fmt.Sprintf("#  - total read errors %d\n", totalErrorCount))
-	sb.WriteString(fmt.Sprintf("#  - total read successes %d\n", totalSuccessCount))
-	sb.WriteString("\n")
 	sb.WriteString(x.identification.metricsString(&x.identification))
 	sb.WriteString("\n")
 	sb.WriteString(x.product.metricsString(&x.identification))
@@ -119,6 +119,74 @@ func (x *sun2000DataStruct) metricsString() string {
 	return sb.String()
 }
 
+// getTarget returns the built-in parser with the given name, as used by the "target" of the register map blocks.
+func (x *sun2000DataStruct) getTarget(name string) modbusParsedData {
+	switch name {
+	case "identification":
+		return &x.identification
+	case "product":
+		return &x.product
+	case "hardware1":
+		return &x.hardware1
+	case "hardware2":
+		return &x.hardware2
+	case "hardware3":
+		return &x.hardware3
+	case "hardware4":
+		return &x.hardware4
+	case "hardware5":
+		return &x.hardware5
+	case "hardware6":
+		return &x.hardware6
+	case "remoteSignalling":
+		return &x.remoteSignalling
+	case "alarm1":
+		return &x.alarm1
+	case "pv":
+		return &x.pv
+	case "inverter":
+		return &x.inverter
+	case "cumulative1":
+		return &x.cumulative1
+	case "cumulative2":
+		return &x.cumulative2
+	case "cumulative3":
+		return &x.cumulative3
+	case "mppt1":
+		return &x.mppt1
+	case "alarm2":
+		return &x.alarm2
+	case "stringAccess":
+		return &x.stringAccess
+	case "mppt2":
+		return &x.mppt2
+	case "internalTemperature":
+		return &x.internalTemperature
+	case "meter":
+		return &x.meter
+	case "esu1":
+		return &x.esu1
+	case "esu2":
+		return &x.esu2
+	case "esu1Pack1":
+		return &x.esu1.pack[0]
+	case "esu1Pack2":
+		return &x.esu1.pack[1]
+	case "esu1Pack3":
+		return &x.esu1.pack[2]
+	case "esu2Pack1":
+		return &x.esu2.pack[0]
+	case "esu2Pack2":
+		return &x.esu2.pack[1]
+	case "esu2Pack3":
+		return &x.esu2.pack[2]
+	case "esuTemperatures":
+		return &x.esuTemperatures
+	default:
+		return nil
+	}
+}
+
 type genericData struct {
 	// RW mutex to protect the data
 	sync.RWMutex
@@ -144,6 +212,12 @@ func (x *genericData) setNextRead(t time.Time) {
 	x.nextRead = t
 }
 
+func (x *genericData) getLastRead() time.Time {
+	x.RLock()
+	defer x.RUnlock()
+	return x.lastRead
+}
+
 func (x *genericData) getNextRead() time.Time {
 	x.RLock()
 	defer x.RUnlock()
@@ -161,75 +235,20 @@ func (x *genericData) metricsString(id *identificationData) string {
 type identificationData struct {
 	genericData
 
-	// 30000 STR 15
-	model string
-	// 30015 STR 10
-	sn string
-	// 30025 STR 10
-	pn string
-
-	// 30035 STR 15
-	firmwareVersion string
-	// 30050 STR 15
-	softwareVersion string
-
-	// 30068 U32 2
-	protocolVersion uint32 // modbus
-	// 30070 U16 1
-	modelID uint16
-	// 30071 U16 1
-	numberOfStrings uint16
-	// 30072 U16 1
-	numberOfMPPTs uint16
-	// 30073 U32 2 gain 1000 kW
-	ratedPower float32
-	// 30075 U32 2 gain 1000 kW
-	maxActivePowerPmax float32
-	// 30077 U32 2 gain 1000 kVA Pmax
-	maxApparentPowerSmax float32
-	// 30079 I32 2 gain 1000 kVar Qmax
-	realtimeMaxReactivePowerQmaxFeedToGrid float32
-	// 30081 I32 2 gain 1000 kVar -Qmax
-	realtimeMaxReactivePowerQmaxAbsorbedFromGrid float32
-	// 30083 U32 2 gain 1000 kW Pmax_real - 0<Pmax≤Smax≤Pmax_real≤Smax_real or 0<Pmax≤Pmax_real≤Smax≤Smax_real
-	maxActiveCapabilityPmaxReal float32
-	// 30085 U32 2 gain 1000 kVA Smax_real - 0<Pmax≤Smax≤Pmax_real≤Smax_real or 0<Pmax≤Pmax_real≤Smax≤Smax_real
-	maxApparentCapabilitySmaxReal float32
+	// name of the device, as configured - not read from the inverter
+	device string
+
+	sun2000.Identification
 }
 
 func (x *identificationData) parse(data []byte) (err error) {
-	if len(data) < 70 {
-		return fmt.Errorf("data length %d < 70", len(data))
+	v, err := sun2000.DecodeIdentification(data)
+	if err != nil {
+		return err
 	}
 	x.Lock()
 	defer x.Unlock()
-
-	var idx uint
-	x.model, idx, _ = getSTR(data, idx, 15)
-	x.sn, idx, _ = getSTR(data, idx, 10)
-	x.pn, idx, _ = getSTR(data, idx, 10)
-	x.firmwareVersion, idx, _ = getSTR(data, idx, 15)
-	x.softwareVersion, idx, _ = getSTR(data, idx, 15)
-	idx, _ = skipRecords(data, idx, 3)
-	x.protocolVersion, idx, _ = getU32(data, idx)
-	x.modelID, idx, _ = getU16(data, idx)
-	x.numberOfStrings, idx, _ = getU16(data, idx)
-	x.numberOfMPPTs, idx, _ = getU16(data, idx)
-	u32, idx, _ := getU32(data, idx)
-	x.ratedPower = float32(u32) / 1000
-	u32, idx, _ = getU32(data, idx)
-	x.maxActivePowerPmax = float32(u32) / 1000
-	u32, idx, _ = getU32(data, idx)
-	x.maxApparentPowerSmax = float32(u32) / 1000
-	i32, idx, _ := getI32(data, idx)
-	x.realtimeMaxReactivePowerQmaxFeedToGrid = float32(i32) / 1000
-	i32, idx, _ = getI32(data, idx)
-	x.realtimeMaxReactivePowerQmaxAbsorbedFromGrid = float32(i32) / 1000
-	u32, idx, _ = getU32(data, idx)
-	x.maxActiveCapabilityPmaxReal = float32(u32) / 1000
-	u32, _, _ = getU32(data, idx)
-	x.maxApparentCapabilitySmaxReal = float32(u32) / 1000
-
+	x.Identification = v
 	return nil
 }
 
@@ -242,24 +261,24 @@ func (x *identificationData) metricsString(id *identificationData) string {
 	sb.WriteString(fmt.Sprintf("# Last Read = %s\n", x.lastRead.Format(time.RFC3339)))
 	sb.WriteString(fmt.Sprintf("# Next Read = %s\n", x.nextRead.Format(time.RFC3339)))
 	sb.WriteString("\n")
-	sb.WriteString(fmt.Sprintf("# Model            = %q\n", x.model))
-	sb.WriteString(fmt.Sprintf("# SN               = %q\n", x.sn))
-	sb.WriteString(fmt.Sprintf("# PN               = %q\n", x.pn))
-	sb.WriteString(fmt.Sprintf("# Firmware Version = %q\n", x.firmwareVersion))
-	sb.WriteString(fmt.Sprintf("# Software Version = %q\n", x.softwareVersion))
-	sb.WriteString(fmt.Sprintf("# Protocol Version = %#08x (D%d.%d)\n", x.protocolVersion, x.protocolVersion>>16&0xffff, x.protocolVersion&0xffff))
-	sb.WriteString(fmt.Sprintf("# Model ID         = %d\n", x.modelID))
+	sb.WriteString(fmt.Sprintf("# Model            = %q\n", x.Model))
+	sb.WriteString(fmt.Sprintf("# SN               = %q\n", x.SN))
+	sb.WriteString(fmt.Sprintf("# PN               = %q\n", x.PN))
+	sb.WriteString(fmt.Sprintf("# Firmware Version = %q\n", x.FirmwareVersion))
+	sb.WriteString(fmt.Sprintf("# Software Version = %q\n", x.SoftwareVersion))
+	sb.WriteString(fmt.Sprintf("# Protocol Version = %#08x (D%d.%d)\n", x.ProtocolVersion, x.ProtocolVersion>>16&0xffff, x.ProtocolVersion&0xffff))
+	sb.WriteString(fmt.Sprintf("# Model ID         = %d\n", x.ModelID))
 	sb.WriteString("\n")
-	sb.WriteString(fmt.Sprintf("# Number of Strings = %d\n", x.numberOfStrings))
-	sb.WriteString(fmt.Sprintf("# Number of MPPTs   = %d\n", x.numberOfMPPTs))
+	sb.WriteString(fmt.Sprintf("# Number of Strings = %d\n", x.NumberOfStrings))
+	sb.WriteString(fmt.Sprintf("# Number of MPPTs   = %d\n", x.NumberOfMPPTs))
 	sb.WriteString("\n")
-	sb.WriteString(fmt.Sprintf("# Rated Power                                         = %2.3f kW\n", x.ratedPower))
-	sb.WriteString(fmt.Sprintf("# Max Active Power Pmax                               = %2.3f kW\n", x.maxActivePowerPmax))
-	sb.WriteString(fmt.Sprintf("# Max Apparent Power Smax                             = %2.3f kVA\n", x.maxApparentPowerSmax))
-	sb.WriteString(fmt.Sprintf("# Realtime Max Reactive Power Qmax Feed to Grid       = %2.3f kVar\n", x.realtimeMaxReactivePowerQmaxFeedToGrid))
-	sb.WriteString(fmt.Sprintf("# Realtime Max Reactive Power Qmax Absorbed from Grid = %2.3f kVar\n", x.realtimeMaxReactivePowerQmaxAbsorbedFromGrid))
-	sb.WriteString(fmt.Sprintf("# Max Active Capability Pmax Real                     = %2.3f kW    0<Pmax≤Smax≤Pmax_real≤Smax_real or 0<Pmax≤Pmax_real≤Smax≤Smax_real\n", x.maxActiveCapabilityPmaxReal))
-	sb.WriteString(fmt.Sprintf("# Max Apparent Capability Smax Real                   = %2.3f kVA    0<Pmax≤Smax≤Pmax_real≤Smax_real or 0<Pmax≤Pmax_real≤Smax≤Smax_real\n", x.maxApparentCapabilitySmaxReal))
+	sb.WriteString(fmt.Sprintf("# Rated Power                                         = %2.3f kW\n", x.RatedPower))
+	sb.WriteString(fmt.Sprintf("# Max Active Power Pmax                               = %2.3f kW\n", x.MaxActivePowerPmax))
+	sb.WriteString(fmt.Sprintf("# Max Apparent Power Smax                             = %2.3f kVA\n", x.MaxApparentPowerSmax))
+	sb.WriteString(fmt.Sprintf("# Realtime Max Reactive Power Qmax Feed to Grid       = %2.3f kVar\n", x.RealtimeMaxReactivePowerQmaxFeedToGrid))
+	sb.WriteString(fmt.Sprintf("# Realtime Max Reactive Power Qmax Absorbed from Grid = %2.3f kVar\n", x.RealtimeMaxReactivePowerQmaxAbsorbedFromGrid))
+	sb.WriteString(fmt.Sprintf("# Max Active Capability Pmax Real                     = %2.3f kW    0<Pmax≤Smax≤Pmax_real≤Smax_real or 0<Pmax≤Pmax_real≤Smax≤Smax_real\n", x.MaxActiveCapabilityPmaxReal))
+	sb.WriteString(fmt.Sprintf("# Max Apparent Capability Smax Real                   = %2.3f kVA    0<Pmax≤Smax≤Pmax_real≤Smax_real or 0<Pmax≤Pmax_real≤Smax≤Smax_real\n", x.MaxApparentCapabilitySmaxReal))
 
 	sb.WriteString("\n")
 
@@ -267,15 +286,15 @@ func (x *identificationData) metricsString(id *identificationData) string {
 	if x.lastRead.IsZero() {
 		sb.WriteString("# No identification data read yet\n")
 	} else {
-		sb.WriteString(fmt.Sprintf("sun2000_number_of_MPPTs{model=%q,sn=%q} %d\n", x.model, x.sn, x.numberOfMPPTs))
-		sb.WriteString(fmt.Sprintf("sun2000_number_of_strings{model=%q,sn=%q} %d\n", x.model, x.sn, x.numberOfStrings))
-		sb.WriteString(fmt.Sprintf("sun2000_rated_power{model=%q,sn=%q,unit=\"kW\",description=\"Rated Power\"} %.3f\n", x.model, x.sn, x.ratedPower))
-		sb.WriteString(fmt.Sprintf("sun2000_Pmax{model=%q,sn=%q,unit=\"kW\",description=\"Maximum Active Power Pmax\"} %.3f\n", x.model, x.sn, x.maxActivePowerPmax))
-		sb.WriteString(fmt.Sprintf("sun2000_Smax{model=%q,sn=%q,unit=\"kVA\",description=\"Maximum Apparent Power Smax\"} %.3f\n", x.model, x.sn, x.maxApparentPowerSmax))
-		sb.WriteString(fmt.Sprintf("sun2000_Qmax_feed_to_grid{model=%q,sn=%q,unit=\"kVar\",description=\"Realtime Max Reactive Power Qmax Feed to Grid\"} %.3f\n", x.model, x.sn, x.realtimeMaxReactivePowerQmaxFeedToGrid))
-		sb.WriteString(fmt.Sprintf("sun2000_Qmax_absorbed_from_grid{model=%q,sn=%q,unit=\"kVar\",description=\"Realtime Max Reactive Power Qmax Absorbed from Grid\"} %.3f\n", x.model, x.sn, x.realtimeMaxReactivePowerQmaxAbsorbedFromGrid))
-		sb.WriteString(fmt.Sprintf("sun2000_Pmax_real{model=%q,sn=%q,unit=\"kW\",description=\"Maximum Active Capability Pmax Real\"} %.3f\n", x.model, x.sn, x.maxActiveCapabilityPmaxReal))
-		sb.WriteString(fmt.Sprintf("sun2000_Smax_real{model=%q,sn=%q,unit=\"kVA\",description=\"Maximum Apparent Capability Smax Real\"} %.3f\n", x.model, x.sn, x.maxApparentCapabilitySmaxReal))
+		sb.WriteString(fmt.Sprintf("sun2000_number_of_MPPTs{device=%q,model=%q,sn=%q} %d\n", x.device, x.Model, x.SN, x.NumberOfMPPTs))
+		sb.WriteString(fmt.Sprintf("sun2000_number_of_strings{device=%q,model=%q,sn=%q} %d\n", x.device, x.Model, x.SN, x.NumberOfStrings))
+		sb.WriteString(fmt.Sprintf("sun2000_rated_power{device=%q,model=%q,sn=%q,unit=\"kW\",description=\"Rated Power\"} %.3f\n", x.device, x.Model, x.SN, x.RatedPower))
+		sb.WriteString(fmt.Sprintf("sun2000_Pmax{device=%q,model=%q,sn=%q,unit=\"kW\",description=\"Maximum Active Power Pmax\"} %.3f\n", x.device, x.Model, x.SN, x.MaxActivePowerPmax))
+		sb.WriteString(fmt.Sprintf("sun2000_Smax{device=%q,model=%q,sn=%q,unit=\"kVA\",description=\"Maximum Apparent Power Smax\"} %.3f\n", x.device, x.Model, x.SN, x.MaxApparentPowerSmax))
+		sb.WriteString(fmt.Sprintf("sun2000_Qmax_feed_to_grid{device=%q,model=%q,sn=%q,unit=\"kVar\",description=\"Realtime Max Reactive Power Qmax Feed to Grid\"} %.3f\n", x.device, x.Model, x.SN, x.RealtimeMaxReactivePowerQmaxFeedToGrid))
+		sb.WriteString(fmt.Sprintf("sun2000_Qmax_absorbed_from_grid{device=%q,model=%q,sn=%q,unit=\"kVar\",description=\"Realtime Max Reactive Power Qmax Absorbed from Grid\"} %.3f\n", x.device, x.Model, x.SN, x.RealtimeMaxReactivePowerQmaxAbsorbedFromGrid))
+		sb.WriteString(fmt.Sprintf("sun2000_Pmax_real{device=%q,model=%q,sn=%q,unit=\"kW\",description=\"Maximum Active Capability Pmax Real\"} %.3f\n", x.device, x.Model, x.SN, x.MaxActiveCapabilityPmaxReal))
+		sb.WriteString(fmt.Sprintf("sun2000_Smax_real{device=%q,model=%q,sn=%q,unit=\"kVA\",description=\"Maximum Apparent Capability Smax Real\"} %.3f\n", x.device, x.Model, x.SN, x.MaxApparentCapabilitySmaxReal))
 
 	}
 	sb.WriteString("\n")
@@ -310,14 +329,14 @@ func (x *productData) parse(data []byte) (err error) {
 	defer x.Unlock()
 
 	var idx uint
-	x.productSalesArea, idx, _ = getSTR(data, idx, 2)
-	x.productSoftwareNumber, idx, _ = getU16(data, idx)
-	x.productSoftwareVersionNumber, idx, _ = getU16(data, idx)
-	x.gridStandardCodeProtocolVersion, idx, _ = getU16(data, idx)
-	x.uniqueIDOfTheSoftware, idx, _ = getU16(data, idx)
-	x.numberOfPackagesToBeUpgraded, idx, _ = getU16(data, idx)
+	x.productSalesArea, idx, _ = sun2000.GetSTR(data, idx, 2)
+	x.productSoftwareNumber, idx, _ = sun2000.GetU16(data, idx)
+	x.productSoftwareVersionNumber, idx, _ = sun2000.GetU16(data, idx)
+	x.gridStandardCodeProtocolVersion, idx, _ = sun2000.GetU16(data, idx)
+	x.uniqueIDOfTheSoftware, idx, _ = sun2000.GetU16(data, idx)
+	x.numberOfPackagesToBeUpgraded, idx, _ = sun2000.GetU16(data, idx)
 	for i := 0; i < 10; i++ {
-		x.subpackageInformation[i], idx, _ = getU32(data, idx)
+		x.subpackageInformation[i], idx, _ = sun2000.GetU32(data, idx)
 	}
 
 	return nil
@@ -350,8 +369,8 @@ func (x *productData) metricsString(id *identificationData) string {
 	} else {
 		id.RLock()
 		defer id.RUnlock()
-		sb.WriteString(fmt.Sprintf("sun2000_unique_id_of_the_software{model=%q,sn=%q} %d\n", id.model, id.sn, x.uniqueIDOfTheSoftware))
-		sb.WriteString(fmt.Sprintf("sun2000_number_of_packages_to_be_upgraded{model=%q,sn=%q} %d\n", id.model, id.sn, x.numberOfPackagesToBeUpgraded))
+		sb.WriteString(fmt.Sprintf("sun2000_unique_id_of_the_software{device=%q,model=%q,sn=%q} %d\n", id.device, id.Model, id.SN, x.uniqueIDOfTheSoftware))
+		sb.WriteString(fmt.Sprintf("sun2000_number_of_packages_to_be_upgraded{device=%q,model=%q,sn=%q} %d\n", id.device, id.Model, id.SN, x.numberOfPackagesToBeUpgraded))
 	}
 	sb.WriteString("\n")
 
@@ -383,14 +402,14 @@ func (x *hardwareData1) parse(data []byte) (err error) {
 	defer x.Unlock()
 
 	var idx uint
-	x.hardwareFunctionalUnitConfigurationIdentifier, idx, _ = getU16(data, idx)
-	x.subdeviceSupportFlag, idx, _ = getU32(data, idx)
-	x.subdeviceInPositionFlag, idx, _ = getU32(data, idx)
+	x.hardwareFunctionalUnitConfigurationIdentifier, idx, _ = sun2000.GetU16(data, idx)
+	x.subdeviceSupportFlag, idx, _ = sun2000.GetU32(data, idx)
+	x.subdeviceInPositionFlag, idx, _ = sun2000.GetU32(data, idx)
 	for i := 0; i < 4; i++ {
-		x.featureMask[i], idx, _ = getU32(data, idx)
+		x.featureMask[i], idx, _ = sun2000.GetU32(data, idx)
 	}
 	for i := 0; i < 32; i++ {
-		x.gridStandardCodeMask[i], idx, _ = getU16(data, idx)
+		x.gridStandardCodeMask[i], idx, _ = sun2000.GetU16(data, idx)
 	}
 
 	return nil
@@ -461,10 +480,10 @@ func (x *hardwareData2) parse(data []byte) (err error) {
 
 	var idx uint
 	for i := 0; i < 8; i++ {
-		x.monitoringParameterMask[i], idx, _ = getU16(data, idx)
+		x.monitoringParameterMask[i], idx, _ = sun2000.GetU16(data, idx)
 	}
 	for i := 0; i < 19; i++ {
-		x.powerParameterMask[i], idx, _ = getU16(data, idx)
+		x.powerParameterMask[i], idx, _ = sun2000.GetU16(data, idx)
 	}
 
 	return nil
@@ -518,7 +537,7 @@ func (x *hardwareData3) parse(data []byte) (err error) {
 	defer x.Unlock()
 
 	var idx uint
-	x.builtinPIDParameterMask, _, _ = getU16(data, idx)
+	x.builtinPIDParameterMask, _, _ = sun2000.GetU16(data, idx)
 
 	return nil
 }
@@ -569,9 +588,9 @@ func (x *hardwareData4) parse(data []byte) (err error) {
 	defer x.Unlock()
 
 	var idx uint
-	x.realtimeMaxActiveCapability, idx, _ = getU32(data, idx)
-	x.realtimeMaxCapacitiveReactiveCapacityPlus, idx, _ = getI32(data, idx)
-	x.realtimeMaxInductiveReactiveCapacityMinus, _, _ = getI32(data, idx)
+	x.realtimeMaxActiveCapability, idx, _ = sun2000.GetU32(data, idx)
+	x.realtimeMaxCapacitiveReactiveCapacityPlus, idx, _ = sun2000.GetI32(data, idx)
+	x.realtimeMaxInductiveReactiveCapacityMinus, _, _ = sun2000.GetI32(data, idx)
 
 	return nil
 }
@@ -635,14 +654,14 @@ func (x *hardwareData5) parse(data []byte) (err error) {
 	defer x.Unlock()
 
 	var idx uint
-	x.hardwareVersion, idx, _ = getSTR(data, idx, 15)
-	x.monitoringBoardSN, idx, _ = getSTR(data, idx, 10)
-	x.monitoringSoftwareVersion, idx, _ = getSTR(data, idx, 15)
-	x.primaryDSPVersion, idx, _ = getSTR(data, idx, 15)
-	x.slaveDSPVersion, idx, _ = getSTR(data, idx, 15)
-	x.cplDRevNo, idx, _ = getSTR(data, idx, 15)
-	x.afciVersion, idx, _ = getSTR(data, idx, 15)
-	x.builtinPID, _, _ = getSTR(data, idx, 15)
+	x.hardwareVersion, idx, _ = sun2000.GetSTR(data, idx, 15)
+	x.monitoringBoardSN, idx, _ = sun2000.GetSTR(data, idx, 10)
+	x.monitoringSoftwareVersion, idx, _ = sun2000.GetSTR(data, idx, 15)
+	x.primaryDSPVersion, idx, _ = sun2000.GetSTR(data, idx, 15)
+	x.slaveDSPVersion, idx, _ = sun2000.GetSTR(data, idx, 15)
+	x.cplDRevNo, idx, _ = sun2000.GetSTR(data, idx, 15)
+	x.afciVersion, idx, _ = sun2000.GetSTR(data, idx, 15)
+	x.builtinPID, _, _ = sun2000.GetSTR(data, idx, 15)
 
 	return nil
 }
@@ -699,8 +718,8 @@ func (x *hardwareData6) parse(data []byte) (err error) {
 	defer x.Unlock()
 
 	var idx uint
-	x.elModuleSoftwareVersion, idx, _ = getSTR(data, idx, 15)
-	x.afci2SoftwareVersion, _, _ = getSTR(data, idx, 15)
+	x.elModuleSoftwareVersion, idx, _ = sun2000.GetSTR(data, idx, 15)
+	x.afci2SoftwareVersion, _, _ = sun2000.GetSTR(data, idx, 15)
 
 	return nil
 }
@@ -752,9 +771,9 @@ func (x *remoteSignallingData) parse(data []byte) (err error) {
 	defer x.Unlock()
 
 	var idx uint
-	x.singleMachineTelesignalling, idx, _ = getU16(data, idx)
-	x.runningStatusMonitoringProcessing, idx, _ = getU16(data, idx)
-	x.runningStatusPowerProcessing, _, _ = getU16(data, idx)
+	x.singleMachineTelesignalling, idx, _ = sun2000.GetU16(data, idx)
+	x.runningStatusMonitoringProcessing, idx, _ = sun2000.GetU16(data, idx)
+	x.runningStatusPowerProcessing, _, _ = sun2000.GetU16(data, idx)
 
 	return nil
 }
@@ -787,28 +806,20 @@ func (x *remoteSignallingData) metricsString(id *identificationData) string {
 	return sb.String()
 }
 
-const alarmCount = 5
-
 type alarmData1 struct {
 	genericData
 
-	// 32008-32010 Bitfield16 1x3 - but Alarms chapters defines also Alarm4 and Alarm 5
-	alarm [alarmCount]uint16
+	sun2000.Alarms
 }
 
 func (x *alarmData1) parse(data []byte) (err error) {
-	if len(data) < 6 {
-		return fmt.Errorf("data length %d < 6", len(data))
+	v, err := sun2000.DecodeAlarms(data)
+	if err != nil {
+		return err
 	}
-
 	x.Lock()
 	defer x.Unlock()
-
-	var idx uint
-	for i := 0; i < 3; i++ {
-		x.alarm[i], idx, _ = getU16(data, idx)
-	}
-
+	x.Alarms = v
 	return nil
 }
 
@@ -821,11 +832,11 @@ func (x *alarmData1) metricsString(id *identificationData) string {
 	sb.WriteString(fmt.Sprintf("# Last Read = %s\n", x.lastRead.Format(time.RFC3339)))
 	sb.WriteString(fmt.Sprintf("# Next Read = %s\n", x.nextRead.Format(time.RFC3339)))
 	sb.WriteString("\n")
-	for i, v := range x.alarm {
+	for i, v := range x.Bits {
 		sb.WriteString(fmt.Sprintf("# Alarm %d = %#04x\t%#016b\n", i+1, v, v))
 	}
 
-	alarms := getAlarms(x.alarm)
+	alarms := sun2000.ActiveAlarms(x.Bits)
 	for _, a := range alarms {
 		sb.WriteString(fmt.Sprintf("# Alarm Triggered: %s\n", a))
 	}
@@ -839,17 +850,17 @@ func (x *alarmData1) metricsString(id *identificationData) string {
 		id.RLock()
 		defer id.RUnlock()
 
-		for i, a := range x.alarm {
-			sb.WriteString(fmt.Sprintf("sun2000_alarm{model=%q,sn=%q,name=\"Alarm%d\"} %d\n", id.model, id.sn, i+1, a))
+		for i, a := range x.Bits {
+			sb.WriteString(fmt.Sprintf("sun2000_alarm{device=%q,model=%q,sn=%q,name=\"Alarm%d\"} %d\n", id.device, id.Model, id.SN, i+1, a))
 		}
 
 		// might be a bit much, but nice for some historical visibility
-		for _, a := range sun2000Alarms {
+		for _, a := range sun2000.KnownAlarms {
 			value := "0"
-			if a.isTriggered(x.alarm) {
+			if a.IsTriggered(x.Bits) {
 				value = "1"
 			}
-			sb.WriteString(fmt.Sprintf("sun2000_alarm_triggered{model=%q,sn=%q,name=%q,id=\"%d\",level=%q} %s\n", id.model, id.sn, a.name, a.id, a.level, value))
+			sb.WriteString(fmt.Sprintf("sun2000_alarm_triggered{device=%q,model=%q,sn=%q,name=%q,id=\"%d\",level=%q} %s\n", id.device, id.Model, id.SN, a.Name, a.ID, a.Level, value))
 		}
 
 	}
@@ -858,114 +869,6 @@ func (x *alarmData1) metricsString(id *identificationData) string {
 	return sb.String()
 }
 
-type sun2000AlarmLevel uint8
-
-const (
-	alarmLevelWarning sun2000AlarmLevel = iota
-	alarmLevelMinor
-	alarmLevelMajor
-)
-
-func (x sun2000AlarmLevel) String() string {
-	switch x {
-	case alarmLevelWarning:
-		return "Warning"
-	case alarmLevelMinor:
-		return "Minor"
-	case alarmLevelMajor:
-		return "Major"
-	default:
-		return "Unknown"
-	}
-}
-
-type sun2000Alarm struct {
-	mask  [alarmCount]uint16
-	name  string
-	id    uint16
-	level sun2000AlarmLevel
-}
-
-// TODO: figure out if bit0 is LSB, or MSB
-var sun2000Alarms = []sun2000Alarm{
-	{[alarmCount]uint16{0b1000000000000000}, "High String Input Voltage", 2001, alarmLevelMajor},
-	{[alarmCount]uint16{0b0100000000000000}, "DC Arc Fault", 2002, alarmLevelMajor},
-	{[alarmCount]uint16{0b0010000000000000}, "String Reverse Connection", 2011, alarmLevelMajor},
-	{[alarmCount]uint16{0b0001000000000000}, "String Current Backfeed ", 2012, alarmLevelWarning},
-	{[alarmCount]uint16{0b0000100000000000}, "Abnormal String Power", 2013, alarmLevelWarning},
-	{[alarmCount]uint16{0b0000010000000000}, "AFCI Self-Check Fail", 2021, alarmLevelMajor},
-	{[alarmCount]uint16{0b0000001000000000}, "Phase Wire Short-Circuited to PE", 2031, alarmLevelMajor},
-	{[alarmCount]uint16{0b0000000100000000}, "Grid Loss", 2032, alarmLevelMajor},
-	{[alarmCount]uint16{0b0000000010000000}, "Grid Undervoltage", 2033, alarmLevelMajor},
-	{[alarmCount]uint16{0b0000000001000000}, "Grid Overvoltage", 2034, alarmLevelMajor},
-	{[alarmCount]uint16{0b0000000000100000}, "Grid Volt. Imbalance", 2035, alarmLevelMajor},
-	{[alarmCount]uint16{0b0000000000010000}, "Grid Overfrequency", 2036, alarmLevelMajor},
-	{[alarmCount]uint16{0b0000000000001000}, "Grid Underfrequency", 2037, alarmLevelMajor},
-	{[alarmCount]uint16{0b0000000000000100}, "Unstable Grid Frequency", 2038, alarmLevelMajor},
-	{[alarmCount]uint16{0b0000000000000010}, "Output Overcurrent", 2039, alarmLevelMajor},
-	{[alarmCount]uint16{0b0000000000000001}, "Output DC Component Overhigh", 2040, alarmLevelMajor},
-
-	{[alarmCount]uint16{0, 0b1000000000000000}, "Abnormal Residual Current", 2051, alarmLevelMajor},
-	{[alarmCount]uint16{0, 0b0100000000000000}, "Abnormal Grounding", 2061, alarmLevelMajor},
-	{[alarmCount]uint16{0, 0b0010000000000000}, "Low Insulation Resistance", 2062, alarmLevelMajor},
-	{[alarmCount]uint16{0, 0b0001000000000000}, "Overtemperature", 2063, alarmLevelMajor},
-	{[alarmCount]uint16{0, 0b0000100000000000}, "Device Fault", 2064, alarmLevelMajor},
-	{[alarmCount]uint16{0, 0b0000010000000000}, "Upgrade Failed or Version Mismatch", 2065, alarmLevelMinor},
-	{[alarmCount]uint16{0, 0b0000001000000000}, "License Expired", 2066, alarmLevelWarning},
-	{[alarmCount]uint16{0, 0b0000000100000000}, "Faulty Monitoring Unit", 61440, alarmLevelMinor},
-	{[alarmCount]uint16{0, 0b0000000010000000}, "Faulty Power Collector", 2067, alarmLevelMajor},
-	{[alarmCount]uint16{0, 0b0000000001000000}, "Battery Abnormal", 2068, alarmLevelMinor},
-	{[alarmCount]uint16{0, 0b0000000000100000}, "Active Islanding", 2070, alarmLevelMajor},
-	{[alarmCount]uint16{0, 0b0000000000010000}, "Passive Islanding", 2071, alarmLevelMajor},
-	{[alarmCount]uint16{0, 0b0000000000001000}, "Transient AC Overvoltage", 2072, alarmLevelMajor},
-	{[alarmCount]uint16{0, 0b0000000000000100}, "Peripheral Port Short Circuit", 2075, alarmLevelWarning},
-	{[alarmCount]uint16{0, 0b0000000000000010}, "Churn Output Overload", 2077, alarmLevelMajor},
-	{[alarmCount]uint16{0, 0b0000000000000001}, "Abnormal PV Module Configuration", 2080, alarmLevelMajor},
-
-	{[alarmCount]uint16{0, 0, 0b1000000000000000}, "Optimizer Fault", 2081, alarmLevelWarning},
-	{[alarmCount]uint16{0, 0, 0b0100000000000000}, "Built-in PID Operation Abnormal", 2085, alarmLevelMajor},
-	{[alarmCount]uint16{0, 0, 0b0010000000000000}, "High Input String Voltage to Ground", 2014, alarmLevelMajor},
-	{[alarmCount]uint16{0, 0, 0b0001000000000000}, "External Fan Abnormal", 2086, alarmLevelMajor},
-	{[alarmCount]uint16{0, 0, 0b0000100000000000}, "Battery Reverse Connection", 2069, alarmLevelMajor},
-	{[alarmCount]uint16{0, 0, 0b0000010000000000}, "On-grid/Off-grid Controller Abnormal", 2082, alarmLevelMajor},
-	{[alarmCount]uint16{0, 0, 0b0000001000000000}, "PV String Loss", 2015, alarmLevelWarning},
-	{[alarmCount]uint16{0, 0, 0b0000000100000000}, "Internal Fan Abnormal", 2087, alarmLevelMajor},
-	{[alarmCount]uint16{0, 0, 0b0000000010000000}, "DC Protection Unit Abnormal", 2088, alarmLevelMajor},
-
-	{[alarmCount]uint16{0, 0, 0, 0b0000000000100000}, "Management System Cert Valid Time Ineffective", 2095, alarmLevelMajor},
-	{[alarmCount]uint16{0, 0, 0, 0b0000000000010000}, "Management System Cert Valid Time Being Overdue", 2096, alarmLevelMajor},
-	{[alarmCount]uint16{0, 0, 0, 0b0000000000001000}, "Management System Cert Valid Time Overdue", 2097, alarmLevelMajor},
-
-	{[alarmCount]uint16{0, 0, 0, 0, 0b0001000000000000}, "CT Disconnection", 2067, alarmLevelMajor},
-	{[alarmCount]uint16{0, 0, 0, 0, 0b0000100000000000}, "PT Disconnection", 2067, alarmLevelMajor},
-}
-
-func (x sun2000Alarm) isTriggered(alarm [alarmCount]uint16) bool {
-	for i := 0; i < alarmCount; i++ {
-		if x.mask[i]&alarm[i] != 0 {
-			return true
-		}
-	}
-	return false
-}
-
-func getAlarms(id [alarmCount]uint16) (out []sun2000Alarm) {
-	out = make([]sun2000Alarm, 0, 8)
-	for _, a := range sun2000Alarms {
-		for i := 0; i < alarmCount; i++ {
-			if a.mask[i]&id[i] != 0 {
-				out = append(out, a)
-				break
-			}
-		}
-	}
-	return out
-}
-
-func (x sun2000Alarm) String() string {
-	return fmt.Sprintf("%s : %s id=%d", x.level, x.name, x.id)
-}
-
 type pvData struct {
 	genericData
 
@@ -989,12 +892,12 @@ func (x *pvData) parse(data []byte) (err error) {
 	defer x.Unlock()
 
 	var idx uint
-	x.deviceSNSignatureCode, idx, _ = getU16(data, idx)
+	x.deviceSNSignatureCode, idx, _ = sun2000.GetU16(data, idx)
 	var i16 int16
 	for i := 0; i < 20; i++ {
-		i16, idx, _ = getI16(data, idx)
+		i16, idx, _ = sun2000.GetI16(data, idx)
 		x.pv[i].voltage = float32(i16) / 10
-		i16, idx, _ = getI16(data, idx)
+		i16, idx, _ = sun2000.GetI16(data, idx)
 		x.pv[i].current = float32(i16) / 100
 	}
 
@@ -1014,7 +917,7 @@ func (x *pvData) metricsString(id *identificationData) string {
 	sb.WriteString("\n")
 	powerTotal := float32(0)
 	for i, v := range x.pv {
-		if v.voltage != 0 || v.current != 0 || i < int(id.numberOfStrings) {
+		if v.voltage != 0 || v.current != 0 || i < int(id.NumberOfStrings) {
 			sb.WriteString(fmt.Sprintf("# PV%2d Voltage   = %7.3f V\n", i+1, v.voltage))
 			sb.WriteString(fmt.Sprintf("# PV%2d Current   = %7.3f A\n", i+1, v.current))
 			power := v.voltage * v.current
@@ -1035,14 +938,14 @@ func (x *pvData) metricsString(id *identificationData) string {
 		defer id.RUnlock()
 
 		for i, v := range x.pv {
-			if v.voltage != 0 || v.current != 0 || i < int(id.numberOfStrings) {
-				sb.WriteString(fmt.Sprintf("sun2000_pv_voltage{model=%q,sn=%q,pv=\"%d\",unit=\"V\"} %.1f\n", id.model, id.sn, i+1, v.voltage))
-				sb.WriteString(fmt.Sprintf("sun2000_pv_current{model=%q,sn=%q,pv=\"%d\",unit=\"A\"} %.2f\n", id.model, id.sn, i+1, v.current))
+			if v.voltage != 0 || v.current != 0 || i < int(id.NumberOfStrings) {
+				sb.WriteString(fmt.Sprintf("sun2000_pv_voltage{device=%q,model=%q,sn=%q,pv=\"%d\",unit=\"V\"} %.1f\n", id.device, id.Model, id.SN, i+1, v.voltage))
+				sb.WriteString(fmt.Sprintf("sun2000_pv_current{device=%q,model=%q,sn=%q,pv=\"%d\",unit=\"A\"} %.2f\n", id.device, id.Model, id.SN, i+1, v.current))
 				power := v.voltage * v.current
-				sb.WriteString(fmt.Sprintf("sun2000_pv_power{model=%q,sn=%q,pv=\"%d\",unit=\"kW\"} %.3f\n", id.model, id.sn, i+1, power/1000))
+				sb.WriteString(fmt.Sprintf("sun2000_pv_power{device=%q,model=%q,sn=%q,pv=\"%d\",unit=\"kW\"} %.3f\n", id.device, id.Model, id.SN, i+1, power/1000))
 			}
 		}
-		sb.WriteString(fmt.Sprintf("sun2000_pv_total_power{model=%q,sn=%q,unit=\"kW\"} %.3f\n", id.model, id.sn, powerTotal/1000))
+		sb.WriteString(fmt.Sprintf("sun2000_pv_total_power{device=%q,model=%q,sn=%q,unit=\"kW\"} %.3f\n", id.device, id.Model, id.SN, powerTotal/1000))
 	}
 	sb.WriteString("\n")
 
@@ -1052,140 +955,17 @@ func (x *pvData) metricsString(id *identificationData) string {
 type inverterData struct {
 	genericData
 
-	// 32064 I32 2 gain 1000 kW
-	dcPower float32
-
-	// 32066 U16 1 gain 10 V
-	inverterABLineVoltage float32
-	// 32067 U16 1 gain 10 V
-	inverterBCLineVoltage float32
-	// 32068 U16 1 gain 10 V
-	inverterCALineVoltage float32
-
-	// 32069 U16 1 gain 10 V
-	inverterPhaseAVoltage float32
-	// 32070 U16 1 gain 10 V
-	inverterPhaseBVoltage float32
-	// 32071 U16 1 gain 10 V
-	inverterPhaseCVoltage float32
-
-	// 32072 I32 2 gain 1000 A
-	inverterPhaseACurrent float32
-	// 32074 I32 2 gain 1000 A
-	inverterPhaseBCurrent float32
-	// 32076 I32 2 gain 1000 A
-	inverterPhaseCCurrent float32
-
-	// 32078 I32 2 gain 1000 kW
-	peakActivePowerOfTheDay float32
-	// 32080 I32 2 gain 1000 kW
-	activePower float32
-	// 32082 I32 2 gain 1000 kVar
-	reactivePower float32
-	// 32084 I16 1 gain 1000
-	powerFactor float32
-
-	// 32085 U16 1 gain 100 Hz
-	inverterFrequency float32
-
-	// 32086 U16 1 gain 100 %
-	inverterEfficiency float32
-
-	// 32087 I16 1 gain 10 ℃
-	internalTemperature float32
-
-	// 32088 U16 1 gain 1000 MΩ
-	insulationImpedanceValue float32
-
-	// 32089 E16 1
-	deviceStatus deviceStatus
-
-	// 32090 U16 1
-	faultCode uint16
-
-	// 32091 epoch 2
-	startupTime time.Time
-	// 32093 epoch 2
-	shutdownTime time.Time
-
-	// 32095 I32 2 gain 1000 kW
-	activePowerFast float32
+	sun2000.Inverter
 }
 
 func (x *inverterData) parse(data []byte) (err error) {
-	size := 2 + 3 + 3 + 6 + 7 + 1*6 + 2*2 + 2
-	if len(data) < size {
-		return fmt.Errorf("data length %d < %d", len(data), size)
+	v, err := sun2000.DecodeInverter(data)
+	if err != nil {
+		return err
 	}
-
 	x.Lock()
 	defer x.Unlock()
-
-	var i32 int32
-	var i16 int16
-	var u16 uint16
-	var epoch uint32
-	var idx uint
-
-	i32, idx, _ = getI32(data, idx)
-	x.dcPower = float32(i32) / 1000
-
-	u16, idx, _ = getU16(data, idx)
-	x.inverterABLineVoltage = float32(u16) / 10
-	u16, idx, _ = getU16(data, idx)
-	x.inverterBCLineVoltage = float32(u16) / 10
-	u16, idx, _ = getU16(data, idx)
-	x.inverterCALineVoltage = float32(u16) / 10
-
-	u16, idx, _ = getU16(data, idx)
-	x.inverterPhaseAVoltage = float32(u16) / 10
-	u16, idx, _ = getU16(data, idx)
-	x.inverterPhaseBVoltage = float32(u16) / 10
-	u16, idx, _ = getU16(data, idx)
-	x.inverterPhaseCVoltage = float32(u16) / 10
-
-	i32, idx, _ = getI32(data, idx)
-	x.inverterPhaseACurrent = float32(i32) / 1000
-	i32, idx, _ = getI32(data, idx)
-	x.inverterPhaseBCurrent = float32(i32) / 1000
-	i32, idx, _ = getI32(data, idx)
-	x.inverterPhaseCCurrent = float32(i32) / 1000
-
-	i32, idx, _ = getI32(data, idx)
-	x.peakActivePowerOfTheDay = float32(i32) / 1000
-	i32, idx, _ = getI32(data, idx)
-	x.activePower = float32(i32) / 1000
-
-	i32, idx, _ = getI32(data, idx)
-	x.reactivePower = float32(i32) / 1000
-	i16, idx, _ = getI16(data, idx)
-	x.powerFactor = float32(i16) / 1000
-
-	u16, idx, _ = getU16(data, idx)
-	x.inverterFrequency = float32(u16) / 100
-
-	u16, idx, _ = getU16(data, idx)
-	x.inverterEfficiency = float32(u16) / 100
-
-	i16, idx, _ = getI16(data, idx)
-	x.internalTemperature = float32(i16) / 10
-
-	u16, idx, _ = getU16(data, idx)
-	x.insulationImpedanceValue = float32(u16) / 1000
-
-	u16, idx, _ = getU16(data, idx)
-	x.deviceStatus = deviceStatus(u16)
-
-	x.faultCode, idx, _ = getU16(data, idx)
-
-	epoch, idx, _ = getU32(data, idx)
-	x.startupTime = time.Unix(int64(epoch), 0)
-	epoch, idx, _ = getU32(data, idx)
-	x.shutdownTime = time.Unix(int64(epoch), 0)
-
-	i32, _, _ = getI32(data, idx)
-	x.activePowerFast = float32(i32) / 1000
-
+	x.Inverter = v
 	return nil
 }
 
@@ -1198,46 +978,46 @@ func (x *inverterData) metricsString(id *identificationData) string {
 	sb.WriteString(fmt.Sprintf("# Last Read = %s\n", x.lastRead.Format(time.RFC3339)))
 	sb.WriteString(fmt.Sprintf("# Next Read = %s\n", x.nextRead.Format(time.RFC3339)))
 	sb.WriteString("\n")
-	sb.WriteString(fmt.Sprintf("# DC Power                       = %2.3f kW\n", x.dcPower))
+	sb.WriteString(fmt.Sprintf("# DC Power                       = %2.3f kW\n", x.DCPower))
 	sb.WriteString("#\n")
-	sb.WriteString(fmt.Sprintf("# Inverter AB Line Voltage       = %3.1f V\n", x.inverterABLineVoltage))
-	sb.WriteString(fmt.Sprintf("# Inverter BC Line Voltage       = %3.1f V\n", x.inverterBCLineVoltage))
-	sb.WriteString(fmt.Sprintf("# Inverter CA Line Voltage       = %3.1f V\n", x.inverterCALineVoltage))
+	sb.WriteString(fmt.Sprintf("# Inverter AB Line Voltage       = %3.1f V\n", x.InverterABLineVoltage))
+	sb.WriteString(fmt.Sprintf("# Inverter BC Line Voltage       = %3.1f V\n", x.InverterBCLineVoltage))
+	sb.WriteString(fmt.Sprintf("# Inverter CA Line Voltage       = %3.1f V\n", x.InverterCALineVoltage))
 	sb.WriteString("#\n")
-	sb.WriteString(fmt.Sprintf("# Inverter Phase A Voltage       = %3.1f V\n", x.inverterPhaseAVoltage))
-	sb.WriteString(fmt.Sprintf("# Inverter Phase B Voltage       = %3.1f V\n", x.inverterPhaseBVoltage))
-	sb.WriteString(fmt.Sprintf("# Inverter Phase C Voltage       = %3.1f V\n", x.inverterPhaseCVoltage))
+	sb.WriteString(fmt.Sprintf("# Inverter Phase A Voltage       = %3.1f V\n", x.InverterPhaseAVoltage))
+	sb.WriteString(fmt.Sprintf("# Inverter Phase B Voltage       = %3.1f V\n", x.InverterPhaseBVoltage))
+	sb.WriteString(fmt.Sprintf("# Inverter Phase C Voltage       = %3.1f V\n", x.InverterPhaseCVoltage))
 	sb.WriteString("#\n")
-	sb.WriteString(fmt.Sprintf("# Inverter Phase A Current       = %3.3f A\n", x.inverterPhaseACurrent))
-	sb.WriteString(fmt.Sprintf("# Inverter Phase B Current       = %3.3f A\n", x.inverterPhaseBCurrent))
-	sb.WriteString(fmt.Sprintf("# Inverter Phase C Current       = %3.3f A\n", x.inverterPhaseCCurrent))
+	sb.WriteString(fmt.Sprintf("# Inverter Phase A Current       = %3.3f A\n", x.InverterPhaseACurrent))
+	sb.WriteString(fmt.Sprintf("# Inverter Phase B Current       = %3.3f A\n", x.InverterPhaseBCurrent))
+	sb.WriteString(fmt.Sprintf("# Inverter Phase C Current       = %3.3f A\n", x.InverterPhaseCCurrent))
 	sb.WriteString("#\n")
-	pA := x.inverterPhaseAVoltage * x.inverterPhaseACurrent
-	pB := x.inverterPhaseBVoltage * x.inverterPhaseBCurrent
-	pC := x.inverterPhaseCVoltage * x.inverterPhaseCCurrent
+	pA := x.InverterPhaseAVoltage * x.InverterPhaseACurrent
+	pB := x.InverterPhaseBVoltage * x.InverterPhaseBCurrent
+	pC := x.InverterPhaseCVoltage * x.InverterPhaseCCurrent
 	sb.WriteString(fmt.Sprintf("# Inverter Phase A Power         = %3.3f VA\n", pA))
 	sb.WriteString(fmt.Sprintf("# Inverter Phase B Power         = %3.3f VA\n", pB))
 	sb.WriteString(fmt.Sprintf("# Inverter Phase C Power         = %3.3f VA\n", pC))
 	sb.WriteString(fmt.Sprintf("# Inverter Total Power           = %3.3f VA\n", pA+pB+pC))
 	sb.WriteString("#\n")
-	sb.WriteString(fmt.Sprintf("# Peak Active Power of the Day   = %3.3f kW\n", x.peakActivePowerOfTheDay))
-	sb.WriteString(fmt.Sprintf("# Active Power Fast              = %3.3f kW\n", x.activePowerFast))
-	sb.WriteString(fmt.Sprintf("# Active Power                   = %3.3f kW\n", x.activePower))
-	sb.WriteString(fmt.Sprintf("# Reactive Power                 = %3.3f kVar\n", x.reactivePower))
-	sb.WriteString(fmt.Sprintf("# Power Factor                   = %3.3f\n", x.powerFactor))
-	sb.WriteString(fmt.Sprintf("# Inverter Frequency             = %2.2f Hz\n", x.inverterFrequency))
-	sb.WriteString(fmt.Sprintf("# Inverter Efficiency            = %3.2f %%\n", x.inverterEfficiency))
+	sb.WriteString(fmt.Sprintf("# Peak Active Power of the Day   = %3.3f kW\n", x.PeakActivePowerOfTheDay))
+	sb.WriteString(fmt.Sprintf("# Active Power Fast              = %3.3f kW\n", x.ActivePowerFast))
+	sb.WriteString(fmt.Sprintf("# Active Power                   = %3.3f kW\n", x.ActivePower))
+	sb.WriteString(fmt.Sprintf("# Reactive Power                 = %3.3f kVar\n", x.ReactivePower))
+	sb.WriteString(fmt.Sprintf("# Power Factor                   = %3.3f\n", x.PowerFactor))
+	sb.WriteString(fmt.Sprintf("# Inverter Frequency             = %2.2f Hz\n", x.InverterFrequency))
+	sb.WriteString(fmt.Sprintf("# Inverter Efficiency            = %3.2f %%\n", x.InverterEfficiency))
 	sb.WriteString("#\n")
-	sb.WriteString(fmt.Sprintf("# Internal Temperature           = %3.1f ℃\n", x.internalTemperature))
-	sb.WriteString(fmt.Sprintf("# Insulation Impedance Value     = %4.3f MΩ\n", x.insulationImpedanceValue))
-	sb.WriteString(fmt.Sprintf("# Device Status                  = %d\t%s\n", x.deviceStatus, x.deviceStatus))
-	sb.WriteString(fmt.Sprintf("# Fault Code                     = %#04x\t%#016b\n", x.faultCode, x.faultCode))
+	sb.WriteString(fmt.Sprintf("# Internal Temperature           = %3.1f ℃\n", x.InternalTemperature))
+	sb.WriteString(fmt.Sprintf("# Insulation Impedance Value     = %4.3f MΩ\n", x.InsulationImpedanceValue))
+	sb.WriteString(fmt.Sprintf("# Device Status                  = %d\t%s\n", x.DeviceStatus, x.DeviceStatus))
+	sb.WriteString(fmt.Sprintf("# Fault Code                     = %#04x\t%#016b\n", x.FaultCode, x.FaultCode))
 	sb.WriteString("#\n")
-	sb.WriteString(fmt.Sprintf("# Startup Time                   = %s\n", x.startupTime.Format(time.RFC3339)))
-	if x.shutdownTime.Unix() == 4294967295 {
+	sb.WriteString(fmt.Sprintf("# Startup Time                   = %s\n", x.StartupTime.Format(time.RFC3339)))
+	if x.ShutdownTime.Unix() == 4294967295 {
 		sb.WriteString("# Shutdown Time                  = N/A\n")
 	} else {
-		sb.WriteString(fmt.Sprintf("# Shutdown Time                  = %s\n", x.shutdownTime.Format(time.RFC3339)))
+		sb.WriteString(fmt.Sprintf("# Shutdown Time                  = %s\n", x.ShutdownTime.Format(time.RFC3339)))
 	}
 	sb.WriteString("\n")
 
@@ -1248,41 +1028,41 @@ func (x *inverterData) metricsString(id *identificationData) string {
 		id.RLock()
 		defer id.RUnlock()
 
-		sb.WriteString(fmt.Sprintf("sun2000_inverter_dc_power{model=%q,sn=%q,unit=\"kW\"} %3.3f\n", id.model, id.sn, x.dcPower))
+		sb.WriteString(fmt.Sprintf("sun2000_inverter_dc_power{device=%q,model=%q,sn=%q,unit=\"kW\"} %3.3f\n", id.device, id.Model, id.SN, x.DCPower))
 
-		sb.WriteString(fmt.Sprintf("sun2000_inverter_line_voltage{model=%q,sn=%q,line=\"AB\",unit=\"V\"} %3.1f\n", id.model, id.sn, x.inverterABLineVoltage))
-		sb.WriteString(fmt.Sprintf("sun2000_inverter_line_voltage{model=%q,sn=%q,line=\"BC\",unit=\"V\"} %3.1f\n", id.model, id.sn, x.inverterBCLineVoltage))
-		sb.WriteString(fmt.Sprintf("sun2000_inverter_line_voltage{model=%q,sn=%q,line=\"CA\",unit=\"V\"} %3.1f\n", id.model, id.sn, x.inverterCALineVoltage))
+		sb.WriteString(fmt.Sprintf("sun2000_inverter_line_voltage{device=%q,model=%q,sn=%q,line=\"AB\",unit=\"V\"} %3.1f\n", id.device, id.Model, id.SN, x.InverterABLineVoltage))
+		sb.WriteString(fmt.Sprintf("sun2000_inverter_line_voltage{device=%q,model=%q,sn=%q,line=\"BC\",unit=\"V\"} %3.1f\n", id.device, id.Model, id.SN, x.InverterBCLineVoltage))
+		sb.WriteString(fmt.Sprintf("sun2000_inverter_line_voltage{device=%q,model=%q,sn=%q,line=\"CA\",unit=\"V\"} %3.1f\n", id.device, id.Model, id.SN, x.InverterCALineVoltage))
 
-		sb.WriteString(fmt.Sprintf("sun2000_inverter_phase_voltage{model=%q,sn=%q,phase=\"A\",unit=\"V\"} %3.1f\n", id.model, id.sn, x.inverterPhaseAVoltage))
-		sb.WriteString(fmt.Sprintf("sun2000_inverter_phase_voltage{model=%q,sn=%q,phase=\"B\",unit=\"V\"} %3.1f\n", id.model, id.sn, x.inverterPhaseBVoltage))
-		sb.WriteString(fmt.Sprintf("sun2000_inverter_phase_voltage{model=%q,sn=%q,phase=\"C\",unit=\"V\"} %3.1f\n", id.model, id.sn, x.inverterPhaseCVoltage))
+		sb.WriteString(fmt.Sprintf("sun2000_inverter_phase_voltage{device=%q,model=%q,sn=%q,phase=\"A\",unit=\"V\"} %3.1f\n", id.device, id.Model, id.SN, x.InverterPhaseAVoltage))
+		sb.WriteString(fmt.Sprintf("sun2000_inverter_phase_voltage{device=%q,model=%q,sn=%q,phase=\"B\",unit=\"V\"} %3.1f\n", id.device, id.Model, id.SN, x.InverterPhaseBVoltage))
+		sb.WriteString(fmt.Sprintf("sun2000_inverter_phase_voltage{device=%q,model=%q,sn=%q,phase=\"C\",unit=\"V\"} %3.1f\n", id.device, id.Model, id.SN, x.InverterPhaseCVoltage))
 
-		sb.WriteString(fmt.Sprintf("sun2000_inverter_phase_current{model=%q,sn=%q,phase=\"A\",unit=\"A\"} %3.3f\n", id.model, id.sn, x.inverterPhaseACurrent))
-		sb.WriteString(fmt.Sprintf("sun2000_inverter_phase_current{model=%q,sn=%q,phase=\"B\",unit=\"A\"} %3.3f\n", id.model, id.sn, x.inverterPhaseBCurrent))
-		sb.WriteString(fmt.Sprintf("sun2000_inverter_phase_current{model=%q,sn=%q,phase=\"C\",unit=\"A\"} %3.3f\n", id.model, id.sn, x.inverterPhaseCCurrent))
+		sb.WriteString(fmt.Sprintf("sun2000_inverter_phase_current{device=%q,model=%q,sn=%q,phase=\"A\",unit=\"A\"} %3.3f\n", id.device, id.Model, id.SN, x.InverterPhaseACurrent))
+		sb.WriteString(fmt.Sprintf("sun2000_inverter_phase_current{device=%q,model=%q,sn=%q,phase=\"B\",unit=\"A\"} %3.3f\n", id.device, id.Model, id.SN, x.InverterPhaseBCurrent))
+		sb.WriteString(fmt.Sprintf("sun2000_inverter_phase_current{device=%q,model=%q,sn=%q,phase=\"C\",unit=\"A\"} %3.3f\n", id.device, id.Model, id.SN, x.InverterPhaseCCurrent))
 
-		sb.WriteString(fmt.Sprintf("sun2000_inverter_phase_power{model=%q,sn=%q,phase=\"A\",unit=\"VA\"} %3.3f\n", id.model, id.sn, pA))
-		sb.WriteString(fmt.Sprintf("sun2000_inverter_phase_power{model=%q,sn=%q,phase=\"B\",unit=\"VA\"} %3.3f\n", id.model, id.sn, pB))
-		sb.WriteString(fmt.Sprintf("sun2000_inverter_phase_power{model=%q,sn=%q,phase=\"C\",unit=\"VA\"} %3.3f\n", id.model, id.sn, pC))
-		sb.WriteString(fmt.Sprintf("sun2000_inverter_total_power{model=%q,sn=%q,unit=\"VA\"} %3.3f\n", id.model, id.sn, pA+pB+pC))
+		sb.WriteString(fmt.Sprintf("sun2000_inverter_phase_power{device=%q,model=%q,sn=%q,phase=\"A\",unit=\"VA\"} %3.3f\n", id.device, id.Model, id.SN, pA))
+		sb.WriteString(fmt.Sprintf("sun2000_inverter_phase_power{device=%q,model=%q,sn=%q,phase=\"B\",unit=\"VA\"} %3.3f\n", id.device, id.Model, id.SN, pB))
+		sb.WriteString(fmt.Sprintf("sun2000_inverter_phase_power{device=%q,model=%q,sn=%q,phase=\"C\",unit=\"VA\"} %3.3f\n", id.device, id.Model, id.SN, pC))
+		sb.WriteString(fmt.Sprintf("sun2000_inverter_total_power{device=%q,model=%q,sn=%q,unit=\"VA\"} %3.3f\n", id.device, id.Model, id.SN, pA+pB+pC))
 
-		sb.WriteString(fmt.Sprintf("sun2000_inverter_peak_active_power_of_the_day{model=%q,sn=%q,unit=\"kW\"} %3.3f\n", id.model, id.sn, x.peakActivePowerOfTheDay))
-		sb.WriteString(fmt.Sprintf("sun2000_inverter_active_power_fast{model=%q,sn=%q,unit=\"kW\"} %3.3f\n", id.model, id.sn, x.activePowerFast))
-		sb.WriteString(fmt.Sprintf("sun2000_inverter_active_power{model=%q,sn=%q,unit=\"kW\"} %3.3f\n", id.model, id.sn, x.activePower))
-		sb.WriteString(fmt.Sprintf("sun2000_inverter_reactive_power{model=%q,sn=%q,unit=\"kVar\"} %3.3f\n", id.model, id.sn, x.reactivePower))
-		sb.WriteString(fmt.Sprintf("sun2000_inverter_power_factor{model=%q,sn=%q} %3.3f\n", id.model, id.sn, x.powerFactor))
-		sb.WriteString(fmt.Sprintf("sun2000_inverter_frequency{model=%q,sn=%q,unit=\"Hz\"} %2.2f\n", id.model, id.sn, x.inverterFrequency))
-		sb.WriteString(fmt.Sprintf("sun2000_inverter_efficiency{model=%q,sn=%q,unit=\"%%\"} %3.2f\n", id.model, id.sn, x.inverterEfficiency))
+		sb.WriteString(fmt.Sprintf("sun2000_inverter_peak_active_power_of_the_day{device=%q,model=%q,sn=%q,unit=\"kW\"} %3.3f\n", id.device, id.Model, id.SN, x.PeakActivePowerOfTheDay))
+		sb.WriteString(fmt.Sprintf("sun2000_inverter_active_power_fast{device=%q,model=%q,sn=%q,unit=\"kW\"} %3.3f\n", id.device, id.Model, id.SN, x.ActivePowerFast))
+		sb.WriteString(fmt.Sprintf("sun2000_inverter_active_power{device=%q,model=%q,sn=%q,unit=\"kW\"} %3.3f\n", id.device, id.Model, id.SN, x.ActivePower))
+		sb.WriteString(fmt.Sprintf("sun2000_inverter_reactive_power{device=%q,model=%q,sn=%q,unit=\"kVar\"} %3.3f\n", id.device, id.Model, id.SN, x.ReactivePower))
+		sb.WriteString(fmt.Sprintf("sun2000_inverter_power_factor{device=%q,model=%q,sn=%q} %3.3f\n", id.device, id.Model, id.SN, x.PowerFactor))
+		sb.WriteString(fmt.Sprintf("sun2000_inverter_frequency{device=%q,model=%q,sn=%q,unit=\"Hz\"} %2.2f\n", id.device, id.Model, id.SN, x.InverterFrequency))
+		sb.WriteString(fmt.Sprintf("sun2000_inverter_efficiency{device=%q,model=%q,sn=%q,unit=\"%%\"} %3.2f\n", id.device, id.Model, id.SN, x.InverterEfficiency))
 
-		sb.WriteString(fmt.Sprintf("sun2000_internal_temperature{model=%q,sn=%q,sensor=\"main\",unit=\"℃\"} %3.1f\n", id.model, id.sn, x.internalTemperature))
+		sb.WriteString(fmt.Sprintf("sun2000_internal_temperature{device=%q,model=%q,sn=%q,sensor=\"main\",unit=\"℃\"} %3.1f\n", id.device, id.Model, id.SN, x.InternalTemperature))
 
-		sb.WriteString(fmt.Sprintf("sun2000_insulation_impedance_value{model=%q,sn=%q,unit=\"MΩ\"} %4.3f\n", id.model, id.sn, x.insulationImpedanceValue))
-		sb.WriteString(fmt.Sprintf("sun2000_device_status{model=%q,sn=%q,state=%q} %d\n", id.model, id.sn, x.deviceStatus, x.deviceStatus))
-		sb.WriteString(fmt.Sprintf("sun2000_fault_code{model=%q,sn=%q} %d\n", id.model, id.sn, x.faultCode))
+		sb.WriteString(fmt.Sprintf("sun2000_insulation_impedance_value{device=%q,model=%q,sn=%q,unit=\"MΩ\"} %4.3f\n", id.device, id.Model, id.SN, x.InsulationImpedanceValue))
+		sb.WriteString(fmt.Sprintf("sun2000_device_status{device=%q,model=%q,sn=%q,state=%q} %d\n", id.device, id.Model, id.SN, x.DeviceStatus, x.DeviceStatus))
+		sb.WriteString(fmt.Sprintf("sun2000_fault_code{device=%q,model=%q,sn=%q} %d\n", id.device, id.Model, id.SN, x.FaultCode))
 
-		sb.WriteString(fmt.Sprintf("sun2000_startup_time{model=%q,sn=%q} %d\n", id.model, id.sn, x.startupTime.Unix()))
-		sb.WriteString(fmt.Sprintf("sun2000_shutdown_time{model=%q,sn=%q} %d\n", id.model, id.sn, x.shutdownTime.Unix()))
+		sb.WriteString(fmt.Sprintf("sun2000_startup_time{device=%q,model=%q,sn=%q} %d\n", id.device, id.Model, id.SN, x.StartupTime.Unix()))
+		sb.WriteString(fmt.Sprintf("sun2000_shutdown_time{device=%q,model=%q,sn=%q} %d\n", id.device, id.Model, id.SN, x.ShutdownTime.Unix()))
 
 	}
 	sb.WriteString("\n")
@@ -1290,77 +1070,6 @@ func (x *inverterData) metricsString(id *identificationData) string {
 	return sb.String()
 }
 
-type deviceStatus uint16
-
-func (x deviceStatus) String() string {
-	switch x {
-	case 0:
-		return "Standby: initializing"
-	case 1:
-		return "Standby: detecting insulation resistance"
-	case 2:
-		return "Standby: detecting irradiation"
-	case 3:
-		return "Standby: grid detecting"
-	case 256:
-		return "Starting"
-	case 512:
-		return "On-grid: running"
-	case 513:
-		return "Grid connection: power limited"
-	case 514:
-		return "Grid connection: self-derating"
-	case 515:
-		return "Off-grid Running"
-	case 768:
-		return "Shutdown: fault"
-	case 769:
-		return "Shutdown: command"
-	case 770:
-		return "Shutdown: OVGR"
-	case 771:
-		return "Shutdown: communication disconnected"
-	case 772:
-		return "Shutdown: power limited"
-	case 773:
-		return "Shutdown: manual startup required"
-	case 774:
-		return "Shutdown: DC switches disconnected"
-	case 775:
-		return "Shutdown: rapid cutoff"
-	case 776:
-		return "Shutdown: input underpower"
-	case 1025:
-		return "Grid scheduling: cosΦ-P curve"
-	case 1026:
-		return "Grid scheduling: Q-U curve"
-	case 1027:
-		return "Grid scheduling: PF-U curve"
-	case 1028:
-		return "Grid scheduling: dry contact"
-	case 1029:
-		return "Grid scheduling: Q-P curve"
-	case 1280:
-		return "Spot-check ready"
-	case 1281:
-		return "Spot-checking"
-	case 1536:
-		return "Inspecting"
-	case 1792:
-		return "AFCI self check"
-	case 2048:
-		return "I-V scanning"
-	case 2304:
-		return "DC input detection"
-	case 2560:
-		return "Running: off-grid charging"
-	case 40960:
-		return "Standby: no irradiation"
-	default:
-		return fmt.Sprintf("Unknown status %d %#04x\t%#016b", x, x, x)
-	}
-}
-
 type cumulativeData1 struct {
 	genericData
 
@@ -1393,25 +1102,25 @@ func (x *cumulativeData1) parse(data []byte) (err error) {
 	var epoch uint32
 	var idx uint
 
-	u32, idx, _ = getU32(data, idx)
+	u32, idx, _ = sun2000.GetU32(data, idx)
 	x.cumulativeGeneratedElectricity = float32(u32) / 100
 
-	u32, idx, _ = getU32(data, idx)
+	u32, idx, _ = sun2000.GetU32(data, idx)
 	x.totalDCInputPower = float32(u32) / 100
 
-	epoch, idx, _ = getU32(data, idx)
+	epoch, idx, _ = sun2000.GetU32(data, idx)
 	x.currentElectricityGenerationStatisticsTime = time.Unix(int64(epoch), 0)
 
-	u32, idx, _ = getU32(data, idx)
+	u32, idx, _ = sun2000.GetU32(data, idx)
 	x.electricityGeneratedInCurrentHour = float32(u32) / 100
 
-	u32, idx, _ = getU32(data, idx)
+	u32, idx, _ = sun2000.GetU32(data, idx)
 	x.electricityGeneratedInCurrentDay = float32(u32) / 100
 
-	u32, idx, _ = getU32(data, idx)
+	u32, idx, _ = sun2000.GetU32(data, idx)
 	x.electricityGeneratedInCurrentMonth = float32(u32) / 100
 
-	u32, _, _ = getU32(data, idx)
+	u32, _, _ = sun2000.GetU32(data, idx)
 	x.electricityGeneratedInCurrentYear = float32(u32) / 100
 
 	return nil
@@ -1442,14 +1151,14 @@ func (x *cumulativeData1) metricsString(id *identificationData) string {
 		id.RLock()
 		defer id.RUnlock()
 
-		sb.WriteString(fmt.Sprintf("sun2000_cumulative_generate_electricity{model=%q,sn=%q,unit=\"kWh\"} %3.3f\n", id.model, id.sn, x.cumulativeGeneratedElectricity))
-		sb.WriteString(fmt.Sprintf("sun2000_total_dc_input_power{model=%q,sn=%q,unit=\"kWh\"} %3.3f\n", id.model, id.sn, x.totalDCInputPower))
+		sb.WriteString(fmt.Sprintf("sun2000_cumulative_generate_electricity{device=%q,model=%q,sn=%q,unit=\"kWh\"} %3.3f\n", id.device, id.Model, id.SN, x.cumulativeGeneratedElectricity))
+		sb.WriteString(fmt.Sprintf("sun2000_total_dc_input_power{device=%q,model=%q,sn=%q,unit=\"kWh\"} %3.3f\n", id.device, id.Model, id.SN, x.totalDCInputPower))
 
-		sb.WriteString(fmt.Sprintf("sun2000_current_electricity_generation_statistics_time{model=%q,sn=%q} %d\n", id.model, id.sn, x.currentElectricityGenerationStatisticsTime.Unix()))
-		sb.WriteString(fmt.Sprintf("sun2000_electricity_generated_in_current_hour{model=%q,sn=%q,unit=\"kWh\"} %3.3f\n", id.model, id.sn, x.electricityGeneratedInCurrentHour))
-		sb.WriteString(fmt.Sprintf("sun2000_electricity_generated_in_current_day{model=%q,sn=%q,unit=\"kWh\"} %3.3f\n", id.model, id.sn, x.electricityGeneratedInCurrentDay))
-		sb.WriteString(fmt.Sprintf("sun2000_electricity_generated_in_current_month{model=%q,sn=%q,unit=\"kWh\"} %3.3f\n", id.model, id.sn, x.electricityGeneratedInCurrentMonth))
-		sb.WriteString(fmt.Sprintf("sun2000_electricity_generated_in_current_year{model=%q,sn=%q,unit=\"kWh\"} %3.3f\n", id.model, id.sn, x.electricityGeneratedInCurrentYear))
+		sb.WriteString(fmt.Sprintf("sun2000_current_electricity_generation_statistics_time{device=%q,model=%q,sn=%q} %d\n", id.device, id.Model, id.SN, x.currentElectricityGenerationStatisticsTime.Unix()))
+		sb.WriteString(fmt.Sprintf("sun2000_electricity_generated_in_current_hour{device=%q,model=%q,sn=%q,unit=\"kWh\"} %3.3f\n", id.device, id.Model, id.SN, x.electricityGeneratedInCurrentHour))
+		sb.WriteString(fmt.Sprintf("sun2000_electricity_generated_in_current_day{device=%q,model=%q,sn=%q,unit=\"kWh\"} %3.3f\n", id.device, id.Model, id.SN, x.electricityGeneratedInCurrentDay))
+		sb.WriteString(fmt.Sprintf("sun2000_electricity_generated_in_current_month{device=%q,model=%q,sn=%q,unit=\"kWh\"} %3.3f\n", id.device, id.Model, id.SN, x.electricityGeneratedInCurrentMonth))
+		sb.WriteString(fmt.Sprintf("sun2000_electricity_generated_in_current_year{device=%q,model=%q,sn=%q,unit=\"kWh\"} %3.3f\n", id.device, id.Model, id.SN, x.electricityGeneratedInCurrentYear))
 	}
 	sb.WriteString("\n")
 
@@ -1522,52 +1231,52 @@ func (x *cumulativeData2) parse(data []byte) (err error) {
 	var epoch uint32
 	var idx uint
 
-	x.numberOfCriticalAlarms, idx, _ = getU16(data, idx)
-	x.numberOfMajorAlarms, idx, _ = getU16(data, idx)
-	x.numberOfMinorAlarms, idx, _ = getU16(data, idx)
-	x.numberOfWarningAlarms, idx, _ = getU16(data, idx)
-	x.alarmClearanceSerialNumber, idx, _ = getU16(data, idx)
+	x.numberOfCriticalAlarms, idx, _ = sun2000.GetU16(data, idx)
+	x.numberOfMajorAlarms, idx, _ = sun2000.GetU16(data, idx)
+	x.numberOfMinorAlarms, idx, _ = sun2000.GetU16(data, idx)
+	x.numberOfWarningAlarms, idx, _ = sun2000.GetU16(data, idx)
+	x.alarmClearanceSerialNumber, idx, _ = sun2000.GetU16(data, idx)
 
-	epoch, idx, _ = getU32(data, idx)
+	epoch, idx, _ = sun2000.GetU32(data, idx)
 	x.electricityStatisticsTimeInThePreviousHour = time.Unix(int64(epoch), 0)
-	u32, idx, _ = getU32(data, idx)
+	u32, idx, _ = sun2000.GetU32(data, idx)
 	x.electricityGeneratedInThePreviousHour = float32(u32) / 100
 
-	epoch, idx, _ = getU32(data, idx)
+	epoch, idx, _ = sun2000.GetU32(data, idx)
 	x.electricityStatisticsTimeOfThePreviousDay = time.Unix(int64(epoch), 0)
-	u32, idx, _ = getU32(data, idx)
+	u32, idx, _ = sun2000.GetU32(data, idx)
 	x.electricityGeneratedOnThePreviousDay = float32(u32) / 100
 
-	epoch, idx, _ = getU32(data, idx)
+	epoch, idx, _ = sun2000.GetU32(data, idx)
 	x.electricityStatisticsTimeOfThePreviousMonth = time.Unix(int64(epoch), 0)
-	u32, idx, _ = getU32(data, idx)
+	u32, idx, _ = sun2000.GetU32(data, idx)
 	x.electricityGeneratedInPreviousMonth = float32(u32) / 100
 
-	epoch, idx, _ = getU32(data, idx)
+	epoch, idx, _ = sun2000.GetU32(data, idx)
 	x.electricityStatisticsTimeOfThePreviousYear = time.Unix(int64(epoch), 0)
-	u32, idx, _ = getU32(data, idx)
+	u32, idx, _ = sun2000.GetU32(data, idx)
 	x.electricityGeneratedInPreviousYear = float32(u32) / 100
 
-	x.latestActiveAlarmSerialNumber, idx, _ = getU32(data, idx)
-	x.latestHistoricalAlarmSerialNumber, idx, _ = getU32(data, idx)
+	x.latestActiveAlarmSerialNumber, idx, _ = sun2000.GetU32(data, idx)
+	x.latestHistoricalAlarmSerialNumber, idx, _ = sun2000.GetU32(data, idx)
 
-	i16, idx, _ = getI16(data, idx)
+	i16, idx, _ = sun2000.GetI16(data, idx)
 	x.totalBusVoltage = float32(i16) / 10
-	i16, idx, _ = getI16(data, idx)
+	i16, idx, _ = sun2000.GetI16(data, idx)
 	x.maximumPVVoltage = float32(i16) / 10
-	i16, idx, _ = getI16(data, idx)
+	i16, idx, _ = sun2000.GetI16(data, idx)
 	x.minimumPVVoltage = float32(i16) / 10
-	i16, idx, _ = getI16(data, idx)
+	i16, idx, _ = sun2000.GetI16(data, idx)
 	x.averagePVNegativeVoltageToGround = float32(i16) / 10
-	i16, idx, _ = getI16(data, idx)
+	i16, idx, _ = sun2000.GetI16(data, idx)
 	x.maximumPVPositiveVoltageToGround = float32(i16) / 10
-	i16, idx, _ = getI16(data, idx)
+	i16, idx, _ = sun2000.GetI16(data, idx)
 	x.minimumPVNegativeVoltageToGround = float32(i16) / 10
 
-	u16, idx, _ = getU16(data, idx)
+	u16, idx, _ = sun2000.GetU16(data, idx)
 	x.inverterToPEVoltageTolerance = inverterToPEVoltageTolerance(u16)
 
-	u16, _, _ = getU16(data, idx)
+	u16, _, _ = sun2000.GetU16(data, idx)
 	x.isoFeatureInformation = u16
 
 	return nil
@@ -1617,33 +1326,33 @@ func (x *cumulativeData2) metricsString(id *identificationData) string {
 		id.RLock()
 		defer id.RUnlock()
 
-		sb.WriteString(fmt.Sprintf("sun2000_number_of_alarms{model=%q,sn=%q,level=\"Critical\"} %d\n", id.model, id.sn, x.numberOfCriticalAlarms))
-		sb.WriteString(fmt.Sprintf("sun2000_number_of_alarms{model=%q,sn=%q,level=\"Major\"} %d\n", id.model, id.sn, x.numberOfMajorAlarms))
-		sb.WriteString(fmt.Sprintf("sun2000_number_of_alarms{model=%q,sn=%q,level=\"Minor\"} %d\n", id.model, id.sn, x.numberOfMinorAlarms))
-		sb.WriteString(fmt.Sprintf("sun2000_number_of_alarms{model=%q,sn=%q,level=\"Warning\"} %d\n", id.model, id.sn, x.numberOfWarningAlarms))
-		sb.WriteString(fmt.Sprintf("sun2000_alarm_clearance_serial_number{model=%q,sn=%q} %d\n", id.model, id.sn, x.alarmClearanceSerialNumber))
+		sb.WriteString(fmt.Sprintf("sun2000_number_of_alarms{device=%q,model=%q,sn=%q,level=\"Critical\"} %d\n", id.device, id.Model, id.SN, x.numberOfCriticalAlarms))
+		sb.WriteString(fmt.Sprintf("sun2000_number_of_alarms{device=%q,model=%q,sn=%q,level=\"Major\"} %d\n", id.device, id.Model, id.SN, x.numberOfMajorAlarms))
+		sb.WriteString(fmt.Sprintf("sun2000_number_of_alarms{device=%q,model=%q,sn=%q,level=\"Minor\"} %d\n", id.device, id.Model, id.SN, x.numberOfMinorAlarms))
+		sb.WriteString(fmt.Sprintf("sun2000_number_of_alarms{device=%q,model=%q,sn=%q,level=\"Warning\"} %d\n", id.device, id.Model, id.SN, x.numberOfWarningAlarms))
+		sb.WriteString(fmt.Sprintf("sun2000_alarm_clearance_serial_number{device=%q,model=%q,sn=%q} %d\n", id.device, id.Model, id.SN, x.alarmClearanceSerialNumber))
 		sb.WriteString("\n")
-		sb.WriteString(fmt.Sprintf("sun2000_electricity_statistics_time_in_the_previous_hour{model=%q,sn=%q} %d\n", id.model, id.sn, x.electricityStatisticsTimeInThePreviousHour.Unix()))
-		sb.WriteString(fmt.Sprintf("sun2000_electricity_generated_in_the_previous_hour{model=%q,sn=%q,unit=\"kWh\"} %3.3f\n", id.model, id.sn, x.electricityGeneratedInThePreviousHour))
-		sb.WriteString(fmt.Sprintf("sun2000_electricity_statistics_time_of_the_previous_day{model=%q,sn=%q} %d\n", id.model, id.sn, x.electricityStatisticsTimeOfThePreviousDay.Unix()))
-		sb.WriteString(fmt.Sprintf("sun2000_electricity_generated_on_the_previous_day{model=%q,sn=%q,unit=\"kWh\"} %3.3f\n", id.model, id.sn, x.electricityGeneratedOnThePreviousDay))
-		sb.WriteString(fmt.Sprintf("sun2000_electricity_statistics_time_of_the_previous_month{model=%q,sn=%q} %d\n", id.model, id.sn, x.electricityStatisticsTimeOfThePreviousMonth.Unix()))
-		sb.WriteString(fmt.Sprintf("sun2000_electricity_generated_in_the_previous_month{model=%q,sn=%q,unit=\"kWh\"} %3.3f\n", id.model, id.sn, x.electricityGeneratedInPreviousMonth))
-		sb.WriteString(fmt.Sprintf("sun2000_electricity_statistics_time_of_the_previous_year{model=%q,sn=%q} %d\n", id.model, id.sn, x.electricityStatisticsTimeOfThePreviousYear.Unix()))
-		sb.WriteString(fmt.Sprintf("sun2000_electricity_generated_in_the_previous_year{model=%q,sn=%q,unit=\"kWh\"} %3.3f\n", id.model, id.sn, x.electricityGeneratedInPreviousYear))
+		sb.WriteString(fmt.Sprintf("sun2000_electricity_statistics_time_in_the_previous_hour{device=%q,model=%q,sn=%q} %d\n", id.device, id.Model, id.SN, x.electricityStatisticsTimeInThePreviousHour.Unix()))
+		sb.WriteString(fmt.Sprintf("sun2000_electricity_generated_in_the_previous_hour{device=%q,model=%q,sn=%q,unit=\"kWh\"} %3.3f\n", id.device, id.Model, id.SN, x.electricityGeneratedInThePreviousHour))
+		sb.WriteString(fmt.Sprintf("sun2000_electricity_statistics_time_of_the_previous_day{device=%q,model=%q,sn=%q} %d\n", id.device, id.Model, id.SN, x.electricityStatisticsTimeOfThePreviousDay.Unix()))
+		sb.WriteString(fmt.Sprintf("sun2000_electricity_generated_on_the_previous_day{device=%q,model=%q,sn=%q,unit=\"kWh\"} %3.3f\n", id.device, id.Model, id.SN, x.electricityGeneratedOnThePreviousDay))
+		sb.WriteString(fmt.Sprintf("sun2000_electricity_statistics_time_of_the_previous_month{device=%q,model=%q,sn=%q} %d\n", id.device, id.Model, id.SN, x.electricityStatisticsTimeOfThePreviousMonth.Unix()))
+		sb.WriteString(fmt.Sprintf("sun2000_electricity_generated_in_the_previous_month{device=%q,model=%q,sn=%q,unit=\"kWh\"} %3.3f\n", id.device, id.Model, id.SN, x.electricityGeneratedInPreviousMonth))
+		sb.WriteString(fmt.Sprintf("sun2000_electricity_statistics_time_of_the_previous_year{device=%q,model=%q,sn=%q} %d\n", id.device, id.Model, id.SN, x.electricityStatisticsTimeOfThePreviousYear.Unix()))
+		sb.WriteString(fmt.Sprintf("sun2000_electricity_generated_in_the_previous_year{device=%q,model=%q,sn=%q,unit=\"kWh\"} %3.3f\n", id.device, id.Model, id.SN, x.electricityGeneratedInPreviousYear))
 		sb.WriteString("\n")
-		sb.WriteString(fmt.Sprintf("sun2000_latest_active_alarm_serial_number{model=%q,sn=%q} %d\n", id.model, id.sn, x.latestActiveAlarmSerialNumber))
-		sb.WriteString(fmt.Sprintf("sun2000_latest_historical_alarm_serial_number{model=%q,sn=%q} %d\n", id.model, id.sn, x.latestHistoricalAlarmSerialNumber))
+		sb.WriteString(fmt.Sprintf("sun2000_latest_active_alarm_serial_number{device=%q,model=%q,sn=%q} %d\n", id.device, id.Model, id.SN, x.latestActiveAlarmSerialNumber))
+		sb.WriteString(fmt.Sprintf("sun2000_latest_historical_alarm_serial_number{device=%q,model=%q,sn=%q} %d\n", id.device, id.Model, id.SN, x.latestHistoricalAlarmSerialNumber))
 		sb.WriteString("\n")
-		sb.WriteString(fmt.Sprintf("sun2000_total_bus_voltage{model=%q,sn=%q,unit=\"V\"} %3.1f\n", id.model, id.sn, x.totalBusVoltage))
-		sb.WriteString(fmt.Sprintf("sun2000_maximum_pv_voltage{model=%q,sn=%q,unit=\"V\"} %3.1f\n", id.model, id.sn, x.maximumPVVoltage))
-		sb.WriteString(fmt.Sprintf("sun2000_minimum_pv_voltage{model=%q,sn=%q,unit=\"V\"} %3.1f\n", id.model, id.sn, x.minimumPVVoltage))
-		sb.WriteString(fmt.Sprintf("sun2000_average_pv_negative_voltage_to_ground{model=%q,sn=%q,unit=\"V\"} %3.1f\n", id.model, id.sn, x.averagePVNegativeVoltageToGround))
-		sb.WriteString(fmt.Sprintf("sun2000_maximum_pv_positive_voltage_to_ground{model=%q,sn=%q,unit=\"V\"} %3.1f\n", id.model, id.sn, x.maximumPVPositiveVoltageToGround))
-		sb.WriteString(fmt.Sprintf("sun2000_minimum_pv_negative_voltage_to_ground{model=%q,sn=%q,unit=\"V\"} %3.1f\n", id.model, id.sn, x.minimumPVNegativeVoltageToGround))
+		sb.WriteString(fmt.Sprintf("sun2000_total_bus_voltage{device=%q,model=%q,sn=%q,unit=\"V\"} %3.1f\n", id.device, id.Model, id.SN, x.totalBusVoltage))
+		sb.WriteString(fmt.Sprintf("sun2000_maximum_pv_voltage{device=%q,model=%q,sn=%q,unit=\"V\"} %3.1f\n", id.device, id.Model, id.SN, x.maximumPVVoltage))
+		sb.WriteString(fmt.Sprintf("sun2000_minimum_pv_voltage{device=%q,model=%q,sn=%q,unit=\"V\"} %3.1f\n", id.device, id.Model, id.SN, x.minimumPVVoltage))
+		sb.WriteString(fmt.Sprintf("sun2000_average_pv_negative_voltage_to_ground{device=%q,model=%q,sn=%q,unit=\"V\"} %3.1f\n", id.device, id.Model, id.SN, x.averagePVNegativeVoltageToGround))
+		sb.WriteString(fmt.Sprintf("sun2000_maximum_pv_positive_voltage_to_ground{device=%q,model=%q,sn=%q,unit=\"V\"} %3.1f\n", id.device, id.Model, id.SN, x.maximumPVPositiveVoltageToGround))
+		sb.WriteString(fmt.Sprintf("sun2000_minimum_pv_negative_voltage_to_ground{device=%q,model=%q,sn=%q,unit=\"V\"} %3.1f\n", id.device, id.Model, id.SN, x.minimumPVNegativeVoltageToGround))
 		sb.WriteString("\n")
-		sb.WriteString(fmt.Sprintf("sun2000_inverter_to_pe_voltage_tolerance{model=%q,sn=%q,unit=\"V\"} %d\n", id.model, id.sn, x.inverterToPEVoltageTolerance))
-		sb.WriteString(fmt.Sprintf("sun2000_iso_feature_information{model=%q,sn=%q} %d\n", id.model, id.sn, x.isoFeatureInformation))
+		sb.WriteString(fmt.Sprintf("sun2000_inverter_to_pe_voltage_tolerance{device=%q,model=%q,sn=%q,unit=\"V\"} %d\n", id.device, id.Model, id.SN, x.inverterToPEVoltageTolerance))
+		sb.WriteString(fmt.Sprintf("sun2000_iso_feature_information{device=%q,model=%q,sn=%q} %d\n", id.device, id.Model, id.SN, x.isoFeatureInformation))
 	}
 
 	sb.WriteString("\n")
@@ -1687,9 +1396,9 @@ func (x *cumulativeData3) parse(data []byte) (err error) {
 	var i16 int16
 	var idx uint
 
-	x.builtInPIDRunningStatus, idx, _ = getU16(data, idx)
+	x.builtInPIDRunningStatus, idx, _ = sun2000.GetU16(data, idx)
 
-	i16, _, _ = getI16(data, idx)
+	i16, _, _ = sun2000.GetI16(data, idx)
 	x.pvNegativeVoltageToGround = float32(i16) / 10
 
 	return nil
@@ -1715,8 +1424,8 @@ func (x *cumulativeData3) metricsString(id *identificationData) string {
 		id.RLock()
 		defer id.RUnlock()
 
-		sb.WriteString(fmt.Sprintf("sun2000_built_in_pid_running_status{model=%q,sn=%q} %d\n", id.model, id.sn, x.builtInPIDRunningStatus))
-		sb.WriteString(fmt.Sprintf("sun2000_pv_negative_voltage_to_ground{model=%q,sn=%q,unit=\"V\"} %3.1f\n", id.model, id.sn, x.pvNegativeVoltageToGround))
+		sb.WriteString(fmt.Sprintf("sun2000_built_in_pid_running_status{device=%q,model=%q,sn=%q} %d\n", id.device, id.Model, id.SN, x.builtInPIDRunningStatus))
+		sb.WriteString(fmt.Sprintf("sun2000_pv_negative_voltage_to_ground{device=%q,model=%q,sn=%q,unit=\"V\"} %3.1f\n", id.device, id.Model, id.SN, x.pvNegativeVoltageToGround))
 	}
 	sb.WriteString("\n")
 
@@ -1743,7 +1452,7 @@ func (x *mpptData1) parse(data []byte) (err error) {
 	var idx uint
 
 	for i := range x.cumulativeDCEnergyYieldOfMPPT {
-		u32, idx, _ = getU32(data, idx)
+		u32, idx, _ = sun2000.GetU32(data, idx)
 		x.cumulativeDCEnergyYieldOfMPPT[i] = float32(u32) / 100
 	}
 
@@ -1760,7 +1469,7 @@ func (x *mpptData1) metricsString(id *identificationData) string {
 	sb.WriteString(fmt.Sprintf("# Next Read = %s\n", x.nextRead.Format(time.RFC3339)))
 	sb.WriteString("\n")
 	for i, y := range x.cumulativeDCEnergyYieldOfMPPT {
-		if y != 0 || i < int(id.numberOfMPPTs) {
+		if y != 0 || i < int(id.NumberOfMPPTs) {
 			sb.WriteString(fmt.Sprintf("# Cumulative DC Energy Yield of MPPT %2d = %3.3f kWh\n", i+1, y))
 		}
 	}
@@ -1774,8 +1483,8 @@ func (x *mpptData1) metricsString(id *identificationData) string {
 		defer id.RUnlock()
 
 		for i, y := range x.cumulativeDCEnergyYieldOfMPPT {
-			if y != 0 || i < int(id.numberOfMPPTs) {
-				sb.WriteString(fmt.Sprintf("sun2000_cumulative_dc_energy_yield_of_mppt{model=%q,sn=%q,mppt=\"%d\",unit=\"kWh\"} %3.3f\n", id.model, id.sn, i+1, y))
+			if y != 0 || i < int(id.NumberOfMPPTs) {
+				sb.WriteString(fmt.Sprintf("sun2000_cumulative_dc_energy_yield_of_mppt{device=%q,model=%q,sn=%q,mppt=\"%d\",unit=\"kWh\"} %3.3f\n", id.device, id.Model, id.SN, i+1, y))
 			}
 		}
 	}
@@ -1807,19 +1516,19 @@ func (x *alarmData2) parse(data []byte) (err error) {
 	var idx uint
 
 	for i := 0; i < 3; i++ {
-		x.monitoringAlarm[i], idx, _ = getU16(data, idx)
+		x.monitoringAlarm[i], idx, _ = sun2000.GetU16(data, idx)
 	}
 
 	for i := 0; i < 16; i++ {
-		x.externalPowerAlarm[i], idx, _ = getU16(data, idx)
+		x.externalPowerAlarm[i], idx, _ = sun2000.GetU16(data, idx)
 	}
 
 	for i := 3; i < 5; i++ {
-		x.monitoringAlarm[i], idx, _ = getU16(data, idx)
+		x.monitoringAlarm[i], idx, _ = sun2000.GetU16(data, idx)
 	}
 
 	for i := 16; i < 18; i++ {
-		x.externalPowerAlarm[i], idx, _ = getU16(data, idx)
+		x.externalPowerAlarm[i], idx, _ = sun2000.GetU16(data, idx)
 	}
 
 	return nil
@@ -1851,11 +1560,11 @@ func (x *alarmData2) metricsString(id *identificationData) string {
 		defer id.RUnlock()
 
 		for i, y := range x.monitoringAlarm {
-			sb.WriteString(fmt.Sprintf("sun2000_monitoring_alarm{model=%q,sn=%q,alarm=\"%d\"} %d\n", id.model, id.sn, i+1, y))
+			sb.WriteString(fmt.Sprintf("sun2000_monitoring_alarm{device=%q,model=%q,sn=%q,alarm=\"%d\"} %d\n", id.device, id.Model, id.SN, i+1, y))
 		}
 		sb.WriteString("\n")
 		for i, y := range x.externalPowerAlarm {
-			sb.WriteString(fmt.Sprintf("sun2000_external_power_alarm{model=%q,sn=%q,alarm=\"%d\"} %d\n", id.model, id.sn, i+1, y))
+			sb.WriteString(fmt.Sprintf("sun2000_external_power_alarm{device=%q,model=%q,sn=%q,alarm=\"%d\"} %d\n", id.device, id.Model, id.SN, i+1, y))
 		}
 	}
 	sb.WriteString("\n")
@@ -1882,7 +1591,7 @@ func (x *stringAccessData) parse(data []byte) (err error) {
 	var idx uint
 
 	for i := range x.stringAccessStatus {
-		x.stringAccessStatus[i], idx, _ = getU16(data, idx)
+		x.stringAccessStatus[i], idx, _ = sun2000.GetU16(data, idx)
 	}
 
 	return nil
@@ -1910,7 +1619,7 @@ func (x *stringAccessData) metricsString(id *identificationData) string {
 		defer id.RUnlock()
 
 		for i, y := range x.stringAccessStatus {
-			sb.WriteString(fmt.Sprintf("sun2000_string_access_status{model=%q,sn=%q,string=\"%d\"} %d\n", id.model, id.sn, i+1, y))
+			sb.WriteString(fmt.Sprintf("sun2000_string_access_status{device=%q,model=%q,sn=%q,string=\"%d\"} %d\n", id.device, id.Model, id.SN, i+1, y))
 		}
 	}
 	sb.WriteString("\n")
@@ -1938,7 +1647,7 @@ func (x *mpptData2) parse(data []byte) (err error) {
 	var idx uint
 
 	for i := range x.mpptTotalInputPower {
-		u32, idx, _ = getU32(data, idx)
+		u32, idx, _ = sun2000.GetU32(data, idx)
 		x.mpptTotalInputPower[i] = float32(u32) / 1000
 	}
 
@@ -1955,7 +1664,7 @@ func (x *mpptData2) metricsString(id *identificationData) string {
 	sb.WriteString(fmt.Sprintf("# Next Read = %s\n", x.nextRead.Format(time.RFC3339)))
 	sb.WriteString("\n")
 	for i, y := range x.mpptTotalInputPower {
-		if y != 0 || i < int(id.numberOfMPPTs) {
+		if y != 0 || i < int(id.NumberOfMPPTs) {
 			sb.WriteString(fmt.Sprintf("# MPPT %2d Total Input Power = %3.3f kW\n", i+1, y))
 		}
 	}
@@ -1969,8 +1678,8 @@ func (x *mpptData2) metricsString(id *identificationData) string {
 		defer id.RUnlock()
 
 		for i, y := range x.mpptTotalInputPower {
-			if y != 0 || i < int(id.numberOfMPPTs) {
-				sb.WriteString(fmt.Sprintf("sun2000_mppt_total_input_power{model=%q,sn=%q,mppt=\"%d\",unit=\"kW\"} %3.3f\n", id.model, id.sn, i+1, y))
+			if y != 0 || i < int(id.NumberOfMPPTs) {
+				sb.WriteString(fmt.Sprintf("sun2000_mppt_total_input_power{device=%q,model=%q,sn=%q,mppt=\"%d\",unit=\"kW\"} %3.3f\n", id.device, id.Model, id.SN, i+1, y))
 			}
 		}
 	}
@@ -1999,7 +1708,7 @@ func (x *internalTemperatureData) parse(data []byte) (err error) {
 	var idx uint
 
 	for i := range x.internalTemperature {
-		i16, idx, _ = getI16(data, idx)
+		i16, idx, _ = sun2000.GetI16(data, idx)
 		x.internalTemperature[i] = float32(i16) / 10
 	}
 
@@ -2033,7 +1742,7 @@ func (x *internalTemperatureData) metricsString(id *identificationData) string {
 		for i, y := range x.internalTemperature {
 			if y != 0 {
 				label := internalTemperatureLabel(i + 1)
-				sb.WriteString(fmt.Sprintf("sun2000_internal_temperature{model=%q,sn=%q,sensor=\"%d %s\",unit=\"℃\"} %3.1f\n", id.model, id.sn, i+1, label, y))
+				sb.WriteString(fmt.Sprintf("sun2000_internal_temperature{device=%q,model=%q,sn=%q,sensor=\"%d %s\",unit=\"℃\"} %3.1f\n", id.device, id.Model, id.SN, i+1, label, y))
 			}
 		}
 	}
@@ -2078,119 +1787,17 @@ func (x internalTemperatureLabel) String() string {
 type meterData struct {
 	genericData
 
-	// 37100 U16 1
-	meterStatus uint16
-	// 37101 I32 2 gain 10 V
-	gridPhaseAVoltage float32
-	// 37103 I32 2 gain 10 V
-	gridPhaseBVoltage float32
-	// 37105 I32 2 gain 10 V
-	gridPhaseCVoltage float32
-	// 37107 I32 2 gain 100 A
-	gridPhaseACurrent float32
-	// 37109 I32 2 gain 100 A
-	gridPhaseBCurrent float32
-	// 37111 I32 2 gain 100 A
-	gridPhaseCCurrent float32
-
-	// 37113 I32 2 gain 1000 kW
-	gridActivePower float32 // >0 feed-in to the grid, <0 supply from the grid
-	// 37115 I32 2 gain 1 Var
-	gridReactivePower float32
-	// 37117 I16 1 gain 1000
-	gridPowerFactor float32
-	// 37118 I16 1 gain 100 Hz
-	gridFrequency float32
-	// 37119 I32 2 gain 100 kWh
-	gridPositiveActiveElectricity float32 // Electricity fed by the inverter to the power grid
-	// 37121 I32 2 gain 100 kWh
-	gridReverseActivePower float32 // Power supplied to a distributed system from the power grid
-	// 37123 I32 2 gain 100 kVar h
-	gridAccumulatedReactivePower float32
-
-	// 37125 U16 1
-	meterType uint16 // 0: single-phase; 1: three-phase
-	// 37126 I32 2 gain 10 V
-	gridLineABVoltage float32
-	// 37128 I32 2 gain 10 V
-	gridLineBCVoltage float32
-	// 37130 I32 2 gain 10 V
-	gridLineCAVoltage float32
-	// 37132 I32 2 gain 1000 kW
-	gridPhaseAActivePower float32
-	// 37134 I32 2 gain 1000 kW
-	gridPhaseBActivePower float32
-	// 37136 I32 2 gain 1000 kW
-	gridPhaseCActivePower float32
-	// 37138 U16 1
-	meterModelDetectionResult uint16 // 0: being identified; 1: The selected model is the same as the actual model of the connected meter; 2: The selected model is different from the actual model of the connected meter
+	sun2000.Meter
 }
 
 func (x *meterData) parse(data []byte) (err error) {
-	size := 1 + 6*2
-	if len(data) < size {
-		return fmt.Errorf("data length %d < %d", len(data), size)
+	v, err := sun2000.DecodeMeter(data)
+	if err != nil {
+		return err
 	}
-
 	x.Lock()
 	defer x.Unlock()
-
-	var u16 uint16
-	var i16 int16
-	var i32 int32
-	var idx uint
-
-	u16, idx, _ = getU16(data, idx)
-	x.meterStatus = u16
-
-	i32, idx, _ = getI32(data, idx)
-	x.gridPhaseAVoltage = float32(i32) / 10
-	i32, idx, _ = getI32(data, idx)
-	x.gridPhaseBVoltage = float32(i32) / 10
-	i32, idx, _ = getI32(data, idx)
-	x.gridPhaseCVoltage = float32(i32) / 10
-
-	i32, idx, _ = getI32(data, idx)
-	x.gridPhaseACurrent = float32(i32) / 100
-	i32, idx, _ = getI32(data, idx)
-	x.gridPhaseBCurrent = float32(i32) / 100
-	i32, idx, _ = getI32(data, idx)
-	x.gridPhaseCCurrent = float32(i32) / 100
-
-	i32, idx, _ = getI32(data, idx)
-	x.gridActivePower = float32(i32) / 1000
-	i32, idx, _ = getI32(data, idx)
-	x.gridReactivePower = float32(i32)
-	i16, idx, _ = getI16(data, idx)
-	x.gridPowerFactor = float32(i16) / 100
-
-	i16, idx, _ = getI16(data, idx)
-	x.gridFrequency = float32(i16) / 100
-	i32, idx, _ = getI32(data, idx)
-	x.gridPositiveActiveElectricity = float32(i32) / 100
-	i32, idx, _ = getI32(data, idx)
-	x.gridReverseActivePower = float32(i32) / 100
-	i32, idx, _ = getI32(data, idx)
-	x.gridAccumulatedReactivePower = float32(i32) / 100
-
-	x.meterType, idx, _ = getU16(data, idx)
-
-	i32, idx, _ = getI32(data, idx)
-	x.gridLineABVoltage = float32(i32) / 10
-	i32, idx, _ = getI32(data, idx)
-	x.gridLineBCVoltage = float32(i32) / 10
-	i32, idx, _ = getI32(data, idx)
-	x.gridLineCAVoltage = float32(i32) / 10
-
-	i32, idx, _ = getI32(data, idx)
-	x.gridPhaseAActivePower = float32(i32) / 1000
-	i32, idx, _ = getI32(data, idx)
-	x.gridPhaseBActivePower = float32(i32) / 1000
-	i32, idx, _ = getI32(data, idx)
-	x.gridPhaseCActivePower = float32(i32) / 1000
-
-	x.meterModelDetectionResult, _, _ = getU16(data, idx)
-
+	x.Meter = v
 	return nil
 }
 
@@ -2204,64 +1811,64 @@ func (x *meterData) metricsString(id *identificationData) string {
 	sb.WriteString(fmt.Sprintf("# Next Read = %s\n", x.nextRead.Format(time.RFC3339)))
 	sb.WriteString("\n")
 	var txt, txt2, txt3 string
-	switch x.meterStatus {
+	switch x.MeterStatus {
 	case 0:
 		txt = "offline"
 	case 1:
 		txt = "online"
 	}
-	sb.WriteString(fmt.Sprintf("# Meter Status       = %#04x\t%#016b\t%s\n", x.meterStatus, x.meterStatus, txt))
+	sb.WriteString(fmt.Sprintf("# Meter Status       = %#04x\t%#016b\t%s\n", x.MeterStatus, x.MeterStatus, txt))
 	sb.WriteString("\n")
-	sb.WriteString(fmt.Sprintf("# Grid Phase A Voltage = %3.1f V\n", x.gridPhaseAVoltage))
-	sb.WriteString(fmt.Sprintf("# Grid Phase B Voltage = %3.1f V\n", x.gridPhaseBVoltage))
-	sb.WriteString(fmt.Sprintf("# Grid Phase C Voltage = %3.1f V\n", x.gridPhaseCVoltage))
+	sb.WriteString(fmt.Sprintf("# Grid Phase A Voltage = %3.1f V\n", x.GridPhaseAVoltage))
+	sb.WriteString(fmt.Sprintf("# Grid Phase B Voltage = %3.1f V\n", x.GridPhaseBVoltage))
+	sb.WriteString(fmt.Sprintf("# Grid Phase C Voltage = %3.1f V\n", x.GridPhaseCVoltage))
 	sb.WriteString("\n")
-	sb.WriteString(fmt.Sprintf("# Grid Phase A Current = %3.2f A\n", x.gridPhaseACurrent))
-	sb.WriteString(fmt.Sprintf("# Grid Phase B Current = %3.2f A\n", x.gridPhaseBCurrent))
-	sb.WriteString(fmt.Sprintf("# Grid Phase C Current = %3.2f A\n", x.gridPhaseCCurrent))
+	sb.WriteString(fmt.Sprintf("# Grid Phase A Current = %3.2f A\n", x.GridPhaseACurrent))
+	sb.WriteString(fmt.Sprintf("# Grid Phase B Current = %3.2f A\n", x.GridPhaseBCurrent))
+	sb.WriteString(fmt.Sprintf("# Grid Phase C Current = %3.2f A\n", x.GridPhaseCCurrent))
 	sb.WriteString("\n")
-	pA := x.gridPhaseAVoltage * x.gridPhaseACurrent
+	pA := x.GridPhaseAVoltage * x.GridPhaseACurrent
 	sb.WriteString(fmt.Sprintf("# Grid Phase A Power   = %5.2f VA\n", pA))
-	pB := x.gridPhaseBVoltage * x.gridPhaseBCurrent
+	pB := x.GridPhaseBVoltage * x.GridPhaseBCurrent
 	sb.WriteString(fmt.Sprintf("# Grid Phase B Power   = %5.2f VA\n", pB))
-	pC := x.gridPhaseCVoltage * x.gridPhaseCCurrent
+	pC := x.GridPhaseCVoltage * x.GridPhaseCCurrent
 	sb.WriteString(fmt.Sprintf("# Grid Phase C Power   = %5.2f VA\n", pC))
 	pTotal := pA + pB + pC
 	sb.WriteString("# -----------------------------\n")
 	sb.WriteString(fmt.Sprintf("# Grid Total Power     = %5.2f VA\n", pTotal))
 	sb.WriteString("\n")
 
-	sb.WriteString(fmt.Sprintf("# Grid Active Power    = %6.3f kW\n", x.gridActivePower))
-	sb.WriteString(fmt.Sprintf("# Grid Reactive Power  = %4.0f Var\n", x.gridReactivePower))
-	sb.WriteString(fmt.Sprintf("# Grid Power Factor    = %3.2f\n", x.gridPowerFactor))
-	sb.WriteString(fmt.Sprintf("# Grid Frequency       = %3.2f Hz\n", x.gridFrequency))
-	sb.WriteString(fmt.Sprintf("# Grid Positive Active Electricity  = %6.2f kWh\n", x.gridPositiveActiveElectricity))
-	sb.WriteString(fmt.Sprintf("# Grid Reverse Active Power         = %6.2f kWh\n", x.gridReverseActivePower))
-	sb.WriteString(fmt.Sprintf("# Grid Accumulated Reactive Power   = %6.2f kVar h\n", x.gridAccumulatedReactivePower))
+	sb.WriteString(fmt.Sprintf("# Grid Active Power    = %6.3f kW\n", x.GridActivePower))
+	sb.WriteString(fmt.Sprintf("# Grid Reactive Power  = %4.0f Var\n", x.GridReactivePower))
+	sb.WriteString(fmt.Sprintf("# Grid Power Factor    = %3.2f\n", x.GridPowerFactor))
+	sb.WriteString(fmt.Sprintf("# Grid Frequency       = %3.2f Hz\n", x.GridFrequency))
+	sb.WriteString(fmt.Sprintf("# Grid Positive Active Electricity  = %6.2f kWh\n", x.GridPositiveActiveElectricity))
+	sb.WriteString(fmt.Sprintf("# Grid Reverse Active Power         = %6.2f kWh\n", x.GridReverseActivePower))
+	sb.WriteString(fmt.Sprintf("# Grid Accumulated Reactive Power   = %6.2f kVar h\n", x.GridAccumulatedReactivePower))
 	sb.WriteString("\n")
 	txt2 = ""
-	switch x.meterType {
+	switch x.MeterType {
 	case 0:
 		txt2 = "single-phase"
 	case 1:
 		txt2 = "three-phase"
 	}
-	sb.WriteString(fmt.Sprintf("# Meter Type          = %d\t%s\n", x.meterType, txt2))
+	sb.WriteString(fmt.Sprintf("# Meter Type          = %d\t%s\n", x.MeterType, txt2))
 
-	sb.WriteString(fmt.Sprintf("# Grid Line AB Voltage = %3.1f V\n", x.gridLineABVoltage))
-	sb.WriteString(fmt.Sprintf("# Grid Line BC Voltage = %3.1f V\n", x.gridLineBCVoltage))
-	sb.WriteString(fmt.Sprintf("# Grid Line CA Voltage = %3.1f V\n", x.gridLineCAVoltage))
+	sb.WriteString(fmt.Sprintf("# Grid Line AB Voltage = %3.1f V\n", x.GridLineABVoltage))
+	sb.WriteString(fmt.Sprintf("# Grid Line BC Voltage = %3.1f V\n", x.GridLineBCVoltage))
+	sb.WriteString(fmt.Sprintf("# Grid Line CA Voltage = %3.1f V\n", x.GridLineCAVoltage))
 	sb.WriteString("\n")
-	sb.WriteString(fmt.Sprintf("# Grid Phase A Active Power = %3.3f kW\n", x.gridPhaseAActivePower))
-	sb.WriteString(fmt.Sprintf("# Grid Phase B Active Power = %3.3f kW\n", x.gridPhaseBActivePower))
-	sb.WriteString(fmt.Sprintf("# Grid Phase C Active Power = %3.3f kW\n", x.gridPhaseCActivePower))
+	sb.WriteString(fmt.Sprintf("# Grid Phase A Active Power = %3.3f kW\n", x.GridPhaseAActivePower))
+	sb.WriteString(fmt.Sprintf("# Grid Phase B Active Power = %3.3f kW\n", x.GridPhaseBActivePower))
+	sb.WriteString(fmt.Sprintf("# Grid Phase C Active Power = %3.3f kW\n", x.GridPhaseCActivePower))
 	sb.WriteString("# -----------------------------\n")
-	pTotalActive := x.gridPhaseAActivePower + x.gridPhaseBActivePower + x.gridPhaseCActivePower
+	pTotalActive := x.GridPhaseAActivePower + x.GridPhaseBActivePower + x.GridPhaseCActivePower
 	sb.WriteString(fmt.Sprintf("# Grid Total Active Power   = %3.3f kW\n", pTotalActive))
 	sb.WriteString("\n")
 
 	txt3 = ""
-	switch x.meterModelDetectionResult {
+	switch x.MeterModelDetectionResult {
 	case 0:
 		txt3 = "being identified"
 	case 1:
@@ -2269,7 +1876,7 @@ func (x *meterData) metricsString(id *identificationData) string {
 	case 2:
 		txt3 = "The selected model is different from the actual model of the connected meter"
 	}
-	sb.WriteString(fmt.Sprintf("# Meter Model Detection Result = %d\t%s\n", x.meterModelDetectionResult, txt3))
+	sb.WriteString(fmt.Sprintf("# Meter Model Detection Result = %d\t%s\n", x.MeterModelDetectionResult, txt3))
 
 	// skip metrics if the data is empty
 	if x.lastRead.IsZero() || id.lastRead.IsZero() {
@@ -2278,41 +1885,41 @@ func (x *meterData) metricsString(id *identificationData) string {
 		id.RLock()
 		defer id.RUnlock()
 
-		sb.WriteString(fmt.Sprintf("sun2000_meter_status{model=%q,sn=%q} %d\n", id.model, id.sn, x.meterStatus))
+		sb.WriteString(fmt.Sprintf("sun2000_meter_status{device=%q,model=%q,sn=%q} %d\n", id.device, id.Model, id.SN, x.MeterStatus))
 		sb.WriteString("\n")
-		sb.WriteString(fmt.Sprintf("sun2000_grid_phase_voltage{model=%q,sn=%q,phase=\"A\",unit=\"V\"} %3.1f\n", id.model, id.sn, x.gridPhaseAVoltage))
-		sb.WriteString(fmt.Sprintf("sun2000_grid_phase_voltage{model=%q,sn=%q,phase=\"B\",unit=\"V\"} %3.1f\n", id.model, id.sn, x.gridPhaseBVoltage))
-		sb.WriteString(fmt.Sprintf("sun2000_grid_phase_voltage{model=%q,sn=%q,phase=\"C\",unit=\"V\"} %3.1f\n", id.model, id.sn, x.gridPhaseCVoltage))
+		sb.WriteString(fmt.Sprintf("sun2000_grid_phase_voltage{device=%q,model=%q,sn=%q,phase=\"A\",unit=\"V\"} %3.1f\n", id.device, id.Model, id.SN, x.GridPhaseAVoltage))
+		sb.WriteString(fmt.Sprintf("sun2000_grid_phase_voltage{device=%q,model=%q,sn=%q,phase=\"B\",unit=\"V\"} %3.1f\n", id.device, id.Model, id.SN, x.GridPhaseBVoltage))
+		sb.WriteString(fmt.Sprintf("sun2000_grid_phase_voltage{device=%q,model=%q,sn=%q,phase=\"C\",unit=\"V\"} %3.1f\n", id.device, id.Model, id.SN, x.GridPhaseCVoltage))
 		sb.WriteString("\n")
-		sb.WriteString(fmt.Sprintf("sun2000_grid_phase_current{model=%q,sn=%q,phase=\"A\",unit=\"A\"} %3.2f\n", id.model, id.sn, x.gridPhaseACurrent))
-		sb.WriteString(fmt.Sprintf("sun2000_grid_phase_current{model=%q,sn=%q,phase=\"B\",unit=\"A\"} %3.2f\n", id.model, id.sn, x.gridPhaseBCurrent))
-		sb.WriteString(fmt.Sprintf("sun2000_grid_phase_current{model=%q,sn=%q,phase=\"C\",unit=\"A\"} %3.2f\n", id.model, id.sn, x.gridPhaseCCurrent))
+		sb.WriteString(fmt.Sprintf("sun2000_grid_phase_current{device=%q,model=%q,sn=%q,phase=\"A\",unit=\"A\"} %3.2f\n", id.device, id.Model, id.SN, x.GridPhaseACurrent))
+		sb.WriteString(fmt.Sprintf("sun2000_grid_phase_current{device=%q,model=%q,sn=%q,phase=\"B\",unit=\"A\"} %3.2f\n", id.device, id.Model, id.SN, x.GridPhaseBCurrent))
+		sb.WriteString(fmt.Sprintf("sun2000_grid_phase_current{device=%q,model=%q,sn=%q,phase=\"C\",unit=\"A\"} %3.2f\n", id.device, id.Model, id.SN, x.GridPhaseCCurrent))
 		sb.WriteString("\n")
-		sb.WriteString(fmt.Sprintf("sun2000_grid_phase_power{model=%q,sn=%q,phase=\"A\",unit=\"VA\"} %3.2f\n", id.model, id.sn, pA))
-		sb.WriteString(fmt.Sprintf("sun2000_grid_phase_power{model=%q,sn=%q,phase=\"B\",unit=\"VA\"} %3.2f\n", id.model, id.sn, pB))
-		sb.WriteString(fmt.Sprintf("sun2000_grid_phase_power{model=%q,sn=%q,phase=\"C\",unit=\"VA\"} %3.2f\n", id.model, id.sn, pC))
-		sb.WriteString(fmt.Sprintf("sun2000_grid_total_power{model=%q,sn=%q,unit=\"VA\"} %3.2f\n", id.model, id.sn, pTotal))
+		sb.WriteString(fmt.Sprintf("sun2000_grid_phase_power{device=%q,model=%q,sn=%q,phase=\"A\",unit=\"VA\"} %3.2f\n", id.device, id.Model, id.SN, pA))
+		sb.WriteString(fmt.Sprintf("sun2000_grid_phase_power{device=%q,model=%q,sn=%q,phase=\"B\",unit=\"VA\"} %3.2f\n", id.device, id.Model, id.SN, pB))
+		sb.WriteString(fmt.Sprintf("sun2000_grid_phase_power{device=%q,model=%q,sn=%q,phase=\"C\",unit=\"VA\"} %3.2f\n", id.device, id.Model, id.SN, pC))
+		sb.WriteString(fmt.Sprintf("sun2000_grid_total_power{device=%q,model=%q,sn=%q,unit=\"VA\"} %3.2f\n", id.device, id.Model, id.SN, pTotal))
 		sb.WriteString("\n")
-		sb.WriteString(fmt.Sprintf("sun2000_grid_active_power{model=%q,sn=%q,unit=\"kW\"} %3.3f\n", id.model, id.sn, x.gridActivePower))
-		sb.WriteString(fmt.Sprintf("sun2000_grid_reactive_power{model=%q,sn=%q,unit=\"Var\"} %3.0f\n", id.model, id.sn, x.gridReactivePower))
-		sb.WriteString(fmt.Sprintf("sun2000_grid_power_factor{model=%q,sn=%q} %3.2f\n", id.model, id.sn, x.gridPowerFactor))
-		sb.WriteString(fmt.Sprintf("sun2000_grid_frequency{model=%q,sn=%q,unit=\"Hz\"} %3.2f\n", id.model, id.sn, x.gridFrequency))
-		sb.WriteString(fmt.Sprintf("sun2000_grid_positive_active_electricity{model=%q,sn=%q,unit=\"kWh\"} %3.2f\n", id.model, id.sn, x.gridPositiveActiveElectricity))
-		sb.WriteString(fmt.Sprintf("sun2000_grid_reverse_active_power{model=%q,sn=%q,unit=\"kWh\"} %3.2f\n", id.model, id.sn, x.gridReverseActivePower))
-		sb.WriteString(fmt.Sprintf("sun2000_grid_accumulated_reactive_power{model=%q,sn=%q,unit=\"kVar h\"} %3.2f\n", id.model, id.sn, x.gridAccumulatedReactivePower))
+		sb.WriteString(fmt.Sprintf("sun2000_grid_active_power{device=%q,model=%q,sn=%q,unit=\"kW\"} %3.3f\n", id.device, id.Model, id.SN, x.GridActivePower))
+		sb.WriteString(fmt.Sprintf("sun2000_grid_reactive_power{device=%q,model=%q,sn=%q,unit=\"Var\"} %3.0f\n", id.device, id.Model, id.SN, x.GridReactivePower))
+		sb.WriteString(fmt.Sprintf("sun2000_grid_power_factor{device=%q,model=%q,sn=%q} %3.2f\n", id.device, id.Model, id.SN, x.GridPowerFactor))
+		sb.WriteString(fmt.Sprintf("sun2000_grid_frequency{device=%q,model=%q,sn=%q,unit=\"Hz\"} %3.2f\n", id.device, id.Model, id.SN, x.GridFrequency))
+		sb.WriteString(fmt.Sprintf("sun2000_grid_positive_active_electricity{device=%q,model=%q,sn=%q,unit=\"kWh\"} %3.2f\n", id.device, id.Model, id.SN, x.GridPositiveActiveElectricity))
+		sb.WriteString(fmt.Sprintf("sun2000_grid_reverse_active_power{device=%q,model=%q,sn=%q,unit=\"kWh\"} %3.2f\n", id.device, id.Model, id.SN, x.GridReverseActivePower))
+		sb.WriteString(fmt.Sprintf("sun2000_grid_accumulated_reactive_power{device=%q,model=%q,sn=%q,unit=\"kVar h\"} %3.2f\n", id.device, id.Model, id.SN, x.GridAccumulatedReactivePower))
 		sb.WriteString("\n")
-		sb.WriteString(fmt.Sprintf("sun2000_meter_type{model=%q,sn=%q} %d\n", id.model, id.sn, x.meterType))
+		sb.WriteString(fmt.Sprintf("sun2000_meter_type{device=%q,model=%q,sn=%q} %d\n", id.device, id.Model, id.SN, x.MeterType))
 		sb.WriteString("\n")
-		sb.WriteString(fmt.Sprintf("sun2000_grid_line_voltage{model=%q,sn=%q,line=\"AB\",unit=\"V\"} %3.1f\n", id.model, id.sn, x.gridLineABVoltage))
-		sb.WriteString(fmt.Sprintf("sun2000_grid_line_voltage{model=%q,sn=%q,line=\"BC\",unit=\"V\"} %3.1f\n", id.model, id.sn, x.gridLineBCVoltage))
-		sb.WriteString(fmt.Sprintf("sun2000_grid_line_voltage{model=%q,sn=%q,line=\"CA\",unit=\"V\"} %3.1f\n", id.model, id.sn, x.gridLineCAVoltage))
+		sb.WriteString(fmt.Sprintf("sun2000_grid_line_voltage{device=%q,model=%q,sn=%q,line=\"AB\",unit=\"V\"} %3.1f\n", id.device, id.Model, id.SN, x.GridLineABVoltage))
+		sb.WriteString(fmt.Sprintf("sun2000_grid_line_voltage{device=%q,model=%q,sn=%q,line=\"BC\",unit=\"V\"} %3.1f\n", id.device, id.Model, id.SN, x.GridLineBCVoltage))
+		sb.WriteString(fmt.Sprintf("sun2000_grid_line_voltage{device=%q,model=%q,sn=%q,line=\"CA\",unit=\"V\"} %3.1f\n", id.device, id.Model, id.SN, x.GridLineCAVoltage))
 		sb.WriteString("\n")
-		sb.WriteString(fmt.Sprintf("sun2000_grid_phase_active_power{model=%q,sn=%q,phase=\"A\",unit=\"kW\"} %3.3f\n", id.model, id.sn, x.gridPhaseAActivePower))
-		sb.WriteString(fmt.Sprintf("sun2000_grid_phase_active_power{model=%q,sn=%q,phase=\"B\",unit=\"kW\"} %3.3f\n", id.model, id.sn, x.gridPhaseBActivePower))
-		sb.WriteString(fmt.Sprintf("sun2000_grid_phase_active_power{model=%q,sn=%q,phase=\"C\",unit=\"kW\"} %3.3f\n", id.model, id.sn, x.gridPhaseCActivePower))
-		sb.WriteString(fmt.Sprintf("sun2000_grid_total_active_power{model=%q,sn=%q,unit=\"kW\"} %3.3f\n", id.model, id.sn, pTotalActive))
+		sb.WriteString(fmt.Sprintf("sun2000_grid_phase_active_power{device=%q,model=%q,sn=%q,phase=\"A\",unit=\"kW\"} %3.3f\n", id.device, id.Model, id.SN, x.GridPhaseAActivePower))
+		sb.WriteString(fmt.Sprintf("sun2000_grid_phase_active_power{device=%q,model=%q,sn=%q,phase=\"B\",unit=\"kW\"} %3.3f\n", id.device, id.Model, id.SN, x.GridPhaseBActivePower))
+		sb.WriteString(fmt.Sprintf("sun2000_grid_phase_active_power{device=%q,model=%q,sn=%q,phase=\"C\",unit=\"kW\"} %3.3f\n", id.device, id.Model, id.SN, x.GridPhaseCActivePower))
+		sb.WriteString(fmt.Sprintf("sun2000_grid_total_active_power{device=%q,model=%q,sn=%q,unit=\"kW\"} %3.3f\n", id.device, id.Model, id.SN, pTotalActive))
 
-		sb.WriteString(fmt.Sprintf("sun2000_meter_model_detection_result{model=%q,sn=%q} %d\n", id.model, id.sn, x.meterModelDetectionResult))
+		sb.WriteString(fmt.Sprintf("sun2000_meter_model_detection_result{device=%q,model=%q,sn=%q} %d\n", id.device, id.Model, id.SN, x.MeterModelDetectionResult))
 
 	}
 	sb.WriteString("\n")
@@ -2323,126 +1930,19 @@ func (x *meterData) metricsString(id *identificationData) string {
 type esu1Data struct {
 	genericData
 
-	// 37000 U16 1
-	runningStatus esuRunningStatus
-	// 37001 I32 2 gain 1000 kW
-	chargeAndDischargePower float32 // > 0: charging < 0: discharging
-	// 37003 uint16 1 gain 10 V
-	busVoltage float32
-	// 37004 uint16 1 gain 10 %
-	batterySOC float32
-	// 37006 uint16 1
-	workingMode esuWorkingMode
-	// 37007 uint32 2 gain 1 W
-	ratedChargePower uint32
-	// 37009 uint32 2 gain 1 W
-	ratedDischargePower uint32
-	// 37014 uint16 1
-	faultID uint16
-	// 37015 uint32 2 gain 100 kWh
-	currentDayChargeCapacity float32
-	// 37017 uint32 2 gain 100 kWh
-	currentDayDischargeCapacity float32
-	// 37021 int16 1 gain 10 A
-	busCurrent float32
-	// 37022 int16 1
-	batteryTemperature float32
-	// 37025 uint16 1 mins
-	remainingChargeDischargeTime uint16
-	// 37026 string 10
-	dcdcVersion string
-	// 37036 string 10
-	bmsVersion string
-	// 37046 uint32 2 gain 1 W
-	maximumChargePower uint32
-	// 37048 uint32 2 gain 1 W
-	maximumDischargePower uint32
-	// 37052 string 10
-	sn string
-	// 37066 uint32 2 gain 100 kWh
-	totalCharge float32
-	// 37068 uint32 2 gain 100 kWh
-	totalDischarge float32
+	sun2000.ESU
 
 	pack [3]batteryData
 }
 
 func (x *esu1Data) parse(data []byte) (err error) {
-	size := 70
-	if len(data) < size {
-		return fmt.Errorf("data length %d < %d", len(data), size)
+	v, err := sun2000.DecodeESU1(data)
+	if err != nil {
+		return err
 	}
-
 	x.Lock()
 	defer x.Unlock()
-
-	var u16 uint16
-	var i16 int16
-	var i32 int32
-	var u32 uint32
-	var idx uint
-
-	u16, idx, _ = getU16(data, idx)
-	x.runningStatus = esuRunningStatus(u16)
-
-	i32, idx, _ = getI32(data, idx)
-	x.chargeAndDischargePower = float32(i32) / 1000
-
-	u16, idx, _ = getU16(data, idx)
-	x.busVoltage = float32(u16) / 10
-	u16, idx, _ = getU16(data, idx)
-	x.batterySOC = float32(u16) / 10
-
-	idx, _ = skipRecords(data, idx, 1)
-
-	u16, idx, _ = getU16(data, idx)
-	x.workingMode = esuWorkingMode(u16)
-
-	u32, idx, _ = getU32(data, idx)
-	x.ratedChargePower = u32
-	u32, idx, _ = getU32(data, idx)
-	x.ratedDischargePower = u32
-
-	idx, _ = skipRecords(data, idx, 3)
-
-	x.faultID, idx, _ = getU16(data, idx)
-
-	u32, idx, _ = getU32(data, idx)
-	x.currentDayChargeCapacity = float32(u32) / 100
-	u32, idx, _ = getU32(data, idx)
-	x.currentDayDischargeCapacity = float32(u32) / 100
-
-	idx, _ = skipRecords(data, idx, 2)
-
-	i16, idx, _ = getI16(data, idx)
-	x.busCurrent = float32(i16) / 10
-	i16, idx, _ = getI16(data, idx)
-	x.batteryTemperature = float32(i16) / 10
-
-	idx, _ = skipRecords(data, idx, 2)
-
-	u16, idx, _ = getU16(data, idx)
-	x.remainingChargeDischargeTime = u16
-
-	x.dcdcVersion, idx, _ = getSTR(data, idx, 10)
-	x.bmsVersion, idx, _ = getSTR(data, idx, 10)
-
-	u32, idx, _ = getU32(data, idx)
-	x.maximumChargePower = u32
-	u32, idx, _ = getU32(data, idx)
-	x.maximumDischargePower = u32
-
-	idx, _ = skipRecords(data, idx, 2)
-
-	x.sn, idx, _ = getSTR(data, idx, 10)
-
-	idx, _ = skipRecords(data, idx, 4)
-
-	u32, idx, _ = getU32(data, idx)
-	x.totalCharge = float32(u32) / 100
-	u32, _, _ = getU32(data, idx)
-	x.totalDischarge = float32(u32) / 100
-
+	x.ESU = v
 	return nil
 }
 
@@ -2456,70 +1956,70 @@ func (x *esu1Data) metricsString(id *identificationData) string {
 	sb.WriteString(fmt.Sprintf("# Next Read = %s\n", x.nextRead.Format(time.RFC3339)))
 	sb.WriteString("\n")
 
-	sb.WriteString(fmt.Sprintf("# SN                         = %q\n", x.sn))
-	sb.WriteString(fmt.Sprintf("# Running Status             = %d\t%s\n", x.runningStatus, x.runningStatus))
+	sb.WriteString(fmt.Sprintf("# SN                         = %q\n", x.SN))
+	sb.WriteString(fmt.Sprintf("# Running Status             = %d\t%s\n", x.RunningStatus, x.RunningStatus))
 	var txt string
-	if x.chargeAndDischargePower > 0 {
+	if x.ChargeAndDischargePower > 0 {
 		txt = "charging"
-	} else if x.chargeAndDischargePower < 0 {
+	} else if x.ChargeAndDischargePower < 0 {
 		txt = "discharging"
 	}
 
-	sb.WriteString(fmt.Sprintf("# Charge And Discharge Power = %6.3f kW %s\n", x.chargeAndDischargePower, txt))
-	sb.WriteString(fmt.Sprintf("# Bus Voltage                = %3.1f V\n", x.busVoltage))
-	sb.WriteString(fmt.Sprintf("# Bus Current                = %3.1f A\n", x.busCurrent))
-	sb.WriteString(fmt.Sprintf("# Battery SOC                = %3.1f %%\n", x.batterySOC))
-	sb.WriteString(fmt.Sprintf("# Remaining Charge Discharge Time = %d mins\n", x.remainingChargeDischargeTime))
-	sb.WriteString(fmt.Sprintf("# Battery Temperature        = %3.1f ℃\n", x.batteryTemperature))
+	sb.WriteString(fmt.Sprintf("# Charge And Discharge Power = %6.3f kW %s\n", x.ChargeAndDischargePower, txt))
+	sb.WriteString(fmt.Sprintf("# Bus Voltage                = %3.1f V\n", x.BusVoltage))
+	sb.WriteString(fmt.Sprintf("# Bus Current                = %3.1f A\n", x.BusCurrent))
+	sb.WriteString(fmt.Sprintf("# Battery SOC                = %3.1f %%\n", x.BatterySOC))
+	sb.WriteString(fmt.Sprintf("# Remaining Charge Discharge Time = %d mins\n", x.RemainingChargeDischargeTime))
+	sb.WriteString(fmt.Sprintf("# Battery Temperature        = %3.1f ℃\n", x.BatteryTemperature))
 	sb.WriteString("\n")
-	sb.WriteString(fmt.Sprintf("# Working Mode              = %d\t%s\n", x.workingMode, x.workingMode))
-	sb.WriteString(fmt.Sprintf("# Rated Charge Power        = %d W\n", x.ratedChargePower))
-	sb.WriteString(fmt.Sprintf("# Rated Discharge Power     = %d W\n", x.ratedDischargePower))
+	sb.WriteString(fmt.Sprintf("# Working Mode              = %d\t%s\n", x.WorkingMode, x.WorkingMode))
+	sb.WriteString(fmt.Sprintf("# Rated Charge Power        = %d W\n", x.RatedChargePower))
+	sb.WriteString(fmt.Sprintf("# Rated Discharge Power     = %d W\n", x.RatedDischargePower))
 	sb.WriteString("\n")
-	sb.WriteString(fmt.Sprintf("# Fault ID                  = %d\n", x.faultID))
+	sb.WriteString(fmt.Sprintf("# Fault ID                  = %d\n", x.FaultID))
 	sb.WriteString("\n")
-	sb.WriteString(fmt.Sprintf("# DCDC Version              = %q\n", x.dcdcVersion))
-	sb.WriteString(fmt.Sprintf("# BMS Version               = %q\n", x.bmsVersion))
-	sb.WriteString(fmt.Sprintf("# Maximum Charge Power      = %d W\n", x.maximumChargePower))
-	sb.WriteString(fmt.Sprintf("# Maximum Discharge Power   = %d W\n", x.maximumDischargePower))
+	sb.WriteString(fmt.Sprintf("# DCDC Version              = %q\n", x.DCDCVersion))
+	sb.WriteString(fmt.Sprintf("# BMS Version               = %q\n", x.BMSVersion))
+	sb.WriteString(fmt.Sprintf("# Maximum Charge Power      = %d W\n", x.MaximumChargePower))
+	sb.WriteString(fmt.Sprintf("# Maximum Discharge Power   = %d W\n", x.MaximumDischargePower))
 	sb.WriteString("\n")
-	sb.WriteString(fmt.Sprintf("# Current Day Charge Capacity     = %6.2f kWh\n", x.currentDayChargeCapacity))
-	sb.WriteString(fmt.Sprintf("# Current Day Discharge Capacity  = %6.2f kWh\n", x.currentDayDischargeCapacity))
-	sb.WriteString(fmt.Sprintf("# Total Charge              = %6.2f kWh\n", x.totalCharge))
-	sb.WriteString(fmt.Sprintf("# Total Discharge           = %6.2f kWh\n", x.totalDischarge))
+	sb.WriteString(fmt.Sprintf("# Current Day Charge Capacity     = %6.2f kWh\n", x.CurrentDayChargeCapacity))
+	sb.WriteString(fmt.Sprintf("# Current Day Discharge Capacity  = %6.2f kWh\n", x.CurrentDayDischargeCapacity))
+	sb.WriteString(fmt.Sprintf("# Total Charge              = %6.2f kWh\n", x.TotalCharge))
+	sb.WriteString(fmt.Sprintf("# Total Discharge           = %6.2f kWh\n", x.TotalDischarge))
 	sb.WriteString("\n")
 
 	// skip metrics if the data is empty
-	if x.lastRead.IsZero() || id.lastRead.IsZero() || len(x.sn) == 0 {
+	if x.lastRead.IsZero() || id.lastRead.IsZero() || len(x.SN) == 0 {
 		sb.WriteString("# No battery ESU1 or identification data read yet\n")
 	} else {
 		id.RLock()
 		defer id.RUnlock()
 
-		tags := fmt.Sprintf("model=%q,sn=%q,esu=\"1\",esu_sn=%q", id.model, id.sn, x.sn)
+		tags := fmt.Sprintf("device=%q,model=%q,sn=%q,esu=\"1\",esu_sn=%q", id.device, id.Model, id.SN, x.SN)
 
-		sb.WriteString(fmt.Sprintf("sun2000_ess_running_status{%s} %d\n", tags, x.runningStatus))
-		sb.WriteString(fmt.Sprintf("sun2000_ess_charge_and_discharge_power{%s,unit=\"kW\"} %6.3f\n", tags, x.chargeAndDischargePower))
-		sb.WriteString(fmt.Sprintf("sun2000_ess_bus_voltage{%s,unit=\"V\"} %3.1f\n", tags, x.busVoltage))
-		sb.WriteString(fmt.Sprintf("sun2000_ess_bus_current{%s,unit=\"A\"} %3.1f\n", tags, x.busCurrent))
-		sb.WriteString(fmt.Sprintf("sun2000_ess_soc{%s,unit=\"%%\"} %3.1f\n", tags, x.batterySOC))
-		sb.WriteString(fmt.Sprintf("sun2000_ess_remaining_charge_discharge_time{%s,unit=\"mins\"} %d\n", tags, x.remainingChargeDischargeTime))
-		sb.WriteString(fmt.Sprintf("sun2000_ess_temperature{%s,unit=\"℃\"} %3.1f\n", tags, x.batteryTemperature))
-		sb.WriteString(fmt.Sprintf("sun2000_ess_working_mode{%s} %d\n", tags, x.workingMode))
-		sb.WriteString(fmt.Sprintf("sun2000_ess_rated_charge_power{%s,unit=\"W\"} %d\n", tags, x.ratedChargePower))
-		sb.WriteString(fmt.Sprintf("sun2000_ess_rated_discharge_power{%s,unit=\"W\"} %d\n", tags, x.ratedDischargePower))
-		sb.WriteString(fmt.Sprintf("sun2000_ess_fault_id{%s} %d\n", tags, x.faultID))
-		sb.WriteString(fmt.Sprintf("sun2000_ess_maximum_charge_power{%s,unit=\"W\"} %d\n", tags, x.maximumChargePower))
-		sb.WriteString(fmt.Sprintf("sun2000_ess_maximum_discharge_power{%s,unit=\"W\"} %d\n", tags, x.maximumDischargePower))
-		sb.WriteString(fmt.Sprintf("sun2000_ess_current_day_charge_capacity{%s,unit=\"kWh\"} %6.2f\n", tags, x.currentDayChargeCapacity))
-		sb.WriteString(fmt.Sprintf("sun2000_ess_current_day_discharge_capacity{%s,unit=\"kWh\"} %6.2f\n", tags, x.currentDayDischargeCapacity))
-		sb.WriteString(fmt.Sprintf("sun2000_ess_total_charge{%s,unit=\"kWh\"} %6.2f\n", tags, x.totalCharge))
-		sb.WriteString(fmt.Sprintf("sun2000_ess_total_discharge{%s,unit=\"kWh\"} %6.2f\n", tags, x.totalDischarge))
+		sb.WriteString(fmt.Sprintf("sun2000_ess_running_status{%s} %d\n", tags, x.RunningStatus))
+		sb.WriteString(fmt.Sprintf("sun2000_ess_charge_and_discharge_power{%s,unit=\"kW\"} %6.3f\n", tags, x.ChargeAndDischargePower))
+		sb.WriteString(fmt.Sprintf("sun2000_ess_bus_voltage{%s,unit=\"V\"} %3.1f\n", tags, x.BusVoltage))
+		sb.WriteString(fmt.Sprintf("sun2000_ess_bus_current{%s,unit=\"A\"} %3.1f\n", tags, x.BusCurrent))
+		sb.WriteString(fmt.Sprintf("sun2000_ess_soc{%s,unit=\"%%\"} %3.1f\n", tags, x.BatterySOC))
+		sb.WriteString(fmt.Sprintf("sun2000_ess_remaining_charge_discharge_time{%s,unit=\"mins\"} %d\n", tags, x.RemainingChargeDischargeTime))
+		sb.WriteString(fmt.Sprintf("sun2000_ess_temperature{%s,unit=\"℃\"} %3.1f\n", tags, x.BatteryTemperature))
+		sb.WriteString(fmt.Sprintf("sun2000_ess_working_mode{%s} %d\n", tags, x.WorkingMode))
+		sb.WriteString(fmt.Sprintf("sun2000_ess_rated_charge_power{%s,unit=\"W\"} %d\n", tags, x.RatedChargePower))
+		sb.WriteString(fmt.Sprintf("sun2000_ess_rated_discharge_power{%s,unit=\"W\"} %d\n", tags, x.RatedDischargePower))
+		sb.WriteString(fmt.Sprintf("sun2000_ess_fault_id{%s} %d\n", tags, x.FaultID))
+		sb.WriteString(fmt.Sprintf("sun2000_ess_maximum_charge_power{%s,unit=\"W\"} %d\n", tags, x.MaximumChargePower))
+		sb.WriteString(fmt.Sprintf("sun2000_ess_maximum_discharge_power{%s,unit=\"W\"} %d\n", tags, x.MaximumDischargePower))
+		sb.WriteString(fmt.Sprintf("sun2000_ess_current_day_charge_capacity{%s,unit=\"kWh\"} %6.2f\n", tags, x.CurrentDayChargeCapacity))
+		sb.WriteString(fmt.Sprintf("sun2000_ess_current_day_discharge_capacity{%s,unit=\"kWh\"} %6.2f\n", tags, x.CurrentDayDischargeCapacity))
+		sb.WriteString(fmt.Sprintf("sun2000_ess_total_charge{%s,unit=\"kWh\"} %6.2f\n", tags, x.TotalCharge))
+		sb.WriteString(fmt.Sprintf("sun2000_ess_total_discharge{%s,unit=\"kWh\"} %6.2f\n", tags, x.TotalDischarge))
 	}
 	sb.WriteString("\n")
 
 	for i := range x.pack {
-		if len(x.pack[i].sn) != 0 {
+		if len(x.pack[i].SN) != 0 {
 			sb.WriteString(x.pack[i].metricsString(id))
 		}
 	}
@@ -2527,136 +2027,22 @@ func (x *esu1Data) metricsString(id *identificationData) string {
 	return sb.String()
 }
 
-type esuRunningStatus uint16
-
-func (x esuRunningStatus) String() string {
-	switch x {
-	case 0:
-		return "offline"
-	case 1:
-		return "stand-by"
-	case 2:
-		return "running"
-	case 3:
-		return "fault"
-	case 4:
-		return "sleep mode"
-	default:
-		return ""
-	}
-}
-
-type esuWorkingMode uint16
-
-func (x esuWorkingMode) String() string {
-	switch x {
-	case 0:
-		return "none"
-	case 1:
-		return "Forcible charge/discharge"
-	case 2:
-		return "Time of Use(LG)"
-	case 3:
-		return "Fixed charge/discharge"
-	case 4:
-		return "Maximise selfconsumption"
-	case 5:
-		return "Fully fed to grid"
-	case 6:
-		return "Time of Use(LUNA2000)"
-	case 7:
-		return "remote scheduling maximum self-use"
-	case 8:
-		return "remote scheduling - full Internet access"
-	case 9:
-		return "remote scheduling - TOU"
-	case 10:
-		return "AI energy management and scheduling"
-	default:
-		return ""
-	}
-}
-
 type esu2Data struct {
 	genericData
 
-	// 37700 STR 10
-	sn string
-	// 37738 U16 1 gain 10 %
-	batterySOC float32
-	// 37741 U16 1
-	runningStatus esuRunningStatus
-	// 37743 I32 2 gain 1 W
-	chargeAndDischargePower float32 // > 0: charging < 0: discharging
-	// 37746 U32 2 gain 100 kWh
-	currentDayChargeCapacity float32
-	// 37748 U32 2 gain 100 kWh
-	currentDayDischargeCapacity float32
-	// 37750 U16 1 gain 10 V
-	busVoltage float32
-	// 37751 I16 1 gain 10 A
-	busCurrent float32
-	// 37752 I16 1
-	batteryTemperature float32
-	// 37753 U32 2 gain 100 kWh
-	totalCharge float32
-	// 37755 U32 2 gain 100 kWh
-	totalDischarge float32
+	sun2000.ESU
 
 	pack [3]batteryData
 }
 
 func (x *esu2Data) parse(data []byte) (err error) {
-	size := 57
-	if len(data) < size {
-		return fmt.Errorf("data length %d < %d", len(data), size)
+	v, err := sun2000.DecodeESU2(data)
+	if err != nil {
+		return err
 	}
-
 	x.Lock()
 	defer x.Unlock()
-
-	var u16 uint16
-	var i16 int16
-	var i32 int32
-	var u32 uint32
-	var idx uint
-
-	x.sn, idx, _ = getSTR(data, idx, 10)
-
-	idx, _ = skipRecords(data, idx, 28)
-
-	u16, idx, _ = getU16(data, idx)
-	x.batterySOC = float32(u16) / 10
-
-	idx, _ = skipRecords(data, idx, 2)
-
-	u16, idx, _ = getU16(data, idx)
-	x.runningStatus = esuRunningStatus(u16)
-
-	idx, _ = skipRecords(data, idx, 1)
-
-	i32, idx, _ = getI32(data, idx)
-	x.chargeAndDischargePower = float32(i32)
-
-	idx, _ = skipRecords(data, idx, 1)
-
-	u32, idx, _ = getU32(data, idx)
-	x.currentDayChargeCapacity = float32(u32) / 100
-	u32, idx, _ = getU32(data, idx)
-	x.currentDayDischargeCapacity = float32(u32) / 100
-
-	u16, idx, _ = getU16(data, idx)
-	x.busVoltage = float32(u16) / 10
-	i16, idx, _ = getI16(data, idx)
-	x.busCurrent = float32(i16) / 10
-	i16, idx, _ = getI16(data, idx)
-	x.batteryTemperature = float32(i16) / 10
-
-	u32, idx, _ = getU32(data, idx)
-	x.totalCharge = float32(u32) / 100
-	u32, _, _ = getU32(data, idx)
-	x.totalDischarge = float32(u32) / 100
-
+	x.ESU = v
 	return nil
 }
 
@@ -2670,50 +2056,50 @@ func (x *esu2Data) metricsString(id *identificationData) string {
 	sb.WriteString(fmt.Sprintf("# Next Read = %s\n", x.nextRead.Format(time.RFC3339)))
 	sb.WriteString("\n")
 
-	sb.WriteString(fmt.Sprintf("# SN                         = %q\n", x.sn))
-	sb.WriteString(fmt.Sprintf("# Running Status             = %d\t%s\n", x.runningStatus, x.runningStatus))
+	sb.WriteString(fmt.Sprintf("# SN                         = %q\n", x.SN))
+	sb.WriteString(fmt.Sprintf("# Running Status             = %d\t%s\n", x.RunningStatus, x.RunningStatus))
 	var txt string
-	if x.chargeAndDischargePower > 0 {
+	if x.ChargeAndDischargePower > 0 {
 		txt = "charging"
-	} else if x.chargeAndDischargePower < 0 {
+	} else if x.ChargeAndDischargePower < 0 {
 		txt = "discharging"
 	}
-	sb.WriteString(fmt.Sprintf("# Charge And Discharge Power = %6.3f kW %s\n", x.chargeAndDischargePower, txt))
-	sb.WriteString(fmt.Sprintf("# Bus Voltage                = %3.1f V\n", x.busVoltage))
-	sb.WriteString(fmt.Sprintf("# Bus Current                = %3.1f A\n", x.busCurrent))
-	sb.WriteString(fmt.Sprintf("# Battery SOC                = %3.1f %%\n", x.batterySOC))
-	sb.WriteString(fmt.Sprintf("# Battery Temperature        = %3.1f ℃\n", x.batteryTemperature))
+	sb.WriteString(fmt.Sprintf("# Charge And Discharge Power = %6.3f kW %s\n", x.ChargeAndDischargePower, txt))
+	sb.WriteString(fmt.Sprintf("# Bus Voltage                = %3.1f V\n", x.BusVoltage))
+	sb.WriteString(fmt.Sprintf("# Bus Current                = %3.1f A\n", x.BusCurrent))
+	sb.WriteString(fmt.Sprintf("# Battery SOC                = %3.1f %%\n", x.BatterySOC))
+	sb.WriteString(fmt.Sprintf("# Battery Temperature        = %3.1f ℃\n", x.BatteryTemperature))
 	sb.WriteString("\n")
-	sb.WriteString(fmt.Sprintf("# Current Day Charge Capacity     = %6.2f kWh\n", x.currentDayChargeCapacity))
-	sb.WriteString(fmt.Sprintf("# Current Day Discharge Capacity  = %6.2f kWh\n", x.currentDayDischargeCapacity))
-	sb.WriteString(fmt.Sprintf("# Total Charge                    = %6.2f kWh\n", x.totalCharge))
-	sb.WriteString(fmt.Sprintf("# Total Discharge                 = %6.2f kWh\n", x.totalDischarge))
+	sb.WriteString(fmt.Sprintf("# Current Day Charge Capacity     = %6.2f kWh\n", x.CurrentDayChargeCapacity))
+	sb.WriteString(fmt.Sprintf("# Current Day Discharge Capacity  = %6.2f kWh\n", x.CurrentDayDischargeCapacity))
+	sb.WriteString(fmt.Sprintf("# Total Charge                    = %6.2f kWh\n", x.TotalCharge))
+	sb.WriteString(fmt.Sprintf("# Total Discharge                 = %6.2f kWh\n", x.TotalDischarge))
 	sb.WriteString("\n")
 
 	// skip metrics if the data is empty
-	if x.lastRead.IsZero() || id.lastRead.IsZero() || len(x.sn) == 0 {
+	if x.lastRead.IsZero() || id.lastRead.IsZero() || len(x.SN) == 0 {
 		sb.WriteString("# No battery ESU2 or identification data read yet\n")
 	} else {
 		id.RLock()
 		defer id.RUnlock()
 
-		tags := fmt.Sprintf("model=%q,sn=%q,esu=\"2\",esu_sn=%q", id.model, id.sn, x.sn)
+		tags := fmt.Sprintf("device=%q,model=%q,sn=%q,esu=\"2\",esu_sn=%q", id.device, id.Model, id.SN, x.SN)
 
-		sb.WriteString(fmt.Sprintf("sun2000_ess_running_status{%s} %d\n", tags, x.runningStatus))
-		sb.WriteString(fmt.Sprintf("sun2000_ess_charge_and_discharge_power{%s,unit=\"kW\"} %6.3f\n", tags, x.chargeAndDischargePower))
-		sb.WriteString(fmt.Sprintf("sun2000_ess_bus_voltage{%s,unit=\"V\"} %3.1f\n", tags, x.busVoltage))
-		sb.WriteString(fmt.Sprintf("sun2000_ess_bus_current{%s,unit=\"A\"} %3.1f\n", tags, x.busCurrent))
-		sb.WriteString(fmt.Sprintf("sun2000_ess_soc{%s,unit=\"%%\"} %3.1f\n", tags, x.batterySOC))
-		sb.WriteString(fmt.Sprintf("sun2000_ess_temperature{%s,unit=\"℃\"} %3.1f\n", tags, x.batteryTemperature))
-		sb.WriteString(fmt.Sprintf("sun2000_ess_current_day_charge_capacity{%s,unit=\"kWh\"} %6.2f\n", tags, x.currentDayChargeCapacity))
-		sb.WriteString(fmt.Sprintf("sun2000_ess_current_day_discharge_capacity{%s,unit=\"kWh\"} %6.2f\n", tags, x.currentDayDischargeCapacity))
-		sb.WriteString(fmt.Sprintf("sun2000_ess_total_charge{%s,unit=\"kWh\"} %6.2f\n", tags, x.totalCharge))
-		sb.WriteString(fmt.Sprintf("sun2000_ess_total_discharge{%s,unit=\"kWh\"} %6.2f\n", tags, x.totalDischarge))
+		sb.WriteString(fmt.Sprintf("sun2000_ess_running_status{%s} %d\n", tags, x.RunningStatus))
+		sb.WriteString(fmt.Sprintf("sun2000_ess_charge_and_discharge_power{%s,unit=\"kW\"} %6.3f\n", tags, x.ChargeAndDischargePower))
+		sb.WriteString(fmt.Sprintf("sun2000_ess_bus_voltage{%s,unit=\"V\"} %3.1f\n", tags, x.BusVoltage))
+		sb.WriteString(fmt.Sprintf("sun2000_ess_bus_current{%s,unit=\"A\"} %3.1f\n", tags, x.BusCurrent))
+		sb.WriteString(fmt.Sprintf("sun2000_ess_soc{%s,unit=\"%%\"} %3.1f\n", tags, x.BatterySOC))
+		sb.WriteString(fmt.Sprintf("sun2000_ess_temperature{%s,unit=\"℃\"} %3.1f\n", tags, x.BatteryTemperature))
+		sb.WriteString(fmt.Sprintf("sun2000_ess_current_day_charge_capacity{%s,unit=\"kWh\"} %6.2f\n", tags, x.CurrentDayChargeCapacity))
+		sb.WriteString(fmt.Sprintf("sun2000_ess_current_day_discharge_capacity{%s,unit=\"kWh\"} %6.2f\n", tags, x.CurrentDayDischargeCapacity))
+		sb.WriteString(fmt.Sprintf("sun2000_ess_total_charge{%s,unit=\"kWh\"} %6.2f\n", tags, x.TotalCharge))
+		sb.WriteString(fmt.Sprintf("sun2000_ess_total_discharge{%s,unit=\"kWh\"} %6.2f\n", tags, x.TotalDischarge))
 	}
 	sb.WriteString("\n")
 
 	for i := range x.pack {
-		if len(x.pack[i].sn) != 0 {
+		if len(x.pack[i].SN) != 0 {
 			sb.WriteString(x.pack[i].metricsString(id))
 		}
 	}
@@ -2724,82 +2110,37 @@ func (x *esu2Data) metricsString(id *identificationData) string {
 type batteryData struct {
 	genericData
 
-	esuId int
-	id    int
-
-	// 38200 STR 10
-	sn string
-	// 38210 STR 15
-	firmwareVersion string
-	// 38228 U16 1
-	workingStatus uint16
-	// 38229 U16 1 gain 10 %
-	soc float32
-	// 38233 I32 2 gain 1000 kW
-	chargeDischargePower float32 // > 0: charging < 0: discharging
-	// 38235 U16 1 gain 10 V
-	voltage float32
-	// 38236 I16 1 gain 10 A
-	current float32
-	// 38238 U32 2 gain 100 kWh
-	totalCharge float32
-	// 38240 U32 2 gain 100 kWh
-	totalDischarge float32
+	parent *sun2000DataStruct
+	esuId  int
+	id     int
+
+	sun2000.BatteryPack
 }
 
 func (x *batteryData) parse(data []byte) (err error) {
-	size := 45
-	if len(data) < size {
-		return fmt.Errorf("data length %d < %d", len(data), size)
+	v, err := sun2000.DecodeBatteryPack(data)
+	if err != nil {
+		return err
 	}
-
 	x.Lock()
 	defer x.Unlock()
-
-	var u16 uint16
-	var i16 int16
-	var i32 int32
-	var u32 uint32
-
-	var idx uint
-
-	x.sn, idx, _ = getSTR(data, idx, 10)
-	x.firmwareVersion, idx, _ = getSTR(data, idx, 15)
-
-	idx, _ = skipRecords(data, idx, 3)
-
-	u16, idx, _ = getU16(data, idx)
-	x.workingStatus = u16
-
-	u16, idx, _ = getU16(data, idx)
-	x.soc = float32(u16) / 10
-
-	idx, _ = skipRecords(data, idx, 3)
-
-	i32, idx, _ = getI32(data, idx)
-	x.chargeDischargePower = float32(i32) / 1000
-
-	u16, idx, _ = getU16(data, idx)
-	x.voltage = float32(u16) / 10
-	i16, idx, _ = getI16(data, idx)
-	x.current = float32(i16) / 10
-
-	idx, _ = skipRecords(data, idx, 1)
-
-	u32, idx, _ = getU32(data, idx)
-	x.totalCharge = float32(u32) / 100
-	u32, _, _ = getU32(data, idx)
-	x.totalDischarge = float32(u32) / 100
-
+	x.BatteryPack = v
 	return nil
 }
 
-func getESUSN(esuId int) (out string) {
+// isPresent tells if the pack was read, and is there - the registers of missing packs are all zeroes.
+func (x *batteryData) isPresent() bool {
+	x.RLock()
+	defer x.RUnlock()
+	return !x.lastRead.IsZero() && len(x.SN) > 0
+}
+
+func (x *sun2000DataStruct) getESUSN(esuId int) (out string) {
 	switch esuId {
 	case 1:
-		return parsedData.esu1.sn
+		return x.esu1.SN
 	case 2:
-		return parsedData.esu2.sn
+		return x.esu2.SN
 	default:
 		return ""
 	}
@@ -2811,40 +2152,40 @@ func (x *batteryData) metricsString(id *identificationData) string {
 	defer x.RUnlock()
 	sb.WriteString(fmt.Sprintf("# ESU %d / Pack %d\n", x.esuId, x.id))
 	sb.WriteString("\n")
-	sb.WriteString(fmt.Sprintf("# SN                         = %q\n", x.sn))
-	sb.WriteString(fmt.Sprintf("# Firmware Version           = %q\n", x.firmwareVersion))
-	sb.WriteString(fmt.Sprintf("# Working Status             = %d\n", x.workingStatus))
+	sb.WriteString(fmt.Sprintf("# SN                         = %q\n", x.SN))
+	sb.WriteString(fmt.Sprintf("# Firmware Version           = %q\n", x.FirmwareVersion))
+	sb.WriteString(fmt.Sprintf("# Working Status             = %d\n", x.WorkingStatus))
 	var txt string
-	if x.chargeDischargePower > 0 {
+	if x.ChargeDischargePower > 0 {
 		txt = "charging"
-	} else if x.chargeDischargePower < 0 {
+	} else if x.ChargeDischargePower < 0 {
 		txt = "discharging"
 	}
-	sb.WriteString(fmt.Sprintf("# Charge And Discharge Power = %6.3f kW %s\n", x.chargeDischargePower, txt))
-	sb.WriteString(fmt.Sprintf("# Voltage                    = %3.1f V\n", x.voltage))
-	sb.WriteString(fmt.Sprintf("# Current                    = %3.1f A\n", x.current))
-	sb.WriteString(fmt.Sprintf("# SOC                        = %3.1f %%\n", x.soc))
-	sb.WriteString(fmt.Sprintf("# Total Charge               = %6.2f kWh\n", x.totalCharge))
-	sb.WriteString(fmt.Sprintf("# Total Discharge            = %6.2f kWh\n", x.totalDischarge))
+	sb.WriteString(fmt.Sprintf("# Charge And Discharge Power = %6.3f kW %s\n", x.ChargeDischargePower, txt))
+	sb.WriteString(fmt.Sprintf("# Voltage                    = %3.1f V\n", x.Voltage))
+	sb.WriteString(fmt.Sprintf("# Current                    = %3.1f A\n", x.Current))
+	sb.WriteString(fmt.Sprintf("# SOC                        = %3.1f %%\n", x.SOC))
+	sb.WriteString(fmt.Sprintf("# Total Charge               = %6.2f kWh\n", x.TotalCharge))
+	sb.WriteString(fmt.Sprintf("# Total Discharge            = %6.2f kWh\n", x.TotalDischarge))
 	sb.WriteString("\n")
 
 	// skip metrics if the data is empty
-	if x.lastRead.IsZero() || id.lastRead.IsZero() || len(x.sn) == 0 {
+	if x.lastRead.IsZero() || id.lastRead.IsZero() || len(x.SN) == 0 {
 		sb.WriteString(fmt.Sprintf("# No battery ESU%d/Pack%d or identification data read yet\n", x.esuId, x.id))
 	} else {
 		id.RLock()
 		defer id.RUnlock()
 
-		esuSN := getESUSN(x.esuId)
-		tags := fmt.Sprintf("model=%q,sn=%q,esu=\"%d\",esu_sn=%q,pack=\"%d\",pack_sn=%q", id.model, id.sn, x.esuId, esuSN, x.id, x.sn)
+		esuSN := x.parent.getESUSN(x.esuId)
+		tags := fmt.Sprintf("device=%q,model=%q,sn=%q,esu=\"%d\",esu_sn=%q,pack=\"%d\",pack_sn=%q", id.device, id.Model, id.SN, x.esuId, esuSN, x.id, x.SN)
 
-		sb.WriteString(fmt.Sprintf("sun2000_ess_pack_working_status{%s} %d\n", tags, x.workingStatus))
-		sb.WriteString(fmt.Sprintf("sun2000_ess_pack_charge_and_discharge_power{%s,unit=\"kW\"} %6.3f\n", tags, x.chargeDischargePower))
-		sb.WriteString(fmt.Sprintf("sun2000_ess_pack_voltage{%s,unit=\"V\"} %3.1f\n", tags, x.voltage))
-		sb.WriteString(fmt.Sprintf("sun2000_ess_pack_current{%s,unit=\"A\"} %3.1f\n", tags, x.current))
-		sb.WriteString(fmt.Sprintf("sun2000_ess_pack_soc{%s,unit=\"%%\"} %3.1f\n", tags, x.soc))
-		sb.WriteString(fmt.Sprintf("sun2000_ess_pack_total_charge{%s,unit=\"kWh\"} %6.2f\n", tags, x.totalCharge))
-		sb.WriteString(fmt.Sprintf("sun2000_ess_pack_total_discharge{%s,unit=\"kWh\"} %6.2f\n", tags, x.totalDischarge))
+		sb.WriteString(fmt.Sprintf("sun2000_ess_pack_working_status{%s} %d\n", tags, x.WorkingStatus))
+		sb.WriteString(fmt.Sprintf("sun2000_ess_pack_charge_and_discharge_power{%s,unit=\"kW\"} %6.3f\n", tags, x.ChargeDischargePower))
+		sb.WriteString(fmt.Sprintf("sun2000_ess_pack_voltage{%s,unit=\"V\"} %3.1f\n", tags, x.Voltage))
+		sb.WriteString(fmt.Sprintf("sun2000_ess_pack_current{%s,unit=\"A\"} %3.1f\n", tags, x.Current))
+		sb.WriteString(fmt.Sprintf("sun2000_ess_pack_soc{%s,unit=\"%%\"} %3.1f\n", tags, x.SOC))
+		sb.WriteString(fmt.Sprintf("sun2000_ess_pack_total_charge{%s,unit=\"kWh\"} %6.2f\n", tags, x.TotalCharge))
+		sb.WriteString(fmt.Sprintf("sun2000_ess_pack_total_discharge{%s,unit=\"kWh\"} %6.2f\n", tags, x.TotalDischarge))
 	}
 	sb.WriteString("\n")
 
@@ -2854,6 +2195,8 @@ func (x *batteryData) metricsString(id *identificationData) string {
 type esuTemperaturesData struct {
 	genericData
 
+	parent *sun2000DataStruct
+
 	esu [2]struct {
 		pack [3]struct {
 			// 38452 INT16 1 gain 10 ℃
@@ -2878,9 +2221,9 @@ func (x *esuTemperaturesData) parse(data []byte) (err error) {
 
 	for i := 0; i < 2; i++ {
 		for j := 0; j < 3; j++ {
-			i16, idx, _ = getI16(data, idx)
+			i16, idx, _ = sun2000.GetI16(data, idx)
 			x.esu[i].pack[j].maxTemperature = float32(i16) / 10
-			i16, idx, _ = getI16(data, idx)
+			i16, idx, _ = sun2000.GetI16(data, idx)
 			x.esu[i].pack[j].minTemperature = float32(i16) / 10
 		}
 	}
@@ -2899,13 +2242,13 @@ func (x *esuTemperaturesData) metricsString(id *identificationData) string {
 	sb.WriteString("\n")
 
 	for i := 0; i < 2; i++ {
-		esuSN := getESUSN(i + 1)
+		esuSN := x.parent.getESUSN(i + 1)
 		if len(esuSN) == 0 {
 			continue
 		}
 		for j := 0; j < 3; j++ {
-			if (i == 0 && len(parsedData.esu1.pack[j].sn) > 0) ||
-				(i == 1 && len(parsedData.esu2.pack[j].sn) > 0) {
+			if (i == 0 && len(x.parent.esu1.pack[j].SN) > 0) ||
+				(i == 1 && len(x.parent.esu2.pack[j].SN) > 0) {
 				sb.WriteString(fmt.Sprintf("# ESU %d / Pack %d\n", i+1, j+1))
 				sb.WriteString(fmt.Sprintf("# Max Temperature = %3.1f ℃\n", x.esu[i].pack[j].maxTemperature))
 				sb.WriteString(fmt.Sprintf("# Min Temperature = %3.1f ℃\n", x.esu[i].pack[j].minTemperature))
@@ -2923,7 +2266,7 @@ func (x *esuTemperaturesData) metricsString(id *identificationData) string {
 
 		for i := 0; i < 2; i++ {
 
-			esuSN := getESUSN(i + 1)
+			esuSN := x.parent.getESUSN(i + 1)
 			if len(esuSN) == 0 {
 				continue
 			}
@@ -2931,14 +2274,14 @@ func (x *esuTemperaturesData) metricsString(id *identificationData) string {
 				var pack *batteryData
 				switch i {
 				case 0:
-					pack = &parsedData.esu1.pack[j]
+					pack = &x.parent.esu1.pack[j]
 				case 1:
-					pack = &parsedData.esu2.pack[j]
+					pack = &x.parent.esu2.pack[j]
 				}
-				if len(pack.sn) == 0 {
+				if len(pack.SN) == 0 {
 					continue
 				}
-				tags := fmt.Sprintf("model=%q,sn=%q,esu=\"%d\",esu_sn=%q,pack=\"%d\",pack_sn=%q", id.model, id.sn, i+1, esuSN, j+1, pack.sn)
+				tags := fmt.Sprintf("device=%q,model=%q,sn=%q,esu=\"%d\",esu_sn=%q,pack=\"%d\",pack_sn=%q", id.device, id.Model, id.SN, i+1, esuSN, j+1, pack.SN)
 
 				sb.WriteString(fmt.Sprintf("sun2000_ess_pack_max_temperature{%s,unit=\"℃\"} %3.1f\n", tags, x.esu[i].pack[j].maxTemperature))
 				sb.WriteString(fmt.Sprintf("sun2000_ess_pack_min_temperature{%s,unit=\"℃\"} %3.1f\n", tags, x.esu[i].pack[j].minTemperature))
@@ -0,0 +1,228 @@
+// Copyright: 2024 Dragos Vingarzan vingarzan -at- gmail -dot- com
+// License: AGPL-3.0
+//
+// This file is part of sun2000-modbus.
+//
+// sun2000-modbus is free software: you can redistribute it and/or modify it under the terms of the GNU Affero General
+// Public License Version 3 (AGPL-3.0) as published by the Free Software Foundation.
+//
+// sun2000-modbus is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY; without even the implied
+// warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the AGPL-3.0 along with sun2000-modbus. If not,
+// see <https://www.gnu.org/licenses/>.
+package main
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// modbusConnection is one transport towards the inverters - a Modbus TCP session to the SDongle/inverter, or a serial
+// port for Modbus RTU. It is shared by all the devices behind it (e.g. the cascaded inverters with different slave IDs
+// behind the same SDongle), since the SDongle accepts only a few clients. The mutex serializes the requests.
+type modbusConnection struct {
+	sync.Mutex
+	name string
+	// the config of the first device using this connection, used to (re)open it
+	dc *deviceConfig
+
+	// nil while closed
+	client modbusTransport
+	// decides when to reopen the connection, after errors
+	sup *connSupervisor
+}
+
+// open (re)opens the connection. Caller must NOT hold the mutex.
+func (c *modbusConnection) open() (err error) {
+	c.Lock()
+	defer c.Unlock()
+	if c.client != nil {
+		c.client.Close()
+	}
+	c.client, err = initModbus(c.dc)
+	if err != nil {
+		c.sup.failed()
+		return err
+	}
+	c.sup.connected(false)
+	return nil
+}
+
+// close closes the connection. Caller must NOT hold the mutex.
+func (c *modbusConnection) close() {
+	c.Lock()
+	defer c.Unlock()
+	if c.client != nil {
+		c.client.Close()
+	}
+	c.client = nil
+}
+
+func (c *modbusConnection) isOpen() bool {
+	c.Lock()
+	defer c.Unlock()
+	return c.client != nil
+}
+
+// reset closes the broken connection, to be reopened by the poller after the backoff, which it returns. Caller must
+// NOT hold the mutex.
+func (c *modbusConnection) reset() time.Duration {
+	c.close()
+	return c.sup.failed()
+}
+
+// ensureOpen reopens the connection if it was closed, and the supervisor allows it. Caller must NOT hold the mutex.
+func (c *modbusConnection) ensureOpen() (reopened bool, err error) {
+	c.Lock()
+	defer c.Unlock()
+	if c.client != nil {
+		return false, nil
+	}
+	ok, state, retryAt := c.sup.mayConnect()
+	if !ok {
+		return false, fmt.Errorf("modbus connection %s is %s until %s", c.name, state, retryAt.Format(time.RFC3339))
+	}
+	lInfo.Printf("Reopening the modbus connection %s", c.name)
+	c.client, err = initModbus(c.dc)
+	if err != nil {
+		wait := c.sup.failed()
+		return false, fmt.Errorf("%w, retrying in %s", err, wait.Round(time.Second))
+	}
+	c.sup.connected(true)
+	return true, nil
+}
+
+// device is one inverter (slave ID) that we poll, with its own data and read schedule.
+type device struct {
+	name    string
+	slaveID byte
+	conn    *modbusConnection
+
+	data       sun2000DataStruct
+	addrRanges []modbusInterval
+	// the hardware found at startup, deciding which of the ranges are polled
+	caps capabilities
+
+	// written by the poller, and read by the HTTP handlers
+	statsMutex sync.Mutex
+	stats      readStats
+}
+
+// readStats counts the Modbus reads of a device.
+type readStats struct {
+	lastSuccessTime   time.Time
+	errorCount        uint
+	totalErrorCount   uint
+	totalSuccessCount uint
+}
+
+func (d *device) getStats() readStats {
+	d.statsMutex.Lock()
+	defer d.statsMutex.Unlock()
+	return d.stats
+}
+
+// newDevices creates the devices from the configuration, sharing the connections to the same endpoints.
+func newDevices(dcs []deviceConfig) (out []*device) {
+	connections := make(map[string]*modbusConnection)
+	for i := range dcs {
+		dc := &dcs[i]
+		var key string
+		switch cfg.modbusMode {
+		case "rtu":
+			key = "rtu://" + cfg.serialDevice
+		case "replay":
+			key = "replay://" + cfg.replayFile
+		default:
+			key = fmt.Sprintf("tcp://%s:%d", dc.ip, dc.port)
+		}
+		conn, ok := connections[key]
+		if !ok {
+			conn = &modbusConnection{name: key, dc: dc, sup: newConnSupervisor(cfg.supervisor)}
+			connections[key] = conn
+		}
+
+		d := &device{
+			name:    dc.name,
+			slaveID: dc.slaveID,
+			conn:    conn,
+		}
+		d.data.init(d.name)
+		d.addrRanges = newModbusAddrRanges(&d.data, regMap, profiles.find(dc.name))
+		out = append(out, d)
+	}
+	return out
+}
+
+// findDevice returns the device with the given name. An empty name is fine when there is only one device.
+func findDevice(devices []*device, name string) (*device, error) {
+	if len(name) == 0 {
+		if len(devices) == 1 {
+			return devices[0], nil
+		}
+		return nil, fmt.Errorf("there are %d devices, please pick one", len(devices))
+	}
+	for _, d := range devices {
+		if d.name == name {
+			return d, nil
+		}
+	}
+	return nil, fmt.Errorf("unknown device %q", name)
+}
+
+// findRange returns the address range bound to the given built-in parser, nil if it is not polled.
+func (d *device) findRange(target string) *modbusInterval {
+	for i := range d.addrRanges {
+		if d.addrRanges[i].values.block.Target == target {
+			return &d.addrRanges[i]
+		}
+	}
+	return nil
+}
+
+// openConnections opens all the distinct connections used by the devices.
+func openConnections(devices []*device) error {
+	opened := make(map[*modbusConnection]bool)
+	for _, d := range devices {
+		if opened[d.conn] {
+			continue
+		}
+		if err := d.conn.open(); err != nil {
+			return err
+		}
+		opened[d.conn] = true
+	}
+	return nil
+}
+
+// closeConnections closes all the distinct connections used by the devices.
+func closeConnections(devices []*device) {
+	closed := make(map[*modbusConnection]bool)
+	for _, d := range devices {
+		if closed[d.conn] {
+			continue
+		}
+		d.conn.close()
+		closed[d.conn] = true
+	}
+}
+
+func (d *device) metricsString() string {
+	sb := strings.Builder{}
+	sb.WriteString(fmt.Sprintf("# Huawei Sun2000 inverter %q (slave %d on %s) scraped data from ModBus\n#\n", d.name, d.slaveID, d.conn.name))
+	stats := d.getStats()
+	sb.WriteString(fmt.Sprintf("#  - last read success at %s\n", stats.lastSuccessTime.Format(time.RFC3339)))
+	sb.WriteString(fmt.Sprintf("#  - consecutive read errors %d\n", stats.errorCount))
+	sb.WriteString(fmt.Sprintf("#  - total read errors %d\n", stats.totalErrorCount))
+	sb.WriteString(fmt.Sprintf("#  - total read successes %d\n", stats.totalSuccessCount))
+	sb.WriteString("\n")
+	sb.WriteString(d.data.metricsString())
+	for _, r := range d.addrRanges {
+		sb.WriteString(r.values.metricsString(&d.data.identification))
+	}
+	return sb.String()
+}
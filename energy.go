@@ -0,0 +1,421 @@
+// Copyright: 2024 Dragos Vingarzan vingarzan -at- gmail -dot- com
+// License: AGPL-3.0
+//
+// This file is part of sun2000-modbus.
+//
+// sun2000-modbus is free software: you can redistribute it and/or modify it under the terms of the GNU Affero General
+// Public License Version 3 (AGPL-3.0) as published by the Free Software Foundation.
+//
+// sun2000-modbus is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY; without even the implied
+// warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the AGPL-3.0 along with sun2000-modbus. If not,
+// see <https://www.gnu.org/licenses/>.
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+// The energy flows of the house, derived from the powers of the inverter, of the meter and of the batteries: how much
+// the house consumes, and where the PV production, the battery and the grid power go to. The powers are integrated into
+// the energies of the day and of the month (in local time), which are saved to a file, to survive restarts.
+//
+// The signs are the ones of the registers: the meter's grid active power is >0 when feeding in to the grid and <0 when
+// supplied from it, the battery's charge and discharge power is >0 when charging and <0 when discharging. The inverter
+// losses are ignored, so the flows are only as accurate as the meter and the inverter readings.
+
+// The flows, in the order they are exported.
+const (
+	flowPVProduction     = "pv_production"
+	flowHouseConsumption = "house_consumption"
+	flowPVToHouse        = "pv_to_house"
+	flowPVToBattery      = "pv_to_battery"
+	flowPVToGrid         = "pv_to_grid"
+	flowBatteryToHouse   = "battery_to_house"
+	flowBatteryToGrid    = "battery_to_grid"
+	flowGridToHouse      = "grid_to_house"
+	flowGridToBattery    = "grid_to_battery"
+)
+
+var energyFlowNames = []string{flowPVProduction, flowHouseConsumption, flowPVToHouse, flowPVToBattery, flowPVToGrid,
+	flowBatteryToHouse, flowBatteryToGrid, flowGridToHouse, flowGridToBattery}
+
+// Longer gaps between two readings (the program or the connection down) are not integrated, since nobody knows what
+// happened meanwhile. Also, older powers are not exported.
+const energyMaxGap = 5 * time.Minute
+
+// energyFlows are the powers in kW, or the energies in kWh, of each flow, all >= 0.
+type energyFlows map[string]float64
+
+// energyInputs are the powers read, in kW, with the signs of the registers.
+type energyInputs struct {
+	// the DC input power of the inverter, from the PV strings
+	pv float64
+	// the AC output power of the inverter
+	active float64
+	// >0 feed-in to the grid, <0 supply from the grid
+	grid float64
+	// >0 charging, <0 discharging
+	battery float64
+}
+
+// computeEnergyFlows splits the powers into flows. The house is supplied first from the PV, then from the battery,
+// then from the grid. What is left of the PV charges the battery, then goes to the grid.
+func computeEnergyFlows(in energyInputs) energyFlows {
+	pv := max(in.pv, 0)
+	house := max(in.active-in.grid, 0)
+	export, supply := max(in.grid, 0), max(-in.grid, 0)
+	charge, discharge := max(in.battery, 0), max(-in.battery, 0)
+
+	f := energyFlows{flowPVProduction: pv, flowHouseConsumption: house}
+	f[flowPVToHouse] = min(pv, house)
+	f[flowBatteryToHouse] = min(discharge, house-f[flowPVToHouse])
+	f[flowGridToHouse] = max(min(supply, house-f[flowPVToHouse]-f[flowBatteryToHouse]), 0)
+	f[flowPVToBattery] = min(pv-f[flowPVToHouse], charge)
+	f[flowGridToBattery] = max(min(supply-f[flowGridToHouse], charge-f[flowPVToBattery]), 0)
+	f[flowPVToGrid] = max(min(pv-f[flowPVToHouse]-f[flowPVToBattery], export), 0)
+	f[flowBatteryToGrid] = max(min(discharge-f[flowBatteryToHouse], export-f[flowPVToGrid]), 0)
+	return f
+}
+
+// selfConsumption is the share of the PV production used locally, by the house or the battery. ok is false without
+// any production.
+func (f energyFlows) selfConsumption() (ratio float64, ok bool) {
+	if f[flowPVProduction] <= 0 {
+		return 0, false
+	}
+	return min(max(1-f[flowPVToGrid]/f[flowPVProduction], 0), 1), true
+}
+
+// autarky (the self-sufficiency) is the share of the house consumption not supplied by the grid. ok is false without
+// any consumption.
+func (f energyFlows) autarky() (ratio float64, ok bool) {
+	if f[flowHouseConsumption] <= 0 {
+		return 0, false
+	}
+	return min(max(1-f[flowGridToHouse]/f[flowHouseConsumption], 0), 1), true
+}
+
+// energyPeriod is the energy of each flow in a day or a month.
+type energyPeriod struct {
+	// e.g. 2024-05-31 for a day, 2024-05 for a month
+	Start string      `json:"start"`
+	KWh   energyFlows `json:"kWh"`
+}
+
+// energyDevice is the state of the flows of a device, as saved in the file.
+type energyDevice struct {
+	Day   energyPeriod `json:"day"`
+	Month energyPeriod `json:"month"`
+	// since the state file was created
+	Total energyFlows `json:"total"`
+
+	// the last reading, not saved
+	last  time.Time
+	power energyFlows
+}
+
+// rollOver starts a new day or month, if at is in another one than the current totals.
+func (e *energyDevice) rollOver(at time.Time, loc *time.Location) {
+	at = at.In(loc)
+	if day := at.Format(time.DateOnly); e.Day.Start != day {
+		e.Day = energyPeriod{Start: day, KWh: energyFlows{}}
+	}
+	if month := at.Format("2006-01"); e.Month.Start != month {
+		e.Month = energyPeriod{Start: month, KWh: energyFlows{}}
+	}
+	if e.Total == nil {
+		e.Total = energyFlows{}
+	}
+}
+
+// energyTracker computes the flows of each device, as a blockListener, and integrates them.
+type energyTracker struct {
+	sync.Mutex
+	devices map[string]*energyDevice
+	// the days and months are in this time zone
+	loc *time.Location
+
+	// the state file, and how often to save it
+	path     string
+	interval time.Duration
+	stop     chan struct{}
+	done     chan struct{}
+}
+
+// The energy flows of all the devices, set up by main().
+var energy = newEnergyTracker()
+
+func newEnergyTracker() *energyTracker {
+	return &energyTracker{devices: make(map[string]*energyDevice), loc: time.Local}
+}
+
+// open loads the energies from the state file, if it exists, and starts saving them to it every interval.
+func (x *energyTracker) open(path string, interval time.Duration) error {
+	x.Lock()
+	defer x.Unlock()
+	in, err := os.ReadFile(path)
+	switch {
+	case err == nil:
+		var state struct {
+			Devices map[string]*energyDevice `json:"devices"`
+		}
+		if err := json.Unmarshal(in, &state); err != nil {
+			return err
+		}
+		for name, e := range state.Devices {
+			x.devices[name] = e
+		}
+	case !errors.Is(err, os.ErrNotExist):
+		return err
+	}
+	x.path, x.interval = path, interval
+	x.stop, x.done = make(chan struct{}), make(chan struct{})
+	go x.run()
+	return nil
+}
+
+func (x *energyTracker) run() {
+	defer close(x.done)
+	ticker := time.NewTicker(x.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-x.stop:
+			return
+		case <-ticker.C:
+			if err := x.save(); err != nil {
+				lError.Printf("Error saving the energy state to %s: %v", x.path, err)
+			}
+		}
+	}
+}
+
+// close stops the periodic saving, and saves one last time.
+func (x *energyTracker) close() {
+	if x.stop == nil {
+		return
+	}
+	close(x.stop)
+	<-x.done
+	if err := x.save(); err != nil {
+		lError.Printf("Error saving the energy state to %s: %v", x.path, err)
+	}
+}
+
+// save writes the state file, through a temporary one, so that a crash does not leave it half written.
+func (x *energyTracker) save() error {
+	x.Lock()
+	out, err := json.MarshalIndent(struct {
+		Saved   time.Time                `json:"saved"`
+		Devices map[string]*energyDevice `json:"devices"`
+	}{time.Now(), x.devices}, "", "  ")
+	x.Unlock()
+	if err != nil {
+		return err
+	}
+	tmp := x.path + ".tmp"
+	if err := os.WriteFile(tmp, append(out, '\n'), 0o640); err != nil {
+		return err
+	}
+	return os.Rename(tmp, x.path)
+}
+
+// blockParsed recomputes the flows of the device after each read of the inverter or of the meter, from their latest
+// values and the ones of the batteries. The devices without a meter are skipped, without it the consumption of the
+// house is not known.
+func (x *energyTracker) blockParsed(d *device, r *modbusInterval) {
+	if target := r.values.block.Target; target != "inverter" && target != "meter" {
+		return
+	}
+	if !d.caps.polls("meter") {
+		return
+	}
+	in, at, ok := d.energyInputs()
+	if !ok {
+		return
+	}
+	x.update(d.name, at, computeEnergyFlows(in))
+}
+
+// energyInputs reads the latest powers of the device, and the time of the last of the readings. ok is false if the
+// inverter or the meter were not read recently.
+func (d *device) energyInputs() (in energyInputs, at time.Time, ok bool) {
+	inverter, meter := &d.data.inverter, &d.data.meter
+	inverter.RLock()
+	in.pv, in.active = float64(inverter.DCPower), float64(inverter.ActivePower)
+	inverterRead := inverter.lastRead
+	inverter.RUnlock()
+	meter.RLock()
+	in.grid = float64(meter.GridActivePower)
+	meterRead := meter.lastRead
+	meter.RUnlock()
+	if inverterRead.IsZero() || meterRead.IsZero() {
+		return in, at, false
+	}
+	at = inverterRead
+	if meterRead.After(at) {
+		at = meterRead
+	}
+	if at.Sub(inverterRead) > energyMaxGap || at.Sub(meterRead) > energyMaxGap {
+		return in, at, false
+	}
+
+	// the batteries which are not there, or not read recently, are left out
+	if d.caps.polls("esu1") {
+		esu := &d.data.esu1
+		esu.RLock()
+		if !esu.lastRead.IsZero() && at.Sub(esu.lastRead) <= energyMaxGap {
+			in.battery += float64(esu.ChargeAndDischargePower)
+		}
+		esu.RUnlock()
+	}
+	if d.caps.polls("esu2") {
+		esu := &d.data.esu2
+		esu.RLock()
+		if !esu.lastRead.IsZero() && at.Sub(esu.lastRead) <= energyMaxGap {
+			// ESU2 has it in W
+			in.battery += float64(esu.ChargeAndDischargePower) / 1000
+		}
+		esu.RUnlock()
+	}
+	return in, at, true
+}
+
+// update integrates the flows since the last reading, as trapezoids, into the energies.
+func (x *energyTracker) update(device string, at time.Time, flows energyFlows) {
+	x.Lock()
+	defer x.Unlock()
+	e := x.devices[device]
+	if e == nil {
+		e = &energyDevice{}
+		x.devices[device] = e
+	}
+	if at.Before(e.last) {
+		return
+	}
+	e.rollOver(at, x.loc)
+	if dt := at.Sub(e.last); !e.last.IsZero() && dt > 0 && dt <= energyMaxGap {
+		hours := dt.Hours()
+		for _, name := range energyFlowNames {
+			kWh := (e.power[name] + flows[name]) / 2 * hours
+			e.Day.KWh[name] += kWh
+			e.Month.KWh[name] += kWh
+			e.Total[name] += kWh
+		}
+	}
+	e.last, e.power = at, flows
+}
+
+// energyPeriodStatus is what the API returns for a day or a month.
+type energyPeriodStatus struct {
+	Start           string      `json:"start"`
+	KWh             energyFlows `json:"kWh"`
+	SelfConsumption *float64    `json:"selfConsumption,omitempty"`
+	Autarky         *float64    `json:"autarky,omitempty"`
+}
+
+// energyStatus is what the API returns per device. The powers are left out if not read recently.
+type energyStatus struct {
+	Device          string             `json:"device"`
+	Time            string             `json:"time,omitempty"`
+	Power           energyFlows        `json:"power,omitempty"`
+	SelfConsumption *float64           `json:"selfConsumption,omitempty"`
+	Autarky         *float64           `json:"autarky,omitempty"`
+	Day             energyPeriodStatus `json:"day"`
+	Month           energyPeriodStatus `json:"month"`
+	Total           energyFlows        `json:"total"`
+}
+
+func (f energyFlows) clone() energyFlows {
+	out := make(energyFlows, len(f))
+	for name, v := range f {
+		out[name] = v
+	}
+	return out
+}
+
+func energyRatios(f energyFlows) (selfConsumption, autarky *float64) {
+	if v, ok := f.selfConsumption(); ok {
+		selfConsumption = &v
+	}
+	if v, ok := f.autarky(); ok {
+		autarky = &v
+	}
+	return selfConsumption, autarky
+}
+
+// status returns the flows of the devices, by name. The day and month totals are of the current ones, zero if nothing
+// was read in them yet.
+func (x *energyTracker) status(now time.Time) (out []energyStatus) {
+	x.Lock()
+	defer x.Unlock()
+	names := make([]string, 0, len(x.devices))
+	for name := range x.devices {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		e := x.devices[name]
+		e.rollOver(now, x.loc)
+		s := energyStatus{Device: name, Total: e.Total.clone()}
+		if !e.last.IsZero() && now.Sub(e.last) <= energyMaxGap {
+			s.Time = e.last.Format(time.RFC3339)
+			s.Power = e.power
+			s.SelfConsumption, s.Autarky = energyRatios(e.power)
+		}
+		for _, p := range []struct {
+			in  *energyPeriod
+			out *energyPeriodStatus
+		}{{&e.Day, &s.Day}, {&e.Month, &s.Month}} {
+			*p.out = energyPeriodStatus{Start: p.in.Start, KWh: p.in.KWh.clone()}
+			p.out.SelfConsumption, p.out.Autarky = energyRatios(p.in.KWh)
+		}
+		out = append(out, s)
+	}
+	return out
+}
+
+func (x *energyTracker) collectMetrics(r *metricsRegistry) {
+	ratio := func(name, help string, v *float64, labels ...metricLabel) {
+		if v != nil {
+			r.gauge(name, help, *v, labels...)
+		}
+	}
+	for _, s := range x.status(time.Now()) {
+		device := metricLabel{"device", s.Device}
+		now, day, month := metricLabel{"period", "now"}, metricLabel{"period", "day"}, metricLabel{"period", "month"}
+		for _, name := range energyFlowNames {
+			flow := metricLabel{"flow", name}
+			if s.Power != nil {
+				r.gauge("sun2000_energy_flow_power_kilowatts", "Power of the energy flow, derived from the inverter, meter and battery powers", s.Power[name], device, flow)
+			}
+			r.gauge("sun2000_energy_flow_period_kwh", "Energy of the flow in the current day or month, in local time", s.Day.KWh[name], device, flow, day)
+			r.gauge("sun2000_energy_flow_period_kwh", "Energy of the flow in the current day or month, in local time", s.Month.KWh[name], device, flow, month)
+			r.counter("sun2000_energy_flow_kwh", "Energy of the flow since the state file was created", s.Total[name], device, flow)
+		}
+		selfConsumption, autarky := "sun2000_self_consumption_ratio", "sun2000_autarky_ratio"
+		selfConsumptionHelp := "Share of the PV production used by the house or the battery"
+		autarkyHelp := "Share of the house consumption not supplied by the grid"
+		ratio(selfConsumption, selfConsumptionHelp, s.SelfConsumption, device, now)
+		ratio(selfConsumption, selfConsumptionHelp, s.Day.SelfConsumption, device, day)
+		ratio(selfConsumption, selfConsumptionHelp, s.Month.SelfConsumption, device, month)
+		ratio(autarky, autarkyHelp, s.Autarky, device, now)
+		ratio(autarky, autarkyHelp, s.Day.Autarky, device, day)
+		ratio(autarky, autarkyHelp, s.Month.Autarky, device, month)
+	}
+}
+
+// handleEnergy serves the energy flows of all the devices.
+func handleEnergy(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(energy.status(time.Now()))
+}
@@ -0,0 +1,162 @@
+// Copyright: 2024 Dragos Vingarzan vingarzan -at- gmail -dot- com
+// License: AGPL-3.0
+//
+// This file is part of sun2000-modbus.
+//
+// sun2000-modbus is free software: you can redistribute it and/or modify it under the terms of the GNU Affero General
+// Public License Version 3 (AGPL-3.0) as published by the Free Software Foundation.
+//
+// sun2000-modbus is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY; without even the implied
+// warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the AGPL-3.0 along with sun2000-modbus. If not,
+// see <https://www.gnu.org/licenses/>.
+package main
+
+import (
+	"encoding/json"
+	"math"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestComputeEnergyFlows(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		in   energyInputs
+		want energyFlows
+	}{
+		{"night, from the grid", energyInputs{pv: 0, active: -0.01, grid: -0.51},
+			energyFlows{flowHouseConsumption: 0.5, flowGridToHouse: 0.5}},
+		{"sunny, feeding in and charging", energyInputs{pv: 6, active: 4, grid: 3, battery: 2},
+			energyFlows{flowPVProduction: 6, flowHouseConsumption: 1, flowPVToHouse: 1, flowPVToBattery: 2, flowPVToGrid: 3}},
+		{"evening, from the battery", energyInputs{pv: 0.2, active: 1.5, grid: -0.3, battery: -1.3},
+			energyFlows{flowPVProduction: 0.2, flowHouseConsumption: 1.8, flowPVToHouse: 0.2, flowBatteryToHouse: 1.3, flowGridToHouse: 0.3}},
+		{"charging from the grid", energyInputs{pv: 0, active: -3, grid: -3.5, battery: 3},
+			energyFlows{flowHouseConsumption: 0.5, flowGridToHouse: 0.5, flowGridToBattery: 3}},
+		{"discharging to the grid", energyInputs{pv: 1, active: 4, grid: 3.5, battery: -3},
+			energyFlows{flowPVProduction: 1, flowHouseConsumption: 0.5, flowPVToHouse: 0.5, flowPVToGrid: 0.5, flowBatteryToGrid: 3}},
+	} {
+		got := computeEnergyFlows(tc.in)
+		for _, name := range energyFlowNames {
+			if math.Abs(got[name]-tc.want[name]) > 1e-9 {
+				t.Errorf("%s: %s is %v, not %v", tc.name, name, got[name], tc.want[name])
+			}
+		}
+	}
+
+	f := computeEnergyFlows(energyInputs{pv: 6, active: 4, grid: 3, battery: 2})
+	if v, ok := f.selfConsumption(); !ok || math.Abs(v-0.5) > 1e-9 {
+		t.Errorf("self-consumption %v %v, not 0.5", v, ok)
+	}
+	if v, ok := f.autarky(); !ok || v != 1 {
+		t.Errorf("autarky %v %v, not 1", v, ok)
+	}
+	f = computeEnergyFlows(energyInputs{active: -0.01, grid: -0.51})
+	if _, ok := f.selfConsumption(); ok {
+		t.Errorf("a self-consumption without PV production")
+	}
+	if v, ok := f.autarky(); !ok || v != 0 {
+		t.Errorf("autarky %v %v, not 0", v, ok)
+	}
+}
+
+func TestEnergyTracker(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "energy.json")
+	x := newEnergyTracker()
+	x.loc = time.UTC
+	if err := x.open(path, time.Hour); err != nil {
+		t.Fatal(err)
+	}
+
+	d := newDevices([]deviceConfig{{name: "test", ip: "127.0.0.1", port: 502, slaveID: 1}})[0]
+	read := func(at time.Time, pv, active, grid, battery float32) {
+		d.data.inverter.Lock()
+		d.data.inverter.DCPower, d.data.inverter.ActivePower, d.data.inverter.lastRead = pv, active, at
+		d.data.inverter.Unlock()
+		d.data.meter.Lock()
+		d.data.meter.GridActivePower, d.data.meter.lastRead = grid, at
+		d.data.meter.Unlock()
+		d.data.esu1.Lock()
+		d.data.esu1.ChargeAndDischargePower, d.data.esu1.lastRead = battery, at
+		d.data.esu1.Unlock()
+		x.blockParsed(d, d.findRange("meter"))
+	}
+
+	// an hour of 2 kW to the house and 1 kW to the grid, just before midnight, then the new day
+	start := time.Date(2024, 5, 31, 22, 0, 0, 0, time.UTC)
+	for m := 0; m <= 60; m++ {
+		read(start.Add(time.Duration(m)*time.Minute), 3, 3, 1, 0)
+	}
+	// half an hour of 1 kW from the grid, after a gap which is not integrated
+	for m := 0; m <= 30; m++ {
+		read(start.Add(3*time.Hour+time.Duration(m)*time.Minute), 0, 0, -1, 0)
+	}
+
+	s := x.status(start.Add(3*time.Hour + 30*time.Minute))
+	if len(s) != 1 || s[0].Device != "test" {
+		t.Fatalf("unexpected status %+v", s)
+	}
+	if s[0].Day.Start != "2024-06-01" || s[0].Month.Start != "2024-06" {
+		t.Errorf("unexpected periods %q %q", s[0].Day.Start, s[0].Month.Start)
+	}
+	if v := s[0].Day.KWh[flowGridToHouse]; math.Abs(v-0.5) > 1e-9 {
+		t.Errorf("grid to house of the day %v, not 0.5", v)
+	}
+	if v := s[0].Total[flowPVToGrid]; math.Abs(v-1) > 1e-9 {
+		t.Errorf("total PV to grid %v, not 1", v)
+	}
+	if v := s[0].Total[flowPVToHouse]; math.Abs(v-2) > 1e-9 {
+		t.Errorf("total PV to house %v, not 2", v)
+	}
+	if s[0].Power[flowGridToHouse] != 1 || s[0].Autarky == nil || *s[0].Autarky != 0 || s[0].SelfConsumption != nil {
+		t.Errorf("unexpected powers %+v", s[0])
+	}
+	if s := x.status(start.Add(4 * time.Hour)); s[0].Power != nil {
+		t.Errorf("old powers are served: %+v", s[0].Power)
+	}
+
+	// saved on close, and loaded back
+	x.close()
+	y := newEnergyTracker()
+	y.loc = time.UTC
+	if err := y.open(path, time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	defer y.close()
+	s = y.status(start.Add(3*time.Hour + 30*time.Minute))
+	if len(s) != 1 || math.Abs(s[0].Total[flowPVToHouse]-2) > 1e-9 || math.Abs(s[0].Day.KWh[flowGridToHouse]-0.5) > 1e-9 {
+		t.Errorf("unexpected status after loading %+v", s)
+	}
+	// a new month starts from zero
+	s = y.status(time.Date(2024, 7, 1, 0, 0, 0, 0, time.UTC))
+	if s[0].Month.Start != "2024-07" || s[0].Month.KWh[flowGridToHouse] != 0 || s[0].Total[flowGridToHouse] == 0 {
+		t.Errorf("unexpected status in the next month %+v", s)
+	}
+
+	// the metrics and the API
+	energy = y
+	defer func() { energy = newEnergyTracker() }()
+	r := newMetricsRegistry()
+	y.collectMetrics(r)
+	var sb strings.Builder
+	if err := r.write(&sb, false); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{`sun2000_energy_flow_period_kwh{device="test",flow="pv_to_house",period="day"}`,
+		`sun2000_energy_flow_kwh_total{device="test",flow="pv_to_house"}`} {
+		if !strings.Contains(sb.String(), name) {
+			t.Errorf("%s missing from the metrics", name)
+		}
+	}
+	rec := httptest.NewRecorder()
+	handleEnergy(rec, httptest.NewRequest("GET", "/api/v1/energy", nil))
+	var api []energyStatus
+	if err := json.Unmarshal(rec.Body.Bytes(), &api); err != nil || len(api) != 1 || api[0].Total[flowPVToGrid] == 0 {
+		t.Errorf("unexpected API response %s: %v", rec.Body.String(), err)
+	}
+}
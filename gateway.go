@@ -0,0 +1,235 @@
+// Copyright: 2024 Dragos Vingarzan vingarzan -at- gmail -dot- com
+// License: AGPL-3.0
+//
+// This file is part of sun2000-modbus.
+//
+// sun2000-modbus is free software: you can redistribute it and/or modify it under the terms of the GNU Affero General
+// Public License Version 3 (AGPL-3.0) as published by the Free Software Foundation.
+//
+// sun2000-modbus is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY; without even the implied
+// warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the AGPL-3.0 along with sun2000-modbus. If not,
+// see <https://www.gnu.org/licenses/>.
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/goburrow/modbus"
+)
+
+// The Modbus TCP gateway lets other clients (e.g. Home Assistant, or an EMS) talk to the inverters, since the SDongle
+// accepts only a few sessions, and we keep one. The reads are answered from the registers last read by the pollers,
+// while fresh enough, and the other ones are forwarded through our connection, in turn with the polling. The writes are
+// forwarded only to the registers allowed.
+
+// registerSpan is a range of registers, from first to last, included.
+type registerSpan struct {
+	first, last uint16
+}
+
+func (s registerSpan) contains(address, quantity uint16) bool {
+	return address >= s.first && uint32(address)+uint32(quantity) <= uint32(s.last)+1
+}
+
+func (s registerSpan) String() string {
+	if s.first == s.last {
+		return strconv.Itoa(int(s.first))
+	}
+	return fmt.Sprintf("%d-%d", s.first, s.last)
+}
+
+// parseRegisterSpans parses a comma separated list of registers or ranges of registers, e.g. 47086,47075-47078.
+func parseRegisterSpans(in string) (out []registerSpan, err error) {
+	for _, entry := range strings.Split(in, ",") {
+		entry = strings.TrimSpace(entry)
+		if len(entry) == 0 {
+			continue
+		}
+		first, last, found := strings.Cut(entry, "-")
+		if !found {
+			last = first
+		}
+		a, errA := strconv.ParseUint(strings.TrimSpace(first), 10, 16)
+		b, errB := strconv.ParseUint(strings.TrimSpace(last), 10, 16)
+		if errA != nil || errB != nil || b < a {
+			return nil, fmt.Errorf("%q is not a register or a first-last range of registers", entry)
+		}
+		out = append(out, registerSpan{uint16(a), uint16(b)})
+	}
+	return out, nil
+}
+
+// The results of the gateway requests, as counted in the metrics.
+const (
+	gatewayCached    = "cached"
+	gatewayForwarded = "forwarded"
+	gatewayRejected  = "rejected"
+	gatewayFailed    = "failed"
+)
+
+// modbusGateway is the modbusServerHandler of the gateway.
+type modbusGateway struct {
+	devices []*device
+	// the registers read are served while younger than this, or while not stale if 0
+	maxAge time.Duration
+	// the registers which may be written
+	writeAllow []registerSpan
+
+	mutex sync.Mutex
+	// by function (read or write) and result
+	requests map[[2]string]uint64
+}
+
+// The gateway, if enabled, set up by main().
+var gateway *modbusGateway
+
+func newModbusGateway(devices []*device, maxAge time.Duration, writeAllow []registerSpan) *modbusGateway {
+	return &modbusGateway{devices: devices, maxAge: maxAge, writeAllow: writeAllow, requests: make(map[[2]string]uint64)}
+}
+
+func (x *modbusGateway) count(function, result string) {
+	x.mutex.Lock()
+	defer x.mutex.Unlock()
+	x.requests[[2]string{function, result}]++
+}
+
+// device returns the device with the slave ID, the first one if several have it (behind different SDongles).
+func (x *modbusGateway) device(slaveID byte) (*device, error) {
+	for _, d := range x.devices {
+		if d.slaveID == slaveID {
+			return d, nil
+		}
+	}
+	return nil, &modbus.ModbusError{ExceptionCode: modbus.ExceptionCodeGatewayPathUnavailable}
+}
+
+// cached returns the registers, if a block which is polled has them all, read recently enough.
+func (x *modbusGateway) cached(d *device, address, quantity uint16, now time.Time) []byte {
+	for i := range d.addrRanges {
+		r := &d.addrRanges[i]
+		if !(registerSpan{r.from, r.to - 1}).contains(address, quantity) || !d.caps.polls(r.values.block.Target) {
+			continue
+		}
+		age, stale := r.age(now)
+		if (x.maxAge > 0 && age > x.maxAge) || (x.maxAge == 0 && stale) {
+			continue
+		}
+		if data := r.values.registers(address, quantity); data != nil {
+			return data
+		}
+	}
+	return nil
+}
+
+// forwardError turns the errors of the device into the exceptions of a gateway. Those of the device itself are passed
+// on as they are.
+func forwardError(err error) error {
+	var mbErr *modbus.ModbusError
+	if errors.As(err, &mbErr) {
+		return mbErr
+	}
+	if errors.Is(err, errConnectionClosed) {
+		return fmt.Errorf("%w: %w", err, &modbus.ModbusError{ExceptionCode: modbus.ExceptionCodeGatewayPathUnavailable})
+	}
+	return fmt.Errorf("%w: %w", err, &modbus.ModbusError{ExceptionCode: modbus.ExceptionCodeGatewayTargetDeviceFailedToRespond})
+}
+
+func (x *modbusGateway) readHoldingRegisters(slaveID byte, address, quantity uint16) (results []byte, err error) {
+	d, err := x.device(slaveID)
+	if err != nil {
+		x.count("read", gatewayRejected)
+		return nil, err
+	}
+	if uint32(address)+uint32(quantity) > 0x10000 {
+		x.count("read", gatewayRejected)
+		return nil, errIllegalDataAddress(address, quantity)
+	}
+	if data := x.cached(d, address, quantity, time.Now()); data != nil {
+		x.count("read", gatewayCached)
+		return data, nil
+	}
+	results, err = d.readModbusFromTo("gateway read", address, address+quantity)
+	if err != nil {
+		lWarning.Printf("Gateway read of %s %d..%d failed: %v", d.name, address, address+quantity, err)
+		x.count("read", gatewayFailed)
+		return nil, forwardError(err)
+	}
+	x.count("read", gatewayForwarded)
+	return results, nil
+}
+
+func (x *modbusGateway) writeRegisters(slaveID byte, address uint16, values []byte) error {
+	d, err := x.device(slaveID)
+	if err != nil {
+		x.count("write", gatewayRejected)
+		return err
+	}
+	quantity := uint16(len(values) / 2)
+	if quantity == 0 {
+		x.count("write", gatewayRejected)
+		return &modbus.ModbusError{ExceptionCode: modbus.ExceptionCodeIllegalDataValue}
+	}
+	if uint32(address)+uint32(quantity) > 0x10000 {
+		x.count("write", gatewayRejected)
+		return errIllegalDataAddress(address, quantity)
+	}
+	allowed := false
+	for _, s := range x.writeAllow {
+		allowed = allowed || s.contains(address, quantity)
+	}
+	if !allowed {
+		lWarning.Printf("Gateway write of %s %d..%d rejected, not in GATEWAY_WRITE_ALLOW", d.name, address, address+quantity)
+		x.count("write", gatewayRejected)
+		return errIllegalDataAddress(address, quantity)
+	}
+	registers := make([]uint16, quantity)
+	for i := range registers {
+		registers[i] = binary.BigEndian.Uint16(values[2*i:])
+	}
+	// forwarded as it is, the client sees the answer of the inverter and reads back if it cares
+	err = d.forwardModbusRegisters("gateway write", address, registers)
+	auditLog.write(auditEntry{Device: d.name, Source: "modbus gateway", Action: "gateway write", Address: address, Values: registers,
+		Error: errorString(err)})
+
+	// the blocks with these registers are read again on the next round, and not served meanwhile
+	written := registerSpan{address, address + quantity - 1}
+	for i := range d.addrRanges {
+		r := &d.addrRanges[i]
+		if r.from <= written.last && written.first < r.to {
+			r.values.invalidate()
+			r.values.setNextRead(time.Time{})
+			if r.target != nil {
+				r.target.setNextRead(time.Time{})
+			}
+		}
+	}
+	if err != nil {
+		x.count("write", gatewayFailed)
+		return forwardError(err)
+	}
+	x.count("write", gatewayForwarded)
+	return nil
+}
+
+func (x *modbusGateway) collectMetrics(r *metricsRegistry) {
+	x.mutex.Lock()
+	defer x.mutex.Unlock()
+	for _, function := range []string{"read", "write"} {
+		for _, result := range []string{gatewayCached, gatewayForwarded, gatewayRejected, gatewayFailed} {
+			if function == "write" && result == gatewayCached {
+				continue
+			}
+			r.counter("sun2000_gateway_requests_total", "Requests of the Modbus gateway clients, by how they were answered",
+				float64(x.requests[[2]string{function, result}]), metricLabel{"function", function}, metricLabel{"result", result})
+		}
+	}
+}
@@ -0,0 +1,166 @@
+// Copyright: 2024 Dragos Vingarzan vingarzan -at- gmail -dot- com
+// License: AGPL-3.0
+//
+// This file is part of sun2000-modbus.
+//
+// sun2000-modbus is free software: you can redistribute it and/or modify it under the terms of the GNU Affero General
+// Public License Version 3 (AGPL-3.0) as published by the Free Software Foundation.
+//
+// sun2000-modbus is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY; without even the implied
+// warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the AGPL-3.0 along with sun2000-modbus. If not,
+// see <https://www.gnu.org/licenses/>.
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/goburrow/modbus"
+	"github.com/vingarzan/sun2000-modbus/sun2000"
+)
+
+func TestParseRegisterSpans(t *testing.T) {
+	spans, err := parseRegisterSpans("47086, 47075-47078")
+	if err != nil || len(spans) != 2 || spans[0] != (registerSpan{47086, 47086}) || spans[1] != (registerSpan{47075, 47078}) {
+		t.Fatalf("unexpected spans %v: %v", spans, err)
+	}
+	if !spans[1].contains(47077, 2) || spans[1].contains(47077, 3) || spans[1].contains(47074, 1) {
+		t.Errorf("wrong contains() of %v", spans[1])
+	}
+	for _, bad := range []string{"x", "47078-47075", "70000", "1-2-3"} {
+		if _, err := parseRegisterSpans(bad); err == nil {
+			t.Errorf("%q was accepted", bad)
+		}
+	}
+}
+
+func TestModbusGateway(t *testing.T) {
+	server := startSimulator(t, nil)
+	d := simulatorDevices(t, server, 1)[0]
+	d.readModbusFromTo("dummy read", 30000, 30015)
+	d.readExpiredRanges(context.Background())
+
+	gateway := newModbusGateway([]*device{d}, 0, []registerSpan{{regActivePowerPercentageDerating, regActivePowerPercentageDerating}})
+	gatewayServer := newModbusServer(gateway)
+	if err := gatewayServer.listen("127.0.0.1:0"); err != nil {
+		t.Fatal(err)
+	}
+	go gatewayServer.serve()
+	defer gatewayServer.close()
+
+	client := sun2000.NewClient(sun2000.Config{Mode: "tcp", Address: gatewayServer.addr(), SlaveID: 1, Timeout: time.Second})
+	if err := client.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	exception := func(err error) byte {
+		var mbErr *modbus.ModbusError
+		if !errors.As(err, &mbErr) {
+			t.Fatalf("not a Modbus exception: %v", err)
+		}
+		return mbErr.ExceptionCode
+	}
+
+	// from the registers polled
+	got, err := client.ReadRegisters(30000, 30015)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := d.findRange("identification").values.registers(30000, 15); !bytes.Equal(got, want) {
+		t.Errorf("the gateway read %x, not %x", got, want)
+	}
+	// not polled, so forwarded
+	got, err = client.ReadRegisters(regActivePowerPercentageDerating, regActivePowerPercentageDerating+1)
+	if err != nil || len(got) != 2 {
+		t.Fatalf("unexpected forwarded read %x: %v", got, err)
+	}
+	// the exceptions of the device are passed on
+	if _, err = client.ReadRegisters(20000, 20010); exception(err) != modbus.ExceptionCodeIllegalDataAddress {
+		t.Errorf("unexpected error of a read out of range: %v", err)
+	}
+	// a slave which is not there
+	client.SetSlaveID(7)
+	if _, err = client.ReadRegisters(30000, 30015); exception(err) != modbus.ExceptionCodeGatewayPathUnavailable {
+		t.Errorf("unexpected error of a read of slave 7: %v", err)
+	}
+	client.SetSlaveID(1)
+
+	// only the registers allowed are written, as they are, without reading them back
+	upstream := &readCountingTransport{modbusTransport: d.conn.client}
+	d.conn.client = upstream
+	if err = client.WriteMultipleRegisters(regActivePowerPercentageDerating, []uint16{500}); err != nil {
+		t.Fatalf("allowed write failed: %v", err)
+	}
+	if upstream.reads != 0 {
+		t.Errorf("the gateway write read %d times from the inverter", upstream.reads)
+	}
+	if err = client.WriteRegisters(regActivePowerFixedDerating, []uint16{0, 1000}); exception(err) != modbus.ExceptionCodeIllegalDataAddress {
+		t.Errorf("unexpected error of a write not allowed: %v", err)
+	}
+	// nor an empty one, which the client would not send, and which would not reach the inverter
+	empty := binary.BigEndian.AppendUint16([]byte{modbus.FuncCodeWriteMultipleRegisters}, regActivePowerPercentageDerating)
+	empty = append(empty, 0, 0, 0)
+	if response := gatewayServer.handle(1, empty); !bytes.Equal(response, []byte{0x90, modbus.ExceptionCodeIllegalDataValue}) {
+		t.Errorf("unexpected response %x to a write of 0 registers", response)
+	}
+	if err = gateway.writeRegisters(1, 0, nil); exception(err) != modbus.ExceptionCodeIllegalDataValue {
+		t.Errorf("unexpected error of a gateway write of 0 registers: %v", err)
+	}
+	if upstream.writes != 1 {
+		t.Errorf("%d writes reached the inverter, not 1", upstream.writes)
+	}
+	got, err = client.ReadRegisters(regActivePowerPercentageDerating, regActivePowerPercentageDerating+1)
+	if err != nil || !bytes.Equal(got, []byte{0x01, 0xf4}) {
+		t.Errorf("read back %x, not 01f4: %v", got, err)
+	}
+
+	// a stale block is not served anymore
+	r := d.findRange("identification")
+	r.values.setLastRead(time.Now().Add(-2 * r.staleAfter))
+	if _, err = client.ReadRegisters(30000, 30015); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, c := range []struct {
+		function, result string
+		want             uint64
+	}{
+		{"read", gatewayCached, 1}, {"read", gatewayForwarded, 3}, {"read", gatewayFailed, 1}, {"read", gatewayRejected, 1},
+		{"write", gatewayForwarded, 1}, {"write", gatewayRejected, 2},
+	} {
+		if got := gateway.requests[[2]string{c.function, c.result}]; got != c.want {
+			t.Errorf("%d %s %s requests, not %d", got, c.result, c.function, c.want)
+		}
+	}
+}
+
+// readCountingTransport counts the reads and the writes towards the inverter.
+type readCountingTransport struct {
+	modbusTransport
+	reads  int
+	writes int
+}
+
+func (x *readCountingTransport) ReadRegisters(from, to uint16) ([]byte, error) {
+	x.reads++
+	return x.modbusTransport.ReadRegisters(from, to)
+}
+
+// WriteRegisters reads back what it writes.
+func (x *readCountingTransport) WriteRegisters(address uint16, values []uint16) error {
+	x.reads++
+	x.writes++
+	return x.modbusTransport.WriteRegisters(address, values)
+}
+
+func (x *readCountingTransport) WriteMultipleRegisters(address uint16, values []uint16) error {
+	x.writes++
+	return x.modbusTransport.WriteMultipleRegisters(address, values)
+}
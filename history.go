@@ -0,0 +1,541 @@
+// Copyright: 2024 Dragos Vingarzan vingarzan -at- gmail -dot- com
+// License: AGPL-3.0
+//
+// This file is part of sun2000-modbus.
+//
+// sun2000-modbus is free software: you can redistribute it and/or modify it under the terms of the GNU Affero General
+// Public License Version 3 (AGPL-3.0) as published by the Free Software Foundation.
+//
+// sun2000-modbus is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY; without even the implied
+// warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the AGPL-3.0 along with sun2000-modbus. If not,
+// see <https://www.gnu.org/licenses/>.
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	_ "modernc.org/sqlite"
+)
+
+// The history keeps samples of selected values in a SQLite database, to chart a few months of them without running
+// Prometheus. Each value read is kept as is for 48 hours, as 5-minute averages (with the minimum and maximum) for 90
+// days, and as hourly ones forever. The values are named as target.key, e.g. inverter.activePower or esu1.batterySOC.
+//
+// The energy counters of cumulative1 (the inverter yield) and of the ESUs (the charge and discharge) are kept as their
+// first and last values of each day, in local time, from which the energy of the days is computed.
+
+const (
+	historyQueueSize = 4096
+	// the samples are written in a transaction every historyFlushInterval, and rolled up every historyRollupInterval
+	historyFlushInterval  = 10 * time.Second
+	historyRollupInterval = 5 * time.Minute
+)
+
+// historyResolution is how the samples of one resolution are kept.
+type historyResolution struct {
+	name string
+	// the length of the buckets, 0 for the raw samples
+	seconds int64
+	// the older samples are deleted, 0 for never
+	retention time.Duration
+}
+
+// The resolutions, each rolled up from the previous one.
+var historyResolutions = []historyResolution{
+	{name: "raw", seconds: 0, retention: 48 * time.Hour},
+	{name: "5m", seconds: 300, retention: 90 * 24 * time.Hour},
+	{name: "1h", seconds: 3600},
+}
+
+// The blocks of which the kWh counters go into the daily energies.
+var historyEnergyTargets = map[string]bool{"cumulative1": true, "esu1": true, "esu2": true}
+
+const historySchema = `
+CREATE TABLE IF NOT EXISTS samples (
+	device     TEXT NOT NULL,
+	field      TEXT NOT NULL,
+	resolution INTEGER NOT NULL,
+	at         INTEGER NOT NULL,
+	value      REAL NOT NULL,
+	low        REAL NOT NULL,
+	high       REAL NOT NULL,
+	n          INTEGER NOT NULL,
+	PRIMARY KEY (device, field, resolution, at)
+) WITHOUT ROWID;
+CREATE TABLE IF NOT EXISTS energy_days (
+	device  TEXT NOT NULL,
+	counter TEXT NOT NULL,
+	day     TEXT NOT NULL,
+	first   REAL NOT NULL,
+	last    REAL NOT NULL,
+	PRIMARY KEY (device, counter, day)
+) WITHOUT ROWID;
+`
+
+type historyConfig struct {
+	// the SQLite database, off if empty
+	path string
+	// the values to keep, as target.key
+	fields []string
+}
+
+// historySample is a value read, to keep as a sample, or as an energy counter, or both.
+type historySample struct {
+	device string
+	field  string
+	at     time.Time
+	value  float64
+	keep   bool
+	energy bool
+}
+
+type historyStore struct {
+	db     *sql.DB
+	fields map[string]bool
+	// the days of the energies are in this time zone
+	loc   *time.Location
+	queue chan historySample
+	// historyFlushInterval, shorter in the tests
+	flushInterval time.Duration
+
+	// owned by run(): the buckets before this are rolled up already
+	rolledUp time.Time
+
+	mutex    sync.Mutex
+	written  uint64
+	dropped  uint64
+	failures uint64
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+// The history, if enabled, set up by main().
+var history *historyStore
+
+// newHistoryStore opens the database, creating it if needed.
+func newHistoryStore(c historyConfig) (*historyStore, error) {
+	db, err := sql.Open("sqlite", c.path)
+	if err != nil {
+		return nil, err
+	}
+	// one connection, so that the pragmas apply to all the statements
+	db.SetMaxOpenConns(1)
+	for _, stmt := range []string{"PRAGMA journal_mode = WAL", "PRAGMA busy_timeout = 5000", historySchema} {
+		if _, err := db.Exec(stmt); err != nil {
+			db.Close()
+			return nil, fmt.Errorf("%s: %w", c.path, err)
+		}
+	}
+	x := &historyStore{
+		db:            db,
+		fields:        make(map[string]bool),
+		loc:           time.Local,
+		queue:         make(chan historySample, historyQueueSize),
+		flushInterval: historyFlushInterval,
+		stop:          make(chan struct{}),
+		done:          make(chan struct{}),
+	}
+	for _, f := range c.fields {
+		x.fields[f] = true
+	}
+	return x, nil
+}
+
+// run writes the queued samples and rolls them up, until close() is called.
+func (x *historyStore) run() {
+	defer close(x.done)
+	flush := time.NewTicker(x.flushInterval)
+	defer flush.Stop()
+	rollup := time.NewTicker(historyRollupInterval)
+	defer rollup.Stop()
+	var batch []historySample
+	write := func() {
+		if err := x.write(batch); err != nil {
+			x.mutex.Lock()
+			x.failures++
+			x.dropped += uint64(len(batch))
+			x.mutex.Unlock()
+			lError.Printf("Error writing %d samples to the history: %v", len(batch), err)
+		}
+		batch = batch[:0]
+	}
+	x.rollup(time.Now())
+	for {
+		select {
+		case <-x.stop:
+			for len(x.queue) > 0 {
+				batch = append(batch, <-x.queue)
+			}
+			write()
+			return
+		case s := <-x.queue:
+			batch = append(batch, s)
+		case <-flush.C:
+			write()
+		case <-rollup.C:
+			write()
+			x.rollup(time.Now())
+		}
+	}
+}
+
+// close writes what is still queued, and closes the database.
+func (x *historyStore) close() {
+	close(x.stop)
+	<-x.done
+	if err := x.db.Close(); err != nil {
+		lError.Printf("Error closing the history: %v", err)
+	}
+}
+
+// write inserts the samples, and updates the energies of the days, in one transaction.
+func (x *historyStore) write(samples []historySample) error {
+	if len(samples) == 0 {
+		return nil
+	}
+	tx, err := x.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	raw, err := tx.Prepare(`INSERT OR REPLACE INTO samples (device, field, resolution, at, value, low, high, n) VALUES (?, ?, 0, ?, ?, ?, ?, 1)`)
+	if err != nil {
+		return err
+	}
+	defer raw.Close()
+	day, err := tx.Prepare(`INSERT INTO energy_days (device, counter, day, first, last) VALUES (?, ?, ?, ?, ?)
+		ON CONFLICT (device, counter, day) DO UPDATE SET last = excluded.last`)
+	if err != nil {
+		return err
+	}
+	defer day.Close()
+	for _, s := range samples {
+		if s.keep {
+			if _, err := raw.Exec(s.device, s.field, s.at.Unix(), s.value, s.value, s.value); err != nil {
+				return err
+			}
+		}
+		if s.energy {
+			if _, err := day.Exec(s.device, s.field, s.at.In(x.loc).Format(time.DateOnly), s.value, s.value); err != nil {
+				return err
+			}
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	x.mutex.Lock()
+	x.written += uint64(len(samples))
+	x.mutex.Unlock()
+	return nil
+}
+
+// rollup averages the samples of each resolution into the buckets of the next one which ended by now, and deletes
+// the samples past their retention. The last bucket rolled up before is done again, for the samples written late.
+func (x *historyStore) rollup(now time.Time) {
+	from := x.rolledUp
+	if from.IsZero() {
+		from = now.Add(-historyResolutions[0].retention)
+	}
+	err := func() error {
+		for i := 1; i < len(historyResolutions); i++ {
+			source, res := historyResolutions[i-1], historyResolutions[i].seconds
+			start := from.Unix() - from.Unix()%res - res
+			end := now.Unix() - now.Unix()%res
+			if source.retention > 0 {
+				// not the buckets of which some samples were deleted already
+				oldest := now.Add(-source.retention).Unix()
+				start = max(start, oldest+(res-oldest%res)%res)
+			}
+			_, err := x.db.Exec(`INSERT OR REPLACE INTO samples (device, field, resolution, at, value, low, high, n)
+				SELECT device, field, ?, at - at % ?, sum(value * n) / sum(n), min(low), max(high), sum(n)
+				FROM samples WHERE resolution = ? AND at >= ? AND at < ?
+				GROUP BY device, field, at - at % ?`, res, res, source.seconds, start, end, res)
+			if err != nil {
+				return err
+			}
+		}
+		for _, r := range historyResolutions {
+			if r.retention == 0 {
+				continue
+			}
+			if _, err := x.db.Exec(`DELETE FROM samples WHERE resolution = ? AND at < ?`, r.seconds, now.Add(-r.retention).Unix()); err != nil {
+				return err
+			}
+		}
+		return nil
+	}()
+	if err != nil {
+		x.mutex.Lock()
+		x.failures++
+		x.mutex.Unlock()
+		lError.Printf("Error rolling up the history: %v", err)
+		return
+	}
+	x.rolledUp = now
+}
+
+// blockParsed queues the selected values of the block, and its energy counters, dropping them if the database is not
+// keeping up, so that the poller is never blocked.
+func (x *historyStore) blockParsed(d *device, r *modbusInterval) {
+	// the registers of the battery packs which are not there are all zeroes
+	if pack, ok := r.target.(*batteryData); ok && !pack.isPresent() {
+		return
+	}
+	target := r.values.block.Target
+	if len(target) == 0 {
+		target = mqttSlug(r.name)
+	}
+	r.values.RLock()
+	defer r.values.RUnlock()
+	for i := range r.values.values {
+		v := &r.values.values[i]
+		if v.field.Type == registerTypeSTR || !d.caps.hasValue(v) || math.IsNaN(v.number) || math.IsInf(v.number, 0) {
+			continue
+		}
+		s := historySample{device: d.name, field: target + "." + v.key(), at: r.values.lastRead, value: v.number}
+		s.keep = x.fields[s.field]
+		// a counter read as 0 is a battery not there, or a bad read, which would count all the energy in one day
+		s.energy = historyEnergyTargets[target] && v.field.Kind == metricCounter && v.field.Unit == "kWh" && v.number > 0
+		if !s.keep && !s.energy {
+			continue
+		}
+		select {
+		case x.queue <- s:
+		default:
+			x.mutex.Lock()
+			x.dropped++
+			x.mutex.Unlock()
+		}
+	}
+}
+
+// historyPoint is a sample, as the API returns it. The minimum and maximum are only in the rolled up ones.
+type historyPoint struct {
+	Time  string   `json:"time"`
+	Value float64  `json:"value"`
+	Min   *float64 `json:"min,omitempty"`
+	Max   *float64 `json:"max,omitempty"`
+}
+
+// historySeries are the samples of a value of a device.
+type historySeries struct {
+	Device     string         `json:"device"`
+	Field      string         `json:"field"`
+	Resolution string         `json:"resolution"`
+	Points     []historyPoint `json:"points"`
+}
+
+// findHistoryResolution returns the resolution with the given name, or else the finest one still kept at from.
+func findHistoryResolution(name string, from, now time.Time) (historyResolution, error) {
+	for _, r := range historyResolutions {
+		if len(name) > 0 && r.name == name {
+			return r, nil
+		}
+		if len(name) == 0 && (r.retention == 0 || !from.Before(now.Add(-r.retention))) {
+			return r, nil
+		}
+	}
+	return historyResolution{}, fmt.Errorf("invalid resolution %q, not raw, 5m or 1h", name)
+}
+
+// query returns the samples of the field from..to, of the device or of all of them, by device.
+func (x *historyStore) query(device, field string, res historyResolution, from, to time.Time) ([]historySeries, error) {
+	q := `SELECT device, at, value, low, high FROM samples WHERE field = ? AND resolution = ? AND at >= ? AND at <= ?`
+	args := []any{field, res.seconds, from.Unix(), to.Unix()}
+	if len(device) > 0 {
+		q += ` AND device = ?`
+		args = append(args, device)
+	}
+	rows, err := x.db.Query(q+` ORDER BY device, at`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	out := []historySeries{}
+	for rows.Next() {
+		var name string
+		var at int64
+		var value, low, high float64
+		if err := rows.Scan(&name, &at, &value, &low, &high); err != nil {
+			return nil, err
+		}
+		if len(out) == 0 || out[len(out)-1].Device != name {
+			out = append(out, historySeries{Device: name, Field: field, Resolution: res.name})
+		}
+		p := historyPoint{Time: time.Unix(at, 0).Format(time.RFC3339), Value: value}
+		if res.seconds > 0 {
+			p.Min, p.Max = &low, &high
+		}
+		s := &out[len(out)-1]
+		s.Points = append(s.Points, p)
+	}
+	return out, rows.Err()
+}
+
+// historyEnergyDay is the energy of each counter of a device in a day, in kWh.
+type historyEnergyDay struct {
+	Device string             `json:"device"`
+	Day    string             `json:"day"`
+	KWh    map[string]float64 `json:"kWh"`
+}
+
+// energyDays returns the daily energies from..to, as dates, of the device or of all of them. The energy of a day is
+// from the last value of the day before, if it was read then, so that nothing is lost between the days, or else from
+// the first value of the day.
+func (x *historyStore) energyDays(device, from, to string) ([]historyEnergyDay, error) {
+	first, err := time.Parse(time.DateOnly, from)
+	if err != nil {
+		return nil, err
+	}
+	q := `SELECT device, counter, day, first, last FROM energy_days WHERE day >= ? AND day <= ?`
+	args := []any{first.AddDate(0, 0, -1).Format(time.DateOnly), to}
+	if len(device) > 0 {
+		q += ` AND device = ?`
+		args = append(args, device)
+	}
+	rows, err := x.db.Query(q+` ORDER BY device, counter, day`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	days := make(map[[2]string]*historyEnergyDay)
+	var prev struct {
+		device, counter, day string
+		last                 float64
+	}
+	for rows.Next() {
+		var name, counter, day string
+		var firstValue, lastValue float64
+		if err := rows.Scan(&name, &counter, &day, &firstValue, &lastValue); err != nil {
+			return nil, err
+		}
+		base := firstValue
+		if prev.device == name && prev.counter == counter && prev.day == previousDay(day) && prev.last <= lastValue {
+			base = prev.last
+		}
+		prev.device, prev.counter, prev.day, prev.last = name, counter, day, lastValue
+		if day < from {
+			continue
+		}
+		e := days[[2]string{name, day}]
+		if e == nil {
+			e = &historyEnergyDay{Device: name, Day: day, KWh: make(map[string]float64)}
+			days[[2]string{name, day}] = e
+		}
+		// the counters have 2 decimals, the subtraction of floats many more
+		e.KWh[counter] = math.Round(max(lastValue-base, 0)*100) / 100
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	out := make([]historyEnergyDay, 0, len(days))
+	for _, e := range days {
+		out = append(out, *e)
+	}
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].Device != out[j].Device {
+			return out[i].Device < out[j].Device
+		}
+		return out[i].Day < out[j].Day
+	})
+	return out, nil
+}
+
+// previousDay returns the date before the given one, empty if not a date.
+func previousDay(day string) string {
+	t, err := time.Parse(time.DateOnly, day)
+	if err != nil {
+		return ""
+	}
+	return t.AddDate(0, 0, -1).Format(time.DateOnly)
+}
+
+func (x *historyStore) collectMetrics(r *metricsRegistry) {
+	x.mutex.Lock()
+	defer x.mutex.Unlock()
+	r.counter("sun2000_history_samples_written_total", "Samples written to the history", float64(x.written))
+	r.counter("sun2000_history_samples_dropped_total", "Samples dropped, not fitting in the queue or failing to be written", float64(x.dropped))
+	r.counter("sun2000_history_errors_total", "Failed writes and roll-ups of the history", float64(x.failures))
+}
+
+// handleHistory serves the samples of a field, from..to (RFC3339, the last 24 hours by default), at the resolution
+// given, or else the finest one still kept at from.
+func handleHistory(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	field := q.Get("field")
+	if len(field) == 0 {
+		http.Error(w, "field is required, e.g. inverter.activePower", http.StatusBadRequest)
+		return
+	}
+	now := time.Now()
+	to, from := now, time.Time{}
+	var err error
+	if s := q.Get("to"); len(s) > 0 {
+		if to, err = time.Parse(time.RFC3339, s); err != nil {
+			http.Error(w, fmt.Sprintf("invalid to: %v", err), http.StatusBadRequest)
+			return
+		}
+	}
+	from = to.Add(-24 * time.Hour)
+	if s := q.Get("from"); len(s) > 0 {
+		if from, err = time.Parse(time.RFC3339, s); err != nil {
+			http.Error(w, fmt.Sprintf("invalid from: %v", err), http.StatusBadRequest)
+			return
+		}
+	}
+	res, err := findHistoryResolution(q.Get("resolution"), from, now)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	out, err := history.query(q.Get("device"), field, res, from, to)
+	if err != nil {
+		lError.Printf("Error querying the history: %v", err)
+		http.Error(w, "history query failed", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(out)
+}
+
+// handleHistoryEnergy serves the daily energies from..to (as dates, the last 30 days by default).
+func handleHistoryEnergy(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	to := time.Now().In(history.loc).Format(time.DateOnly)
+	if s := q.Get("to"); len(s) > 0 {
+		if _, err := time.Parse(time.DateOnly, s); err != nil {
+			http.Error(w, fmt.Sprintf("invalid to: %v", err), http.StatusBadRequest)
+			return
+		}
+		to = s
+	}
+	last, _ := time.Parse(time.DateOnly, to)
+	from := last.AddDate(0, 0, -29).Format(time.DateOnly)
+	if s := q.Get("from"); len(s) > 0 {
+		if _, err := time.Parse(time.DateOnly, s); err != nil {
+			http.Error(w, fmt.Sprintf("invalid from: %v", err), http.StatusBadRequest)
+			return
+		}
+		from = s
+	}
+	out, err := history.energyDays(q.Get("device"), from, to)
+	if err != nil {
+		lError.Printf("Error querying the history: %v", err)
+		http.Error(w, "history query failed", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(out)
+}
@@ -0,0 +1,196 @@
+// Copyright: 2024 Dragos Vingarzan vingarzan -at- gmail -dot- com
+// License: AGPL-3.0
+//
+// This file is part of sun2000-modbus.
+//
+// sun2000-modbus is free software: you can redistribute it and/or modify it under the terms of the GNU Affero General
+// Public License Version 3 (AGPL-3.0) as published by the Free Software Foundation.
+//
+// sun2000-modbus is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY; without even the implied
+// warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the AGPL-3.0 along with sun2000-modbus. If not,
+// see <https://www.gnu.org/licenses/>.
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func newTestHistory(t *testing.T) *historyStore {
+	t.Helper()
+	x, err := newHistoryStore(historyConfig{path: filepath.Join(t.TempDir(), "history.db"), fields: []string{"inverter.activePower"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	x.loc = time.UTC
+	t.Cleanup(func() { x.db.Close() })
+	return x
+}
+
+func TestHistoryRollup(t *testing.T) {
+	x := newTestHistory(t)
+	now := time.Date(2024, 6, 21, 12, 0, 0, 0, time.UTC)
+
+	// one sample a minute for the last 3 hours, the value being the minute, and one past the raw retention
+	samples := []historySample{{device: "sun2000", field: "inverter.activePower", at: now.Add(-50 * time.Hour), value: 1, keep: true}}
+	for at := now.Add(-3 * time.Hour); at.Before(now); at = at.Add(time.Minute) {
+		samples = append(samples, historySample{device: "sun2000", field: "inverter.activePower", at: at, value: float64(at.Minute()), keep: true})
+	}
+	if err := x.write(samples); err != nil {
+		t.Fatal(err)
+	}
+	x.rollup(now)
+
+	from, to := now.Add(-3*time.Hour), now
+	raw, err := x.query("", "inverter.activePower", historyResolutions[0], now.Add(-100*time.Hour), to)
+	if err != nil || len(raw) != 1 || len(raw[0].Points) != 180 {
+		t.Fatalf("raw samples: %v %+v", err, raw)
+	}
+	if raw[0].Points[0].Min != nil {
+		t.Errorf("a raw sample with a minimum")
+	}
+	fiveMinutes, err := x.query("sun2000", "inverter.activePower", historyResolutions[1], from, to)
+	if err != nil || len(fiveMinutes) != 1 || len(fiveMinutes[0].Points) != 36 {
+		t.Fatalf("5m samples: %v %+v", err, fiveMinutes)
+	}
+	// 10:05 to 10:09
+	p := fiveMinutes[0].Points[1]
+	if p.Time != "2024-06-21T09:05:00Z" || p.Value != 7 || *p.Min != 5 || *p.Max != 9 {
+		t.Errorf("5m sample %+v", p)
+	}
+	hours, err := x.query("sun2000", "inverter.activePower", historyResolutions[2], from, to)
+	if err != nil || len(hours) != 1 || len(hours[0].Points) != 3 {
+		t.Fatalf("1h samples: %v %+v", err, hours)
+	}
+	if p := hours[0].Points[2]; p.Time != "2024-06-21T11:00:00Z" || p.Value != 29.5 || *p.Min != 0 || *p.Max != 59 {
+		t.Errorf("1h sample %+v", p)
+	}
+	if none, _ := x.query("other", "inverter.activePower", historyResolutions[0], from, to); len(none) != 0 {
+		t.Errorf("samples of another device: %+v", none)
+	}
+
+	for _, c := range []struct {
+		name string
+		from time.Time
+		want string
+	}{
+		{"", now.Add(-24 * time.Hour), "raw"},
+		{"", now.Add(-30 * 24 * time.Hour), "5m"},
+		{"", now.Add(-365 * 24 * time.Hour), "1h"},
+		{"1h", now.Add(-time.Hour), "1h"},
+	} {
+		if r, err := findHistoryResolution(c.name, c.from, now); err != nil || r.name != c.want {
+			t.Errorf("findHistoryResolution(%q, %s) = %q, %v, want %q", c.name, c.from, r.name, err, c.want)
+		}
+	}
+	if _, err := findHistoryResolution("1d", now, now); err == nil {
+		t.Errorf("an invalid resolution was accepted")
+	}
+}
+
+func TestHistoryEnergyDays(t *testing.T) {
+	x := newTestHistory(t)
+	counter := func(day string, hour int, value float64) historySample {
+		at, _ := time.Parse(time.DateOnly, day)
+		return historySample{device: "sun2000", field: "cumulative1.cumulativeGeneratedElectricity", at: at.Add(time.Duration(hour) * time.Hour), value: value, energy: true}
+	}
+	err := x.write([]historySample{
+		counter("2024-06-01", 6, 100), counter("2024-06-01", 20, 110.5),
+		counter("2024-06-02", 6, 111), counter("2024-06-02", 12, 115), counter("2024-06-02", 20, 120.1),
+		// nothing read on the 3rd
+		counter("2024-06-04", 6, 130), counter("2024-06-04", 20, 135),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	days, err := x.energyDays("", "2024-06-02", "2024-06-30")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]float64{"2024-06-02": 9.6, "2024-06-04": 5}
+	if len(days) != len(want) {
+		t.Fatalf("days %+v", days)
+	}
+	for _, d := range days {
+		if got := d.KWh["cumulative1.cumulativeGeneratedElectricity"]; got != want[d.Day] {
+			t.Errorf("%s: %v kWh, want %v", d.Day, got, want[d.Day])
+		}
+	}
+}
+
+func TestHistoryStore(t *testing.T) {
+	server := startSimulator(t, nil)
+	d := simulatorDevices(t, server, 1)[0]
+	d.readModbusFromTo("dummy read", 30000, 30015)
+	d.readExpiredRanges(context.Background())
+
+	x := newTestHistory(t)
+	for i := range d.addrRanges {
+		if !d.addrRanges[i].values.getLastRead().IsZero() {
+			x.blockParsed(d, &d.addrRanges[i])
+		}
+	}
+	queued := len(x.queue)
+	x.flushInterval = 10 * time.Millisecond
+	go x.run()
+	history = x
+	defer func() { history = nil }()
+	waitFor(t, "the samples to be written", func() bool {
+		x.mutex.Lock()
+		defer x.mutex.Unlock()
+		return x.written >= uint64(queued)
+	})
+
+	get := func(url string, out any) {
+		t.Helper()
+		w := httptest.NewRecorder()
+		mux := http.NewServeMux()
+		mux.HandleFunc("GET /api/v1/history", handleHistory)
+		mux.HandleFunc("GET /api/v1/history/energy", handleHistoryEnergy)
+		mux.ServeHTTP(w, httptest.NewRequest("GET", url, nil))
+		if out == nil {
+			if w.Code != http.StatusBadRequest {
+				t.Errorf("%s: %d, want 400", url, w.Code)
+			}
+			return
+		}
+		if w.Code != http.StatusOK {
+			t.Fatalf("%s: %d %s", url, w.Code, w.Body)
+		}
+		if err := json.Unmarshal(w.Body.Bytes(), out); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var series []historySeries
+	get("/api/v1/history?field=inverter.activePower&device=other", &series)
+	if series == nil || len(series) != 0 {
+		t.Errorf("series of another device %+v", series)
+	}
+	get("/api/v1/history?field=inverter.activePower", &series)
+	if len(series) != 1 || series[0].Device != d.name || series[0].Resolution != "raw" || len(series[0].Points) != 1 {
+		t.Errorf("series %+v", series)
+	}
+	var days []historyEnergyDay
+	get("/api/v1/history/energy", &days)
+	if len(days) != 1 {
+		t.Fatalf("days %+v", days)
+	}
+	for _, counter := range []string{"cumulative1.cumulativeGeneratedElectricity", "esu1.totalCharge", "esu1.totalDischarge"} {
+		// read once, so nothing yet
+		if kWh, ok := days[0].KWh[counter]; !ok || kWh != 0 {
+			t.Errorf("%s: %v, %v", counter, kWh, ok)
+		}
+	}
+	get("/api/v1/history", nil)
+	get("/api/v1/history?field=inverter.activePower&resolution=1d", nil)
+	get("/api/v1/history/energy?from=yesterday", nil)
+	x.close()
+}
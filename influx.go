@@ -0,0 +1,453 @@
+// Copyright: 2024 Dragos Vingarzan vingarzan -at- gmail -dot- com
+// License: AGPL-3.0
+//
+// This file is part of sun2000-modbus.
+//
+// sun2000-modbus is free software: you can redistribute it and/or modify it under the terms of the GNU Affero General
+// Public License Version 3 (AGPL-3.0) as published by the Free Software Foundation.
+//
+// sun2000-modbus is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY; without even the implied
+// warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the AGPL-3.0 along with sun2000-modbus. If not,
+// see <https://www.gnu.org/licenses/>.
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The InfluxDB v2 writer sends each block read as one point of line protocol, to the HTTP write API:
+//
+//	inverter,device=sun2000,model=SUN2000-10KTL-M1,sn=... activePower=3.12,... 1718967605000
+//
+// The measurement is the built-in target of the block (or its name), the tags the device, model and SN, plus the
+// labels of the block (e.g. esu and pack), and the fields the values, with the time of the read. The points are sent
+// in batches, and those which could not be sent are kept (in a file, if set) and sent again later.
+
+const (
+	influxQueueSize = 1024
+	// the wait before retrying, doubling each time up to influxRetryMax
+	influxRetryMin = 5 * time.Second
+	influxRetryMax = 5 * time.Minute
+)
+
+type influxConfig struct {
+	// e.g. http://influxdb:8086
+	url    string
+	token  string
+	org    string
+	bucket string
+	// the points are sent when there are this many, or every flushInterval
+	batchSize     int
+	flushInterval time.Duration
+	// optional file keeping the points not sent yet, across restarts
+	bufferFile string
+	// how many points are kept for the retries, in memory or in the file; the newer ones are dropped beyond that
+	bufferMaxPoints int
+}
+
+type influxWriter struct {
+	cfg      influxConfig
+	writeURL string
+	client   *http.Client
+	queue    chan []byte
+
+	// owned by run()
+	batch    [][]byte
+	backoff  time.Duration
+	retryAt  time.Time
+	retryMin time.Duration
+
+	// the points not sent yet, if there is no buffer file
+	mutex    sync.Mutex
+	buffered [][]byte
+	// the number of points in the buffer, in memory or in the file
+	bufferedCount int
+	written       uint64
+	failures      uint64
+	dropped       uint64
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+// The InfluxDB writer, if enabled, set up by main().
+var influx *influxWriter
+
+func newInfluxWriter(c influxConfig) (*influxWriter, error) {
+	u, err := url.Parse(c.url)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || len(u.Host) == 0 {
+		return nil, fmt.Errorf("invalid URL %q, not http(s)://host:port", c.url)
+	}
+	if len(c.org) == 0 || len(c.bucket) == 0 {
+		return nil, errors.New("INFLUX_ORG and INFLUX_BUCKET are required")
+	}
+	u = u.JoinPath("api/v2/write")
+	u.RawQuery = url.Values{"org": {c.org}, "bucket": {c.bucket}, "precision": {"ms"}}.Encode()
+	x := &influxWriter{
+		cfg:      c,
+		writeURL: u.String(),
+		client:   &http.Client{Timeout: 10 * time.Second},
+		queue:    make(chan []byte, influxQueueSize),
+		retryMin: influxRetryMin,
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+	if len(c.bufferFile) > 0 {
+		lines, err := readInfluxBuffer(c.bufferFile)
+		if err != nil {
+			return nil, err
+		}
+		if len(lines) > c.bufferMaxPoints {
+			// e.g. left by a run with a larger INFLUX_BUFFER_MAX_POINTS
+			lWarning.Printf("InfluxDB buffer %s too large, dropping %d points", c.bufferFile, len(lines)-c.bufferMaxPoints)
+			x.dropped += uint64(len(lines) - c.bufferMaxPoints)
+			lines = lines[:c.bufferMaxPoints]
+			if err = writeInfluxBuffer(c.bufferFile, lines); err != nil {
+				return nil, err
+			}
+		}
+		x.bufferedCount = len(lines)
+		if x.bufferedCount > 0 {
+			lInfo.Printf("InfluxDB: %d points left to send in %s", x.bufferedCount, c.bufferFile)
+		}
+	}
+	return x, nil
+}
+
+// run sends the queued points, in batches, until close() is called.
+func (x *influxWriter) run() {
+	defer close(x.done)
+	ticker := time.NewTicker(x.cfg.flushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-x.stop:
+			for len(x.queue) > 0 {
+				x.batch = append(x.batch, <-x.queue)
+			}
+			x.flush()
+			return
+		case line := <-x.queue:
+			x.batch = append(x.batch, line)
+			if len(x.batch) >= x.cfg.batchSize {
+				x.flush()
+			}
+		case <-ticker.C:
+			x.flush()
+		}
+	}
+}
+
+// close sends what is still queued, or buffers it if that fails.
+func (x *influxWriter) close() {
+	close(x.stop)
+	<-x.done
+}
+
+// flush sends the buffered points, then the batch. While retrying, the batch is buffered, to keep the order.
+func (x *influxWriter) flush() {
+	now := time.Now()
+	if now.Before(x.retryAt) || !x.sendBuffered() {
+		x.bufferLines(x.batch)
+		x.batch = nil
+		return
+	}
+	if len(x.batch) == 0 {
+		return
+	}
+	if err := x.send(x.batch); err != nil {
+		x.failed(err)
+		x.bufferLines(x.batch)
+	}
+	x.batch = nil
+}
+
+// failed schedules the next retry, waiting twice as long as the previous time.
+func (x *influxWriter) failed(err error) {
+	x.backoff = min(max(2*x.backoff, x.retryMin), influxRetryMax)
+	x.retryAt = time.Now().Add(x.backoff)
+	lWarning.Printf("InfluxDB write failed, retrying in %s: %v", x.backoff, err)
+}
+
+// errInfluxRejected is for the points which InfluxDB refuses, which are dropped, since sending them again won't help.
+var errInfluxRejected = errors.New("rejected by InfluxDB")
+
+// send POSTs the lines. Only the errors worth a retry are returned.
+func (x *influxWriter) send(lines [][]byte) error {
+	req, err := http.NewRequest(http.MethodPost, x.writeURL, bytes.NewReader(bytes.Join(lines, []byte("\n"))))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "text/plain; charset=utf-8")
+	if len(x.cfg.token) > 0 {
+		req.Header.Set("Authorization", "Token "+x.cfg.token)
+	}
+	resp, err := x.client.Do(req)
+	if err == nil {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		resp.Body.Close()
+		switch {
+		case resp.StatusCode/100 == 2:
+		case resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode/100 == 5:
+			err = fmt.Errorf("status %s: %s", resp.Status, bytes.TrimSpace(body))
+		default:
+			err = fmt.Errorf("%w, status %s: %s", errInfluxRejected, resp.Status, bytes.TrimSpace(body))
+		}
+	}
+
+	x.mutex.Lock()
+	defer x.mutex.Unlock()
+	switch {
+	case err == nil:
+		x.written += uint64(len(lines))
+		x.backoff = 0
+		return nil
+	case errors.Is(err, errInfluxRejected):
+		x.failures++
+		x.dropped += uint64(len(lines))
+		lError.Printf("InfluxDB dropping %d points: %v", len(lines), err)
+		return nil
+	}
+	x.failures++
+	return err
+}
+
+// bufferLines keeps the lines to be sent later, in the file if set, dropping them if the buffer is full.
+func (x *influxWriter) bufferLines(lines [][]byte) {
+	if len(lines) == 0 {
+		return
+	}
+	x.mutex.Lock()
+	defer x.mutex.Unlock()
+	if room := max(x.cfg.bufferMaxPoints-x.bufferedCount, 0); len(lines) > room {
+		lWarning.Printf("InfluxDB buffer full, dropping %d points", len(lines)-room)
+		x.dropped += uint64(len(lines) - room)
+		if lines = lines[:room]; len(lines) == 0 {
+			return
+		}
+	}
+	if len(x.cfg.bufferFile) == 0 {
+		x.buffered = append(x.buffered, lines...)
+		x.bufferedCount = len(x.buffered)
+		return
+	}
+	f, err := os.OpenFile(x.cfg.bufferFile, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o640)
+	if err == nil {
+		_, err = f.Write(append(bytes.Join(lines, []byte("\n")), '\n'))
+		if closeErr := f.Close(); err == nil {
+			err = closeErr
+		}
+	}
+	if err != nil {
+		lError.Printf("InfluxDB dropping %d points, which could not be buffered in %s: %v", len(lines), x.cfg.bufferFile, err)
+		x.dropped += uint64(len(lines))
+		return
+	}
+	x.bufferedCount += len(lines)
+}
+
+// sendBuffered sends the buffered points, in batches. false if some are left, after a failure.
+func (x *influxWriter) sendBuffered() bool {
+	x.mutex.Lock()
+	lines := x.buffered
+	count := x.bufferedCount
+	x.mutex.Unlock()
+	if count == 0 {
+		return true
+	}
+	if len(x.cfg.bufferFile) > 0 {
+		var err error
+		if lines, err = readInfluxBuffer(x.cfg.bufferFile); err != nil {
+			lError.Printf("InfluxDB dropping the buffer %s, which could not be read: %v", x.cfg.bufferFile, err)
+			lines = nil
+		}
+	}
+
+	sent := 0
+	var err error
+	for sent < len(lines) {
+		batch := lines[sent:min(sent+x.cfg.batchSize, len(lines))]
+		if err = x.send(batch); err != nil {
+			break
+		}
+		sent += len(batch)
+	}
+	if sent > 0 {
+		lInfo.Printf("InfluxDB sent %d buffered points", sent)
+	}
+
+	x.mutex.Lock()
+	defer x.mutex.Unlock()
+	left := lines[sent:]
+	if len(x.cfg.bufferFile) == 0 {
+		x.buffered = append([][]byte{}, left...)
+	} else if writeErr := writeInfluxBuffer(x.cfg.bufferFile, left); writeErr != nil {
+		lError.Printf("InfluxDB could not rewrite the buffer %s: %v", x.cfg.bufferFile, writeErr)
+	}
+	x.bufferedCount = len(left)
+	if err != nil {
+		x.failed(err)
+		return false
+	}
+	return true
+}
+
+func readInfluxBuffer(path string) (lines [][]byte, err error) {
+	f, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(nil, 1<<20)
+	for scanner.Scan() {
+		if len(scanner.Bytes()) > 0 {
+			lines = append(lines, append([]byte{}, scanner.Bytes()...))
+		}
+	}
+	return lines, scanner.Err()
+}
+
+// writeInfluxBuffer replaces the buffer file with the lines, through a temporary one. It is removed if empty.
+func writeInfluxBuffer(path string, lines [][]byte) error {
+	if len(lines) == 0 {
+		if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+		return nil
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, append(bytes.Join(lines, []byte("\n")), '\n'), 0o640); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// Line protocol escaping: the measurement, the tag keys and values and the field keys, and the string field values.
+var (
+	influxMeasurementEscaper = strings.NewReplacer(",", `\,`, " ", `\ `, "\n", `\n`)
+	influxKeyEscaper         = strings.NewReplacer(",", `\,`, "=", `\=`, " ", `\ `, "\n", `\n`)
+	influxStringEscaper      = strings.NewReplacer(`"`, `\"`, `\`, `\\`, "\n", `\n`)
+)
+
+// influxLine formats a point. The tags are appended in the order given, which should be sorted, and the empty ones
+// skipped. Without any field, it returns nil.
+func influxLine(measurement string, tags [][2]string, fields []influxField, at time.Time) []byte {
+	if len(fields) == 0 {
+		return nil
+	}
+	var b bytes.Buffer
+	b.WriteString(influxMeasurementEscaper.Replace(measurement))
+	for _, t := range tags {
+		if len(t[1]) == 0 {
+			continue
+		}
+		fmt.Fprintf(&b, ",%s=%s", influxKeyEscaper.Replace(t[0]), influxKeyEscaper.Replace(t[1]))
+	}
+	for i, f := range fields {
+		sep := ","
+		if i == 0 {
+			sep = " "
+		}
+		b.WriteString(sep + influxKeyEscaper.Replace(f.key) + "=")
+		if f.text != nil {
+			b.WriteString(`"` + influxStringEscaper.Replace(*f.text) + `"`)
+		} else {
+			b.WriteString(strconv.FormatFloat(f.number, 'g', -1, 64))
+		}
+	}
+	fmt.Fprintf(&b, " %d", at.UnixMilli())
+	return b.Bytes()
+}
+
+// influxField is a field of a point: a string if text is set, else a float.
+type influxField struct {
+	key    string
+	number float64
+	text   *string
+}
+
+// blockParsed queues the point of the block, dropping it if InfluxDB is not keeping up, so that the poller is never
+// blocked. The strings are written as strings, and everything else as floats, even the enums and bitfields, since the
+// type of a field must not change.
+func (x *influxWriter) blockParsed(d *device, r *modbusInterval) {
+	id := &d.data.identification
+	id.RLock()
+	if id.lastRead.IsZero() {
+		// without the SN, the points would go to another series
+		id.RUnlock()
+		return
+	}
+	tags := [][2]string{{"device", d.name}, {"model", id.Model}, {"sn", id.SN}}
+	id.RUnlock()
+
+	// the registers of the battery packs which are not there are all zeroes
+	if pack, ok := r.target.(*batteryData); ok && !pack.isPresent() {
+		return
+	}
+
+	measurement := r.values.block.Target
+	if len(measurement) == 0 {
+		measurement = mqttSlug(r.name)
+	}
+	r.values.RLock()
+	for k, v := range r.values.block.Labels {
+		tags = append(tags, [2]string{k, v})
+	}
+	var fields []influxField
+	for i := range r.values.values {
+		v := &r.values.values[i]
+		if !d.caps.hasValue(v) {
+			continue
+		}
+		f := influxField{key: v.key(), number: v.number}
+		if v.field.Type == registerTypeSTR {
+			f.text = &v.text
+		} else if math.IsNaN(v.number) || math.IsInf(v.number, 0) {
+			continue
+		}
+		fields = append(fields, f)
+	}
+	sort.Slice(tags, func(i, j int) bool { return tags[i][0] < tags[j][0] })
+	line := influxLine(measurement, tags, fields, r.values.lastRead)
+	r.values.RUnlock()
+	if line == nil {
+		return
+	}
+
+	select {
+	case x.queue <- line:
+	default:
+		x.mutex.Lock()
+		x.dropped++
+		x.mutex.Unlock()
+		lWarning.Printf("InfluxDB queue full, dropping the point of %s", r.name)
+	}
+}
+
+func (x *influxWriter) collectMetrics(r *metricsRegistry) {
+	x.mutex.Lock()
+	defer x.mutex.Unlock()
+	r.counter("sun2000_influx_points_written_total", "Points written to InfluxDB", float64(x.written))
+	r.counter("sun2000_influx_write_errors_total", "Failed writes to InfluxDB", float64(x.failures))
+	r.counter("sun2000_influx_points_dropped_total", "Points dropped, rejected by InfluxDB or not fitting in the queue or buffer", float64(x.dropped))
+	r.gauge("sun2000_influx_buffered_points", "Points waiting to be sent to InfluxDB again", float64(x.bufferedCount))
+}
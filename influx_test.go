@@ -0,0 +1,221 @@
+// Copyright: 2024 Dragos Vingarzan vingarzan -at- gmail -dot- com
+// License: AGPL-3.0
+//
+// This file is part of sun2000-modbus.
+//
+// sun2000-modbus is free software: you can redistribute it and/or modify it under the terms of the GNU Affero General
+// Public License Version 3 (AGPL-3.0) as published by the Free Software Foundation.
+//
+// sun2000-modbus is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY; without even the implied
+// warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the AGPL-3.0 along with sun2000-modbus. If not,
+// see <https://www.gnu.org/licenses/>.
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestInfluxLine(t *testing.T) {
+	text := `a "quoted" \ text`
+	line := influxLine("ESU1 Data", [][2]string{{"device", "my,inverter"}, {"model", ""}, {"sn", "a=b"}},
+		[]influxField{{key: "activePower", number: 3.12}, {key: "sn x", text: &text}}, time.UnixMilli(1718967605123))
+	want := `ESU1\ Data,device=my\,inverter,sn=a\=b activePower=3.12,sn\ x="a \"quoted\" \\ text" 1718967605123`
+	if string(line) != want {
+		t.Errorf("got  %s\nwant %s", line, want)
+	}
+	if influxLine("empty", nil, nil, time.Now()) != nil {
+		t.Errorf("a point without fields")
+	}
+}
+
+// influxStandIn is a local stand-in for the InfluxDB write API.
+type influxStandIn struct {
+	sync.Mutex
+	status int
+	lines  []string
+	auth   string
+	query  string
+}
+
+func (x *influxStandIn) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, _ := io.ReadAll(r.Body)
+	x.Lock()
+	defer x.Unlock()
+	x.auth, x.query = r.Header.Get("Authorization"), r.URL.RawQuery
+	if x.status != 0 {
+		http.Error(w, "not now", x.status)
+		return
+	}
+	x.lines = append(x.lines, strings.Split(string(body), "\n")...)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (x *influxStandIn) setStatus(status int) {
+	x.Lock()
+	defer x.Unlock()
+	x.status = status
+}
+
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	for deadline := time.Now().Add(5 * time.Second); !cond(); {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestInfluxWriter(t *testing.T) {
+	server := startSimulator(t, nil)
+	d := simulatorDevices(t, server, 1)[0]
+	d.readModbusFromTo("dummy read", 30000, 30015)
+	d.readExpiredRanges(context.Background())
+
+	standIn := &influxStandIn{status: http.StatusServiceUnavailable}
+	db := httptest.NewServer(standIn)
+	defer db.Close()
+	c := influxConfig{url: db.URL, token: "secret", org: "home", bucket: "solar", batchSize: 5, flushInterval: 20 * time.Millisecond,
+		bufferMaxPoints: 1000, bufferFile: filepath.Join(t.TempDir(), "influx.buffer")}
+	if _, err := newInfluxWriter(influxConfig{url: "influx:8086", org: "home", bucket: "solar"}); err == nil {
+		t.Errorf("a URL without a scheme was accepted")
+	}
+	newWriter := func() *influxWriter {
+		x, err := newInfluxWriter(c)
+		if err != nil {
+			t.Fatal(err)
+		}
+		x.retryMin = 10 * time.Millisecond
+		return x
+	}
+	// queues the points of all the blocks read, then starts sending them
+	points := 0
+	parsedAndRun := func(x *influxWriter) {
+		for i := range d.addrRanges {
+			if !d.addrRanges[i].values.getLastRead().IsZero() {
+				x.blockParsed(d, &d.addrRanges[i])
+			}
+		}
+		points += len(x.queue)
+		go x.run()
+	}
+
+	// while InfluxDB is down, the points go to the buffer file, and stay there across restarts
+	x := newWriter()
+	parsedAndRun(x)
+	waitFor(t, "the buffered points", func() bool {
+		x.mutex.Lock()
+		defer x.mutex.Unlock()
+		return x.bufferedCount > 0 && x.failures > 0
+	})
+	x.close()
+	if x.written != 0 {
+		t.Errorf("%d points written while InfluxDB was down", x.written)
+	}
+	buffered, err := readInfluxBuffer(c.bufferFile)
+	if err != nil || len(buffered) == 0 {
+		t.Fatalf("nothing buffered in the file: %v", err)
+	}
+
+	standIn.setStatus(0)
+	x = newWriter()
+	parsedAndRun(x)
+	waitFor(t, "the points to be written", func() bool {
+		x.mutex.Lock()
+		defer x.mutex.Unlock()
+		return x.written+x.dropped >= uint64(points)
+	})
+	x.close()
+	if x.dropped != 0 || x.written != uint64(points) {
+		t.Errorf("%d points written and %d dropped, of %d", x.written, x.dropped, points)
+	}
+	if _, err := os.Stat(c.bufferFile); !os.IsNotExist(err) {
+		t.Errorf("the buffer file is still there: %v", err)
+	}
+
+	standIn.Lock()
+	if standIn.auth != "Token secret" || standIn.query != "bucket=solar&org=home&precision=ms" {
+		t.Errorf("unexpected authorization %q or query %q", standIn.auth, standIn.query)
+	}
+	var inverter, pack string
+	for _, l := range standIn.lines {
+		switch {
+		case strings.HasPrefix(l, "inverter,"):
+			inverter = l
+		case strings.HasPrefix(l, "esu1Pack1,"):
+			pack = l
+		}
+	}
+	standIn.Unlock()
+	if !strings.HasPrefix(inverter, "inverter,device=sim1,model=") || !strings.Contains(inverter, ",sn=") ||
+		!strings.Contains(inverter, ",activePower=") || !strings.Contains(inverter, ",inverterFrequency=50,") {
+		t.Errorf("unexpected inverter point %q", inverter)
+	}
+	if !strings.Contains(pack, ",esu=1,") || !strings.Contains(pack, ",pack=1,") || !strings.Contains(pack, `sn="`) {
+		t.Errorf("unexpected battery pack point %q", pack)
+	}
+
+	// the points which InfluxDB refuses are dropped, not retried
+	standIn.setStatus(http.StatusBadRequest)
+	x = newWriter()
+	parsedAndRun(x)
+	x.close()
+	if x.dropped == 0 || x.bufferedCount != 0 {
+		t.Errorf("%d points dropped and %d buffered after a 400", x.dropped, x.bufferedCount)
+	}
+}
+
+func TestInfluxBufferLimit(t *testing.T) {
+	line := func(i int) []byte { return []byte(fmt.Sprintf("inverter,device=sim1 activePower=%d 1718967605000", i)) }
+	var lines [][]byte
+	for i := range 10 {
+		lines = append(lines, line(i))
+	}
+	c := influxConfig{url: "http://influxdb:8086", org: "home", bucket: "solar", batchSize: 5, flushInterval: time.Second,
+		bufferMaxPoints: 4, bufferFile: filepath.Join(t.TempDir(), "influx.buffer")}
+	if err := writeInfluxBuffer(c.bufferFile, lines); err != nil {
+		t.Fatal(err)
+	}
+
+	// a buffer file larger than the limit, e.g. from a larger INFLUX_BUFFER_MAX_POINTS, is cut to it on loading
+	x, err := newInfluxWriter(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if x.bufferedCount != 4 || x.dropped != 6 {
+		t.Errorf("%d points buffered and %d dropped on loading, not 4 and 6", x.bufferedCount, x.dropped)
+	}
+	if buffered, err := readInfluxBuffer(c.bufferFile); err != nil || len(buffered) != 4 || !bytes.Equal(buffered[3], lines[3]) {
+		t.Errorf("unexpected buffer file %q: %v", buffered, err)
+	}
+	// and a full one takes no more
+	x.bufferLines(lines[:2])
+	if x.bufferedCount != 4 || x.dropped != 8 {
+		t.Errorf("%d points buffered and %d dropped when full, not 4 and 8", x.bufferedCount, x.dropped)
+	}
+
+	// the same in memory
+	c.bufferFile = ""
+	if x, err = newInfluxWriter(c); err != nil {
+		t.Fatal(err)
+	}
+	x.bufferLines(lines[:3])
+	x.bufferLines(lines[3:])
+	if x.bufferedCount != 4 || len(x.buffered) != 4 || x.dropped != 6 || !bytes.Equal(x.buffered[3], lines[3]) {
+		t.Errorf("%d points buffered and %d dropped in memory, not 4 and 6", len(x.buffered), x.dropped)
+	}
+}
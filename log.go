@@ -15,6 +15,8 @@
 package main
 
 import (
+	"fmt"
+	"io"
 	"log"
 	"os"
 )
@@ -58,3 +60,23 @@ func init() {
 	log.SetFlags(logFormat)
 	log.SetPrefix(prefix + "      | ")
 }
+
+// setLogLevel turns off the loggers below the level: debug, info, warning or error. The Modbus traffic is logged at
+// the debug level.
+func setLogLevel(level string) error {
+	loggers := []*log.Logger{lDebug, lModBus, lInfo, lWarning, lError}
+	// the first of the loggers which stays on
+	first := map[string]int{"debug": 0, "info": 2, "warning": 3, "error": 4}
+	n, ok := first[level]
+	if !ok {
+		return fmt.Errorf("unknown log level %q", level)
+	}
+	for i, l := range loggers {
+		if i < n {
+			l.SetOutput(io.Discard)
+		} else {
+			l.SetOutput(os.Stderr)
+		}
+	}
+	return nil
+}
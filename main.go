@@ -15,38 +15,107 @@
 package main
 
 import (
+	"context"
+	"errors"
+	"flag"
 	"fmt"
 	"log"
 	"net/http"
+	"os"
+	"os/signal"
+	"strings"
 	"sync"
+	"syscall"
 	"time"
-
-	"github.com/goburrow/modbus"
 )
 
 // Global variables, because we are lazy
 var (
 	cfg config
 
-	handlerModbus *modbus.TCPClientHandler
-	clientModbus  modbus.Client
-
-	lastSuccessTime   time.Time
-	errorCount        uint
-	totalErrorCount   uint
-	totalSuccessCount uint
-
-	parsedData sun2000DataStruct
+	devices []*device
 )
 
 func handleMetrics(w http.ResponseWriter, r *http.Request) {
-	fmt.Fprint(w, parsedData.metricsString())
+	if cfg.metricsFormat == "legacy" {
+		for _, d := range devices {
+			fmt.Fprint(w, d.metricsString())
+		}
+		return
+	}
+
+	registry := newMetricsRegistry()
+	for _, d := range devices {
+		d.collectMetrics(registry)
+	}
+	collectConnectionMetrics(registry, devices)
+	energy.collectMetrics(registry)
+	stream.collectMetrics(registry)
+	if gateway != nil {
+		gateway.collectMetrics(registry)
+	}
+	if influx != nil {
+		influx.collectMetrics(registry)
+	}
+	if history != nil {
+		history.collectMetrics(registry)
+	}
+	if powerLimits != nil {
+		powerLimits.collectMetrics(registry)
+	}
+	openMetrics := strings.Contains(r.Header.Get("Accept"), "application/openmetrics-text")
+	if openMetrics {
+		w.Header().Set("Content-Type", "application/openmetrics-text; version=1.0.0; charset=utf-8")
+	} else {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	}
+	if err := registry.write(w, openMetrics); err != nil {
+		lWarning.Printf("Error writing the metrics: %v", err)
+	}
 }
 
 func main() {
 
-	cfg.setDefaults()
-	cfg.getFromEnv()
+	if len(os.Args) > 1 && os.Args[1] == "simulate" {
+		if err := runSimulator(os.Args[2:]); err != nil && !errors.Is(err, flag.ErrHelp) {
+			log.Fatal(err)
+		}
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "config" {
+		if err := runConfig(os.Args[2:]); err != nil {
+			if !errors.Is(err, flag.ErrHelp) {
+				fmt.Fprintln(os.Stderr, err)
+			}
+			os.Exit(1)
+		}
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "scan" {
+		if err := runScan(os.Args[2:]); err != nil && !errors.Is(err, flag.ErrHelp) {
+			log.Fatal(err)
+		}
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "battery" {
+		if err := runBattery(os.Args[2:]); err != nil && !errors.Is(err, flag.ErrHelp) {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	if err := cfg.load(os.Args[1:]); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return
+		}
+		log.Fatalf("Bad configuration:\n%v", err)
+	}
+	if len(cfg.configFile) > 0 {
+		lInfo.Printf("Loaded the configuration from %s", cfg.configFile)
+	}
+
+	// stop on SIGTERM (e.g. from Kubernetes) or Ctrl-C
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
 
 	var wg sync.WaitGroup
 	var err error
@@ -54,20 +123,172 @@ func main() {
 	listenOn := fmt.Sprintf("%s:%s", cfg.httpIP, cfg.httpPort)
 
 	http.HandleFunc("/metrics", handleMetrics)
-	wg.Add(1)
+	http.HandleFunc("GET /api/v1/{category}", handleAPI)
+	http.HandleFunc("GET /api/v1/alarms/events", handleAlarmEvents)
+	http.HandleFunc("GET /api/v1/energy", handleEnergy)
+	http.HandleFunc("GET /api/v1/dashboard", handleDashboardData)
+	http.HandleFunc("GET /api/v1/stream", handleStream)
+	http.HandleFunc("GET /{$}", handleDashboard)
+	if cfg.controlEnabled {
+		if len(cfg.controlToken) == 0 {
+			lWarning.Printf("The battery control API is enabled without a CONTROL_TOKEN, anyone reaching %s can use it!", listenOn)
+		}
+		http.HandleFunc("/api/v1/control/battery", handleBatteryControl)
+		http.HandleFunc("/api/v1/control/power", handlePowerLimit)
+	}
+	if len(cfg.controlAuditLog) > 0 {
+		if err := auditLog.open(cfg.controlAuditLog); err != nil {
+			log.Fatalf("CONTROL_AUDIT_LOG: %v", err)
+		}
+	}
+
+	if len(cfg.captureFile) > 0 {
+		if err := captures.open(cfg.captureFile); err != nil {
+			log.Fatalf("MODBUS_CAPTURE: %v", err)
+		}
+		lInfo.Printf("Capturing the Modbus responses to %s", cfg.captureFile)
+	}
+
+	if regMap, err = cfg.loadRegisterMap(); err != nil {
+		log.Fatal(err)
+	}
+	if len(cfg.registerMap) > 0 {
+		lInfo.Printf("Loaded the register map from %s", cfg.registerMap)
+	}
+
+	if len(cfg.deviceProfile) > 0 {
+		profiles, err = loadDeviceProfiles(cfg.deviceProfile)
+		if err != nil {
+			log.Fatalf("DEVICE_PROFILE: %v", err)
+		}
+		lInfo.Printf("Loaded the device profiles from %s", cfg.deviceProfile)
+	}
+
+	// Init the modbus clients. If the SDongle is busy (e.g. still serving the previous instance), the pollers retry.
+	devices = newDevices(cfg.devices)
+	err = openConnections(devices)
+	if err != nil {
+		lWarning.Printf("%v, will retry", err)
+	}
+
+	if len(cfg.alarmEventLog) > 0 {
+		if err := alarmEvents.open(cfg.alarmEventLog); err != nil {
+			log.Fatalf("ALARM_EVENT_LOG: %v", err)
+		}
+	}
+	alarmEvents.addWebhooks(cfg.alarmWebhooks)
+	blockListeners = append(blockListeners, alarmEvents)
+
+	if len(cfg.energyStateFile) > 0 {
+		if err := energy.open(cfg.energyStateFile, cfg.energySaveInterval); err != nil {
+			log.Fatalf("ENERGY_STATE_FILE: %v", err)
+		}
+	}
+	blockListeners = append(blockListeners, energy, stream)
+
+	var mqttPub *mqttPublisher
+	if len(cfg.mqtt.broker) > 0 {
+		mqttPub, err = newMQTTPublisher(cfg.mqtt)
+		if err != nil {
+			log.Fatalf("MQTT_BROKER: %v", err)
+		}
+		go mqttPub.run()
+		blockListeners = append(blockListeners, mqttPub)
+	}
+
+	if len(cfg.influx.url) > 0 {
+		influx, err = newInfluxWriter(cfg.influx)
+		if err != nil {
+			log.Fatalf("INFLUX_URL: %v", err)
+		}
+		go influx.run()
+		blockListeners = append(blockListeners, influx)
+	}
+
+	if len(cfg.history.path) > 0 {
+		history, err = newHistoryStore(cfg.history)
+		if err != nil {
+			log.Fatalf("HISTORY_DB: %v", err)
+		}
+		go history.run()
+		blockListeners = append(blockListeners, history)
+		http.HandleFunc("GET /api/v1/history", handleHistory)
+		http.HandleFunc("GET /api/v1/history/energy", handleHistoryEnergy)
+	}
+
+	if len(cfg.powerLimitSchedule) > 0 {
+		powerLimits = newPowerLimiter(devices, cfg.powerLimitSchedule, time.Duration(cfg.powerLimitInterval)*time.Second)
+		go powerLimits.run()
+	}
+
+	var gatewayServer *modbusServer
+	if len(cfg.gatewayListen) > 0 {
+		gateway = newModbusGateway(devices, cfg.gatewayMaxAge, cfg.gatewayWriteAllow)
+		gatewayServer = newModbusServer(gateway)
+		if err := gatewayServer.listen(cfg.gatewayListen); err != nil {
+			log.Fatalf("GATEWAY_LISTEN: %v", err)
+		}
+		lInfo.Printf("Serving the Modbus gateway on %s", gatewayServer.addr())
+		go func() {
+			if err := gatewayServer.serve(); err != nil {
+				lError.Printf("Modbus gateway: %v", err)
+			}
+		}()
+	}
+
+	server := &http.Server{Addr: listenOn}
+	// the streams never end by themselves
+	server.RegisterOnShutdown(stream.close)
+	exitCode := 0
 	go func() {
-		lError.Fatal(http.ListenAndServe(listenOn, nil))
+		if err := server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			lError.Printf("HTTP server: %v", err)
+			exitCode = 1
+			stop()
+		}
 	}()
 
-	// Init the modbus client
-	handlerModbus, clientModbus, err = initModbus(cfg.modbusIP, cfg.modbusPort, cfg.modbusTimeout, cfg.modbusSlaveID)
-	if err != nil {
-		log.Fatal(err)
+	for _, d := range devices {
+		wg.Add(1)
+		go func(d *device) {
+			defer wg.Done()
+			d.readModbusLoop(ctx, uint(cfg.modbusSleep))
+		}(d)
 	}
 
-	wg.Add(1)
-	go readModbusLoop(uint(cfg.modbusSleep))
+	<-ctx.Done()
+	// a second signal kills the process right away
+	stop()
+	lInfo.Printf("Shutting down...")
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	if err := server.Shutdown(shutdownCtx); err != nil {
+		lWarning.Printf("HTTP server shutdown: %v", err)
+	}
+	cancel()
 
+	if gatewayServer != nil {
+		gatewayServer.close()
+	}
+	// the pollers finish the read in progress, if any
 	wg.Wait()
-	handlerModbus.Close()
+	// the defaults are written back, so before closing
+	if powerLimits != nil {
+		powerLimits.close()
+	}
+	closeConnections(devices)
+	alarmEvents.close()
+	energy.close()
+	if mqttPub != nil {
+		mqttPub.close()
+	}
+	if influx != nil {
+		influx.close()
+	}
+	if history != nil {
+		history.close()
+	}
+	auditLog.close()
+	captures.close()
+	lInfo.Printf("Bye")
+	os.Exit(exitCode)
 }
@@ -0,0 +1,433 @@
+// Copyright: 2024 Dragos Vingarzan vingarzan -at- gmail -dot- com
+// License: AGPL-3.0
+//
+// This file is part of sun2000-modbus.
+//
+// sun2000-modbus is free software: you can redistribute it and/or modify it under the terms of the GNU Affero General
+// Public License Version 3 (AGPL-3.0) as published by the Free Software Foundation.
+//
+// sun2000-modbus is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY; without even the implied
+// warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the AGPL-3.0 along with sun2000-modbus. If not,
+// see <https://www.gnu.org/licenses/>.
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/vingarzan/sun2000-modbus/sun2000"
+)
+
+// A small typed metrics registry, producing the Prometheus text exposition format (or OpenMetrics, if the scraper
+// asks for it). It is filled from scratch on each scrape, from the data read so far.
+
+type metricKind string
+
+const (
+	metricGauge     metricKind = "gauge"
+	metricCounter   metricKind = "counter"
+	metricHistogram metricKind = "histogram"
+)
+
+// The default lookback delta of Prometheus: the instant queries only see the samples at most this old.
+const prometheusLookback = 5 * time.Minute
+
+type metricLabel struct {
+	name, value string
+}
+
+type metricSample struct {
+	// appended to the name of the family, e.g. _bucket for histograms
+	suffix string
+	labels []metricLabel
+	value  float64
+	// when the value was read, zero for now
+	timestamp time.Time
+}
+
+type metricFamily struct {
+	// for counters, this includes the _total suffix
+	name    string
+	help    string
+	kind    metricKind
+	samples []metricSample
+}
+
+type metricsRegistry struct {
+	families []*metricFamily
+	byName   map[string]*metricFamily
+}
+
+func newMetricsRegistry() *metricsRegistry {
+	return &metricsRegistry{byName: make(map[string]*metricFamily)}
+}
+
+// family returns the family, creating it on first use, with the help of the first sample. nil if the name is already
+// used by another kind.
+func (r *metricsRegistry) family(name, help string, kind metricKind) *metricFamily {
+	f, ok := r.byName[name]
+	if !ok {
+		f = &metricFamily{name: name, help: help, kind: kind}
+		r.families = append(r.families, f)
+		r.byName[name] = f
+	} else if f.kind != kind {
+		lWarning.Printf("Metric %s is already a %s, skipping it as a %s", name, f.kind, kind)
+		return nil
+	}
+	return f
+}
+
+// add adds a sample, creating its family on first use.
+func (r *metricsRegistry) add(name, help string, kind metricKind, value float64, labels ...metricLabel) {
+	r.addAt(time.Time{}, name, help, kind, value, labels...)
+}
+
+// addAt adds a sample with the time it was read at, if not zero.
+func (r *metricsRegistry) addAt(at time.Time, name, help string, kind metricKind, value float64, labels ...metricLabel) {
+	if kind == metricCounter && !strings.HasSuffix(name, "_total") {
+		name += "_total"
+	}
+	if f := r.family(name, help, kind); f != nil {
+		f.samples = append(f.samples, metricSample{labels: labels, value: value, timestamp: at})
+	}
+}
+
+func (r *metricsRegistry) gauge(name, help string, value float64, labels ...metricLabel) {
+	r.add(name, help, metricGauge, value, labels...)
+}
+
+func (r *metricsRegistry) counter(name, help string, value float64, labels ...metricLabel) {
+	r.add(name, help, metricCounter, value, labels...)
+}
+
+// histogram adds the buckets, sum and count of the histogram. Caller must make sure it does not change meanwhile.
+func (r *metricsRegistry) histogram(name, help string, h *histogram, labels ...metricLabel) {
+	f := r.family(name, help, metricHistogram)
+	if f == nil {
+		return
+	}
+	cumulative := uint64(0)
+	for i, count := range h.counts {
+		cumulative += count
+		le := math.Inf(1)
+		if i < len(h.bounds) {
+			le = h.bounds[i]
+		}
+		bucket := append(append([]metricLabel{}, labels...), metricLabel{"le", formatMetricValue(le)})
+		f.samples = append(f.samples, metricSample{suffix: "_bucket", labels: bucket, value: float64(cumulative)})
+	}
+	f.samples = append(f.samples,
+		metricSample{suffix: "_sum", labels: labels, value: h.sum},
+		metricSample{suffix: "_count", labels: labels, value: float64(h.count)})
+}
+
+// histogram counts the observations in buckets, by their upper bounds, as Prometheus does. It is not safe for
+// concurrent use on its own.
+type histogram struct {
+	bounds []float64
+	// per bucket, not cumulative, with the one for +Inf last
+	counts []uint64
+	sum    float64
+	count  uint64
+}
+
+func newHistogram(bounds ...float64) *histogram {
+	return &histogram{bounds: bounds, counts: make([]uint64, len(bounds)+1)}
+}
+
+func (h *histogram) observe(v float64) {
+	i := 0
+	for i < len(h.bounds) && v > h.bounds[i] {
+		i++
+	}
+	h.counts[i]++
+	h.sum += v
+	h.count++
+}
+
+// write writes all the metrics, in the Prometheus text format 0.0.4, or in OpenMetrics 1.0.0.
+func (r *metricsRegistry) write(w io.Writer, openMetrics bool) error {
+	bw := bufio.NewWriter(w)
+	for _, f := range r.families {
+		// in OpenMetrics the counter family is named without the _total suffix of its samples
+		familyName := f.name
+		if openMetrics && f.kind == metricCounter {
+			familyName = strings.TrimSuffix(familyName, "_total")
+		}
+		fmt.Fprintf(bw, "# HELP %s %s\n", familyName, escapeMetricHelp(f.help))
+		fmt.Fprintf(bw, "# TYPE %s %s\n", familyName, f.kind)
+		for _, s := range f.samples {
+			bw.WriteString(f.name)
+			bw.WriteString(s.suffix)
+			if len(s.labels) > 0 {
+				bw.WriteByte('{')
+				for i, l := range s.labels {
+					if i > 0 {
+						bw.WriteByte(',')
+					}
+					fmt.Fprintf(bw, "%s=\"%s\"", l.name, escapeMetricLabel(l.value))
+				}
+				bw.WriteByte('}')
+			}
+			bw.WriteByte(' ')
+			bw.WriteString(formatMetricValue(s.value))
+			if !s.timestamp.IsZero() {
+				// milliseconds in the Prometheus format, seconds in OpenMetrics
+				if openMetrics {
+					fmt.Fprintf(bw, " %s", strconv.FormatFloat(float64(s.timestamp.UnixMilli())/1000, 'f', -1, 64))
+				} else {
+					fmt.Fprintf(bw, " %d", s.timestamp.UnixMilli())
+				}
+			}
+			bw.WriteByte('\n')
+		}
+	}
+	if openMetrics {
+		bw.WriteString("# EOF\n")
+	}
+	return bw.Flush()
+}
+
+func escapeMetricHelp(s string) string {
+	return strings.NewReplacer(`\`, `\\`, "\n", `\n`).Replace(s)
+}
+
+func escapeMetricLabel(s string) string {
+	return strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`).Replace(s)
+}
+
+func formatMetricValue(v float64) string {
+	switch {
+	case math.IsNaN(v):
+		return "NaN"
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// unitSuffixes maps the units of the register map to the suffix of the metric names.
+var unitSuffixes = map[string]string{
+	"kWh":    "kwh",
+	"kW":     "kilowatts",
+	"W":      "watts",
+	"kVA":    "kilovolt_amperes",
+	"VA":     "volt_amperes",
+	"kVar":   "kilovars",
+	"Var":    "vars",
+	"kVar h": "kvarh",
+	"V":      "volts",
+	"A":      "amperes",
+	"Hz":     "hertz",
+	"%":      "percent",
+	"℃":      "celsius",
+	"MΩ":     "megohms",
+	"mins":   "minutes",
+	"s":      "seconds",
+}
+
+// metricNameWithUnit appends the unit to the metric name, unless it is already there.
+func metricNameWithUnit(name, unit string) string {
+	if len(unit) == 0 {
+		return name
+	}
+	suffix, ok := unitSuffixes[unit]
+	if !ok {
+		suffix = strings.Map(func(r rune) rune {
+			if r >= 'a' && r <= 'z' || r >= '0' && r <= '9' {
+				return r
+			}
+			if r >= 'A' && r <= 'Z' {
+				return r - 'A' + 'a'
+			}
+			return '_'
+		}, unit)
+	}
+	if strings.HasSuffix(name, "_"+suffix) {
+		return name
+	}
+	return name + "_" + suffix
+}
+
+// labels returns the labels identifying the inverter, on all its metrics. Caller must hold the read lock.
+func (x *identificationData) labels() []metricLabel {
+	return []metricLabel{{"device", x.device}, {"model", x.Model}, {"sn", x.SN}}
+}
+
+// collectMetrics adds all the metrics of the device to the registry. The values come from the register map, plus a
+// few which are derived from the data of the built-in parsers.
+func (d *device) collectMetrics(r *metricsRegistry) {
+	id := &d.data.identification
+	id.RLock()
+	idRead := !id.lastRead.IsZero()
+	labels := id.labels()
+	id.RUnlock()
+
+	device := []metricLabel{{"device", d.name}}
+	stats := d.getStats()
+	r.counter("sun2000_modbus_reads_total", "Successful Modbus reads", float64(stats.totalSuccessCount), device...)
+	r.counter("sun2000_modbus_read_errors_total", "Failed Modbus reads", float64(stats.totalErrorCount), device...)
+	r.gauge("sun2000_modbus_consecutive_read_errors", "Modbus reads failed since the last successful one", float64(stats.errorCount), device...)
+	if !stats.lastSuccessTime.IsZero() {
+		r.gauge("sun2000_modbus_last_success_time_seconds", "Time of the last successful Modbus read", float64(stats.lastSuccessTime.Unix()), device...)
+	}
+
+	for i := range d.addrRanges {
+		if d.caps.polls(d.addrRanges[i].values.block.Target) {
+			d.addrRanges[i].collectStats(r, device)
+		}
+	}
+
+	// nothing else makes sense, without knowing which inverter this is
+	if !idRead {
+		return
+	}
+
+	// the registers of the battery packs which are not there are all zeroes, so skip their values
+	present := make(map[[2]string]bool)
+	for _, p := range []*batteryData{&d.data.esu1.pack[0], &d.data.esu1.pack[1], &d.data.esu1.pack[2],
+		&d.data.esu2.pack[0], &d.data.esu2.pack[1], &d.data.esu2.pack[2]} {
+		present[[2]string{strconv.Itoa(p.esuId), strconv.Itoa(p.id)}] = p.isPresent()
+	}
+	keep := func(labels []metricLabel) bool {
+		var esu, pack string
+		for _, l := range labels {
+			switch l.name {
+			case "esu":
+				esu = l.value
+			case "pack":
+				pack = l.value
+			}
+		}
+		return (len(esu) == 0 || len(pack) == 0 || present[[2]string{esu, pack}]) && d.caps.hasLabels(labels)
+	}
+
+	// the stale values are left out (or only marked), so that a dead connection does not look like a flat line
+	now := time.Now()
+	stale := make(map[string]bool)
+	for i := range d.addrRanges {
+		addrRange := &d.addrRanges[i]
+		if !d.caps.polls(addrRange.values.block.Target) {
+			continue
+		}
+		age, isStale := addrRange.age(now)
+		stale[addrRange.values.block.Target] = isStale
+		block := append(append([]metricLabel{}, labels...), metricLabel{"range", addrRange.name})
+		if !addrRange.values.getLastRead().IsZero() {
+			r.gauge("sun2000_data_age_seconds", "Time since the last successful read of the block", age.Seconds(), block...)
+		}
+		r.gauge("sun2000_data_stale", "1 if the values of the block are stale: not read yet, or not read again in time", bool2float(isStale), block...)
+		if isStale && cfg.staleMetrics == "omit" {
+			continue
+		}
+		// a sample older than the lookback of Prometheus vanishes from its queries, until the next read: only the blocks
+		// read more often carry the time of their read
+		timestamps := cfg.metricsTimestamps && addrRange.pullInterval < prometheusLookback
+		addrRange.values.collect(r, labels, keep, timestamps)
+	}
+	d.caps.collectMetrics(r, labels)
+
+	d.data.collectMetrics(r, labels, func(target string) bool {
+		return !stale[target] || cfg.staleMetrics == "keep"
+	})
+}
+
+func bool2float(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// collectMetrics adds the metrics which are derived from the data of the built-in parsers, from the targets which are
+// fresh.
+func (x *sun2000DataStruct) collectMetrics(r *metricsRegistry, labels []metricLabel, fresh func(target string) bool) {
+	with := func(extra ...metricLabel) []metricLabel {
+		return append(append([]metricLabel{}, labels...), extra...)
+	}
+
+	x.identification.RLock()
+	r.gauge("sun2000_inverter_info", "Inverter identification", 1, with(
+		metricLabel{"pn", x.identification.PN},
+		metricLabel{"firmware_version", x.identification.FirmwareVersion},
+		metricLabel{"software_version", x.identification.SoftwareVersion})...)
+	x.identification.RUnlock()
+
+	x.inverter.RLock()
+	if !x.inverter.lastRead.IsZero() && fresh("inverter") {
+		phases := []struct {
+			phase            string
+			voltage, current float32
+		}{
+			{"A", x.inverter.InverterPhaseAVoltage, x.inverter.InverterPhaseACurrent},
+			{"B", x.inverter.InverterPhaseBVoltage, x.inverter.InverterPhaseBCurrent},
+			{"C", x.inverter.InverterPhaseCVoltage, x.inverter.InverterPhaseCCurrent},
+		}
+		var total float64
+		for _, p := range phases {
+			power := float64(p.voltage) * float64(p.current)
+			total += power
+			r.gauge("sun2000_inverter_phase_power_volt_amperes", "Inverter phase power, as voltage x current", power, with(metricLabel{"phase", p.phase})...)
+		}
+		r.gauge("sun2000_inverter_total_power_volt_amperes", "Inverter total power, as the sum of the phases", total, labels...)
+	}
+	x.inverter.RUnlock()
+
+	x.alarm1.RLock()
+	if !x.alarm1.lastRead.IsZero() && fresh("alarm1") {
+		for _, a := range sun2000.KnownAlarms {
+			value := 0.0
+			if a.IsTriggered(x.alarm1.Bits) {
+				value = 1
+			}
+			r.gauge("sun2000_alarm_active", "Inverter alarm, 1 while active", value, with(
+				metricLabel{"name", a.Name},
+				metricLabel{"id", strconv.Itoa(int(a.ID))},
+				metricLabel{"level", a.Level.String()})...)
+		}
+	}
+	x.alarm1.RUnlock()
+
+	x.esu1.RLock()
+	if len(x.esu1.SN) > 0 {
+		r.gauge("sun2000_ess_info", "Energy storage unit identification", 1, with(
+			metricLabel{"esu", "1"},
+			metricLabel{"esu_sn", x.esu1.SN},
+			metricLabel{"dcdc_version", x.esu1.DCDCVersion},
+			metricLabel{"bms_version", x.esu1.BMSVersion})...)
+	}
+	x.esu1.RUnlock()
+	x.esu2.RLock()
+	if len(x.esu2.SN) > 0 {
+		r.gauge("sun2000_ess_info", "Energy storage unit identification", 1, with(
+			metricLabel{"esu", "2"},
+			metricLabel{"esu_sn", x.esu2.SN})...)
+	}
+	x.esu2.RUnlock()
+
+	for _, packs := range []*[3]batteryData{&x.esu1.pack, &x.esu2.pack} {
+		for i := range packs {
+			p := &packs[i]
+			if !p.isPresent() {
+				continue
+			}
+			p.RLock()
+			r.gauge("sun2000_ess_pack_info", "Battery pack identification", 1, with(
+				metricLabel{"esu", strconv.Itoa(p.esuId)},
+				metricLabel{"pack", strconv.Itoa(p.id)},
+				metricLabel{"pack_sn", p.SN},
+				metricLabel{"firmware_version", p.FirmwareVersion})...)
+			p.RUnlock()
+		}
+	}
+}
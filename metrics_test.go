@@ -0,0 +1,263 @@
+// Copyright: 2024 Dragos Vingarzan vingarzan -at- gmail -dot- com
+// License: AGPL-3.0
+//
+// This file is part of sun2000-modbus.
+//
+// sun2000-modbus is free software: you can redistribute it and/or modify it under the terms of the GNU Affero General
+// Public License Version 3 (AGPL-3.0) as published by the Free Software Foundation.
+//
+// sun2000-modbus is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY; without even the implied
+// warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the AGPL-3.0 along with sun2000-modbus. If not,
+// see <https://www.gnu.org/licenses/>.
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMetricsExposition(t *testing.T) {
+	server := startSimulator(t, nil)
+	testDevices := simulatorDevices(t, server, 1, 2)
+	registry := newMetricsRegistry()
+	// the first read after connecting is not answered
+	testDevices[0].readModbusFromTo("dummy read", 30000, 30015)
+	for _, d := range testDevices {
+		d.readExpiredRanges(context.Background())
+		d.collectMetrics(registry)
+	}
+
+	sb := strings.Builder{}
+	if err := registry.write(&sb, false); err != nil {
+		t.Fatal(err)
+	}
+	out := sb.String()
+
+	// every sample must belong to the family announced right before it, and appear only once
+	types := make(map[string]string)
+	series := make(map[string]bool)
+	var family string
+	scanner := bufio.NewScanner(strings.NewReader(out))
+	for scanner.Scan() {
+		line := scanner.Text()
+		if strings.HasPrefix(line, "# HELP ") {
+			continue
+		}
+		if strings.HasPrefix(line, "# TYPE ") {
+			fields := strings.Fields(line)
+			family = fields[2]
+			if _, ok := types[family]; ok {
+				t.Errorf("family %s announced twice", family)
+			}
+			types[family] = fields[3]
+			continue
+		}
+		name := line[:strings.IndexAny(line, "{ ")]
+		if types[family] == "histogram" {
+			for _, suffix := range []string{"_bucket", "_sum", "_count"} {
+				name = strings.Replace(name, family+suffix, family, 1)
+			}
+		}
+		if name != family {
+			t.Errorf("sample %s outside of its family %s", name, family)
+		}
+		key := line[:strings.LastIndex(line, " ")]
+		if series[key] {
+			t.Errorf("duplicate series %s", key)
+		}
+		series[key] = true
+		if strings.Contains(key, `unit="`) {
+			t.Errorf("unit label in %s", key)
+		}
+	}
+
+	for name, kind := range map[string]string{
+		"sun2000_cumulative_generate_electricity_kwh_total": "counter",
+		"sun2000_ess_total_charge_kwh_total":                "counter",
+		"sun2000_grid_reverse_active_energy_kwh_total":      "counter",
+		"sun2000_electricity_generated_in_current_day_kwh":  "gauge",
+		"sun2000_inverter_phase_voltage_volts":              "gauge",
+		"sun2000_inverter_active_power_kilowatts":           "gauge",
+		"sun2000_startup_time_seconds":                      "gauge",
+		"sun2000_modbus_read_errors_total":                  "counter",
+		"sun2000_modbus_range_read_duration_seconds":        "histogram",
+		"sun2000_modbus_range_read_errors_total":            "counter",
+	} {
+		if types[name] != kind {
+			t.Errorf("%s is a %q, not a %s", name, types[name], kind)
+		}
+	}
+	for _, line := range []string{
+		`sun2000_inverter_phase_voltage_volts{device="sim2",model="SUN2000-5KTL-M1",sn="SIM0000002",phase="A"}`,
+		`sun2000_ess_pack_soc_percent{device="sim1",model="SUN2000-5KTL-M1",sn="SIM0000001",esu="1",pack="1"}`,
+		`sun2000_device_status{device="sim1",model="SUN2000-5KTL-M1",sn="SIM0000001",state="On-grid: running"} 512`,
+		`sun2000_ess_pack_info{device="sim1",model="SUN2000-5KTL-M1",sn="SIM0000001",esu="1",pack="1",pack_sn="SIM0000001P1",firmware_version="V100R002C00"} 1`,
+		`sun2000_modbus_range_reads_total{device="sim1",range="PV Data"} 1`,
+		`sun2000_modbus_range_read_duration_seconds_bucket{device="sim1",range="PV Data",le="+Inf"} 1`,
+		`sun2000_modbus_range_read_duration_seconds_count{device="sim1",range="PV Data"} 1`,
+		`sun2000_modbus_range_read_bytes_total{device="sim1",range="PV Data"} 82`,
+		`sun2000_modbus_range_read_errors_total{device="sim1",range="PV Data",class="timeout"} 0`,
+		`sun2000_modbus_range_parse_errors_total{device="sim1",range="PV Data",parser="builtin"} 0`,
+		`sun2000_modbus_range_next_read_time_seconds{device="sim1",range="PV Data"}`,
+	} {
+		if !strings.Contains(out, line) {
+			t.Errorf("missing %s", line)
+		}
+	}
+	// there is only one pack in the simulator
+	if strings.Contains(out, `pack="2"`) {
+		t.Errorf("metrics of a missing pack")
+	}
+
+	sb.Reset()
+	if err := registry.write(&sb, true); err != nil {
+		t.Fatal(err)
+	}
+	out = sb.String()
+	if !strings.Contains(out, "# TYPE sun2000_ess_total_charge_kwh counter\n") || !strings.HasSuffix(out, "# EOF\n") {
+		t.Errorf("not OpenMetrics")
+	}
+}
+
+// TestMetricsWhilePolling scrapes the read counters while they are counted, for go test -race.
+func TestMetricsWhilePolling(t *testing.T) {
+	server := startSimulator(t, nil)
+	d := simulatorDevices(t, server, 1)[0]
+	d.readModbusFromTo("dummy read", 30000, 30015)
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for range 20 {
+			d.handleReadModbusResults(d.readModbusFromTo("identification", 30000, 30015))
+		}
+	}()
+	for polling := true; polling; {
+		select {
+		case <-done:
+			polling = false
+		default:
+		}
+		d.collectMetrics(newMetricsRegistry())
+		d.metricsString()
+	}
+	if stats := d.getStats(); stats.totalSuccessCount != 20 || stats.lastSuccessTime.IsZero() {
+		t.Errorf("unexpected read stats %+v", stats)
+	}
+}
+
+func TestHistogram(t *testing.T) {
+	h := newHistogram(0.1, 1)
+	for _, v := range []float64{0.05, 0.1, 0.5, 3} {
+		h.observe(v)
+	}
+	registry := newMetricsRegistry()
+	registry.histogram("test_seconds", "Test", h, metricLabel{"range", "a"})
+	var sb strings.Builder
+	if err := registry.write(&sb, false); err != nil {
+		t.Fatal(err)
+	}
+	want := `# HELP test_seconds Test
+# TYPE test_seconds histogram
+test_seconds_bucket{range="a",le="0.1"} 2
+test_seconds_bucket{range="a",le="1"} 3
+test_seconds_bucket{range="a",le="+Inf"} 4
+test_seconds_sum{range="a"} 3.65
+test_seconds_count{range="a"} 4
+`
+	if sb.String() != want {
+		t.Errorf("unexpected exposition:\n%s", sb.String())
+	}
+}
+
+func TestStaleMetrics(t *testing.T) {
+	server := startSimulator(t, nil)
+	d := simulatorDevices(t, server, 1)[0]
+	d.readModbusFromTo("dummy read", 30000, 30015)
+	d.readExpiredRanges(context.Background())
+
+	// the Grid Data was not read again for an hour
+	r := d.findRange("inverter")
+	readAt := time.Now().Add(-time.Hour).Truncate(time.Millisecond)
+	r.values.setLastRead(readAt)
+	if _, stale := r.age(time.Now()); !stale || r.staleAfter != 3*10*time.Second+5*time.Second {
+		t.Fatalf("the Grid Data is not stale after an hour, with staleAfter %s", r.staleAfter)
+	}
+
+	collect := func() string {
+		registry := newMetricsRegistry()
+		d.collectMetrics(registry)
+		var sb strings.Builder
+		if err := registry.write(&sb, false); err != nil {
+			t.Fatal(err)
+		}
+		return sb.String()
+	}
+	out := collect()
+	for _, s := range []string{
+		`sun2000_data_stale{device="sim1",model="SUN2000-5KTL-M1",sn="SIM0000001",range="Grid Data"} 1`,
+		`sun2000_data_stale{device="sim1",model="SUN2000-5KTL-M1",sn="SIM0000001",range="PV Data"} 0`,
+		`sun2000_data_age_seconds{device="sim1",model="SUN2000-5KTL-M1",sn="SIM0000001",range="Grid Data"} 3600`,
+		`sun2000_pv_voltage_volts{`,
+	} {
+		if !strings.Contains(out, s) {
+			t.Errorf("no %s in the metrics", s)
+		}
+	}
+	for _, s := range []string{"sun2000_inverter_active_power_kilowatts", "sun2000_inverter_phase_power_volt_amperes"} {
+		if strings.Contains(out, s) {
+			t.Errorf("stale %s in the metrics", s)
+		}
+	}
+
+	// only marked as stale, with the time of the read
+	cfg.staleMetrics = "keep"
+	out = collect()
+	sample := fmt.Sprintf(`sun2000_inverter_frequency_hertz{device="sim1",model="SUN2000-5KTL-M1",sn="SIM0000001"} 50 %d`, readAt.UnixMilli())
+	if !strings.Contains(out, sample) || !strings.Contains(out, "sun2000_inverter_phase_power_volt_amperes") {
+		t.Errorf("no %s in the metrics", sample)
+	}
+}
+
+func TestMetricsTimestamps(t *testing.T) {
+	server := startSimulator(t, nil)
+	d := simulatorDevices(t, server, 1)[0]
+	d.readModbusFromTo("dummy read", 30000, 30015)
+	d.readExpiredRanges(context.Background())
+
+	registry := newMetricsRegistry()
+	d.collectMetrics(registry)
+	var sb strings.Builder
+	if err := registry.write(&sb, false); err != nil {
+		t.Fatal(err)
+	}
+	out := sb.String()
+
+	// the Grid Data is read every 10s, the Identification Data every hour, beyond the lookback of Prometheus
+	readAt := d.findRange("inverter").values.getLastRead()
+	for sample, stamped := range map[string]bool{
+		`sun2000_inverter_frequency_hertz{device="sim1",model="SUN2000-5KTL-M1",sn="SIM0000001"} 50`: true,
+		`sun2000_number_of_strings{device="sim1",model="SUN2000-5KTL-M1",sn="SIM0000001"} `:          false,
+	} {
+		i := strings.Index(out, sample)
+		if i < 0 {
+			t.Errorf("no %s in the metrics", sample)
+			continue
+		}
+		line := out[i : i+strings.IndexByte(out[i:], '\n')]
+		hasTimestamp := len(strings.Fields(line[strings.LastIndexByte(line, '}')+1:])) == 2
+		if hasTimestamp != stamped {
+			t.Errorf("%s: timestamp %v, want %v", line, hasTimestamp, stamped)
+		}
+		if stamped && !strings.HasSuffix(line, fmt.Sprintf(" %d", readAt.UnixMilli())) {
+			t.Errorf("%s: not the time of the read %d", line, readAt.UnixMilli())
+		}
+	}
+}
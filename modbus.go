@@ -16,73 +16,115 @@ package main
 
 import (
 	"fmt"
-	"log"
-	"strings"
 	"time"
 
-	"github.com/goburrow/modbus"
+	"github.com/vingarzan/sun2000-modbus/sun2000"
 )
 
-func initModbus(ip string, port uint16, timeout uint, slaveID byte) (handler *modbus.TCPClientHandler, client modbus.Client, err error) {
-	// Modbus TCP
-	modbus_target := fmt.Sprintf("%s:%d", ip, port)
-	handler = modbus.NewTCPClientHandler(modbus_target)
-	handler.Timeout = time.Duration(timeout) * time.Second
-	handler.SlaveId = slaveID
-	handler.Logger = lModBus
+// modbusTransport is what the devices read and write through: a sun2000.Client towards the inverter, or the replay of
+// a capture.
+type modbusTransport interface {
+	SetSlaveID(slaveID byte)
+	ReadRegisters(from, to uint16) ([]byte, error)
+	WriteRegisters(address uint16, values []uint16) error
+	WriteMultipleRegisters(address uint16, values []uint16) error
+	Close() error
+}
+
+func initModbus(dc *deviceConfig) (modbusTransport, error) {
+	if cfg.modbusMode == "replay" {
+		records, err := loadCapture(cfg.replayFile)
+		if err != nil {
+			return nil, fmt.Errorf("modbus failed to load the capture: %w", err)
+		}
+		return newCaptureReplay(records), nil
+	}
+	c := sun2000.Config{
+		Mode:           cfg.modbusMode,
+		Address:        fmt.Sprintf("%s:%d", dc.ip, dc.port),
+		SerialDevice:   cfg.serialDevice,
+		SerialBaudRate: cfg.serialBaudRate,
+		SerialDataBits: cfg.serialDataBits,
+		SerialParity:   cfg.serialParity,
+		SerialStopBits: cfg.serialStopBits,
+		SlaveID:        dc.slaveID,
+		Timeout:        time.Duration(cfg.modbusTimeout) * time.Second,
+		Logger:         lModBus,
+	}
+	client := sun2000.NewClient(c)
 	// Connect manually so that multiple requests are handled in one connection session
-	err = handler.Connect()
-	if err != nil {
-		return nil, nil, fmt.Errorf("modbus failed to connect to %s:%d: %v", ip, port, err)
+	if err := client.Connect(); err != nil {
+		return nil, err
+	}
+	return client, nil
+}
+
+func (d *device) readModbusFromTo(what string, from uint16, to uint16) (results []byte, err error) {
+	lDebug.Printf("   >>   Reading %s from modbus %s/%d %d..%d\n", what, d.name, d.slaveID, from, to)
+
+	d.conn.Lock()
+	defer d.conn.Unlock()
+	if d.conn.client == nil {
+		return nil, fmt.Errorf("%s: %w", d.conn.name, errConnectionClosed)
+	}
+	// the connection might be shared with other slaves, so set ours before each request
+	d.conn.client.SetSlaveID(d.slaveID)
+	results, err = d.conn.client.ReadRegisters(from, to)
+	if err == nil {
+		captures.write(d, what, from, to, results)
 	}
+	return results, err
+}
 
-	client = modbus.NewClient(handler)
+// writeModbusRegisters writes the values from the address on, with write-multiple-registers, then reads them back to
+// make sure that the inverter took them.
+func (d *device) writeModbusRegisters(what string, address uint16, values []uint16) (err error) {
+	return d.writeModbus(what, address, values, modbusTransport.WriteRegisters)
+}
 
-	return handler, client, nil
+// forwardModbusRegisters writes the values from the address on, with write-multiple-registers, and leaves it to the
+// caller to check them, e.g. to the gateway clients.
+func (d *device) forwardModbusRegisters(what string, address uint16, values []uint16) (err error) {
+	return d.writeModbus(what, address, values, modbusTransport.WriteMultipleRegisters)
 }
 
-func readModbusFromTo(what string, from uint16, to uint16) (results []byte, err error) {
-	lDebug.Printf("   >>   Reading %s from modbus %d..%d\n", what, from, to)
+func (d *device) writeModbus(what string, address uint16, values []uint16,
+	write func(modbusTransport, uint16, []uint16) error) error {
+	lInfo.Printf("   <<   Writing %s to modbus %s/%d %d..%d %v\n", what, d.name, d.slaveID, address, address+uint16(len(values)), values)
 
-	size := (to - from)
-	return clientModbus.ReadHoldingRegisters(from, size)
+	d.conn.Lock()
+	defer d.conn.Unlock()
+	if d.conn.client == nil {
+		return fmt.Errorf("%s: %w", d.conn.name, errConnectionClosed)
+	}
+	d.conn.client.SetSlaveID(d.slaveID)
+
+	if err := write(d.conn.client, address, values); err != nil {
+		return fmt.Errorf("%s %w", what, err)
+	}
+	return nil
 }
 
-func handleReadModbusResults(results []byte, err error) (ok bool) {
+// handleReadModbusResults counts the errors, and closes the connection when the supervisor thinks that it is broken.
+// The poller reopens it later, so this never sleeps or exits.
+func (d *device) handleReadModbusResults(results []byte, err error) (ok bool) {
 	if err != nil {
-		lWarning.Printf("Error reading modbus: %v\n", err)
-		errorCount++
-		totalErrorCount++
-		if errorCount > 10 {
-			handlerModbus.Close()
-			handlerModbus = nil
-
-			lWarning.Printf("Too many errors, sleeping for 3 minute\n")
-			time.Sleep(3 * time.Minute)
-			handlerModbus, clientModbus, err = initModbus(cfg.modbusIP, cfg.modbusPort, uint(cfg.modbusTimeout), cfg.modbusSlaveID)
-			if err != nil {
-				log.Fatal(err)
-			}
-			return false
-		}
-		if strings.Contains(err.Error(), "modbus: response transaction id") {
-			lWarning.Printf("modbus: sun2000 has a known bug where it fucks up transaction ids... we must close the connection, then reopen.")
-			handlerModbus.Close()
-			handlerModbus = nil
-			lInfo.Printf("Sleeping 30 seconds...")
-			time.Sleep(30 * time.Second)
-			handlerModbus, clientModbus, err = initModbus(cfg.modbusIP, cfg.modbusPort, uint(cfg.modbusTimeout), cfg.modbusSlaveID)
-			if err != nil {
-				log.Fatal(err)
-			}
+		lWarning.Printf("Error reading modbus from %s: %v\n", d.name, err)
+		d.statsMutex.Lock()
+		d.stats.errorCount++
+		d.stats.totalErrorCount++
+		d.statsMutex.Unlock()
+		if d.conn.sup.readFailed(err) {
+			wait := d.conn.reset()
+			lWarning.Printf("Closed the modbus connection %s, after a %s error, reopening in %s", d.conn.name, classifyError(err), wait.Round(time.Second))
 		}
-		// TODO - how to detect if the connection was dropped and to re-open it?
 		return false
-	} else {
-		errorCount = 0
-		totalSuccessCount++
-		lastSuccessTime = time.Now()
 	}
-	// lDebug.Printf("Results: %q\n", results)
+	d.statsMutex.Lock()
+	d.stats.errorCount = 0
+	d.stats.totalSuccessCount++
+	d.stats.lastSuccessTime = time.Now()
+	d.statsMutex.Unlock()
+	d.conn.sup.readSucceeded()
 	return true
 }
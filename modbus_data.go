@@ -14,7 +14,10 @@
 // see <https://www.gnu.org/licenses/>.
 package main
 
-import "time"
+import (
+	"context"
+	"time"
+)
 
 type modbusParsedData interface {
 	isExpired() bool
@@ -26,264 +29,161 @@ type modbusParsedData interface {
 }
 
 type modbusInterval struct {
-	name         string
-	from, to     uint16
-	target       modbusParsedData
+	name     string
+	from, to uint16
+	// the built-in parser of the block, nil for the blocks only known from the register map
+	target modbusParsedData
+	// the generic decoding of the block, driven by the register map
+	values       *registerValues
 	pullInterval time.Duration
+	// the values are stale after this long without a successful read, never if 0
+	staleAfter time.Duration
+	// shared by the copies of the range
+	stats *rangeStats
 }
 
+// blockListener is told about each block which was read and parsed successfully, e.g. to publish it somewhere else
+// than on /metrics. It is called from the poller, so it must not block.
+type blockListener interface {
+	blockParsed(d *device, r *modbusInterval)
+}
+
+// The listeners of all the devices, set up by main() before the polling starts.
+var blockListeners []blockListener
+
 // To optimize a bit the read process, we do bulk reads, in ranges of addresses.
 // Then we parse the results and store them in the appropriate struct.
 // Since some data is not updated very often, we can have different pull intervals for each address range.
 // Seems like we could get at max 125 registers at once, or something around that.
-var modbusAddrRanges = []modbusInterval{
-	{
-		name:         "Identification Data",
-		from:         30000,
-		to:           30087,
-		target:       &parsedData.identification,
-		pullInterval: 1 * time.Hour,
-	},
-	{
-		name:         "Product Data",
-		from:         30105,
-		to:           30132,
-		target:       &parsedData.product,
-		pullInterval: 1 * time.Hour,
-	},
-	{
-		name:         "Hardware Data Part 1",
-		from:         30206,
-		to:           30252,
-		target:       &parsedData.hardware1,
-		pullInterval: 1 * time.Hour,
-	},
-	{
-		name:         "Hardware Data Part 2",
-		from:         30300,
-		to:           30327,
-		target:       &parsedData.hardware2,
-		pullInterval: 1 * time.Hour,
-	},
-	{
-		name:         "Hardware Data Part 3",
-		from:         30350,
-		to:           30351,
-		target:       &parsedData.hardware3,
-		pullInterval: 1 * time.Hour,
-	},
-	// Does not work
-	// {
-	// 	name:         "Hardware Data Part 4",
-	// 	from:         30364,
-	// 	to:           30370,
-	// 	target:       &parsedData.hardware4,
-	// 	pullInterval: 5 * time.Minute,
-	// },
-	{
-		name:         "Hardware Data Part 5",
-		from:         31000,
-		to:           31115,
-		target:       &parsedData.hardware5,
-		pullInterval: 1 * time.Hour,
-	},
-	// Does not work
-	// {
-	// 	name:         "Hardware Data Part 6",
-	// 	from:         31130,
-	// 	to:           31160,
-	// 	target:       &parsedData.hardware6,
-	// 	pullInterval: 1 * time.Hour,
-	// },
-	{
-		name:         "Remote Signalling Data",
-		from:         32000,
-		to:           32003,
-		target:       &parsedData.remoteSignalling,
-		pullInterval: 1 * time.Hour,
-	},
-	{
-		name:         "Alarm Data 1",
-		from:         32008,
-		to:           32011,
-		target:       &parsedData.alarm1,
-		pullInterval: 2 * time.Minute,
-	},
-	{
-		name:         "PV Data",
-		from:         32015,
-		to:           32056,
-		target:       &parsedData.pv,
-		pullInterval: 10 * time.Second,
-	},
-	{
-		name:         "Grid Data",
-		from:         32064,
-		to:           32097,
-		target:       &parsedData.inverter,
-		pullInterval: 10 * time.Second,
-	},
-	{
-		name:         "Cumulative Data 1",
-		from:         32106,
-		to:           32120,
-		target:       &parsedData.cumulative1,
-		pullInterval: 2 * time.Minute,
-	},
-	{
-		name:         "Cumulative Data 2",
-		from:         32151,
-		to:           32192,
-		target:       &parsedData.cumulative2,
-		pullInterval: 2 * time.Minute,
-	},
-	{
-		name:         "Cumulative Data 3",
-		from:         32190,
-		to:           32192,
-		target:       &parsedData.cumulative3,
-		pullInterval: 2 * time.Minute,
-	},
-	{
-		name:         "MPPT Data 1",
-		from:         32212,
-		to:           32232,
-		target:       &parsedData.mppt1,
-		pullInterval: 2 * time.Minute,
-	},
-	{
-		name:         "Alarm Data 2",
-		from:         32252,
-		to:           32278,
-		target:       &parsedData.alarm2,
-		pullInterval: 2 * time.Minute,
-	},
-	// Does not work
-	// {
-	// 	name:         "String Access Data",
-	// 	from:         32300,
-	// 	to:           32318,
-	// 	target:       &parsedData.stringAccess,
-	// 	pullInterval: 1 * time.Hour,
-	// },
-	{
-		name:         "MPPT Data 2",
-		from:         32324,
-		to:           32344,
-		target:       &parsedData.mppt2,
-		pullInterval: 2 * time.Minute,
-	},
-	{
-		name:         "Internal Temperature Data",
-		from:         35021,
-		to:           35033,
-		target:       &parsedData.internalTemperature,
-		pullInterval: 2 * time.Minute,
-	},
-	{
-		name:         "Meter Data",
-		from:         37100,
-		to:           37139,
-		target:       &parsedData.meter,
-		pullInterval: 10 * time.Second,
-	},
-	{
-		name:         "ESU1 Data",
-		from:         37000,
-		to:           37070,
-		target:       &parsedData.esu1,
-		pullInterval: 30 * time.Second,
-	},
-	// // I don't have this one
-	// {
-	// 	name:         "ESU2 Data",
-	// 	from:         37700,
-	// 	to:           37757,
-	// 	target:       &parsedData.esu2,
-	// 	pullInterval: 30 * time.Second,
-	// },
-	{
-		name:         "ESU1-Pack1 Data",
-		from:         38200,
-		to:           38242,
-		target:       &parsedData.esu1.pack[0],
-		pullInterval: 30 * time.Second,
-	},
-	{
-		name:         "ESU1-Pack2 Data",
-		from:         38242,
-		to:           38284,
-		target:       &parsedData.esu1.pack[1],
-		pullInterval: 30 * time.Second,
-	},
-	{
-		name:         "ESU1-Pack3 Data",
-		from:         38284,
-		to:           38326,
-		target:       &parsedData.esu1.pack[2],
-		pullInterval: 30 * time.Second,
-	},
-	// // I don't have this one
-	// {
-	// 	name:         "ESU2-Pack1 Data",
-	// 	from:         38326,
-	// 	to:           38368,
-	// 	target:       &parsedData.esu2.pack[0],
-	// 	pullInterval: 30 * time.Second,
-	// },
-	// // I don't have this one
-	// {
-	// 	name:         "ESU2-Pack2 Data",
-	// 	from:         38368,
-	// 	to:           38410,
-	// 	target:       &parsedData.esu2.pack[1],
-	// 	pullInterval: 30 * time.Second,
-	// },
-	// // I don't have this one
-	// {
-	// 	name:         "ESU2-Pack3 Data",
-	// 	from:         38410,
-	// 	to:           38452,
-	// 	target:       &parsedData.esu2.pack[2],
-	// 	pullInterval: 30 * time.Second,
-	// },
+// Each device has its own set of ranges, pointing into its own data. The ranges come from the register map (see
+// registers.yaml), the disabled blocks are skipped. With a device profile from the scan, the blocks it probed are polled
+// only if the device answered them, enabled or not in the map.
+func newModbusAddrRanges(data *sun2000DataStruct, m *registerMap, profile *deviceProfile) (out []modbusInterval) {
+	for i := range m.Blocks {
+		b := &m.Blocks[i]
+		enabled := b.isEnabled()
+		if profile != nil {
+			// the scan knows better than the register map, for the blocks which it probed
+			if supported, known := profile.isSupported(b); known {
+				enabled = supported
+			}
+		}
+		if !enabled {
+			continue
+		}
+		r := modbusInterval{
+			name:         b.Name,
+			from:         b.From,
+			to:           b.To,
+			values:       newRegisterValues(b),
+			pullInterval: b.Interval,
+			staleAfter:   b.StaleAfter,
+			stats:        newRangeStats(),
+		}
+		if r.staleAfter == 0 && cfg.staleFactor > 0 {
+			r.staleAfter = time.Duration(cfg.staleFactor)*b.Interval + time.Duration(cfg.modbusSleep)*time.Second
+		}
+		if len(b.Target) > 0 {
+			r.target = data.getTarget(b.Target)
+		}
+		out = append(out, r)
+	}
+	return out
+}
 
-	{
-		name:         "ESU Temperatures",
-		from:         38452,
-		to:           38452 + 2*3*2,
-		target:       &parsedData.esuTemperatures,
-		pullInterval: 30 * time.Second,
-	},
+// age returns how long ago the range was read successfully, and if it is stale: not read yet, or not again in time.
+func (r *modbusInterval) age(now time.Time) (age time.Duration, stale bool) {
+	lastRead := r.values.getLastRead()
+	if lastRead.IsZero() {
+		return 0, true
+	}
+	age = now.Sub(lastRead)
+	return age, r.staleAfter > 0 && age > r.staleAfter
 }
 
-func readModbusLoop(pollInterval uint) {
+// readModbusLoop polls the device every pollInterval seconds, until the context is done.
+func (d *device) readModbusLoop(ctx context.Context, pollInterval uint) {
 
 	// dummy read, since the first call always seems to fail - inverted bug?
-	readModbusFromTo("dummy read", 30000, 30015)
+	d.readModbusFromTo("dummy read", 30000, 30015)
 
 	for {
-
-		for _, addrRange := range modbusAddrRanges {
-			if !addrRange.target.isExpired() {
-				continue
+		reopened, err := d.conn.ensureOpen()
+		if err != nil {
+			lWarning.Printf("Skipping the reads of %s: %v", d.name, err)
+		} else {
+			if reopened {
+				d.readModbusFromTo("dummy read", 30000, 30015)
 			}
-
-			results, err := readModbusFromTo(addrRange.name, addrRange.from, addrRange.to)
-			ok := handleReadModbusResults(results, err)
-			if ok {
-				// Interpret the results
-				err := addrRange.target.parse(results)
-				if err != nil {
-					lError.Printf("Error parsing %s: %v", addrRange.name, err)
-				}
-				addrRange.target.setLastRead(time.Now())
-				addrRange.target.setNextRead(time.Now().Add(addrRange.pullInterval))
-				lInfo.Printf("Will read again the %s after %s", addrRange.name, addrRange.target.getNextRead().Format(time.RFC3339))
+			if cfg.detectCapabilities && !d.caps.isDetected() && !d.detectCapabilities() {
+				lWarning.Printf("Could not detect the hardware of %s yet, polling all the blocks", d.name)
 			}
+			d.readExpiredRanges(ctx)
 		}
 
 		lDebug.Printf("... sleeping %d seconds...", pollInterval)
-		time.Sleep(time.Duration(time.Duration(pollInterval) * time.Second))
+		select {
+		case <-ctx.Done():
+			lInfo.Printf("Stopped polling %s", d.name)
+			return
+		case <-time.After(time.Duration(pollInterval) * time.Second):
+		}
+	}
+}
+
+// readExpiredRanges does one round of reads, of all the ranges which are due, stopping early if the context is done.
+func (d *device) readExpiredRanges(ctx context.Context) {
+	for i := range d.addrRanges {
+		if ctx.Err() != nil {
+			return
+		}
+		addrRange := &d.addrRanges[i]
+		if !addrRange.values.isExpired() || !d.caps.polls(addrRange.values.block.Target) {
+			continue
+		}
+		if !d.readRange(addrRange) && !d.conn.isOpen() {
+			// the rest waits for the connection to be reopened
+			return
+		}
+	}
+}
+
+// readRange reads and parses one range, now. Returns false if the read failed.
+func (d *device) readRange(addrRange *modbusInterval) (ok bool) {
+	start := time.Now()
+	results, err := d.readModbusFromTo(addrRange.name, addrRange.from, addrRange.to)
+	addrRange.stats.readDone(time.Since(start), len(results), err)
+	ok = d.handleReadModbusResults(results, err)
+	if !ok {
+		return false
+	}
+
+	// Interpret the results
+	parsed := []modbusParsedData{addrRange.values}
+	if addrRange.target != nil {
+		parsed = append(parsed, addrRange.target)
+	}
+	now := time.Now()
+	parseOK := true
+	for _, p := range parsed {
+		err := p.parse(results)
+		if err != nil {
+			lError.Printf("Error parsing %s of %s: %v", addrRange.name, d.name, err)
+			parseOK = false
+			if p == modbusParsedData(addrRange.values) {
+				addrRange.stats.parseFailed("register_map")
+			} else {
+				addrRange.stats.parseFailed("builtin")
+			}
+		}
+		p.setLastRead(now)
+		p.setNextRead(now.Add(addrRange.pullInterval))
+	}
+	if parseOK {
+		for _, l := range blockListeners {
+			l.blockParsed(d, addrRange)
+		}
 	}
+	lInfo.Printf("Will read again the %s of %s after %s", addrRange.name, d.name, addrRange.values.getNextRead().Format(time.RFC3339))
+	return true
 }
@@ -0,0 +1,221 @@
+// Copyright: 2024 Dragos Vingarzan vingarzan -at- gmail -dot- com
+// License: AGPL-3.0
+//
+// This file is part of sun2000-modbus.
+//
+// sun2000-modbus is free software: you can redistribute it and/or modify it under the terms of the GNU Affero General
+// Public License Version 3 (AGPL-3.0) as published by the Free Software Foundation.
+//
+// sun2000-modbus is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY; without even the implied
+// warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the AGPL-3.0 along with sun2000-modbus. If not,
+// see <https://www.gnu.org/licenses/>.
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+
+	"github.com/goburrow/modbus"
+)
+
+// A minimal Modbus TCP server, only with the functions the SUN2000 supports (and which we use): read holding
+// registers, write single register and write multiple registers.
+
+// modbusServerHandler answers the requests. Returning a *modbus.ModbusError sends that exception back, any other error
+// is sent as a server device failure.
+type modbusServerHandler interface {
+	readHoldingRegisters(slaveID byte, address, quantity uint16) (results []byte, err error)
+	writeRegisters(slaveID byte, address uint16, values []byte) (err error)
+}
+
+type modbusServer struct {
+	handler modbusServerHandler
+
+	// Quirks of the real inverter, to test that we cope with them:
+	//  - do not answer the first request on each connection
+	//  - answer every Nth request with a wrong transaction id
+	dropFirstRequest  bool
+	txIDMismatchEvery uint
+
+	listener net.Listener
+	mutex    sync.Mutex
+	conns    map[net.Conn]bool
+	requests uint
+	wg       sync.WaitGroup
+}
+
+func newModbusServer(handler modbusServerHandler) *modbusServer {
+	return &modbusServer{
+		handler: handler,
+		conns:   make(map[net.Conn]bool),
+	}
+}
+
+// listen binds the server to the address, e.g. ":502". Use serve() to accept the clients.
+func (s *modbusServer) listen(address string) (err error) {
+	s.listener, err = net.Listen("tcp", address)
+	return err
+}
+
+// addr returns the address the server listens on, useful if it was started on port 0.
+func (s *modbusServer) addr() string {
+	return s.listener.Addr().String()
+}
+
+// serve accepts the clients, until close() is called.
+func (s *modbusServer) serve() error {
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			return err
+		}
+		s.mutex.Lock()
+		s.conns[conn] = true
+		s.mutex.Unlock()
+		s.wg.Add(1)
+		go s.serveConn(conn)
+	}
+}
+
+// close stops accepting clients and closes the existing connections.
+func (s *modbusServer) close() error {
+	err := s.listener.Close()
+	s.mutex.Lock()
+	for conn := range s.conns {
+		conn.Close()
+	}
+	s.mutex.Unlock()
+	s.wg.Wait()
+	return err
+}
+
+func (s *modbusServer) serveConn(conn net.Conn) {
+	defer s.wg.Done()
+	defer func() {
+		s.mutex.Lock()
+		delete(s.conns, conn)
+		s.mutex.Unlock()
+		conn.Close()
+	}()
+	lDebug.Printf("Modbus client %s connected", conn.RemoteAddr())
+
+	first := true
+	header := make([]byte, 7)
+	for {
+		// MBAP header: transaction id, protocol id, length (of unit id + PDU), unit id
+		if _, err := io.ReadFull(conn, header); err != nil {
+			if !errors.Is(err, io.EOF) && !errors.Is(err, net.ErrClosed) {
+				lDebug.Printf("Modbus client %s: %v", conn.RemoteAddr(), err)
+			}
+			return
+		}
+		txID := binary.BigEndian.Uint16(header[0:])
+		length := binary.BigEndian.Uint16(header[4:])
+		slaveID := header[6]
+		if length < 2 || length > 254 {
+			lWarning.Printf("Modbus client %s sent a bad length %d", conn.RemoteAddr(), length)
+			return
+		}
+		request := make([]byte, length-1)
+		if _, err := io.ReadFull(conn, request); err != nil {
+			return
+		}
+
+		if first && s.dropFirstRequest {
+			first = false
+			lDebug.Printf("Modbus client %s: dropping the first request, as the SUN2000 does", conn.RemoteAddr())
+			continue
+		}
+		first = false
+
+		response := s.handle(slaveID, request)
+
+		s.mutex.Lock()
+		s.requests++
+		if s.txIDMismatchEvery > 0 && s.requests%s.txIDMismatchEvery == 0 {
+			txID++
+		}
+		s.mutex.Unlock()
+
+		out := make([]byte, 7, 7+len(response))
+		binary.BigEndian.PutUint16(out[0:], txID)
+		binary.BigEndian.PutUint16(out[4:], uint16(len(response)+1))
+		out[6] = slaveID
+		out = append(out, response...)
+		if _, err := conn.Write(out); err != nil {
+			return
+		}
+	}
+}
+
+// handle executes one request PDU and returns the response PDU.
+func (s *modbusServer) handle(slaveID byte, request []byte) (response []byte) {
+	functionCode := request[0]
+	data := request[1:]
+	var results []byte
+	var err error
+
+	switch functionCode {
+	case modbus.FuncCodeReadHoldingRegisters:
+		if len(data) != 4 {
+			err = &modbus.ModbusError{ExceptionCode: modbus.ExceptionCodeIllegalDataValue}
+			break
+		}
+		address := binary.BigEndian.Uint16(data[0:])
+		quantity := binary.BigEndian.Uint16(data[2:])
+		if quantity < 1 || quantity > 125 {
+			err = &modbus.ModbusError{ExceptionCode: modbus.ExceptionCodeIllegalDataValue}
+			break
+		}
+		var values []byte
+		values, err = s.handler.readHoldingRegisters(slaveID, address, quantity)
+		if err == nil {
+			results = append([]byte{byte(len(values))}, values...)
+		}
+	case modbus.FuncCodeWriteSingleRegister:
+		if len(data) != 4 {
+			err = &modbus.ModbusError{ExceptionCode: modbus.ExceptionCodeIllegalDataValue}
+			break
+		}
+		err = s.handler.writeRegisters(slaveID, binary.BigEndian.Uint16(data[0:]), data[2:4])
+		results = data
+	case modbus.FuncCodeWriteMultipleRegisters:
+		if len(data) < 5 || int(data[4]) != len(data)-5 || int(binary.BigEndian.Uint16(data[2:]))*2 != len(data)-5 {
+			err = &modbus.ModbusError{ExceptionCode: modbus.ExceptionCodeIllegalDataValue}
+			break
+		}
+		if quantity := binary.BigEndian.Uint16(data[2:]); quantity < 1 || quantity > 123 {
+			err = &modbus.ModbusError{ExceptionCode: modbus.ExceptionCodeIllegalDataValue}
+			break
+		}
+		err = s.handler.writeRegisters(slaveID, binary.BigEndian.Uint16(data[0:]), data[5:])
+		results = data[0:4]
+	default:
+		err = &modbus.ModbusError{ExceptionCode: modbus.ExceptionCodeIllegalFunction}
+	}
+
+	if err != nil {
+		var mbErr *modbus.ModbusError
+		if !errors.As(err, &mbErr) {
+			lWarning.Printf("Modbus request %#02x for slave %d failed: %v", functionCode, slaveID, err)
+			mbErr = &modbus.ModbusError{ExceptionCode: modbus.ExceptionCodeServerDeviceFailure}
+		}
+		return []byte{functionCode | 0x80, mbErr.ExceptionCode}
+	}
+	return append([]byte{functionCode}, results...)
+}
+
+// errIllegalDataAddress is the usual answer for registers which are not there.
+func errIllegalDataAddress(address, quantity uint16) error {
+	return fmt.Errorf("registers %d..%d: %w", address, address+quantity, &modbus.ModbusError{ExceptionCode: modbus.ExceptionCodeIllegalDataAddress})
+}
@@ -0,0 +1,136 @@
+// Copyright: 2024 Dragos Vingarzan vingarzan -at- gmail -dot- com
+// License: AGPL-3.0
+//
+// This file is part of sun2000-modbus.
+//
+// sun2000-modbus is free software: you can redistribute it and/or modify it under the terms of the GNU Affero General
+// Public License Version 3 (AGPL-3.0) as published by the Free Software Foundation.
+//
+// sun2000-modbus is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY; without even the implied
+// warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the AGPL-3.0 along with sun2000-modbus. If not,
+// see <https://www.gnu.org/licenses/>.
+
+//go:build linux
+
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"os"
+	"syscall"
+	"testing"
+	"unsafe"
+)
+
+// openPTY returns the master side of a new pseudo-terminal pair and the path of its slave side.
+func openPTY(t *testing.T) (master *os.File, slavePath string) {
+	master, err := os.OpenFile("/dev/ptmx", os.O_RDWR|syscall.O_NOCTTY, 0)
+	if err != nil {
+		t.Skipf("no pseudo-terminals available: %v", err)
+	}
+	var unlock int32
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, master.Fd(), syscall.TIOCSPTLCK, uintptr(unsafe.Pointer(&unlock))); errno != 0 {
+		master.Close()
+		t.Skipf("unlockpt failed: %v", errno)
+	}
+	var ptn uint32
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, master.Fd(), syscall.TIOCGPTN, uintptr(unsafe.Pointer(&ptn))); errno != 0 {
+		master.Close()
+		t.Skipf("ptsname failed: %v", errno)
+	}
+	return master, fmt.Sprintf("/dev/pts/%d", ptn)
+}
+
+func crc16Modbus(data []byte) uint16 {
+	crc := uint16(0xffff)
+	for _, b := range data {
+		crc ^= uint16(b)
+		for i := 0; i < 8; i++ {
+			if crc&1 != 0 {
+				crc = crc>>1 ^ 0xa001
+			} else {
+				crc >>= 1
+			}
+		}
+	}
+	return crc
+}
+
+// serveRTU is a minimal Modbus RTU slave, answering only to Read Holding Registers.
+func serveRTU(port *os.File, slaveID byte, registers map[uint16]uint16) {
+	request := make([]byte, 0, 8)
+	buf := make([]byte, 256)
+	for {
+		n, err := port.Read(buf)
+		if err != nil {
+			return
+		}
+		request = append(request, buf[:n]...)
+		if len(request) < 8 {
+			continue
+		}
+		frame := request[:8]
+		request = request[8:]
+		if frame[0] != slaveID || frame[1] != 0x03 || crc16Modbus(frame[:6]) != binary.LittleEndian.Uint16(frame[6:]) {
+			continue
+		}
+		address := binary.BigEndian.Uint16(frame[2:])
+		count := binary.BigEndian.Uint16(frame[4:])
+		response := []byte{slaveID, 0x03, byte(2 * count)}
+		for i := uint16(0); i < count; i++ {
+			response = binary.BigEndian.AppendUint16(response, registers[address+i])
+		}
+		response = binary.LittleEndian.AppendUint16(response, crc16Modbus(response))
+		if _, err := port.Write(response); err != nil {
+			return
+		}
+	}
+}
+
+func TestModbusRTU(t *testing.T) {
+	master, slavePath := openPTY(t)
+	defer master.Close()
+
+	// "SUN2000-5KTL-M1" as model, then numberOfStrings=2 and numberOfMPPTs=2
+	registers := map[uint16]uint16{}
+	model := "SUN2000-5KTL-M1"
+	for i := 0; i < len(model); i += 2 {
+		v := uint16(model[i]) << 8
+		if i+1 < len(model) {
+			v |= uint16(model[i+1])
+		}
+		registers[30000+uint16(i/2)] = v
+	}
+	registers[30071] = 2
+	registers[30072] = 2
+
+	go serveRTU(master, 1, registers)
+
+	cfg.setDefaults()
+	cfg.modbusMode = "rtu"
+	cfg.serialDevice = slavePath
+	cfg.modbusTimeout = 2
+	testDevices := newDevices([]deviceConfig{{name: "rtu", slaveID: 1}})
+	if err := openConnections(testDevices); err != nil {
+		t.Fatalf("openConnections() failed: %v", err)
+	}
+	defer closeConnections(testDevices)
+	d := testDevices[0]
+
+	results, err := d.readModbusFromTo("Identification Data", 30000, 30087)
+	if !d.handleReadModbusResults(results, err) {
+		t.Fatalf("readModbusFromTo() failed: %v", err)
+	}
+
+	id := &d.data.identification
+	if err := id.parse(results); err != nil {
+		t.Fatalf("parse() failed: %v", err)
+	}
+	if id.Model != model || id.NumberOfStrings != 2 || id.NumberOfMPPTs != 2 {
+		t.Errorf("unexpected identification, got model=%q strings=%d mppts=%d", id.Model, id.NumberOfStrings, id.NumberOfMPPTs)
+	}
+}
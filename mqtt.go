@@ -0,0 +1,568 @@
+// Copyright: 2024 Dragos Vingarzan vingarzan -at- gmail -dot- com
+// License: AGPL-3.0
+//
+// This file is part of sun2000-modbus.
+//
+// sun2000-modbus is free software: you can redistribute it and/or modify it under the terms of the GNU Affero General
+// Public License Version 3 (AGPL-3.0) as published by the Free Software Foundation.
+//
+// sun2000-modbus is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY; without even the implied
+// warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the AGPL-3.0 along with sun2000-modbus. If not,
+// see <https://www.gnu.org/licenses/>.
+package main
+
+import (
+	"bufio"
+	"crypto/tls"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/vingarzan/sun2000-modbus/sun2000"
+)
+
+// A minimal MQTT 3.1.1 publisher, with QoS 0 only, which is all we need to push the values to Home Assistant (or
+// anything else listening on the broker). Each block is published as one JSON object per device, after each read:
+//
+//	sun2000/<device>/<block> {"activePower": 3.12, ...}
+//
+// along with the retained Home Assistant discovery configs of its fields, so that they show up as sensors on their own.
+
+const (
+	mqttPacketConnect    = 0x10
+	mqttPacketConnAck    = 0x20
+	mqttPacketPublish    = 0x30
+	mqttPacketPingReq    = 0xc0
+	mqttPacketPingResp   = 0xd0
+	mqttPacketDisconnect = 0xe0
+
+	mqttKeepAlive      = 60 * time.Second
+	mqttReconnectDelay = 10 * time.Second
+	mqttQueueSize      = 1024
+)
+
+type mqttConfig struct {
+	// tcp://host:1883 or ssl://host:8883
+	broker   string
+	username string
+	password string
+	clientID string
+	// the values are published under <topicPrefix>/<device>/...
+	topicPrefix string
+	// the Home Assistant discovery configs under <discoveryPrefix>/..., empty to not publish them
+	discoveryPrefix string
+}
+
+type mqttMessage struct {
+	topic   string
+	payload []byte
+	retain  bool
+}
+
+type mqttPublisher struct {
+	cfg   mqttConfig
+	queue chan mqttMessage
+
+	// the discovery configs already sent on the current connection
+	mutex      sync.Mutex
+	discovered map[string]bool
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+func newMQTTPublisher(c mqttConfig) (*mqttPublisher, error) {
+	u, err := url.Parse(c.broker)
+	if err != nil {
+		return nil, fmt.Errorf("invalid broker %q: %w", c.broker, err)
+	}
+	switch u.Scheme {
+	case "tcp", "mqtt", "ssl", "tls", "mqtts":
+	default:
+		return nil, fmt.Errorf("invalid broker %q: the scheme must be tcp:// or ssl://", c.broker)
+	}
+	return &mqttPublisher{
+		cfg:        c,
+		queue:      make(chan mqttMessage, mqttQueueSize),
+		discovered: make(map[string]bool),
+		stop:       make(chan struct{}),
+		done:       make(chan struct{}),
+	}, nil
+}
+
+// availabilityTopic is where "online"/"offline" is published, the latter by the broker if we vanish.
+func (p *mqttPublisher) availabilityTopic() string {
+	return p.cfg.topicPrefix + "/status"
+}
+
+// run keeps (re)connecting to the broker and publishes the queued messages, until close() is called.
+func (p *mqttPublisher) run() {
+	defer close(p.done)
+	for {
+		err := p.session()
+		if err == nil {
+			return
+		}
+		lWarning.Printf("MQTT %s: %v, reconnecting in %s", p.cfg.broker, err, mqttReconnectDelay)
+		select {
+		case <-p.stop:
+			return
+		case <-time.After(mqttReconnectDelay):
+		}
+	}
+}
+
+// close disconnects from the broker, after publishing what is still queued.
+func (p *mqttPublisher) close() {
+	close(p.stop)
+	<-p.done
+}
+
+func (p *mqttPublisher) dial() (conn net.Conn, err error) {
+	u, _ := url.Parse(p.cfg.broker)
+	host := u.Host
+	switch u.Scheme {
+	case "ssl", "tls", "mqtts":
+		if len(u.Port()) == 0 {
+			host = net.JoinHostPort(host, "8883")
+		}
+		return tls.DialWithDialer(&net.Dialer{Timeout: 10 * time.Second}, "tcp", host, &tls.Config{ServerName: u.Hostname()})
+	default:
+		if len(u.Port()) == 0 {
+			host = net.JoinHostPort(host, "1883")
+		}
+		return net.DialTimeout("tcp", host, 10*time.Second)
+	}
+}
+
+// session is one connection to the broker. Returns nil only when asked to stop.
+func (p *mqttPublisher) session() error {
+	conn, err := p.dial()
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	w := bufio.NewWriter(conn)
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+	if err := p.writeConnect(w); err != nil {
+		return err
+	}
+	r := bufio.NewReader(conn)
+	packetType, body, err := mqttReadPacket(r)
+	if err != nil {
+		return fmt.Errorf("reading CONNACK: %w", err)
+	}
+	if packetType != mqttPacketConnAck || len(body) != 2 {
+		return fmt.Errorf("expected a CONNACK, got packet type %#02x", packetType)
+	}
+	if body[1] != 0 {
+		return fmt.Errorf("connection refused with return code %d", body[1])
+	}
+	conn.SetDeadline(time.Time{})
+	lInfo.Printf("MQTT connected to %s", p.cfg.broker)
+
+	// the discovery configs must be sent again, the broker might have lost them
+	p.mutex.Lock()
+	p.discovered = make(map[string]bool)
+	p.mutex.Unlock()
+
+	// the broker only sends PINGRESP back, but we have to read them, to notice when the connection is gone
+	readErr := make(chan error, 1)
+	go func() {
+		for {
+			if _, _, err := mqttReadPacket(r); err != nil {
+				readErr <- err
+				return
+			}
+		}
+	}()
+
+	write := func(m mqttMessage) error {
+		conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
+		mqttWritePublish(w, m)
+		return w.Flush()
+	}
+	if err := write(mqttMessage{topic: p.availabilityTopic(), payload: []byte("online"), retain: true}); err != nil {
+		return err
+	}
+
+	ping := time.NewTicker(mqttKeepAlive / 2)
+	defer ping.Stop()
+	for {
+		select {
+		case <-p.stop:
+			// flush what is left, then say goodbye
+			for len(p.queue) > 0 {
+				if err := write(<-p.queue); err != nil {
+					return nil
+				}
+			}
+			write(mqttMessage{topic: p.availabilityTopic(), payload: []byte("offline"), retain: true})
+			w.Write([]byte{mqttPacketDisconnect, 0})
+			w.Flush()
+			return nil
+		case err := <-readErr:
+			return err
+		case m := <-p.queue:
+			if err := write(m); err != nil {
+				return err
+			}
+		case <-ping.C:
+			conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
+			w.Write([]byte{mqttPacketPingReq, 0})
+			if err := w.Flush(); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+func (p *mqttPublisher) writeConnect(w *bufio.Writer) error {
+	var flags byte = 0x02 // clean session
+	var payload []byte
+	payload = mqttAppendString(payload, p.cfg.clientID)
+	// the will, so that Home Assistant marks the sensors as unavailable if we vanish
+	flags |= 0x04 | 0x20
+	payload = mqttAppendString(payload, p.availabilityTopic())
+	payload = mqttAppendString(payload, "offline")
+	if len(p.cfg.username) > 0 {
+		flags |= 0x80
+		payload = mqttAppendString(payload, p.cfg.username)
+		if len(p.cfg.password) > 0 {
+			flags |= 0x40
+			payload = mqttAppendString(payload, p.cfg.password)
+		}
+	}
+
+	var body []byte
+	body = mqttAppendString(body, "MQTT")
+	body = append(body, 4, flags)
+	body = binary.BigEndian.AppendUint16(body, uint16(mqttKeepAlive/time.Second))
+	body = append(body, payload...)
+
+	w.WriteByte(mqttPacketConnect)
+	w.Write(mqttAppendLength(nil, len(body)))
+	w.Write(body)
+	return w.Flush()
+}
+
+func mqttWritePublish(w *bufio.Writer, m mqttMessage) {
+	header := byte(mqttPacketPublish)
+	if m.retain {
+		header |= 0x01
+	}
+	topic := mqttAppendString(nil, m.topic)
+	w.WriteByte(header)
+	w.Write(mqttAppendLength(nil, len(topic)+len(m.payload)))
+	w.Write(topic)
+	w.Write(m.payload)
+}
+
+func mqttAppendString(b []byte, s string) []byte {
+	b = binary.BigEndian.AppendUint16(b, uint16(len(s)))
+	return append(b, s...)
+}
+
+// mqttAppendLength appends the "remaining length" of a packet, 7 bits per byte.
+func mqttAppendLength(b []byte, length int) []byte {
+	for {
+		digit := byte(length % 128)
+		length /= 128
+		if length > 0 {
+			digit |= 0x80
+		}
+		b = append(b, digit)
+		if length == 0 {
+			return b
+		}
+	}
+}
+
+// mqttReadPacket reads one packet, returning its type (the high nibble of the first byte) and its body.
+func mqttReadPacket(r *bufio.Reader) (packetType byte, body []byte, err error) {
+	header, err := r.ReadByte()
+	if err != nil {
+		return 0, nil, err
+	}
+	length := 0
+	for shift := 0; ; shift += 7 {
+		if shift > 21 {
+			return 0, nil, errors.New("malformed remaining length")
+		}
+		b, err := r.ReadByte()
+		if err != nil {
+			return 0, nil, err
+		}
+		length |= int(b&0x7f) << shift
+		if b&0x80 == 0 {
+			break
+		}
+	}
+	body = make([]byte, length)
+	if _, err := io.ReadFull(r, body); err != nil {
+		return 0, nil, err
+	}
+	return header & 0xf0, body, nil
+}
+
+// publish queues a message, dropping it if the broker is not keeping up, so that the poller is never blocked. It
+// returns false if the message was dropped.
+func (p *mqttPublisher) publish(m mqttMessage) bool {
+	select {
+	case p.queue <- m:
+		return true
+	default:
+		lWarning.Printf("MQTT queue full, dropping the message to %s", m.topic)
+		return false
+	}
+}
+
+// mqttSlug turns a name into something usable in topics and IDs, e.g. "ESU1-Pack1 Data" to "esu1_pack1_data".
+func mqttSlug(s string) string {
+	var sb strings.Builder
+	underscore := false
+	for _, r := range strings.ToLower(s) {
+		if r >= 'a' && r <= 'z' || r >= '0' && r <= '9' {
+			sb.WriteRune(r)
+			underscore = false
+		} else if !underscore && sb.Len() > 0 {
+			sb.WriteByte('_')
+			underscore = true
+		}
+	}
+	return strings.TrimSuffix(sb.String(), "_")
+}
+
+// blockTopic is the topic of the values of a block, named after its built-in target if it has one.
+func (p *mqttPublisher) blockTopic(d *device, r *modbusInterval) string {
+	name := r.values.block.Target
+	if len(name) == 0 {
+		name = mqttSlug(r.name)
+	}
+	return fmt.Sprintf("%s/%s/%s", p.cfg.topicPrefix, mqttSlug(d.name), name)
+}
+
+// mqttUnits maps the units of the register map to the ones Home Assistant expects.
+var mqttUnits = map[string]string{
+	"kVar":   "kvar",
+	"Var":    "var",
+	"kVar h": "kvarh",
+	"℃":      "°C",
+	"mins":   "min",
+}
+
+// haSensorClasses returns the Home Assistant unit, device_class and state_class of a field.
+func haSensorClasses(f *registerField) (unit, deviceClass, stateClass string) {
+	switch f.Type {
+	case registerTypeEpoch:
+		return "", "timestamp", ""
+	case registerTypeSTR, registerTypeE16, registerTypeBitfield16, registerTypeBitfield32:
+		return "", "", ""
+	}
+	unit = f.Unit
+	if u, ok := mqttUnits[unit]; ok {
+		unit = u
+	}
+	stateClass = "measurement"
+	switch f.Unit {
+	case "W", "kW":
+		deviceClass = "power"
+	case "kWh":
+		deviceClass = "energy"
+		// the daily, monthly, ... totals reset, which total_increasing copes with too
+		stateClass = "total_increasing"
+	case "VA", "kVA":
+		deviceClass = "apparent_power"
+	case "Var", "kVar":
+		deviceClass = "reactive_power"
+	case "V":
+		deviceClass = "voltage"
+	case "A":
+		deviceClass = "current"
+	case "Hz":
+		deviceClass = "frequency"
+	case "℃":
+		deviceClass = "temperature"
+	case "mins", "s":
+		deviceClass = "duration"
+	case "%":
+		if strings.Contains(strings.ToLower(f.Name), "soc") {
+			deviceClass = "battery"
+		}
+	}
+	if len(f.Unit) == 0 && strings.Contains(strings.ToLower(f.Name), "powerfactor") {
+		deviceClass = "power_factor"
+	}
+	if f.Kind == metricCounter {
+		stateClass = "total_increasing"
+	}
+	return unit, deviceClass, stateClass
+}
+
+// haDevice is the device block of the discovery configs, grouping all the sensors of one inverter.
+type haDevice struct {
+	Identifiers  []string `json:"identifiers"`
+	Name         string   `json:"name"`
+	Manufacturer string   `json:"manufacturer"`
+	Model        string   `json:"model,omitempty"`
+	SWVersion    string   `json:"sw_version,omitempty"`
+}
+
+type haSensorConfig struct {
+	Name                string    `json:"name"`
+	UniqueID            string    `json:"unique_id"`
+	ObjectID            string    `json:"object_id"`
+	StateTopic          string    `json:"state_topic"`
+	ValueTemplate       string    `json:"value_template"`
+	JSONAttributesTopic string    `json:"json_attributes_topic,omitempty"`
+	JSONAttrTemplate    string    `json:"json_attributes_template,omitempty"`
+	AvailabilityTopic   string    `json:"availability_topic"`
+	UnitOfMeasurement   string    `json:"unit_of_measurement,omitempty"`
+	DeviceClass         string    `json:"device_class,omitempty"`
+	StateClass          string    `json:"state_class,omitempty"`
+	EntityCategory      string    `json:"entity_category,omitempty"`
+	Device              *haDevice `json:"device"`
+}
+
+// discover queues the retained discovery config of a sensor, unless it was already sent on this connection. If the
+// queue is full, it is sent again on the next read of the block.
+func (p *mqttPublisher) discover(component, objectID string, config *haSensorConfig) {
+	if len(p.cfg.discoveryPrefix) == 0 {
+		return
+	}
+	topic := fmt.Sprintf("%s/%s/%s/config", p.cfg.discoveryPrefix, component, objectID)
+	p.mutex.Lock()
+	if p.discovered[topic] {
+		p.mutex.Unlock()
+		return
+	}
+	p.discovered[topic] = true
+	p.mutex.Unlock()
+
+	payload, err := json.Marshal(config)
+	if err == nil && p.publish(mqttMessage{topic: topic, payload: payload, retain: true}) {
+		return
+	}
+	if err != nil {
+		lError.Printf("MQTT discovery of %s: %v", objectID, err)
+	}
+	p.mutex.Lock()
+	delete(p.discovered, topic)
+	p.mutex.Unlock()
+}
+
+// blockParsed publishes the values of the block, and the discovery configs of its fields.
+func (p *mqttPublisher) blockParsed(d *device, r *modbusInterval) {
+	id := &d.data.identification
+	id.RLock()
+	if id.lastRead.IsZero() {
+		// without the SN, there is nothing to group the sensors under
+		id.RUnlock()
+		return
+	}
+	dev := &haDevice{
+		Identifiers:  []string{"sun2000_" + id.SN},
+		Name:         d.name,
+		Manufacturer: "Huawei",
+		Model:        id.Model,
+		SWVersion:    id.SoftwareVersion,
+	}
+	id.RUnlock()
+
+	// the registers of the battery packs which are not there are all zeroes
+	if pack, ok := r.target.(*batteryData); ok && !pack.isPresent() {
+		return
+	}
+
+	topic := p.blockTopic(d, r)
+	state := make(map[string]any)
+	r.values.RLock()
+	for i := range r.values.values {
+		v := &r.values.values[i]
+		if !d.caps.hasValue(v) {
+			continue
+		}
+		key := v.key()
+		state[key] = v.jsonValue()
+
+		name := v.field.Description
+		if len(name) == 0 {
+			name = v.field.Name
+		}
+		if v.field.Repeat > 0 {
+			name = fmt.Sprintf("%s %d", name, v.index)
+		}
+		objectID := fmt.Sprintf("%s_%s_%s", mqttSlug(dev.Identifiers[0]), mqttSlug(r.name), mqttSlug(key))
+		config := &haSensorConfig{
+			Name:              name,
+			UniqueID:          objectID,
+			ObjectID:          fmt.Sprintf("%s_%s", mqttSlug(d.name), mqttSlug(key)),
+			StateTopic:        topic,
+			ValueTemplate:     fmt.Sprintf("{{ value_json[%q] }}", key),
+			AvailabilityTopic: p.availabilityTopic(),
+			Device:            dev,
+		}
+		config.UnitOfMeasurement, config.DeviceClass, config.StateClass = haSensorClasses(v.field)
+		if len(v.field.Metric) == 0 {
+			// the raw details, which Home Assistant lists apart, under Diagnostic
+			config.EntityCategory = "diagnostic"
+		}
+		p.discover("sensor", objectID, config)
+	}
+	r.values.RUnlock()
+
+	payload, err := json.Marshal(state)
+	if err != nil {
+		lError.Printf("MQTT state of %s: %v", r.name, err)
+		return
+	}
+	p.publish(mqttMessage{topic: topic, payload: payload})
+
+	if alarm, ok := r.target.(*alarmData1); ok {
+		p.publishAlarms(d, alarm, dev)
+	}
+}
+
+// publishAlarms publishes the active alarms, decoded from the alarm bitfields, as a list and as their count.
+func (p *mqttPublisher) publishAlarms(d *device, x *alarmData1, dev *haDevice) {
+	x.RLock()
+	alarms := sun2000.ActiveAlarms(x.Bits)
+	x.RUnlock()
+
+	state := struct {
+		Count  int         `json:"count"`
+		Active []alarmJSON `json:"active"`
+	}{Count: len(alarms), Active: alarmsJSON(alarms)}
+	payload, err := json.Marshal(state)
+	if err != nil {
+		lError.Printf("MQTT alarms: %v", err)
+		return
+	}
+	topic := fmt.Sprintf("%s/%s/alarms", p.cfg.topicPrefix, mqttSlug(d.name))
+	p.publish(mqttMessage{topic: topic, payload: payload})
+
+	objectID := fmt.Sprintf("%s_active_alarms", mqttSlug(dev.Identifiers[0]))
+	p.discover("sensor", objectID, &haSensorConfig{
+		Name:                "Active Alarms",
+		UniqueID:            objectID,
+		ObjectID:            mqttSlug(d.name) + "_active_alarms",
+		StateTopic:          topic,
+		ValueTemplate:       "{{ value_json.count }}",
+		JSONAttributesTopic: topic,
+		JSONAttrTemplate:    "{{ {'active': value_json.active} | tojson }}",
+		AvailabilityTopic:   p.availabilityTopic(),
+		StateClass:          "measurement",
+		Device:              dev,
+	})
+}
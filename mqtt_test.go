@@ -0,0 +1,200 @@
+// Copyright: 2024 Dragos Vingarzan vingarzan -at- gmail -dot- com
+// License: AGPL-3.0
+//
+// This file is part of sun2000-modbus.
+//
+// sun2000-modbus is free software: you can redistribute it and/or modify it under the terms of the GNU Affero General
+// Public License Version 3 (AGPL-3.0) as published by the Free Software Foundation.
+//
+// sun2000-modbus is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY; without even the implied
+// warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the AGPL-3.0 along with sun2000-modbus. If not,
+// see <https://www.gnu.org/licenses/>.
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeBroker is an in-process MQTT broker, which accepts one client and records what it publishes.
+type fakeBroker struct {
+	listener net.Listener
+
+	mutex     sync.Mutex
+	connect   []byte
+	published map[string]mqttMessage
+	received  chan struct{}
+}
+
+func startFakeBroker(t *testing.T) *fakeBroker {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := &fakeBroker{listener: listener, published: make(map[string]mqttMessage), received: make(chan struct{}, 1)}
+	go b.serve()
+	t.Cleanup(func() { listener.Close() })
+	return b
+}
+
+func (b *fakeBroker) serve() {
+	conn, err := b.listener.Accept()
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	for {
+		packetType, body, err := mqttReadPacket(r)
+		if err != nil {
+			return
+		}
+		switch packetType {
+		case mqttPacketConnect:
+			b.mutex.Lock()
+			b.connect = body
+			b.mutex.Unlock()
+			conn.Write([]byte{mqttPacketConnAck, 2, 0, 0})
+		case mqttPacketPublish:
+			n := binary.BigEndian.Uint16(body)
+			m := mqttMessage{topic: string(body[2 : 2+n]), payload: body[2+n:]}
+			b.mutex.Lock()
+			b.published[m.topic] = m
+			b.mutex.Unlock()
+			select {
+			case b.received <- struct{}{}:
+			default:
+			}
+		case mqttPacketPingReq:
+			conn.Write([]byte{mqttPacketPingResp, 0})
+		case mqttPacketDisconnect:
+			return
+		}
+	}
+}
+
+// waitFor waits until the topic was published, and returns its payload decoded.
+func (b *fakeBroker) waitFor(t *testing.T, topic string, out any) {
+	deadline := time.After(5 * time.Second)
+	for {
+		b.mutex.Lock()
+		m, ok := b.published[topic]
+		b.mutex.Unlock()
+		if ok {
+			if err := json.Unmarshal(m.payload, out); err != nil {
+				t.Fatalf("%s: %v in %s", topic, err, m.payload)
+			}
+			return
+		}
+		select {
+		case <-b.received:
+		case <-deadline:
+			t.Fatalf("%s was not published", topic)
+		}
+	}
+}
+
+func TestMQTTPublisher(t *testing.T) {
+	broker := startFakeBroker(t)
+	pub, err := newMQTTPublisher(mqttConfig{
+		broker:          "tcp://" + broker.listener.Addr().String(),
+		username:        "user",
+		password:        "secret",
+		clientID:        "test",
+		topicPrefix:     "sun2000",
+		discoveryPrefix: "homeassistant",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	go pub.run()
+	blockListeners = []blockListener{pub}
+	t.Cleanup(func() { blockListeners = nil })
+
+	server := startSimulator(t, nil)
+	d := simulatorDevices(t, server, 1)[0]
+	// the first read after connecting is not answered
+	d.readModbusFromTo("dummy read", 30000, 30015)
+	d.readExpiredRanges(context.Background())
+
+	var inverter map[string]any
+	broker.waitFor(t, "sun2000/sim1/inverter", &inverter)
+	if power, ok := inverter["activePower"].(float64); !ok || power <= 0 {
+		t.Errorf("unexpected activePower %v", inverter["activePower"])
+	}
+	if inverter["deviceStatus"] != "On-grid: running" {
+		t.Errorf("unexpected deviceStatus %v", inverter["deviceStatus"])
+	}
+	var pv map[string]any
+	broker.waitFor(t, "sun2000/sim1/pv", &pv)
+	if _, ok := pv["pv_voltage_1"]; !ok {
+		t.Errorf("no pv_voltage_1 in %v", pv)
+	}
+
+	var config haSensorConfig
+	broker.waitFor(t, "homeassistant/sensor/sun2000_sim0000001_grid_data_activepower/config", &config)
+	if config.DeviceClass != "power" || config.StateClass != "measurement" || config.UnitOfMeasurement != "kW" ||
+		config.StateTopic != "sun2000/sim1/inverter" || config.Device.Model != "SUN2000-5KTL-M1" {
+		t.Errorf("unexpected discovery config %+v", config)
+	}
+	broker.waitFor(t, "homeassistant/sensor/sun2000_sim0000001_cumulative_data_1_cumulativegeneratedelectricity/config", &config)
+	if config.DeviceClass != "energy" || config.StateClass != "total_increasing" {
+		t.Errorf("unexpected discovery config %+v", config)
+	}
+	broker.waitFor(t, "homeassistant/sensor/sun2000_sim0000001_esu1_data_batterysoc/config", &config)
+	if config.DeviceClass != "battery" || config.UnitOfMeasurement != "%" {
+		t.Errorf("unexpected discovery config %+v", config)
+	}
+
+	var alarms struct {
+		Count int `json:"count"`
+	}
+	broker.waitFor(t, "sun2000/sim1/alarms", &alarms)
+	if alarms.Count != 0 {
+		t.Errorf("unexpected alarms %+v", alarms)
+	}
+
+	// only the one pack of the simulator is published
+	broker.mutex.Lock()
+	_, missing := broker.published["sun2000/sim1/esu1Pack2"]
+	connect := broker.connect
+	broker.mutex.Unlock()
+	if missing {
+		t.Errorf("a missing pack was published")
+	}
+	// protocol name, level 4, then flags: username, password, will retain, will, clean session
+	if len(connect) < 8 || string(connect[2:6]) != "MQTT" || connect[7] != 0x80|0x40|0x20|0x04|0x02 {
+		t.Errorf("unexpected CONNECT %q", connect)
+	}
+
+	pub.close()
+}
+
+func TestMQTTDiscoveryQueueFull(t *testing.T) {
+	pub, err := newMQTTPublisher(mqttConfig{broker: "tcp://127.0.0.1:1883", topicPrefix: "sun2000", discoveryPrefix: "homeassistant"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	topic := "homeassistant/sensor/x/config"
+	// not run, so nothing takes from the queue
+	pub.queue = make(chan mqttMessage)
+	pub.discover("sensor", "x", &haSensorConfig{Name: "X"})
+	if pub.discovered[topic] {
+		t.Errorf("a dropped discovery config is marked as sent")
+	}
+	pub.queue = make(chan mqttMessage, 1)
+	pub.discover("sensor", "x", &haSensorConfig{Name: "X"})
+	pub.discover("sensor", "x", &haSensorConfig{Name: "X"})
+	if !pub.discovered[topic] || len(pub.queue) != 1 {
+		t.Errorf("discovered %v, %d queued, want it sent once", pub.discovered[topic], len(pub.queue))
+	}
+}
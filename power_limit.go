@@ -0,0 +1,502 @@
+// Copyright: 2024 Dragos Vingarzan vingarzan -at- gmail -dot- com
+// License: AGPL-3.0
+//
+// This file is part of sun2000-modbus.
+//
+// sun2000-modbus is free software: you can redistribute it and/or modify it under the terms of the GNU Affero General
+// Public License Version 3 (AGPL-3.0) as published by the Free Software Foundation.
+//
+// sun2000-modbus is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY; without even the implied
+// warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the AGPL-3.0 along with sun2000-modbus. If not,
+// see <https://www.gnu.org/licenses/>.
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Active power limitation: the derating of the output of the inverter and the limit of the power exported to the
+// grid, following a daily schedule of time windows. Outside of the windows, and when the limiter stops, the inverter is
+// set back to no limits.
+
+// The writable registers of the power control.
+const (
+	// I16 % gain 10
+	regActivePowerPercentageDerating = 40125
+	// U32 W
+	regActivePowerFixedDerating = 40126
+	// U16, see the activePowerControl values
+	regActivePowerControlMode = 47415
+	// I32 W
+	regMaximumFeedGridPower = 47416
+	// I16 % gain 10
+	regMaximumFeedGridPowerPercent = 47418
+)
+
+// The values of regActivePowerControlMode, for the grid export limitation.
+const (
+	activePowerControlUnlimited      = 0
+	activePowerControlZeroExport     = 5
+	activePowerControlLimitedKW      = 6
+	activePowerControlLimitedPercent = 7
+)
+
+// powerValue is a power either in kW, or in % of Pmax.
+type powerValue struct {
+	value   float64
+	percent bool
+}
+
+// parsePowerValue parses a power with its unit, e.g. 50%, 2.5kW or 800W.
+func parsePowerValue(s string) (out powerValue, err error) {
+	number, scale := s, 1.0
+	switch lower := strings.ToLower(s); {
+	case strings.HasSuffix(lower, "%"):
+		number, out.percent = s[:len(s)-1], true
+	case strings.HasSuffix(lower, "kw"):
+		number = s[:len(s)-2]
+	case strings.HasSuffix(lower, "w"):
+		number, scale = s[:len(s)-1], 0.001
+	default:
+		return out, fmt.Errorf("power %q needs a unit, %%, kW or W", s)
+	}
+	out.value, err = strconv.ParseFloat(number, 64)
+	if err != nil {
+		return out, fmt.Errorf("invalid power %q", s)
+	}
+	out.value *= scale
+	if out.value < 0 || (out.percent && out.value > 100) {
+		return out, fmt.Errorf("power %q is out of range", s)
+	}
+	return out, nil
+}
+
+// kW returns the power, bounded by Pmax.
+func (x powerValue) kW(pmax float64) float64 {
+	if x.percent {
+		return pmax * x.value / 100
+	}
+	return math.Min(x.value, pmax)
+}
+
+func (x powerValue) String() string {
+	if x.percent {
+		return strconv.FormatFloat(x.value, 'f', -1, 64) + "%"
+	}
+	return strconv.FormatFloat(x.value, 'f', -1, 64) + "kW"
+}
+
+// powerLimit is what the inverter is asked to honour. Unset means no limit.
+type powerLimit struct {
+	// of the output of the inverter
+	derating *powerValue
+	// of the power fed into the grid, as measured by the meter
+	export *powerValue
+}
+
+func (x powerLimit) String() string {
+	var parts []string
+	if x.derating != nil {
+		parts = append(parts, "derating:"+x.derating.String())
+	}
+	if x.export != nil {
+		parts = append(parts, "export:"+x.export.String())
+	}
+	if len(parts) == 0 {
+		return "none"
+	}
+	return strings.Join(parts, "+")
+}
+
+// plan returns the writes to set the limit, with the powers bounded by Pmax (in kW). All the registers are written
+// each time, so that no older limit stays behind.
+func (x powerLimit) plan(pmax float64) (out []registerWrite) {
+	percent, fixed := 100.0, pmax
+	if x.derating != nil {
+		if x.derating.percent {
+			percent = x.derating.value
+		} else {
+			fixed = x.derating.kW(pmax)
+		}
+	}
+	out = append(out,
+		registerWrite{"active power percentage derating", regActivePowerPercentageDerating, []uint16{uint16(math.Round(percent * 10))}},
+		registerWrite{"active power fixed derating", regActivePowerFixedDerating, u32Registers(uint32(math.Round(fixed * 1000)))})
+
+	mode := uint16(activePowerControlUnlimited)
+	switch {
+	case x.export == nil:
+	case x.export.percent:
+		mode = activePowerControlLimitedPercent
+		out = append(out, registerWrite{"maximum feed grid power percentage", regMaximumFeedGridPowerPercent, []uint16{uint16(math.Round(x.export.value * 10))}})
+	case x.export.value == 0:
+		mode = activePowerControlZeroExport
+	default:
+		mode = activePowerControlLimitedKW
+		out = append(out, registerWrite{"maximum feed grid power", regMaximumFeedGridPower, u32Registers(uint32(math.Round(x.export.kW(pmax) * 1000)))})
+	}
+	return append(out, registerWrite{"active power control mode", regActivePowerControlMode, []uint16{mode}})
+}
+
+// powerLimitWindow is a daily time window of the schedule, as the time since midnight. When to is before from, the
+// window goes over midnight.
+type powerLimitWindow struct {
+	from, to time.Duration
+	limit    powerLimit
+}
+
+func (x *powerLimitWindow) contains(t time.Time) bool {
+	d := time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute + time.Duration(t.Second())*time.Second
+	if x.from <= x.to {
+		return d >= x.from && d < x.to
+	}
+	return d >= x.from || d < x.to
+}
+
+func parseClock(s string) (time.Duration, error) {
+	hours, minutes, found := strings.Cut(s, ":")
+	h, err1 := strconv.ParseUint(hours, 10, 8)
+	m, err2 := strconv.ParseUint(minutes, 10, 8)
+	if !found || err1 != nil || err2 != nil || m > 59 || h > 24 || (h == 24 && m > 0) {
+		return 0, fmt.Errorf("invalid time %q, not in the HH:MM format", s)
+	}
+	return time.Duration(h)*time.Hour + time.Duration(m)*time.Minute, nil
+}
+
+// parsePowerLimitSchedule parses a comma separated list of time windows, each in the form from-to=kind:power, with
+// more limits joined by +. The kind is either derating or export, the power in %, kW or W. The first window containing
+// the time is used, e.g.:
+//
+//	10:00-16:00=export:0kW,22:00-06:00=derating:50%+export:1.5kW
+func parsePowerLimitSchedule(in string) (out []powerLimitWindow, err error) {
+	for _, entry := range strings.Split(in, ",") {
+		entry = strings.TrimSpace(entry)
+		if len(entry) == 0 {
+			continue
+		}
+		window, limits, found := strings.Cut(entry, "=")
+		from, to, found2 := strings.Cut(window, "-")
+		if !found || !found2 {
+			return nil, fmt.Errorf("window %q is not in the from-to=kind:power format", entry)
+		}
+		var w powerLimitWindow
+		if w.from, err = parseClock(from); err != nil {
+			return nil, fmt.Errorf("window %q: %v", entry, err)
+		}
+		if w.to, err = parseClock(to); err != nil {
+			return nil, fmt.Errorf("window %q: %v", entry, err)
+		}
+		if w.from == w.to {
+			return nil, fmt.Errorf("window %q is empty", entry)
+		}
+		for _, limit := range strings.Split(limits, "+") {
+			kind, power, found := strings.Cut(limit, ":")
+			if !found {
+				return nil, fmt.Errorf("window %q: limit %q is not in the kind:power format", entry, limit)
+			}
+			v, err := parsePowerValue(power)
+			if err != nil {
+				return nil, fmt.Errorf("window %q: %v", entry, err)
+			}
+			switch kind {
+			case "derating":
+				w.limit.derating = &v
+			case "export":
+				w.limit.export = &v
+			default:
+				return nil, fmt.Errorf("window %q: the limit must be derating or export, not %q", entry, kind)
+			}
+		}
+		out = append(out, w)
+	}
+	if len(out) == 0 {
+		return nil, fmt.Errorf("no windows in %q", in)
+	}
+	return out, nil
+}
+
+// powerLimitState is the last limit written to a device.
+type powerLimitState struct {
+	target    powerLimit
+	applied   bool
+	appliedAt time.Time
+	err       error
+}
+
+// powerLimiter writes the limits of the schedule to the devices, when they change, and the defaults when it stops.
+type powerLimiter struct {
+	sync.Mutex
+	devices  []*device
+	schedule []powerLimitWindow
+	interval time.Duration
+	state    map[*device]*powerLimitState
+
+	// the clock, replaced in the tests
+	now func() time.Time
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+// The power limiter, if POWER_LIMIT_SCHEDULE is set.
+var powerLimits *powerLimiter
+
+// While the inverter follows a new limit, the power is a bit above it.
+const powerLimitTolerance = 0.02
+
+// On stop, the limits are removed in a few attempts, within a timeout, so that the shutdown does not hang.
+const (
+	powerLimitFallbackAttempts = 3
+	powerLimitFallbackRetry    = time.Second
+	powerLimitFallbackTimeout  = 30 * time.Second
+)
+
+func newPowerLimiter(devices []*device, schedule []powerLimitWindow, interval time.Duration) *powerLimiter {
+	x := &powerLimiter{
+		devices:  devices,
+		schedule: schedule,
+		interval: interval,
+		state:    make(map[*device]*powerLimitState),
+		now:      time.Now,
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+	for _, d := range devices {
+		x.state[d] = &powerLimitState{}
+	}
+	return x
+}
+
+// target returns the limit for the time, from the first window containing it.
+func (x *powerLimiter) target(t time.Time) powerLimit {
+	for i := range x.schedule {
+		if x.schedule[i].contains(t) {
+			return x.schedule[i].limit
+		}
+	}
+	return powerLimit{}
+}
+
+// forDevice returns the limit as it applies to the device. The export is measured by the meter, so it is only limited
+// by the inverter which has one (e.g. the master behind the SDongle): each cascaded inverter limiting it too would
+// allow as many times the limit, or be asked for what it cannot measure.
+func (x powerLimit) forDevice(d *device) powerLimit {
+	if x.export != nil && !d.caps.polls("meter") {
+		x.export = nil
+	}
+	return x
+}
+
+// apply writes the limit to the devices which don't have it yet, or failed before. It returns false if any failed.
+func (x *powerLimiter) apply(target powerLimit) (ok bool) {
+	ok = true
+	for _, d := range x.devices {
+		limit := target.forDevice(d)
+		x.Lock()
+		state := x.state[d]
+		same := state.applied && state.target.String() == limit.String()
+		x.Unlock()
+		if same {
+			continue
+		}
+
+		err := d.setPowerLimit(limit)
+		if err != nil {
+			lWarning.Printf("Error setting the power limit %s on %s: %v", limit, d.name, err)
+			ok = false
+		} else {
+			lInfo.Printf("Power limit on %s set to %s", d.name, limit)
+		}
+		x.Lock()
+		*state = powerLimitState{target: limit, applied: err == nil, appliedAt: x.now(), err: err}
+		x.Unlock()
+	}
+	return ok
+}
+
+func (d *device) pmax() (float64, error) {
+	x := &d.data.identification
+	x.RLock()
+	defer x.RUnlock()
+	if x.lastRead.IsZero() || x.MaxActivePowerPmax <= 0 {
+		return 0, errors.New("the maximum active power (Pmax) was not read yet")
+	}
+	return float64(x.MaxActivePowerPmax), nil
+}
+
+func (d *device) setPowerLimit(limit powerLimit) error {
+	pmax, err := d.pmax()
+	if err != nil {
+		return err
+	}
+	for _, v := range []*powerValue{limit.derating, limit.export} {
+		if v != nil && !v.percent && v.value > pmax {
+			lWarning.Printf("The power limit %s on %s is above Pmax, using %.3fkW", v, d.name, pmax)
+		}
+	}
+	return d.executeWrites(limit.plan(pmax), "power limiter")
+}
+
+// run applies the schedule every interval, or sooner after errors, until close() is called.
+func (x *powerLimiter) run() {
+	defer close(x.done)
+	for {
+		wait := x.interval
+		if !x.apply(x.target(x.now())) {
+			wait = min(wait, 10*time.Second)
+		}
+		select {
+		case <-x.stop:
+			x.removeLimits()
+			return
+		case <-time.After(wait):
+		}
+	}
+}
+
+// removeLimits falls back to no limits, on stop. The connection may be down, e.g. in the backoff of the supervisor,
+// so it is reopened once, and the writes retried.
+func (x *powerLimiter) removeLimits() {
+	lInfo.Printf("Power limiter stopping, removing the limits")
+	previous := make(map[*device]string)
+	x.Lock()
+	for d, state := range x.state {
+		previous[d] = state.target.String()
+	}
+	x.Unlock()
+
+	deadline := time.Now().Add(powerLimitFallbackTimeout)
+	for attempt := 1; !x.apply(powerLimit{}); attempt++ {
+		if attempt == powerLimitFallbackAttempts || time.Now().Add(powerLimitFallbackRetry).After(deadline) {
+			x.Lock()
+			defer x.Unlock()
+			for _, d := range x.devices {
+				if state := x.state[d]; !state.applied {
+					lError.Printf("Failed to remove the power limit on %s, which is still set to %s: %v", d.name, previous[d], state.err)
+				}
+			}
+			return
+		}
+		if attempt == 1 {
+			reopened := make(map[*modbusConnection]bool)
+			for _, d := range x.devices {
+				if x.failedOn(d) && !reopened[d.conn] {
+					reopened[d.conn] = true
+					if err := d.conn.open(); err != nil {
+						lWarning.Printf("Failed to reopen the modbus connection %s, to remove the power limits: %v", d.conn.name, err)
+					}
+				}
+			}
+		}
+		time.Sleep(powerLimitFallbackRetry)
+	}
+	lInfo.Printf("Power limits removed")
+}
+
+func (x *powerLimiter) failedOn(d *device) bool {
+	x.Lock()
+	defer x.Unlock()
+	return !x.state[d].applied
+}
+
+func (x *powerLimiter) close() {
+	close(x.stop)
+	<-x.done
+}
+
+// powerLimitStatus is what the API returns per device, with the powers in kW.
+type powerLimitStatus struct {
+	Device          string   `json:"device"`
+	Target          string   `json:"target"`
+	Pmax            float64  `json:"pmax"`
+	ActivePowerMax  float64  `json:"activePowerMax"`
+	ExportMax       *float64 `json:"exportMax,omitempty"`
+	ActivePower     float32  `json:"activePower"`
+	GridActivePower float32  `json:"gridActivePower"`
+	Honoured        bool     `json:"honoured"`
+	Applied         bool     `json:"applied"`
+	AppliedAt       string   `json:"appliedAt,omitempty"`
+	Error           string   `json:"error,omitempty"`
+}
+
+// status returns the targets of the devices, next to their actual powers.
+func (x *powerLimiter) status() (out []powerLimitStatus) {
+	for _, d := range x.devices {
+		x.Lock()
+		state := *x.state[d]
+		x.Unlock()
+
+		s := powerLimitStatus{Device: d.name, Target: state.target.String(), Applied: state.applied, Error: errorString(state.err)}
+		if !state.appliedAt.IsZero() {
+			s.AppliedAt = state.appliedAt.Format(time.RFC3339)
+		}
+		d.data.inverter.RLock()
+		s.ActivePower = d.data.inverter.ActivePower
+		d.data.inverter.RUnlock()
+		d.data.meter.RLock()
+		s.GridActivePower = d.data.meter.GridActivePower
+		d.data.meter.RUnlock()
+
+		s.Pmax, _ = d.pmax()
+		s.ActivePowerMax = s.Pmax
+		if state.target.derating != nil {
+			s.ActivePowerMax = state.target.derating.kW(s.Pmax)
+		}
+		tolerance := powerLimitTolerance * s.Pmax
+		s.Honoured = float64(s.ActivePower) <= s.ActivePowerMax+tolerance
+		if state.target.export != nil {
+			exportMax := state.target.export.kW(s.Pmax)
+			s.ExportMax = &exportMax
+			s.Honoured = s.Honoured && float64(s.GridActivePower) <= exportMax+tolerance
+		}
+		out = append(out, s)
+	}
+	return out
+}
+
+func (x *powerLimiter) collectMetrics(r *metricsRegistry) {
+	boolValue := func(b bool) float64 {
+		if b {
+			return 1
+		}
+		return 0
+	}
+	for _, s := range x.status() {
+		device := metricLabel{"device", s.Device}
+		r.gauge("sun2000_power_limit_active_power_target_kilowatts", "Target maximum of the active power of the inverter", s.ActivePowerMax, device)
+		if s.ExportMax != nil {
+			r.gauge("sun2000_power_limit_export_target_kilowatts", "Target maximum of the power fed into the grid", *s.ExportMax, device)
+		}
+		r.gauge("sun2000_power_limit_applied", "Whether the target power limit was written to the inverter", boolValue(s.Applied), device)
+		r.gauge("sun2000_power_limit_honoured", "Whether the active and grid powers are within the target limits", boolValue(s.Honoured), device)
+	}
+}
+
+// handlePowerLimit is the HTTP API showing the targets of the power limiter, and the actual powers.
+func handlePowerLimit(w http.ResponseWriter, r *http.Request) {
+	if !checkControlToken(w, r, "power limit") {
+		return
+	}
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", "GET")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if powerLimits == nil {
+		http.Error(w, "the power limiter is not running", http.StatusServiceUnavailable)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(powerLimits.status())
+}
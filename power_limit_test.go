@@ -0,0 +1,184 @@
+// Copyright: 2024 Dragos Vingarzan vingarzan -at- gmail -dot- com
+// License: AGPL-3.0
+//
+// This file is part of sun2000-modbus.
+//
+// sun2000-modbus is free software: you can redistribute it and/or modify it under the terms of the GNU Affero General
+// Public License Version 3 (AGPL-3.0) as published by the Free Software Foundation.
+//
+// sun2000-modbus is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY; without even the implied
+// warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the AGPL-3.0 along with sun2000-modbus. If not,
+// see <https://www.gnu.org/licenses/>.
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"testing"
+	"time"
+)
+
+func TestParsePowerLimitSchedule(t *testing.T) {
+	schedule, err := parsePowerLimitSchedule("10:00-16:00=export:0kW, 22:00-06:00=derating:50%+export:1500W")
+	if err != nil {
+		t.Fatal(err)
+	}
+	at := func(clock string) string {
+		d, _ := parseClock(clock)
+		l := newPowerLimiter(nil, schedule, time.Minute)
+		return l.target(time.Date(2024, 6, 21, 0, 0, 0, 0, time.Local).Add(d)).String()
+	}
+	for clock, expected := range map[string]string{
+		"09:59": "none",
+		"10:00": "export:0kW",
+		"15:59": "export:0kW",
+		"16:00": "none",
+		"23:00": "derating:50%+export:1.5kW",
+		"05:00": "derating:50%+export:1.5kW",
+	} {
+		if got := at(clock); got != expected {
+			t.Errorf("at %s: %s instead of %s", clock, got, expected)
+		}
+	}
+
+	for _, in := range []string{
+		"",
+		"10:00-16:00",
+		"10:00=export:0kW",
+		"10:00-10:00=export:0kW",
+		"25:00-16:00=export:0kW",
+		"10:00-16:60=export:0kW",
+		"10:00-16:00=export:0",
+		"10:00-16:00=export:120%",
+		"10:00-16:00=export:-1kW",
+		"10:00-16:00=import:1kW",
+	} {
+		if _, err := parsePowerLimitSchedule(in); err == nil {
+			t.Errorf("%q was accepted", in)
+		}
+	}
+}
+
+func TestPowerLimitPlan(t *testing.T) {
+	registers := func(l powerLimit) map[uint16][]uint16 {
+		out := make(map[uint16][]uint16)
+		for _, w := range l.plan(5.5) {
+			out[w.address] = w.values
+		}
+		return out
+	}
+	half, fixed, zero, tooMuch := powerValue{50, true}, powerValue{3, false}, powerValue{0, false}, powerValue{8, false}
+
+	r := registers(powerLimit{})
+	if r[regActivePowerPercentageDerating][0] != 1000 || r[regActivePowerFixedDerating][1] != 5500 || r[regActivePowerControlMode][0] != activePowerControlUnlimited {
+		t.Errorf("unexpected defaults %v", r)
+	}
+	r = registers(powerLimit{derating: &half, export: &zero})
+	if r[regActivePowerPercentageDerating][0] != 500 || r[regActivePowerControlMode][0] != activePowerControlZeroExport {
+		t.Errorf("unexpected registers %v", r)
+	}
+	r = registers(powerLimit{derating: &fixed, export: &half})
+	if r[regActivePowerFixedDerating][1] != 3000 || r[regMaximumFeedGridPowerPercent][0] != 500 || r[regActivePowerControlMode][0] != activePowerControlLimitedPercent {
+		t.Errorf("unexpected registers %v", r)
+	}
+	// bounded by Pmax
+	r = registers(powerLimit{derating: &tooMuch, export: &tooMuch})
+	if r[regActivePowerFixedDerating][1] != 5500 || r[regMaximumFeedGridPower][1] != 5500 || r[regActivePowerControlMode][0] != activePowerControlLimitedKW {
+		t.Errorf("unexpected registers %v", r)
+	}
+}
+
+func TestPowerLimiter(t *testing.T) {
+	server := startSimulator(t, nil)
+	d := simulatorDevices(t, server, 1)[0]
+	// the first read after connecting is not answered
+	d.readModbusFromTo("dummy read", 30000, 30015)
+	d.readExpiredRanges(context.Background())
+
+	schedule, err := parsePowerLimitSchedule("12:00-14:00=export:0kW,14:00-15:00=derating:20%")
+	if err != nil {
+		t.Fatal(err)
+	}
+	l := newPowerLimiter([]*device{d}, schedule, time.Hour)
+	check := func(clock time.Time, target string) powerLimitStatus {
+		t.Helper()
+		if !l.apply(l.target(clock)) {
+			t.Fatalf("failed to apply the limit at %s", clock)
+		}
+		for _, target := range []string{"inverter", "meter"} {
+			if !d.readRange(d.findRange(target)) {
+				t.Fatalf("failed to read the %s data", target)
+			}
+		}
+		s := l.status()[0]
+		if s.Target != target || !s.Applied || !s.Honoured {
+			t.Errorf("at %s: unexpected status %+v", clock.Format("15:04"), s)
+		}
+		return s
+	}
+
+	s := check(time.Date(2024, 6, 21, 13, 0, 0, 0, time.Local), "export:0kW")
+	if s.ExportMax == nil || *s.ExportMax != 0 || s.GridActivePower > 0.01 || s.ActivePower <= 0 {
+		t.Errorf("the export is not limited: %+v", s)
+	}
+	s = check(time.Date(2024, 6, 21, 14, 30, 0, 0, time.Local), "derating:20%")
+	if s.ExportMax != nil || s.ActivePowerMax != 1.1 || s.ActivePower > 1.1 || s.GridActivePower <= 0 {
+		t.Errorf("the active power is not limited: %+v", s)
+	}
+
+	// stopping falls back to no limits, even if the connection is down, in the backoff after an error
+	d.conn.reset()
+	go l.run()
+	l.close()
+	if s := l.status()[0]; s.Target != "none" || !s.Applied {
+		t.Errorf("unexpected status after stopping %+v", s)
+	}
+	results, err := d.readModbusFromTo("power control mode", regActivePowerControlMode, regActivePowerControlMode+1)
+	if err != nil || binary.BigEndian.Uint16(results) != activePowerControlUnlimited {
+		t.Errorf("the export limit was not removed: % x %v", results, err)
+	}
+	results, err = d.readModbusFromTo("percentage derating", regActivePowerPercentageDerating, regActivePowerPercentageDerating+1)
+	if err != nil || binary.BigEndian.Uint16(results) != 1000 {
+		t.Errorf("the derating was not removed: % x %v", results, err)
+	}
+}
+
+func TestPowerLimiterCascaded(t *testing.T) {
+	server := startSimulator(t, nil)
+	devices := simulatorDevices(t, server, 1, 2)
+	master, slave := devices[0], devices[1]
+	master.readModbusFromTo("dummy read", 30000, 30015)
+	for _, d := range devices {
+		d.readExpiredRanges(context.Background())
+	}
+	// the cascaded inverter has no meter
+	slave.caps.Lock()
+	slave.caps.detected = true
+	slave.caps.Unlock()
+
+	schedule, err := parsePowerLimitSchedule("12:00-14:00=derating:80%+export:1kW")
+	if err != nil {
+		t.Fatal(err)
+	}
+	l := newPowerLimiter(devices, schedule, time.Hour)
+	if !l.apply(l.target(time.Date(2024, 6, 21, 13, 0, 0, 0, time.Local))) {
+		t.Fatal("failed to apply the limit")
+	}
+	for _, c := range []struct {
+		d    *device
+		mode uint16
+	}{{master, activePowerControlLimitedKW}, {slave, activePowerControlUnlimited}} {
+		results, err := c.d.readModbusFromTo("power control mode", regActivePowerControlMode, regActivePowerControlMode+1)
+		if err != nil || binary.BigEndian.Uint16(results) != c.mode {
+			t.Errorf("%s: power control mode % x %v, want %d", c.d.name, results, err, c.mode)
+		}
+	}
+	for i, s := range l.status() {
+		if want := []string{"derating:80%+export:1kW", "derating:80%"}[i]; s.Target != want {
+			t.Errorf("%s: target %q, want %q", s.Device, s.Target, want)
+		}
+	}
+}
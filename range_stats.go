@@ -0,0 +1,97 @@
+// Copyright: 2024 Dragos Vingarzan vingarzan -at- gmail -dot- com
+// License: AGPL-3.0
+//
+// This file is part of sun2000-modbus.
+//
+// sun2000-modbus is free software: you can redistribute it and/or modify it under the terms of the GNU Affero General
+// Public License Version 3 (AGPL-3.0) as published by the Free Software Foundation.
+//
+// sun2000-modbus is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY; without even the implied
+// warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the AGPL-3.0 along with sun2000-modbus. If not,
+// see <https://www.gnu.org/licenses/>.
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// rangeStats is the telemetry of the poller for one range: how long the reads take, how they fail and how much they
+// bring, to tune the intervals and to see which blocks the SDongle struggles with.
+type rangeStats struct {
+	sync.Mutex
+
+	latency     *histogram
+	reads       uint64
+	errors      map[errorClass]uint64
+	bytes       uint64
+	lastSuccess time.Time
+	// by parser: "register_map" for the generic decoding, "builtin" for the target
+	parseErrors map[string]uint64
+}
+
+// The buckets of the read latency, in seconds. A SDongle takes from 50ms to a few seconds, per read.
+var rangeLatencyBuckets = []float64{0.05, 0.1, 0.25, 0.5, 1, 2, 5, 10}
+
+func newRangeStats() *rangeStats {
+	return &rangeStats{
+		latency:     newHistogram(rangeLatencyBuckets...),
+		errors:      make(map[errorClass]uint64),
+		parseErrors: make(map[string]uint64),
+	}
+}
+
+// readDone records a read, failed if err is set. The timeouts are left out of the latency, since they would only show
+// the timeout.
+func (x *rangeStats) readDone(latency time.Duration, bytes int, err error) {
+	x.Lock()
+	defer x.Unlock()
+	if err != nil {
+		x.errors[classifyError(err)]++
+		if classifyError(err) != errorClassTimeout {
+			x.latency.observe(latency.Seconds())
+		}
+		return
+	}
+	x.latency.observe(latency.Seconds())
+	x.reads++
+	x.bytes += uint64(bytes)
+	x.lastSuccess = time.Now()
+}
+
+func (x *rangeStats) parseFailed(parser string) {
+	x.Lock()
+	defer x.Unlock()
+	x.parseErrors[parser]++
+}
+
+// collectStats adds the metrics of the poller for the range, with the labels of the device.
+func (r *modbusInterval) collectStats(reg *metricsRegistry, device []metricLabel) {
+	labels := append(append([]metricLabel{}, device...), metricLabel{"range", r.name})
+	with := func(extra metricLabel) []metricLabel {
+		return append(append([]metricLabel{}, labels...), extra)
+	}
+	nextRead := r.values.getNextRead()
+
+	x := r.stats
+	x.Lock()
+	defer x.Unlock()
+	reg.histogram("sun2000_modbus_range_read_duration_seconds", "Duration of the Modbus reads of the range, waiting for the shared connection included", x.latency, labels...)
+	reg.counter("sun2000_modbus_range_reads_total", "Successful Modbus reads of the range", float64(x.reads), labels...)
+	for _, class := range errorClasses {
+		reg.counter("sun2000_modbus_range_read_errors_total", "Failed Modbus reads of the range, by class of error", float64(x.errors[class]), with(metricLabel{"class", string(class)})...)
+	}
+	reg.counter("sun2000_modbus_range_read_bytes_total", "Bytes read from the range", float64(x.bytes), labels...)
+	for _, parser := range []string{"register_map", "builtin"} {
+		reg.counter("sun2000_modbus_range_parse_errors_total", "Reads of the range which failed to parse, by parser", float64(x.parseErrors[parser]), with(metricLabel{"parser", parser})...)
+	}
+	if !x.lastSuccess.IsZero() {
+		reg.gauge("sun2000_modbus_range_last_success_time_seconds", "Time of the last successful read of the range", float64(x.lastSuccess.Unix()), labels...)
+	}
+	if !nextRead.IsZero() {
+		reg.gauge("sun2000_modbus_range_next_read_time_seconds", "Time of the next scheduled read of the range", float64(nextRead.Unix()), labels...)
+	}
+}
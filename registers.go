@@ -0,0 +1,647 @@
+// Copyright: 2024 Dragos Vingarzan vingarzan -at- gmail -dot- com
+// License: AGPL-3.0
+//
+// This file is part of sun2000-modbus.
+//
+// sun2000-modbus is free software: you can redistribute it and/or modify it under the terms of the GNU Affero General
+// Public License Version 3 (AGPL-3.0) as published by the Free Software Foundation.
+//
+// sun2000-modbus is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY; without even the implied
+// warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the AGPL-3.0 along with sun2000-modbus. If not,
+// see <https://www.gnu.org/licenses/>.
+package main
+
+import (
+	_ "embed"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/vingarzan/sun2000-modbus/sun2000"
+	"gopkg.in/yaml.v3"
+)
+
+// The register map describes what to read from the inverter: the blocks of registers read in one go, and the fields
+// in each of them. The built-in one is embedded from registers.yaml and can be extended or overridden with a user
+// file (REGISTER_MAP), so that new registers can be added without touching the code.
+
+//go:embed registers.yaml
+var defaultRegisterMapYAML []byte
+
+// The register map in use. Starts as the built-in one, main() merges the user file on top.
+var regMap = mustLoadDefaultRegisterMap()
+
+type registerType string
+
+const (
+	registerTypeSTR        registerType = "STR"
+	registerTypeU16        registerType = "U16"
+	registerTypeU32        registerType = "U32"
+	registerTypeI16        registerType = "I16"
+	registerTypeI32        registerType = "I32"
+	registerTypeBitfield16 registerType = "Bitfield16"
+	registerTypeBitfield32 registerType = "Bitfield32"
+	registerTypeEpoch      registerType = "Epoch"
+	registerTypeE16        registerType = "E16"
+)
+
+// size returns the number of registers of one value of this type. STR has a variable length.
+func (x registerType) size() uint16 {
+	switch x {
+	case registerTypeU32, registerTypeI32, registerTypeBitfield32, registerTypeEpoch:
+		return 2
+	default:
+		return 1
+	}
+}
+
+func (x *registerType) UnmarshalYAML(value *yaml.Node) error {
+	var s string
+	if err := value.Decode(&s); err != nil {
+		return err
+	}
+	for _, t := range []registerType{registerTypeSTR, registerTypeU16, registerTypeU32, registerTypeI16, registerTypeI32,
+		registerTypeBitfield16, registerTypeBitfield32, registerTypeEpoch, registerTypeE16} {
+		if strings.EqualFold(s, string(t)) {
+			*x = t
+			return nil
+		}
+	}
+	if strings.EqualFold(s, "Bitfield") {
+		*x = registerTypeBitfield16
+		return nil
+	}
+	return fmt.Errorf("line %d: unknown register type %q", value.Line, s)
+}
+
+type registerField struct {
+	// name of the value, unique in the block (repeated fields share it)
+	Name    string       `yaml:"name"`
+	Address uint16       `yaml:"address"`
+	Type    registerType `yaml:"type"`
+	// number of registers, only for STR
+	Length uint16 `yaml:"length,omitempty"`
+	// the raw value is divided by this
+	Gain float64 `yaml:"gain,omitempty"`
+	Unit string  `yaml:"unit,omitempty"`
+	// Prometheus metric name, to which the unit is appended (e.g. _volts). Without it, the value is decoded, but not
+	// exported as a metric.
+	Metric string `yaml:"metric,omitempty"`
+	// gauge (default), or counter for the lifetime totals, which get the _total suffix too
+	Kind        metricKind        `yaml:"kind,omitempty"`
+	Description string            `yaml:"description,omitempty"`
+	Labels      map[string]string `yaml:"labels,omitempty"`
+	// texts for the values of an E16
+	Enum map[int]string `yaml:"enum,omitempty"`
+
+	// For arrays: number of values, registers from one to the next (defaults to the size of the type), the name of
+	// the label carrying the index and the index of the first one (defaults to 1).
+	Repeat uint16 `yaml:"repeat,omitempty"`
+	Stride uint16 `yaml:"stride,omitempty"`
+	Label  string `yaml:"label,omitempty"`
+	Start  int    `yaml:"start,omitempty"`
+
+	// set when the built-in parser of the block's target already handles (and exports) this field
+	builtin bool
+}
+
+// size returns the number of registers of one value of this field.
+func (x *registerField) size() uint16 {
+	if x.Type == registerTypeSTR {
+		return x.Length
+	}
+	return x.Type.size()
+}
+
+func (x *registerField) count() uint16 {
+	if x.Repeat == 0 {
+		return 1
+	}
+	return x.Repeat
+}
+
+func (x *registerField) stride() uint16 {
+	if x.Stride == 0 {
+		return x.size()
+	}
+	return x.Stride
+}
+
+type registerBlock struct {
+	Name string `yaml:"name"`
+	// binds the block to one of the built-in parsers (see sun2000DataStruct.getTarget), which the rest of the code
+	// relies on. Blocks without a target are only decoded and exported generically.
+	Target   string        `yaml:"target,omitempty"`
+	From     uint16        `yaml:"from"`
+	To       uint16        `yaml:"to"`
+	Interval time.Duration `yaml:"interval"`
+	// after this long without a successful read, the values are stale. Defaults to STALE_FACTOR intervals.
+	StaleAfter time.Duration `yaml:"staleAfter,omitempty"`
+	// nil means enabled
+	Enabled *bool `yaml:"enabled,omitempty"`
+	// extra labels on all the metrics of the block
+	Labels map[string]string `yaml:"labels,omitempty"`
+	Fields []registerField   `yaml:"fields"`
+}
+
+func (x *registerBlock) isEnabled() bool {
+	return x.Enabled == nil || *x.Enabled
+}
+
+type registerMap struct {
+	Blocks []registerBlock `yaml:"blocks"`
+}
+
+// parseRegisterMap decodes and validates a register map. A map which does not validate is still returned, along with
+// all the errors found in it.
+func parseRegisterMap(in []byte) (out *registerMap, err error) {
+	out = &registerMap{}
+	decoder := yaml.NewDecoder(strings.NewReader(string(in)))
+	decoder.KnownFields(true)
+	if err = decoder.Decode(out); err != nil {
+		return nil, err
+	}
+	for i := range out.Blocks {
+		for j := range out.Blocks[i].Fields {
+			f := &out.Blocks[i].Fields[j]
+			if f.Gain == 0 {
+				f.Gain = 1
+			}
+			if len(f.Kind) == 0 {
+				f.Kind = metricGauge
+			}
+			if f.Repeat > 0 && f.Start == 0 {
+				f.Start = 1
+			}
+		}
+	}
+	return out, out.validate()
+}
+
+func (x *registerMap) validate() error {
+	var errs []error
+	var dummy sun2000DataStruct
+	names := make(map[string]bool)
+	for _, b := range x.Blocks {
+		if len(b.Name) == 0 {
+			errs = append(errs, fmt.Errorf("block %d..%d has no name", b.From, b.To))
+		}
+		if names[b.Name] {
+			errs = append(errs, fmt.Errorf("block %q is defined more than once", b.Name))
+		}
+		names[b.Name] = true
+		if b.To <= b.From {
+			errs = append(errs, fmt.Errorf("block %q: to %d must be after from %d", b.Name, b.To, b.From))
+		} else if b.To-b.From > 125 {
+			errs = append(errs, fmt.Errorf("block %q: %d registers, but at most 125 can be read at once", b.Name, b.To-b.From))
+		}
+		if b.Interval <= 0 {
+			errs = append(errs, fmt.Errorf("block %q: interval must be positive", b.Name))
+		}
+		if len(b.Target) > 0 && dummy.getTarget(b.Target) == nil {
+			errs = append(errs, fmt.Errorf("block %q: unknown target %q", b.Name, b.Target))
+		}
+		for _, f := range b.Fields {
+			if len(f.Name) == 0 {
+				errs = append(errs, fmt.Errorf("block %q: field at %d has no name", b.Name, f.Address))
+			}
+			if len(f.Type) == 0 {
+				errs = append(errs, fmt.Errorf("block %q: field %q has no type", b.Name, f.Name))
+			}
+			if f.Kind != metricGauge && f.Kind != metricCounter {
+				errs = append(errs, fmt.Errorf("block %q: field %q has kind %q, but it should be gauge or counter", b.Name, f.Name, f.Kind))
+			}
+			if f.Type == registerTypeSTR && f.Length == 0 {
+				errs = append(errs, fmt.Errorf("block %q: field %q is a STR, but has no length", b.Name, f.Name))
+			}
+			if f.Repeat > 1 && len(f.Label) == 0 && len(f.Metric) > 0 {
+				errs = append(errs, fmt.Errorf("block %q: field %q is repeated, but has no label for the index", b.Name, f.Name))
+			}
+			last := uint32(f.Address) + uint32(f.count()-1)*uint32(f.stride()) + uint32(f.size())
+			if f.Address < b.From || last > uint32(b.To) {
+				errs = append(errs, fmt.Errorf("block %q: field %q at %d..%d is outside of the block %d..%d", b.Name, f.Name, f.Address, last, b.From, b.To))
+			}
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func mustLoadDefaultRegisterMap() *registerMap {
+	m, err := parseRegisterMap(defaultRegisterMapYAML)
+	if err != nil {
+		panic(fmt.Sprintf("the built-in register map is broken: %v", err))
+	}
+	for i := range m.Blocks {
+		if len(m.Blocks[i].Target) == 0 {
+			continue
+		}
+		for j := range m.Blocks[i].Fields {
+			m.Blocks[i].Fields[j].builtin = true
+		}
+	}
+	return m
+}
+
+// findTarget returns the block bound to the given built-in parser.
+func (x *registerMap) findTarget(target string) *registerBlock {
+	for i := range x.Blocks {
+		if x.Blocks[i].Target == target {
+			return &x.Blocks[i]
+		}
+	}
+	return nil
+}
+
+// loadRegisterMap reads a user register map and merges it over the built-in one. Blocks with the same name replace
+// the built-in ones (e.g. to disable them, or to fix addresses for some firmware), new ones are appended.
+func loadRegisterMap(path string) (out *registerMap, err error) {
+	in, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	// report all the problems at once, not just the first one
+	var errs []error
+	user, err := parseRegisterMap(in)
+	if user == nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	} else if err != nil {
+		errs = append(errs, fmt.Errorf("%s: %w", path, err))
+	}
+	out = mustLoadDefaultRegisterMap()
+	for _, b := range user.Blocks {
+		if len(b.Target) > 0 {
+			// the built-in parsers decode from fixed offsets, so the block must still start at the same address
+			orig := out.findTarget(b.Target)
+			if orig == nil {
+				errs = append(errs, fmt.Errorf("%s: block %q: unknown target %q", path, b.Name, b.Target))
+				continue
+			}
+			if b.From != orig.From || b.To < orig.To {
+				errs = append(errs, fmt.Errorf("%s: block %q: target %q needs the registers %d..%d", path, b.Name, b.Target, orig.From, orig.To))
+				continue
+			}
+			for i := range b.Fields {
+				for _, f := range orig.Fields {
+					if b.Fields[i].Name == f.Name {
+						b.Fields[i].builtin = true
+					}
+				}
+			}
+		}
+		replaced := false
+		for i := range out.Blocks {
+			if out.Blocks[i].Name == b.Name {
+				out.Blocks[i] = b
+				replaced = true
+				break
+			}
+		}
+		if !replaced {
+			out.Blocks = append(out.Blocks, b)
+		}
+	}
+	if len(errs) > 0 {
+		return nil, errors.Join(errs...)
+	}
+	return out, out.validate()
+}
+
+// registerValue is one decoded value of a field. Repeated fields have one per index.
+type registerValue struct {
+	field *registerField
+	// label value of a repeated field
+	index int
+	// all numeric types, after the gain. Epoch as Unix seconds.
+	number float64
+	// the STR value, or the text of an E16
+	text string
+}
+
+// registerValues is the generic decoding of a block, driven by the register map.
+type registerValues struct {
+	genericData
+
+	block  *registerBlock
+	values []registerValue
+	// the registers of the last read, served by the Modbus gateway, nil if there is none or it was written since
+	raw []byte
+}
+
+func newRegisterValues(block *registerBlock) *registerValues {
+	return &registerValues{block: block}
+}
+
+// decodeField decodes all the values of a field, from the data of its block.
+func decodeField(data []byte, from uint16, f *registerField) (out []registerValue, err error) {
+	for i := uint16(0); i < f.count(); i++ {
+		idx := uint(f.Address-from+i*f.stride()) * 2
+		v := registerValue{field: f}
+		if f.Repeat > 0 {
+			v.index = f.Start + int(i)
+		}
+		switch f.Type {
+		case registerTypeSTR:
+			v.text, _, err = sun2000.GetSTR(data, idx, uint(f.Length))
+		case registerTypeU16, registerTypeBitfield16:
+			var u16 uint16
+			u16, _, err = sun2000.GetU16(data, idx)
+			v.number = float64(u16) / f.Gain
+		case registerTypeE16:
+			var u16 uint16
+			u16, _, err = sun2000.GetU16(data, idx)
+			v.number = float64(u16)
+			v.text = f.Enum[int(u16)]
+		case registerTypeU32, registerTypeBitfield32:
+			var u32 uint32
+			u32, _, err = sun2000.GetU32(data, idx)
+			v.number = float64(u32) / f.Gain
+		case registerTypeEpoch:
+			var u32 uint32
+			u32, _, err = sun2000.GetU32(data, idx)
+			v.number = float64(u32)
+		case registerTypeI16:
+			var i16 int16
+			i16, _, err = sun2000.GetI16(data, idx)
+			v.number = float64(i16) / f.Gain
+		case registerTypeI32:
+			var i32 int32
+			i32, _, err = sun2000.GetI32(data, idx)
+			v.number = float64(i32) / f.Gain
+		default:
+			err = fmt.Errorf("unknown register type %q", f.Type)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("field %s: %w", f.Name, err)
+		}
+		out = append(out, v)
+	}
+	return out, nil
+}
+
+// findField returns the field with the given name, in the block bound to the given target.
+func (x *registerMap) findField(target, name string) *registerField {
+	b := x.findTarget(target)
+	if b == nil {
+		return nil
+	}
+	for i := range b.Fields {
+		if b.Fields[i].Name == name {
+			return &b.Fields[i]
+		}
+	}
+	return nil
+}
+
+// encodeField is the reverse of decodeField, for one value of a field (index is the label value, for repeated ones).
+// The registers are stored as big-endian bytes, in the map by address.
+func encodeField(registers map[uint16]uint16, f *registerField, index int, number float64, text string) {
+	address := f.Address
+	if f.Repeat > 0 {
+		address += uint16(index-f.Start) * f.stride()
+	}
+	switch f.Type {
+	case registerTypeSTR:
+		b := make([]byte, 2*f.Length)
+		copy(b, text)
+		for i := uint16(0); i < f.Length; i++ {
+			registers[address+i] = uint16(b[2*i])<<8 | uint16(b[2*i+1])
+		}
+		return
+	case registerTypeEpoch, registerTypeE16:
+	default:
+		number *= f.Gain
+	}
+	number = math.Round(number)
+	switch f.Type.size() {
+	case 1:
+		registers[address] = uint16(int64(number))
+	case 2:
+		u32 := uint32(int64(number))
+		registers[address] = uint16(u32 >> 16)
+		registers[address+1] = uint16(u32)
+	}
+}
+
+func (x *registerValues) parse(data []byte) (err error) {
+	size := int(x.block.To-x.block.From) * 2
+	if len(data) < size {
+		return fmt.Errorf("data length %d < %d", len(data), size)
+	}
+
+	values := make([]registerValue, 0, len(x.block.Fields))
+	for i := range x.block.Fields {
+		v, err := decodeField(data, x.block.From, &x.block.Fields[i])
+		if err != nil {
+			return err
+		}
+		values = append(values, v...)
+	}
+
+	x.Lock()
+	defer x.Unlock()
+	x.values = values
+	x.raw = append(x.raw[:0:0], data[:size]...)
+
+	return nil
+}
+
+// registers returns the quantity registers from the address on, as last read, or nil if they were not read. The
+// address must be in the block.
+func (x *registerValues) registers(address, quantity uint16) []byte {
+	x.RLock()
+	defer x.RUnlock()
+	if x.raw == nil {
+		return nil
+	}
+	from := int(address-x.block.From) * 2
+	return append([]byte{}, x.raw[from:from+int(quantity)*2]...)
+}
+
+// invalidate drops the registers read, e.g. after a write to them, so that the gateway does not serve them anymore.
+func (x *registerValues) invalidate() {
+	x.Lock()
+	defer x.Unlock()
+	x.raw = nil
+}
+
+// labels returns the labels of a value, sorted by name, without the model/sn/device ones.
+func (x *registerValues) labels(v *registerValue) (out [][2]string) {
+	for k, l := range x.block.Labels {
+		out = append(out, [2]string{k, l})
+	}
+	for k, l := range v.field.Labels {
+		out = append(out, [2]string{k, l})
+	}
+	if v.field.Repeat > 0 && len(v.field.Label) > 0 {
+		out = append(out, [2]string{v.field.Label, fmt.Sprintf("%d", v.index)})
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i][0] < out[j][0] })
+	return out
+}
+
+func (x *registerValue) String() string {
+	switch x.field.Type {
+	case registerTypeSTR:
+		return fmt.Sprintf("%q", x.text)
+	case registerTypeBitfield16:
+		return fmt.Sprintf("%#04x\t%#016b", uint16(x.number), uint16(x.number))
+	case registerTypeBitfield32:
+		return fmt.Sprintf("%#08x\t%#032b", uint32(x.number), uint32(x.number))
+	case registerTypeEpoch:
+		return time.Unix(int64(x.number), 0).Format(time.RFC3339)
+	case registerTypeE16:
+		return fmt.Sprintf("%d\t%s", int(x.number), x.text)
+	default:
+		if len(x.field.Unit) > 0 {
+			return fmt.Sprintf("%g %s", x.number, x.field.Unit)
+		}
+		return fmt.Sprintf("%g", x.number)
+	}
+}
+
+// key is the key of a value in the JSON of its block, e.g. "activePower" or "pv_voltage_1".
+func (x *registerValue) key() string {
+	key := strings.ReplaceAll(x.field.Name, ".", "_")
+	if x.field.Repeat > 0 {
+		key = fmt.Sprintf("%s_%d", key, x.index)
+	}
+	return key
+}
+
+// jsonValue returns the value as it goes in JSON: the text for STR and (when known) E16, the time for Epoch, or else
+// the number.
+func (x *registerValue) jsonValue() any {
+	switch x.field.Type {
+	case registerTypeSTR:
+		return x.text
+	case registerTypeE16:
+		if len(x.text) > 0 {
+			return x.text
+		}
+	case registerTypeEpoch:
+		return time.Unix(int64(x.number), 0).Format(time.RFC3339)
+	}
+	return x.number
+}
+
+// metricName returns the name of the field's metric, with the unit appended.
+func (x *registerField) metricName() string {
+	if x.Type == registerTypeEpoch {
+		return metricNameWithUnit(x.Metric, "s")
+	}
+	return metricNameWithUnit(x.Metric, x.Unit)
+}
+
+// collect adds the values of the fields with a metric to the registry, if keep (when given) agrees.
+// With timestamps, the samples carry the time of the read.
+func (x *registerValues) collect(r *metricsRegistry, idLabels []metricLabel, keep func(labels []metricLabel) bool, timestamps bool) {
+	x.RLock()
+	defer x.RUnlock()
+	if x.lastRead.IsZero() {
+		return
+	}
+
+	for i := range x.values {
+		v := &x.values[i]
+		if len(v.field.Metric) == 0 {
+			continue
+		}
+		labels := append([]metricLabel{}, idLabels...)
+		for _, l := range x.labels(v) {
+			labels = append(labels, metricLabel{l[0], l[1]})
+		}
+		if keep != nil && !keep(labels) {
+			continue
+		}
+		help := v.field.Description
+		if len(v.field.Unit) > 0 {
+			help = fmt.Sprintf("%s, in %s", help, v.field.Unit)
+		}
+		value := v.number
+		switch v.field.Type {
+		case registerTypeSTR:
+			labels = append(labels, metricLabel{"value", v.text})
+			value = 1
+		case registerTypeE16:
+			labels = append(labels, metricLabel{"state", v.text})
+		}
+		var at time.Time
+		if timestamps {
+			at = x.lastRead
+		}
+		r.addAt(at, v.field.metricName(), help, v.field.Kind, value, labels...)
+	}
+}
+
+// metricsString exports the values which are not already exported by the built-in parser of the block. Hence it is
+// empty for the built-in blocks, unless the user map added fields to them.
+func (x *registerValues) metricsString(id *identificationData) string {
+	sb := strings.Builder{}
+	x.RLock()
+	defer x.RUnlock()
+
+	var values []*registerValue
+	for i := range x.values {
+		if !x.values[i].field.builtin {
+			values = append(values, &x.values[i])
+		}
+	}
+	if len(values) == 0 && len(x.block.Target) > 0 {
+		return ""
+	}
+
+	sb.WriteString(fmt.Sprintf("# %s\n", x.block.Name))
+	sb.WriteString(fmt.Sprintf("# Last Read = %s\n", x.lastRead.Format(time.RFC3339)))
+	sb.WriteString(fmt.Sprintf("# Next Read = %s\n", x.nextRead.Format(time.RFC3339)))
+	sb.WriteString("\n")
+	for _, v := range values {
+		name := v.field.Description
+		if len(name) == 0 {
+			name = v.field.Name
+		}
+		if v.field.Repeat > 0 {
+			name = fmt.Sprintf("%s %d", name, v.index)
+		}
+		sb.WriteString(fmt.Sprintf("# %s = %s\n", name, v))
+	}
+	sb.WriteString("\n")
+
+	// skip metrics if the data is empty
+	if x.lastRead.IsZero() || id.lastRead.IsZero() {
+		sb.WriteString(fmt.Sprintf("# No %s or identification data read yet\n", x.block.Name))
+	} else {
+		id.RLock()
+		defer id.RUnlock()
+
+		for _, v := range values {
+			if len(v.field.Metric) == 0 {
+				continue
+			}
+			tags := fmt.Sprintf("device=%q,model=%q,sn=%q", id.device, id.Model, id.SN)
+			for _, l := range x.labels(v) {
+				tags += fmt.Sprintf(",%s=%q", l[0], l[1])
+			}
+			switch v.field.Type {
+			case registerTypeSTR:
+				sb.WriteString(fmt.Sprintf("%s{%s,value=%q} 1\n", v.field.Metric, tags, v.text))
+				continue
+			case registerTypeE16:
+				tags += fmt.Sprintf(",state=%q", v.text)
+			}
+			if len(v.field.Unit) > 0 {
+				tags += fmt.Sprintf(",unit=%q", v.field.Unit)
+			}
+			sb.WriteString(fmt.Sprintf("%s{%s} %g\n", v.field.Metric, tags, v.number))
+		}
+	}
+	sb.WriteString("\n")
+
+	return sb.String()
+}
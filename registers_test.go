@@ -0,0 +1,231 @@
+// Copyright: 2024 Dragos Vingarzan vingarzan -at- gmail -dot- com
+// License: AGPL-3.0
+//
+// This file is part of sun2000-modbus.
+//
+// sun2000-modbus is free software: you can redistribute it and/or modify it under the terms of the GNU Affero General
+// Public License Version 3 (AGPL-3.0) as published by the Free Software Foundation.
+//
+// sun2000-modbus is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY; without even the implied
+// warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the AGPL-3.0 along with sun2000-modbus. If not,
+// see <https://www.gnu.org/licenses/>.
+package main
+
+import (
+	"math"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// builtinValue finds the value of a register map field in the struct of the built-in parser. Returns an invalid
+// reflect.Value if there is no such field (e.g. the Epoch ones, which are time.Time there).
+func builtinValue(target modbusParsedData, v *registerValue) reflect.Value {
+	s := reflect.ValueOf(target).Elem()
+	name := v.field.Name
+	idx := v.index - 1
+
+	// esu1PackMaxTemperature & co are in esu[i].pack[j].maxTemperature
+	if _, ok := target.(*esuTemperaturesData); ok {
+		esu := 0
+		if strings.HasPrefix(name, "esu2") {
+			esu = 1
+		}
+		leaf := "maxTemperature"
+		if strings.Contains(name, "Min") {
+			leaf = "minTemperature"
+		}
+		return s.FieldByName("esu").Index(esu).FieldByName("pack").Index(idx).FieldByName(leaf)
+	}
+
+	// the typed results of the sun2000 package have the same names, exported, and the alarms are its Bits
+	if _, ok := target.(*alarmData1); ok && name == "alarm" {
+		name = "Bits"
+	}
+	parts := strings.Split(name, ".")
+	f := s.FieldByNameFunc(func(n string) bool { return strings.EqualFold(n, parts[0]) })
+	if !f.IsValid() {
+		return f
+	}
+	if f.Kind() == reflect.Array {
+		f = f.Index(idx)
+	}
+	if len(parts) > 1 {
+		f = f.FieldByName(parts[1])
+	}
+	return f
+}
+
+// TestRegisterMapMatchesParsers decodes random data with both the built-in parsers and the register map, to make sure
+// that the map describes the same registers.
+func TestRegisterMapMatchesParsers(t *testing.T) {
+	rnd := rand.New(rand.NewSource(1))
+	var data sun2000DataStruct
+	data.init("test")
+
+	for i := range regMap.Blocks {
+		b := &regMap.Blocks[i]
+		if len(b.Target) == 0 {
+			continue
+		}
+		target := data.getTarget(b.Target)
+		raw := make([]byte, 2*(b.To-b.From))
+		rnd.Read(raw)
+		if err := target.parse(raw); err != nil {
+			t.Fatalf("%s: parse() failed: %v", b.Name, err)
+		}
+		values := newRegisterValues(b)
+		if err := values.parse(raw); err != nil {
+			t.Fatalf("%s: generic parse() failed: %v", b.Name, err)
+		}
+
+		for j := range values.values {
+			v := &values.values[j]
+			f := builtinValue(target, v)
+			if !f.IsValid() {
+				t.Errorf("%s: field %s[%d] not found in %T", b.Name, v.field.Name, v.index, target)
+				continue
+			}
+			ok := true
+			switch f.Kind() {
+			case reflect.String:
+				ok = f.String() == v.text
+			case reflect.Float32, reflect.Float64:
+				ok = math.Abs(f.Float()-v.number) <= 1e-6*math.Max(1, math.Abs(v.number))
+			case reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+				ok = float64(f.Uint()) == v.number
+			case reflect.Int, reflect.Int16, reflect.Int32, reflect.Int64:
+				ok = float64(f.Int()) == v.number
+			}
+			if !ok {
+				t.Errorf("%s: field %s[%d] = %v, but the built-in parser has %v", b.Name, v.field.Name, v.index, v, f)
+			}
+		}
+	}
+}
+
+func TestLoadRegisterMap(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "registers.yaml")
+	user := `
+blocks:
+  - name: ESU1 Data
+    enabled: false
+    from: 37000
+    to: 37070
+    interval: 30s
+    fields: []
+  - name: Grid Data
+    target: inverter
+    from: 32064
+    to: 32100
+    interval: 5s
+    fields:
+      - {name: activePower, address: 32080, type: I32, gain: 1000, unit: kW, metric: sun2000_inverter_active_power}
+      - {name: newRegister, address: 32098, type: U16, metric: sun2000_new_register}
+  - name: Extra Data
+    from: 40000
+    to: 40002
+    interval: 1m
+    fields:
+      - {name: mode, address: 40000, type: E16, metric: sun2000_mode, enum: {0: off, 1: on}}
+      - {name: power, address: 40001, type: I16, gain: 10, unit: kW, metric: sun2000_extra_power}
+`
+	if err := os.WriteFile(path, []byte(user), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	m, err := loadRegisterMap(path)
+	if err != nil {
+		t.Fatalf("loadRegisterMap() failed: %v", err)
+	}
+	if len(m.Blocks) != len(regMap.Blocks)+1 {
+		t.Errorf("expected %d blocks, got %d", len(regMap.Blocks)+1, len(m.Blocks))
+	}
+
+	var data sun2000DataStruct
+	data.init("test")
+	data.identification.setLastRead(data.identification.getNextRead().AddDate(1, 0, 0))
+	var grid, extra *modbusInterval
+	ranges := newModbusAddrRanges(&data, m, nil)
+	for i := range ranges {
+		switch ranges[i].name {
+		case "ESU1 Data":
+			t.Errorf("disabled block still polled")
+		case "Grid Data":
+			grid = &ranges[i]
+		case "Extra Data":
+			extra = &ranges[i]
+		}
+	}
+	if grid == nil || grid.target != &data.inverter || grid.to != 32100 {
+		t.Fatalf("unexpected Grid Data range %+v", grid)
+	}
+	if extra == nil || extra.target != nil {
+		t.Fatalf("unexpected Extra Data range %+v", extra)
+	}
+
+	raw := make([]byte, 2*(grid.to-grid.from))
+	raw[2*(32098-32064)+1] = 42
+	if err := grid.values.parse(raw); err != nil {
+		t.Fatal(err)
+	}
+	grid.values.setLastRead(data.identification.lastRead)
+	out := grid.values.metricsString(&data.identification)
+	if !strings.Contains(out, `sun2000_new_register{device="test",model="",sn=""} 42`) {
+		t.Errorf("new register not exported:\n%s", out)
+	}
+	if strings.Contains(out, "sun2000_inverter_active_power") {
+		t.Errorf("built-in field exported twice:\n%s", out)
+	}
+
+	if err := extra.values.parse([]byte{0, 1, 0xff, 0xec}); err != nil {
+		t.Fatal(err)
+	}
+	extra.values.setLastRead(data.identification.lastRead)
+	out = extra.values.metricsString(&data.identification)
+	for _, line := range []string{
+		`sun2000_mode{device="test",model="",sn="",state="on"} 1`,
+		`sun2000_extra_power{device="test",model="",sn="",unit="kW"} -2`,
+	} {
+		if !strings.Contains(out, line) {
+			t.Errorf("missing %s in:\n%s", line, out)
+		}
+	}
+}
+
+func TestLoadRegisterMapErrors(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "registers.yaml")
+	user := `
+blocks:
+  - name: Grid Data
+    target: inverter
+    from: 32066
+    to: 32100
+    interval: 5s
+  - name: Too Big
+    from: 40000
+    to: 40200
+    interval: 0s
+    fields:
+      - {name: x, address: 40300, type: U16}
+      - {name: s, address: 40000, type: STR}
+`
+	if err := os.WriteFile(path, []byte(user), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	_, err := loadRegisterMap(path)
+	if err == nil {
+		t.Fatal("loadRegisterMap() should have failed")
+	}
+	for _, msg := range []string{"needs the registers 32064..32097", "at most 125", "interval must be positive",
+		"outside of the block", "has no length"} {
+		if !strings.Contains(err.Error(), msg) {
+			t.Errorf("error %q does not mention %q", err, msg)
+		}
+	}
+}
@@ -0,0 +1,270 @@
+// Copyright: 2024 Dragos Vingarzan vingarzan -at- gmail -dot- com
+// License: AGPL-3.0
+//
+// This file is part of sun2000-modbus.
+//
+// sun2000-modbus is free software: you can redistribute it and/or modify it under the terms of the GNU Affero General
+// Public License Version 3 (AGPL-3.0) as published by the Free Software Foundation.
+//
+// sun2000-modbus is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY; without even the implied
+// warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the AGPL-3.0 along with sun2000-modbus. If not,
+// see <https://www.gnu.org/licenses/>.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// The scan finds out which blocks of the register map a device answers, since that depends on the model, firmware and
+// what is connected (e.g. the second ESU). It writes a device profile, with which the poller reads only those blocks,
+// instead of everybody having to enable and disable the blocks in their own register map.
+
+type probeResult string
+
+const (
+	// the block was read fine
+	probeOK probeResult = "ok"
+	// the inverter answered with an exception, e.g. illegal data address
+	probeException probeResult = "exception"
+	probeTimeout   probeResult = "timeout"
+	probeError     probeResult = "error"
+)
+
+type blockProbe struct {
+	// the name of the block of the register map, empty for the windows
+	Name   string      `yaml:"name,omitempty"`
+	From   uint16      `yaml:"from"`
+	To     uint16      `yaml:"to"`
+	Result probeResult `yaml:"result"`
+	Detail string      `yaml:"detail,omitempty"`
+}
+
+// deviceProfile is what the scan found out about a device.
+type deviceProfile struct {
+	Device   string    `yaml:"device"`
+	SlaveID  byte      `yaml:"slave"`
+	Model    string    `yaml:"model,omitempty"`
+	SN       string    `yaml:"sn,omitempty"`
+	Firmware string    `yaml:"firmware,omitempty"`
+	Scanned  time.Time `yaml:"scanned"`
+	// the blocks of the register map, enabled or not
+	Blocks []blockProbe `yaml:"blocks"`
+	// the other address windows which were asked for, as a hint for extending the register map
+	Windows []blockProbe `yaml:"windows,omitempty"`
+}
+
+type deviceProfiles struct {
+	Devices []*deviceProfile `yaml:"devices"`
+}
+
+// The profiles of the devices, from DEVICE_PROFILE. Set up by main() before creating the devices.
+var profiles *deviceProfiles
+
+func loadDeviceProfiles(path string) (*deviceProfiles, error) {
+	in, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var out deviceProfiles
+	if err := yaml.Unmarshal(in, &out); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return &out, nil
+}
+
+// find returns the profile of the device, nil if it was not scanned.
+func (x *deviceProfiles) find(device string) *deviceProfile {
+	if x == nil {
+		return nil
+	}
+	for _, p := range x.Devices {
+		if p.Device == device {
+			return p
+		}
+	}
+	return nil
+}
+
+// isSupported tells if the device answered the block when scanned, or answered with an exception. known is false if
+// the block was not scanned, e.g. if it was added to the register map later, or its addresses changed, and if the
+// scan could not tell, after timeouts or other errors.
+func (x *deviceProfile) isSupported(b *registerBlock) (supported, known bool) {
+	for _, p := range x.Blocks {
+		if p.Name == b.Name && p.From == b.From && p.To == b.To {
+			switch p.Result {
+			case probeOK:
+				return true, true
+			case probeException:
+				return false, true
+			default:
+				return false, false
+			}
+		}
+	}
+	return false, false
+}
+
+// How many times a block is read when probing, if the reads time out or the connection breaks.
+const probeAttempts = 3
+
+// probe reads the registers once, retrying after reconnecting if the read timed out or the connection broke.
+func (d *device) probe(name string, from, to uint16) blockProbe {
+	out := blockProbe{Name: name, From: from, To: to}
+	var err error
+	for attempt := 0; attempt < probeAttempts; attempt++ {
+		_, err = d.readModbusFromTo(name, from, to)
+		if err == nil {
+			out.Result = probeOK
+			return out
+		}
+		class := classifyError(err)
+		if class != errorClassConnection && class != errorClassTransactionID && class != errorClassTimeout || attempt == probeAttempts-1 {
+			break
+		}
+		// the session is broken, or the late answer would break it: start over, with the dummy read of a new session
+		lWarning.Printf("Probing %s of %s: %v, retrying", name, d.name, err)
+		if err := d.conn.open(); err != nil {
+			out.Result, out.Detail = probeError, err.Error()
+			return out
+		}
+		d.readModbusFromTo("dummy read", 30000, 30015)
+	}
+	switch classifyError(err) {
+	case errorClassException:
+		out.Result = probeException
+	case errorClassTimeout:
+		out.Result = probeTimeout
+	default:
+		out.Result = probeError
+	}
+	out.Detail = err.Error()
+	return out
+}
+
+// scan probes all the blocks of the register map, then the windows, in chunks of windowSize registers.
+func (d *device) scan(m *registerMap, windows [][2]uint16, windowSize uint16) *deviceProfile {
+	p := &deviceProfile{Device: d.name, SlaveID: d.slaveID, Scanned: time.Now().UTC().Truncate(time.Second)}
+	for i := range m.Blocks {
+		b := &m.Blocks[i]
+		probe := d.probe(b.Name, b.From, b.To)
+		lInfo.Printf("Scanned %s of %s: %s %s", b.Name, d.name, probe.Result, probe.Detail)
+		p.Blocks = append(p.Blocks, probe)
+		if b.Target == "identification" && probe.Result == probeOK {
+			if r := d.findRange("identification"); r != nil && d.readRange(r) {
+				id := &d.data.identification
+				id.RLock()
+				p.Model, p.SN, p.Firmware = id.Model, id.SN, id.SoftwareVersion
+				id.RUnlock()
+			}
+		}
+	}
+	for _, w := range windows {
+		for from := uint32(w[0]); from < uint32(w[1]); from += uint32(windowSize) {
+			to := min(from+uint32(windowSize), uint32(w[1]))
+			probe := d.probe("", uint16(from), uint16(to))
+			lInfo.Printf("Scanned %d..%d of %s: %s %s", from, to, d.name, probe.Result, probe.Detail)
+			p.Windows = append(p.Windows, probe)
+		}
+	}
+	return p
+}
+
+// parseScanWindows parses the windows to scan, as "from-to,from-to", with "to" excluded.
+func parseScanWindows(s string) (out [][2]uint16, err error) {
+	for _, entry := range strings.Split(s, ",") {
+		entry = strings.TrimSpace(entry)
+		if len(entry) == 0 {
+			continue
+		}
+		from, to, ok := strings.Cut(entry, "-")
+		if !ok {
+			return nil, fmt.Errorf("window %q is not from-to", entry)
+		}
+		f, err1 := strconv.ParseUint(from, 10, 16)
+		t, err2 := strconv.ParseUint(to, 10, 16)
+		if err1 != nil || err2 != nil || t <= f {
+			return nil, fmt.Errorf("window %q is not from-to, with from < to", entry)
+		}
+		out = append(out, [2]uint16{uint16(f), uint16(t)})
+	}
+	return out, nil
+}
+
+// runScan is the "scan" command, probing the devices with the Modbus settings from the environment, as for the
+// exporter, and writing their profiles.
+func runScan(args []string) error {
+	fs := flag.NewFlagSet("scan", flag.ContinueOnError)
+	only := fs.String("device", "", "name of the device to scan, from MODBUS_DEVICES (default all)")
+	windows := fs.String("windows", "", "other address windows to probe, as from-to,from-to (e.g. 40000-40300)")
+	windowSize := fs.Uint("window-size", 50, "registers to read at once in the windows (1 to 125)")
+	output := fs.String("o", "-", "file to write the device profiles to, - for stdout")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *windowSize < 1 || *windowSize > 125 {
+		return fmt.Errorf("-window-size must be from 1 to 125, not %d", *windowSize)
+	}
+	scanWindows, err := parseScanWindows(*windows)
+	if err != nil {
+		return fmt.Errorf("-windows: %w", err)
+	}
+
+	if err := cfg.load(nil); err != nil {
+		return err
+	}
+	if regMap, err = cfg.loadRegisterMap(); err != nil {
+		return err
+	}
+	all := newDevices(cfg.devices)
+	if len(*only) > 0 {
+		d, err := findDevice(all, *only)
+		if err != nil {
+			return err
+		}
+		all = []*device{d}
+	}
+	if err := openConnections(all); err != nil {
+		return err
+	}
+	defer closeConnections(all)
+
+	var out deviceProfiles
+	for _, d := range all {
+		// dummy read, since the first call always seems to fail
+		d.readModbusFromTo("dummy read", 30000, 30015)
+		out.Devices = append(out.Devices, d.scan(regMap, scanWindows, uint16(*windowSize)))
+	}
+
+	return writeDeviceProfiles(*output, &out)
+}
+
+// writeDeviceProfiles writes the profiles as YAML, to stdout for "-".
+func writeDeviceProfiles(path string, x *deviceProfiles) error {
+	var w io.Writer = os.Stdout
+	if path != "-" {
+		f, err := os.Create(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		w = f
+	}
+	fmt.Fprintf(w, "# Written by sun2000-modbus scan, use it with DEVICE_PROFILE to poll only the supported blocks.\n")
+	enc := yaml.NewEncoder(w)
+	enc.SetIndent(2)
+	if err := enc.Encode(x); err != nil {
+		return err
+	}
+	return enc.Close()
+}
@@ -0,0 +1,107 @@
+// Copyright: 2024 Dragos Vingarzan vingarzan -at- gmail -dot- com
+// License: AGPL-3.0
+//
+// This file is part of sun2000-modbus.
+//
+// sun2000-modbus is free software: you can redistribute it and/or modify it under the terms of the GNU Affero General
+// Public License Version 3 (AGPL-3.0) as published by the Free Software Foundation.
+//
+// sun2000-modbus is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY; without even the implied
+// warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the AGPL-3.0 along with sun2000-modbus. If not,
+// see <https://www.gnu.org/licenses/>.
+package main
+
+import (
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+func TestScanSimulator(t *testing.T) {
+	server := startSimulator(t, nil)
+	d := simulatorDevices(t, server, 1)[0]
+	d.readModbusFromTo("dummy read", 30000, 30015)
+
+	// the built-in blocks, and one which the simulator does not have
+	m := &registerMap{Blocks: append([]registerBlock{}, regMap.Blocks...)}
+	m.Blocks = append(m.Blocks, registerBlock{Name: "Missing Data", From: 45000, To: 45010, Interval: 60e9})
+	p := d.scan(m, [][2]uint16{{40100, 40200}}, 50)
+
+	if p.Device != "sim1" || p.SlaveID != 1 || p.Model != "SUN2000-5KTL-M1" || p.SN != "SIM0000001" {
+		t.Errorf("unexpected profile %+v", p)
+	}
+	results := make(map[string]probeResult)
+	for _, b := range p.Blocks {
+		results[b.Name] = b.Result
+	}
+	// disabled in the map, but answered by the simulator
+	if results["ESU2 Data"] != probeOK || results["Identification Data"] != probeOK {
+		t.Errorf("unexpected results %v", results)
+	}
+	if results["Missing Data"] != probeException {
+		t.Errorf("unexpected result %q for the missing block", results["Missing Data"])
+	}
+	if len(p.Windows) != 2 || p.Windows[0].From != 40100 || p.Windows[1].To != 40200 || p.Windows[1].Result != probeOK {
+		t.Errorf("unexpected windows %+v", p.Windows)
+	}
+
+	// the profile goes through the file, as with DEVICE_PROFILE
+	path := filepath.Join(t.TempDir(), "profile.yaml")
+	if err := writeDeviceProfiles(path, &deviceProfiles{Devices: []*deviceProfile{p}}); err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := loadDeviceProfiles(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if loaded.find("sim2") != nil || loaded.find("sim1") == nil {
+		t.Fatalf("unexpected profiles %+v", loaded)
+	}
+	var data sun2000DataStruct
+	data.init("sim1")
+	polled := make(map[string]bool)
+	for _, r := range newModbusAddrRanges(&data, m, loaded.find("sim1")) {
+		polled[r.name] = true
+	}
+	if !polled["ESU2 Data"] || polled["Missing Data"] || !polled["Grid Data"] {
+		t.Errorf("unexpected ranges %v", polled)
+	}
+
+	// a block which timed out is neither on nor off, the register map decides
+	timedOut := &deviceProfile{Device: "sim1"}
+	for _, name := range []string{"Grid Data", "ESU2 Data"} {
+		b := m.Blocks[slices.IndexFunc(m.Blocks, func(b registerBlock) bool { return b.Name == name })]
+		timedOut.Blocks = append(timedOut.Blocks, blockProbe{Name: b.Name, From: b.From, To: b.To, Result: probeTimeout})
+	}
+	polled = make(map[string]bool)
+	for _, r := range newModbusAddrRanges(&data, m, timedOut) {
+		polled[r.name] = true
+	}
+	if !polled["Grid Data"] || polled["ESU2 Data"] {
+		t.Errorf("unexpected ranges after timeouts %v", polled)
+	}
+}
+
+func TestScanProbeTimeout(t *testing.T) {
+	server := startSimulator(t, nil)
+	d := simulatorDevices(t, server, 1)[0]
+	// without the dummy read, the first request of the session is not answered, as with the real SDongle
+	if p := d.probe("Identification Data", 30000, 30015); p.Result != probeOK {
+		t.Errorf("a timeout was not retried: %+v", p)
+	}
+}
+
+func TestParseScanWindows(t *testing.T) {
+	windows, err := parseScanWindows("40000-40300, 47000-47100")
+	if err != nil || len(windows) != 2 || windows[0] != [2]uint16{40000, 40300} || windows[1] != [2]uint16{47000, 47100} {
+		t.Errorf("unexpected windows %v, %v", windows, err)
+	}
+	for _, bad := range []string{"40000", "40300-40000", "a-b", "0-70000"} {
+		if _, err := parseScanWindows(bad); err == nil {
+			t.Errorf("%q was accepted", bad)
+		}
+	}
+}
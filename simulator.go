@@ -0,0 +1,588 @@
+// Copyright: 2024 Dragos Vingarzan vingarzan -at- gmail -dot- com
+// License: AGPL-3.0
+//
+// This file is part of sun2000-modbus.
+//
+// sun2000-modbus is free software: you can redistribute it and/or modify it under the terms of the GNU Affero General
+// Public License Version 3 (AGPL-3.0) as published by the Free Software Foundation.
+//
+// sun2000-modbus is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY; without even the implied
+// warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the AGPL-3.0 along with sun2000-modbus. If not,
+// see <https://www.gnu.org/licenses/>.
+package main
+
+import (
+	"encoding/binary"
+	"flag"
+	"fmt"
+	"math"
+	"math/rand"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/goburrow/modbus"
+	"github.com/vingarzan/sun2000-modbus/sun2000"
+)
+
+// The simulator is a fake SUN2000, with a PV array, a LUNA2000 battery and a power meter, served over Modbus TCP. It
+// is meant for tests and demos, without a live inverter. Run it with:
+//
+//	sun2000-modbus simulate -listen :1502
+//
+// The values are encoded with the register map, so they decode back to the same thing in the poller.
+
+const (
+	simulatorFirstRegister = 30000
+	simulatorLastRegister  = 38464
+)
+
+// simulatorSettings are the ranges of the settings, which can also be written.
+var simulatorSettings = [][2]uint16{{40100, 40200}, {47000, 47500}}
+
+// simulatorWritable are the registers which can be written, see power_limit.go.
+var simulatorWritable = map[uint16]bool{
+	regActivePowerPercentageDerating: true,
+	regActivePowerFixedDerating:      true, regActivePowerFixedDerating + 1: true,
+	regActivePowerControlMode: true,
+	regMaximumFeedGridPower:   true, regMaximumFeedGridPower + 1: true,
+	regMaximumFeedGridPowerPercent: true,
+}
+
+// simulatorBatteryWritable are the battery settings, which can be written if there is a battery, see control.go.
+var simulatorBatteryWritable = map[uint16]bool{
+	regESSMaxChargePower: true, regESSMaxChargePower + 1: true,
+	regESSMaxDischargePower: true, regESSMaxDischargePower + 1: true,
+	regESSForcibleChargeDischargePeriod: true,
+	regESSWorkingModeSettings:           true,
+	regESSForcibleChargeDischarge:       true,
+	regESSForcibleSettingMode:           true,
+	regESSForcibleChargePower:           true, regESSForcibleChargePower + 1: true,
+	regESSForcibleDischargePower: true, regESSForcibleDischargePower + 1: true,
+}
+
+type simulatorConfig struct {
+	listen   string
+	slaveIDs []byte
+	model    string
+
+	// PV peak power at noon, in kW
+	pvPeak float64
+	// average house load, in kW
+	load float64
+	// LUNA2000 battery modules of 5 kWh each, 0 for no battery
+	batteryPacks int
+	// initial state of charge, in %
+	soc float64
+
+	// the simulated clock starts at this time and runs this much faster than the real one
+	start     time.Time
+	timeScale float64
+	seed      int64
+
+	// the SUN2000 quirks
+	dropFirstRequest  bool
+	txIDMismatchEvery uint
+}
+
+func (c *simulatorConfig) setDefaults() {
+	c.listen = ":1502"
+	c.slaveIDs = []byte{1}
+	c.model = "SUN2000-5KTL-M1"
+	c.pvPeak = 5
+	c.load = 0.5
+	c.batteryPacks = 1
+	c.soc = 50
+	c.start = time.Now()
+	c.timeScale = 1
+	c.seed = 1
+	c.dropFirstRequest = true
+}
+
+// parseFlags reads the command line of the simulate command.
+func (c *simulatorConfig) parseFlags(args []string) error {
+	fs := flag.NewFlagSet("simulate", flag.ContinueOnError)
+	fs.StringVar(&c.listen, "listen", c.listen, "address to serve Modbus TCP on")
+	slaves := fs.String("slaves", "1", "comma separated slave IDs, one simulated inverter each")
+	fs.StringVar(&c.model, "model", c.model, "model of the inverters")
+	fs.Float64Var(&c.pvPeak, "pv-peak", c.pvPeak, "PV peak power at noon, in kW")
+	fs.Float64Var(&c.load, "load", c.load, "average house load, in kW")
+	fs.IntVar(&c.batteryPacks, "battery-packs", c.batteryPacks, "battery modules of 5 kWh (0 to 3)")
+	fs.Float64Var(&c.soc, "soc", c.soc, "initial battery state of charge, in %")
+	start := fs.String("start", "", "simulated start time, as RFC3339 (default now)")
+	fs.Float64Var(&c.timeScale, "time-scale", c.timeScale, "how much faster the simulated clock runs")
+	fs.Int64Var(&c.seed, "seed", c.seed, "seed of the random variations")
+	fs.BoolVar(&c.dropFirstRequest, "quirk-first-read", c.dropFirstRequest, "do not answer the first request on each connection")
+	fs.UintVar(&c.txIDMismatchEvery, "quirk-txid-every", c.txIDMismatchEvery, "answer every Nth request with a wrong transaction id (0 to disable)")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	c.slaveIDs = nil
+	for _, s := range strings.Split(*slaves, ",") {
+		id, err := strconv.ParseUint(strings.TrimSpace(s), 10, 8)
+		if err != nil || id == 0 || id > 247 {
+			return fmt.Errorf("invalid slave ID %q", s)
+		}
+		c.slaveIDs = append(c.slaveIDs, byte(id))
+	}
+	if len(*start) > 0 {
+		t, err := time.Parse(time.RFC3339, *start)
+		if err != nil {
+			return fmt.Errorf("invalid start time: %w", err)
+		}
+		c.start = t
+	}
+	if c.batteryPacks < 0 || c.batteryPacks > 3 {
+		return fmt.Errorf("battery-packs must be between 0 and 3, not %d", c.batteryPacks)
+	}
+	if c.timeScale <= 0 {
+		return fmt.Errorf("time-scale must be positive")
+	}
+	return nil
+}
+
+// simulatedInverter is the state of one SUN2000, integrated over the simulated time.
+type simulatedInverter struct {
+	cfg       *simulatorConfig
+	regMap    *registerMap
+	registers map[uint16]uint16
+	rnd       *rand.Rand
+
+	lastStep time.Time
+	soc      float64
+	// noise on the PV and the load, changing slowly
+	cloud, loadNoise float64
+	// end of the forcible charge/discharge, if one was started
+	forcibleUntil time.Time
+
+	// energy counters, in kWh
+	generated, dayGenerated, monthGenerated, yearGenerated, hourGenerated float64
+	feedIn, fromGrid                                                      float64
+	charged, discharged, dayCharged, dayDischarged                        float64
+	peakPower                                                             float64
+}
+
+func newSimulatedInverter(cfg *simulatorConfig, slaveID byte) *simulatedInverter {
+	x := &simulatedInverter{
+		cfg:       cfg,
+		regMap:    mustLoadDefaultRegisterMap(),
+		registers: make(map[uint16]uint16),
+		rnd:       rand.New(rand.NewSource(cfg.seed + int64(slaveID))),
+		lastStep:  cfg.start,
+		soc:       cfg.soc,
+		cloud:     1,
+		loadNoise: 1,
+	}
+	// some history, so that the counters don't start from 0
+	x.generated = 12345.67
+	x.feedIn = 6789.01
+	x.fromGrid = 2345.67
+	x.charged = 1234.5
+	x.discharged = 1111.1
+
+	sn := fmt.Sprintf("SIM%07d", slaveID)
+	x.setText("identification", "model", cfg.model)
+	x.setText("identification", "sn", sn)
+	x.setText("identification", "pn", "01074256")
+	x.setText("identification", "firmwareVersion", "V100R001C00SPC124")
+	x.setText("identification", "softwareVersion", "V100R001C00SPC124")
+	x.set("identification", "numberOfStrings", 2)
+	x.set("identification", "numberOfMPPTs", 2)
+	x.set("identification", "ratedPower", cfg.pvPeak)
+	x.set("identification", "maxActivePowerPmax", cfg.pvPeak*1.1)
+	x.set("identification", "maxApparentPowerSmax", cfg.pvPeak*1.1)
+	x.set("identification", "maxActiveCapabilityPmaxReal", cfg.pvPeak*1.1)
+	x.set("identification", "maxApparentCapabilitySmaxReal", cfg.pvPeak*1.1)
+	x.setText("hardware5", "hardwareVersion", "HW-SIM")
+	x.setText("hardware5", "monitoringBoardSN", sn+"M")
+
+	x.set("meter", "meterStatus", 1)
+	x.set("meter", "meterType", 1)
+	x.set("meter", "meterModelDetectionResult", 1)
+
+	x.registers[regActivePowerPercentageDerating] = 1000
+	x.setU32(regActivePowerFixedDerating, uint32(cfg.pvPeak*1.1*1000))
+	x.registers[regActivePowerControlMode] = activePowerControlUnlimited
+
+	if cfg.batteryPacks > 0 {
+		x.setText("esu1", "sn", sn+"B")
+		x.setText("esu1", "dcdcVersion", "V100R002C00")
+		x.setText("esu1", "bmsVersion", "V100R002C00")
+		x.set("esu1", "workingMode", 4)
+		x.set("esu1", "ratedChargePower", float64(cfg.batteryPacks)*2500)
+		x.set("esu1", "ratedDischargePower", float64(cfg.batteryPacks)*2500)
+		x.set("esu1", "maximumChargePower", float64(cfg.batteryPacks)*2500)
+		x.set("esu1", "maximumDischargePower", float64(cfg.batteryPacks)*2500)
+		x.registers[regESSWorkingModeSettings] = essWorkingModeSettings[4]
+		x.setU32(regESSMaxChargePower, uint32(cfg.batteryPacks)*2500)
+		x.setU32(regESSMaxDischargePower, uint32(cfg.batteryPacks)*2500)
+		for p := 1; p <= cfg.batteryPacks; p++ {
+			target := fmt.Sprintf("esu1Pack%d", p)
+			x.setText(target, "sn", fmt.Sprintf("%sP%d", sn, p))
+			x.setText(target, "firmwareVersion", "V100R002C00")
+			x.set(target, "workingStatus", 2)
+		}
+	}
+
+	x.update(0)
+	return x
+}
+
+func (x *simulatedInverter) field(target, name string) *registerField {
+	f := x.regMap.findField(target, name)
+	if f == nil {
+		panic(fmt.Sprintf("simulator: no field %s.%s in the register map", target, name))
+	}
+	return f
+}
+
+func (x *simulatedInverter) set(target, name string, number float64) {
+	encodeField(x.registers, x.field(target, name), 0, number, "")
+}
+
+func (x *simulatedInverter) setIndex(target, name string, index int, number float64) {
+	encodeField(x.registers, x.field(target, name), index, number, "")
+}
+
+func (x *simulatedInverter) setText(target, name, text string) {
+	encodeField(x.registers, x.field(target, name), 0, 0, text)
+}
+
+func (x *simulatedInverter) setU32(address uint16, v uint32) {
+	x.registers[address] = uint16(v >> 16)
+	x.registers[address+1] = uint16(v)
+}
+
+func (x *simulatedInverter) getU32(address uint16) uint32 {
+	return uint32(x.registers[address])<<16 | uint32(x.registers[address+1])
+}
+
+// write stores the values of the settings, and starts or stops the forcible charge/discharge.
+func (x *simulatedInverter) write(address uint16, values []uint16) error {
+	for i := range values {
+		a := address + uint16(i)
+		if !simulatorWritable[a] && !(simulatorBatteryWritable[a] && x.cfg.batteryPacks > 0) {
+			return errIllegalDataAddress(address, uint16(len(values)))
+		}
+	}
+	for i, v := range values {
+		x.registers[address+uint16(i)] = v
+	}
+	if address <= regESSForcibleChargeDischarge && int(address)+len(values) > regESSForcibleChargeDischarge {
+		x.forcibleUntil = time.Time{}
+		if x.registers[regESSForcibleChargeDischarge] != essForcibleStop {
+			x.forcibleUntil = x.lastStep.Add(time.Duration(x.registers[regESSForcibleChargeDischargePeriod]) * time.Minute)
+		}
+	}
+	x.update(0)
+	return nil
+}
+
+// activePowerLimit returns the maximum output, by the derating and by the grid export limitation, for the load.
+func (x *simulatedInverter) activePowerLimit(load float64) float64 {
+	pmax := x.cfg.pvPeak * 1.1
+	limit := math.Min(pmax*float64(int16(x.registers[regActivePowerPercentageDerating]))/1000,
+		float64(x.getU32(regActivePowerFixedDerating))/1000)
+	switch x.registers[regActivePowerControlMode] {
+	case activePowerControlZeroExport:
+		limit = math.Min(limit, load)
+	case activePowerControlLimitedKW:
+		limit = math.Min(limit, load+float64(int32(x.getU32(regMaximumFeedGridPower)))/1000)
+	case activePowerControlLimitedPercent:
+		limit = math.Min(limit, load+pmax*float64(int16(x.registers[regMaximumFeedGridPowerPercent]))/1000)
+	}
+	return limit
+}
+
+// pvPower returns the PV power at the given time of the day, a sine between 6:00 and 20:00, peaking at 13:00.
+func (x *simulatedInverter) pvPower(t time.Time) float64 {
+	h := float64(t.Hour()) + float64(t.Minute())/60 + float64(t.Second())/3600
+	if h <= 6 || h >= 20 {
+		return 0
+	}
+	s := math.Sin(math.Pi * (h - 6) / 14)
+	return x.cfg.pvPeak * s * s * x.cloud
+}
+
+// step advances the simulation to the given time and updates the registers.
+func (x *simulatedInverter) step(now time.Time) {
+	if !now.After(x.lastStep) {
+		return
+	}
+	dt := now.Sub(x.lastStep).Hours()
+	if now.YearDay() != x.lastStep.YearDay() || now.Year() != x.lastStep.Year() {
+		x.dayGenerated, x.dayCharged, x.dayDischarged, x.peakPower = 0, 0, 0, 0
+		if now.Month() != x.lastStep.Month() {
+			x.monthGenerated = 0
+		}
+		if now.Year() != x.lastStep.Year() {
+			x.yearGenerated = 0
+		}
+	}
+	if now.Hour() != x.lastStep.Hour() {
+		x.hourGenerated = 0
+	}
+	x.lastStep = now
+
+	// a random walk, kept around 1
+	x.cloud = math.Min(1, math.Max(0.6, x.cloud+(x.rnd.Float64()-0.5)*0.05))
+	x.loadNoise = math.Min(1.5, math.Max(0.7, x.loadNoise+(x.rnd.Float64()-0.5)*0.1))
+
+	x.update(dt)
+}
+
+// update integrates the energy flows over dt hours and writes all the registers.
+func (x *simulatedInverter) update(dt float64) {
+	now := x.lastStep
+	pv := x.pvPower(now)
+	load := x.cfg.load * x.loadNoise
+
+	// maximise self consumption: the surplus goes into the battery, the deficit comes from it - unless told otherwise
+	battery := 0.0
+	capacity := 5 * float64(x.cfg.batteryPacks)
+	maxChargePower := math.Min(2.5*float64(x.cfg.batteryPacks), float64(x.getU32(regESSMaxChargePower))/1000)
+	maxDischargePower := math.Min(2.5*float64(x.cfg.batteryPacks), float64(x.getU32(regESSMaxDischargePower))/1000)
+	workingMode := sun2000.ESUWorkingMode(4)
+	for mode, setting := range essWorkingModeSettings {
+		if x.registers[regESSWorkingModeSettings] == setting {
+			workingMode = mode
+		}
+	}
+	if !x.forcibleUntil.IsZero() && !now.Before(x.forcibleUntil) {
+		x.forcibleUntil = time.Time{}
+		x.registers[regESSForcibleChargeDischarge] = essForcibleStop
+	}
+	if capacity > 0 {
+		surplus := pv*0.97 - load
+		switch {
+		case !x.forcibleUntil.IsZero():
+			workingMode = 1
+			if x.registers[regESSForcibleChargeDischarge] == essForcibleCharge && x.soc < 100 {
+				battery = math.Min(float64(x.getU32(regESSForcibleChargePower))/1000, maxChargePower)
+			} else if x.registers[regESSForcibleChargeDischarge] == essForcibleDischarge && x.soc > 5 {
+				battery = -math.Min(float64(x.getU32(regESSForcibleDischargePower))/1000, maxDischargePower)
+			}
+		case workingMode == 5:
+			// fully fed to grid, the battery stays idle
+		case surplus > 0 && x.soc < 100:
+			battery = math.Min(surplus, maxChargePower)
+		case surplus < 0 && x.soc > 5:
+			battery = -math.Min(-surplus, maxDischargePower)
+		}
+		x.soc = math.Min(100, math.Max(0, x.soc+battery*dt/capacity*100))
+	}
+	// the battery is on the DC side, so the inverter outputs what is left, curtailing the PV to stay within the limits
+	active := pv*0.97 - battery
+	if limit := x.activePowerLimit(load); active > limit {
+		pv = math.Max(limit+battery, 0) / 0.97
+		active = pv*0.97 - battery
+	}
+	grid := active - load
+
+	x.generated += math.Max(active, 0) * dt
+	x.dayGenerated += math.Max(active, 0) * dt
+	x.monthGenerated += math.Max(active, 0) * dt
+	x.yearGenerated += math.Max(active, 0) * dt
+	x.hourGenerated += math.Max(active, 0) * dt
+	x.feedIn += math.Max(grid, 0) * dt
+	x.fromGrid += math.Max(-grid, 0) * dt
+	if battery > 0 {
+		x.charged += battery * dt
+		x.dayCharged += battery * dt
+	} else {
+		x.discharged += -battery * dt
+		x.dayDischarged += -battery * dt
+	}
+	x.peakPower = math.Max(x.peakPower, active)
+
+	// PV strings
+	for i := 1; i <= 2; i++ {
+		voltage := 0.0
+		if pv > 0 {
+			voltage = 360 + 20*x.cloud
+		}
+		current := 0.0
+		if voltage > 0 {
+			current = pv * 1000 / 2 / voltage
+		}
+		x.setIndex("pv", "pv.voltage", i, voltage)
+		x.setIndex("pv", "pv.current", i, current)
+		x.setIndex("mppt2", "mpptTotalInputPower", i, pv/2)
+		x.setIndex("mppt1", "cumulativeDCEnergyYieldOfMPPT", i, x.generated/2)
+	}
+
+	// inverter
+	status := 512.0
+	if pv == 0 && battery == 0 {
+		status = 40960
+	}
+	phaseVoltage := 230 + x.cloud
+	x.set("inverter", "dcPower", pv)
+	x.set("inverter", "activePower", active)
+	x.set("inverter", "activePowerFast", active)
+	x.set("inverter", "peakActivePowerOfTheDay", x.peakPower)
+	x.set("inverter", "reactivePower", 0.01*active)
+	x.set("inverter", "powerFactor", 1)
+	x.set("inverter", "inverterFrequency", 50)
+	x.set("inverter", "inverterEfficiency", 97)
+	x.set("inverter", "internalTemperature", 25+3*active)
+	x.set("inverter", "insulationImpedanceValue", 3)
+	x.set("inverter", "deviceStatus", status)
+	x.set("inverter", "startupTime", float64(time.Date(now.Year(), now.Month(), now.Day(), 6, 0, 0, 0, now.Location()).Unix()))
+	x.set("inverter", "shutdownTime", math.MaxUint32)
+	for _, phase := range []string{"A", "B", "C"} {
+		x.set("inverter", "inverterPhase"+phase+"Voltage", phaseVoltage)
+		x.set("inverter", "inverterPhase"+phase+"Current", active*1000/3/phaseVoltage)
+	}
+	for _, line := range []string{"AB", "BC", "CA"} {
+		x.set("inverter", "inverter"+line+"LineVoltage", phaseVoltage*math.Sqrt(3))
+	}
+	for i := 1; i <= 12; i++ {
+		x.setIndex("internalTemperature", "internalTemperature", i, 25+2*active)
+	}
+
+	x.set("cumulative1", "cumulativeGeneratedElectricity", x.generated)
+	x.set("cumulative1", "totalDCInputPower", x.generated/0.97)
+	x.set("cumulative1", "currentElectricityGenerationStatisticsTime", float64(now.Unix()))
+	x.set("cumulative1", "electricityGeneratedInCurrentHour", x.hourGenerated)
+	x.set("cumulative1", "electricityGeneratedInCurrentDay", x.dayGenerated)
+	x.set("cumulative1", "electricityGeneratedInCurrentMonth", x.monthGenerated)
+	x.set("cumulative1", "electricityGeneratedInCurrentYear", x.yearGenerated)
+
+	// meter, >0 is feed-in
+	for _, phase := range []string{"A", "B", "C"} {
+		x.set("meter", "gridPhase"+phase+"Voltage", phaseVoltage)
+		x.set("meter", "gridPhase"+phase+"Current", grid*1000/3/phaseVoltage)
+		x.set("meter", "gridPhase"+phase+"ActivePower", grid/3)
+	}
+	for _, line := range []string{"AB", "BC", "CA"} {
+		x.set("meter", "gridLine"+line+"Voltage", phaseVoltage*math.Sqrt(3))
+	}
+	x.set("meter", "gridActivePower", grid)
+	x.set("meter", "gridPowerFactor", 1)
+	x.set("meter", "gridFrequency", 50)
+	x.set("meter", "gridPositiveActiveElectricity", x.feedIn)
+	x.set("meter", "gridReverseActivePower", x.fromGrid)
+
+	// battery
+	if x.cfg.batteryPacks > 0 {
+		x.set("esu1", "runningStatus", 2)
+		x.set("esu1", "workingMode", float64(workingMode))
+		x.set("esu1", "chargeAndDischargePower", battery)
+		x.set("esu1", "batterySOC", x.soc)
+		x.set("esu1", "busVoltage", 450)
+		x.set("esu1", "busCurrent", battery*1000/450)
+		x.set("esu1", "batteryTemperature", 20+math.Abs(battery))
+		x.set("esu1", "currentDayChargeCapacity", x.dayCharged)
+		x.set("esu1", "currentDayDischargeCapacity", x.dayDischarged)
+		x.set("esu1", "totalCharge", x.charged)
+		x.set("esu1", "totalDischarge", x.discharged)
+		packs := float64(x.cfg.batteryPacks)
+		for p := 1; p <= x.cfg.batteryPacks; p++ {
+			target := fmt.Sprintf("esu1Pack%d", p)
+			x.set(target, "soc", x.soc)
+			x.set(target, "chargeDischargePower", battery/packs)
+			x.set(target, "voltage", 450)
+			x.set(target, "current", battery*1000/packs/450)
+			x.set(target, "totalCharge", x.charged/packs)
+			x.set(target, "totalDischarge", x.discharged/packs)
+			x.setIndex("esuTemperatures", "esu1PackMaxTemperature", p, 22+math.Abs(battery))
+			x.setIndex("esuTemperatures", "esu1PackMinTemperature", p, 20+math.Abs(battery))
+		}
+	}
+}
+
+// simulator serves the simulated inverters, one per slave ID.
+type simulator struct {
+	sync.Mutex
+	cfg       *simulatorConfig
+	realStart time.Time
+	inverters map[byte]*simulatedInverter
+}
+
+func newSimulator(cfg *simulatorConfig) *simulator {
+	x := &simulator{
+		cfg:       cfg,
+		realStart: time.Now(),
+		inverters: make(map[byte]*simulatedInverter),
+	}
+	for _, id := range cfg.slaveIDs {
+		x.inverters[id] = newSimulatedInverter(cfg, id)
+	}
+	return x
+}
+
+// now returns the simulated time.
+func (x *simulator) now() time.Time {
+	elapsed := time.Since(x.realStart)
+	return x.cfg.start.Add(time.Duration(float64(elapsed) * x.cfg.timeScale))
+}
+
+func (x *simulator) readHoldingRegisters(slaveID byte, address, quantity uint16) (results []byte, err error) {
+	x.Lock()
+	defer x.Unlock()
+	inv, ok := x.inverters[slaveID]
+	if !ok {
+		// what the SDongle answers for the slaves it does not have
+		return nil, &modbus.ModbusError{ExceptionCode: modbus.ExceptionCodeGatewayTargetDeviceFailedToRespond}
+	}
+	inRange := func(first, last uint16) bool {
+		return address >= first && uint32(address)+uint32(quantity) <= uint32(last)+1
+	}
+	ok = inRange(simulatorFirstRegister, simulatorLastRegister)
+	for _, r := range simulatorSettings {
+		ok = ok || inRange(r[0], r[1])
+	}
+	if !ok {
+		return nil, errIllegalDataAddress(address, quantity)
+	}
+	inv.step(x.now())
+	for i := uint16(0); i < quantity; i++ {
+		results = binary.BigEndian.AppendUint16(results, inv.registers[address+i])
+	}
+	return results, nil
+}
+
+func (x *simulator) writeRegisters(slaveID byte, address uint16, values []byte) error {
+	x.Lock()
+	defer x.Unlock()
+	inv, ok := x.inverters[slaveID]
+	if !ok {
+		return &modbus.ModbusError{ExceptionCode: modbus.ExceptionCodeGatewayTargetDeviceFailedToRespond}
+	}
+	inv.step(x.now())
+	registers := make([]uint16, len(values)/2)
+	for i := range registers {
+		registers[i] = binary.BigEndian.Uint16(values[2*i:])
+	}
+	return inv.write(address, registers)
+}
+
+// newSimulatorServer returns the Modbus server of the simulator, not yet listening.
+func newSimulatorServer(cfg *simulatorConfig) *modbusServer {
+	server := newModbusServer(newSimulator(cfg))
+	server.dropFirstRequest = cfg.dropFirstRequest
+	server.txIDMismatchEvery = cfg.txIDMismatchEvery
+	return server
+}
+
+// runSimulator is the "simulate" command.
+func runSimulator(args []string) error {
+	var simCfg simulatorConfig
+	simCfg.setDefaults()
+	if err := simCfg.parseFlags(args); err != nil {
+		return err
+	}
+
+	server := newSimulatorServer(&simCfg)
+	if err := server.listen(simCfg.listen); err != nil {
+		return err
+	}
+	lInfo.Printf("Simulating %d %s inverter(s) on %s, slave IDs %v", len(simCfg.slaveIDs), simCfg.model, server.addr(), simCfg.slaveIDs)
+	return server.serve()
+}
@@ -0,0 +1,278 @@
+// Copyright: 2024 Dragos Vingarzan vingarzan -at- gmail -dot- com
+// License: AGPL-3.0
+//
+// This file is part of sun2000-modbus.
+//
+// sun2000-modbus is free software: you can redistribute it and/or modify it under the terms of the GNU Affero General
+// Public License Version 3 (AGPL-3.0) as published by the Free Software Foundation.
+//
+// sun2000-modbus is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY; without even the implied
+// warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the AGPL-3.0 along with sun2000-modbus. If not,
+// see <https://www.gnu.org/licenses/>.
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/goburrow/modbus"
+	"github.com/vingarzan/sun2000-modbus/sun2000"
+)
+
+// startSimulator serves two simulated inverters on a random local port, at noon on a sunny day.
+func startSimulator(t *testing.T, setup func(*simulatorConfig)) *modbusServer {
+	var simCfg simulatorConfig
+	simCfg.setDefaults()
+	simCfg.start = time.Date(2024, 6, 21, 13, 0, 0, 0, time.Local)
+	simCfg.slaveIDs = []byte{1, 2}
+	if setup != nil {
+		setup(&simCfg)
+	}
+	server := newSimulatorServer(&simCfg)
+	if err := server.listen("127.0.0.1:0"); err != nil {
+		t.Fatalf("listen() failed: %v", err)
+	}
+	go server.serve()
+	t.Cleanup(func() { server.close() })
+	return server
+}
+
+// simulatorDevices returns the devices to poll the simulator, with the connection opened.
+func simulatorDevices(t *testing.T, server *modbusServer, slaveIDs ...byte) []*device {
+	host, port, _ := net.SplitHostPort(server.addr())
+	p, _ := strconv.ParseUint(port, 10, 16)
+	cfg.setDefaults()
+	cfg.modbusTimeout = 1
+	var dcs []deviceConfig
+	for _, id := range slaveIDs {
+		dcs = append(dcs, deviceConfig{name: "sim" + strconv.Itoa(int(id)), ip: host, port: uint16(p), slaveID: id})
+	}
+	testDevices := newDevices(dcs)
+	if err := openConnections(testDevices); err != nil {
+		t.Fatalf("openConnections() failed: %v", err)
+	}
+	t.Cleanup(func() { closeConnections(testDevices) })
+	return testDevices
+}
+
+func TestSimulatorEndToEnd(t *testing.T) {
+	server := startSimulator(t, nil)
+	testDevices := simulatorDevices(t, server, 1, 2)
+	d := testDevices[0]
+
+	// the first read after connecting is not answered, like on the real thing
+	if _, err := d.readModbusFromTo("dummy read", 30000, 30015); err == nil {
+		t.Errorf("the first read should have timed out")
+	}
+
+	for _, d := range testDevices {
+		d.readExpiredRanges(context.Background())
+		if count := d.getStats().totalErrorCount; count != 0 {
+			t.Fatalf("%s: %d read errors", d.name, count)
+		}
+	}
+
+	data := &d.data
+	if data.identification.Model != "SUN2000-5KTL-M1" || data.identification.SN != "SIM0000001" {
+		t.Errorf("unexpected identification %q %q", data.identification.Model, data.identification.SN)
+	}
+	if testDevices[1].data.identification.SN != "SIM0000002" {
+		t.Errorf("unexpected SN of the second inverter %q", testDevices[1].data.identification.SN)
+	}
+	if data.pv.pv[0].voltage < 300 || data.pv.pv[0].current <= 0 {
+		t.Errorf("no PV at noon: %v V %v A", data.pv.pv[0].voltage, data.pv.pv[0].current)
+	}
+	if data.inverter.ActivePower <= 0 || data.inverter.DeviceStatus != 512 {
+		t.Errorf("inverter not producing at noon: %v kW, %v", data.inverter.ActivePower, data.inverter.DeviceStatus)
+	}
+	if data.esu1.ChargeAndDischargePower <= 0 || data.esu1.BatterySOC < 50 || data.esu1.pack[0].SN != "SIM0000001P1" {
+		t.Errorf("battery not charging at noon: %v kW, %v %%", data.esu1.ChargeAndDischargePower, data.esu1.BatterySOC)
+	}
+	if data.meter.MeterStatus != 1 || data.meter.GridActivePower >= data.inverter.ActivePower {
+		t.Errorf("unexpected meter: status %d, %v kW", data.meter.MeterStatus, data.meter.GridActivePower)
+	}
+
+	metrics := d.metricsString()
+	for _, line := range []string{
+		`sun2000_inverter_active_power{device="sim1",model="SUN2000-5KTL-M1",sn="SIM0000001",unit="kW"}`,
+		`sun2000_grid_active_power{device="sim1",model="SUN2000-5KTL-M1",sn="SIM0000001",unit="kW"}`,
+		`sun2000_ess_soc{device="sim1",model="SUN2000-5KTL-M1",sn="SIM0000001",esu="1",esu_sn="SIM0000001B",unit="%"}`,
+	} {
+		if !strings.Contains(metrics, line) {
+			t.Errorf("missing %s", line)
+		}
+	}
+}
+
+func TestSimulatorQuirks(t *testing.T) {
+	server := startSimulator(t, func(c *simulatorConfig) {
+		c.txIDMismatchEvery = 2
+	})
+	d := simulatorDevices(t, server, 1)[0]
+
+	var mismatch bool
+	for i := 0; i < 4; i++ {
+		_, err := d.readModbusFromTo("Identification Data", 30000, 30087)
+		if err != nil && strings.Contains(err.Error(), "modbus: response transaction id") {
+			mismatch = true
+		}
+	}
+	if !mismatch {
+		t.Errorf("no transaction id mismatch in 4 reads")
+	}
+
+	// unknown slaves and registers get exceptions
+	server.mutex.Lock()
+	server.txIDMismatchEvery = 0
+	server.mutex.Unlock()
+	d.slaveID = 9
+	_, err := d.readModbusFromTo("Identification Data", 30000, 30087)
+	var mbErr *modbus.ModbusError
+	if !errors.As(err, &mbErr) || mbErr.ExceptionCode != modbus.ExceptionCodeGatewayTargetDeviceFailedToRespond {
+		t.Errorf("expected a gateway exception for an unknown slave, got %v", err)
+	}
+	d.slaveID = 1
+	_, err = d.readModbusFromTo("Nothing", 40000, 40010)
+	if !errors.As(err, &mbErr) || mbErr.ExceptionCode != modbus.ExceptionCodeIllegalDataAddress {
+		t.Errorf("expected an illegal data address exception, got %v", err)
+	}
+}
+
+func TestPollerStops(t *testing.T) {
+	server := startSimulator(t, nil)
+	d := simulatorDevices(t, server, 1)[0]
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		d.readModbusLoop(ctx, 3600)
+		close(done)
+	}()
+	deadline := time.Now().Add(5 * time.Second)
+	for d.data.identification.getNextRead().IsZero() {
+		if time.Now().After(deadline) {
+			t.Fatal("the poller did not read anything")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the poller did not stop")
+	}
+}
+
+func TestReconnectAfterErrors(t *testing.T) {
+	server := startSimulator(t, nil)
+	d := simulatorDevices(t, server, 1)[0]
+	d.readModbusFromTo("dummy read", 30000, 30015)
+
+	// the exceptions of a slave which is not there don't mean that the connection is broken
+	d.slaveID = 9
+	for i := 0; i < 11; i++ {
+		results, err := d.readModbusFromTo("Identification Data", 30000, 30087)
+		if d.handleReadModbusResults(results, err) {
+			t.Fatal("the read of a missing slave succeeded")
+		}
+	}
+	if !d.conn.isOpen() {
+		t.Fatal("the connection was closed after exceptions")
+	}
+	d.slaveID = 1
+
+	// a transaction id mismatch does
+	server.mutex.Lock()
+	server.txIDMismatchEvery = 1
+	server.mutex.Unlock()
+	results, err := d.readModbusFromTo("Identification Data", 30000, 30087)
+	if d.handleReadModbusResults(results, err) {
+		t.Fatal("the read with a wrong transaction id succeeded")
+	}
+	if d.conn.isOpen() {
+		t.Fatal("the connection was not closed after a transaction id mismatch")
+	}
+	if ok, state, _ := d.conn.sup.mayConnect(); ok || state != stateBackingOff {
+		t.Fatalf("the connection may be reopened right away, in state %s", state)
+	}
+	server.mutex.Lock()
+	server.txIDMismatchEvery = 0
+	server.mutex.Unlock()
+
+	// the poller reopens it, once the backoff is over
+	d.conn.sup.Lock()
+	d.conn.sup.retryAt = time.Now()
+	d.conn.sup.Unlock()
+	if reopened, err := d.conn.ensureOpen(); err != nil || !reopened {
+		t.Fatalf("ensureOpen() = %v, %v", reopened, err)
+	}
+	d.readModbusFromTo("dummy read", 30000, 30015)
+	results, err = d.readModbusFromTo("Identification Data", 30000, 30087)
+	if !d.handleReadModbusResults(results, err) {
+		t.Fatalf("the read after reopening failed: %v", err)
+	}
+	if d.conn.sup.state != stateConnected || d.conn.sup.reconnects != 1 || d.conn.sup.errors[errorClassException] != 11 {
+		t.Errorf("unexpected supervisor state %s, reconnects %d, errors %v", d.conn.sup.state, d.conn.sup.reconnects, d.conn.sup.errors)
+	}
+}
+
+func TestClientTypedReads(t *testing.T) {
+	server := startSimulator(t, nil)
+	client := sun2000.NewClient(sun2000.Config{Address: server.addr(), SlaveID: 1, Timeout: time.Second})
+	if err := client.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	// the first read after connecting is not answered
+	client.ReadRegisters(30000, 30015)
+
+	id, err := client.ReadIdentification()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id.Model != "SUN2000-5KTL-M1" || id.SN != "SIM0000001" || id.MaxActivePowerPmax != 5.5 {
+		t.Errorf("unexpected identification %+v", id)
+	}
+	inverter, err := client.ReadInverter()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if inverter.DeviceStatus.String() != "On-grid: running" || inverter.ActivePower <= 0 {
+		t.Errorf("unexpected inverter %+v", inverter)
+	}
+	if _, err := client.ReadMeter(); err != nil {
+		t.Fatal(err)
+	}
+	alarms, err := client.ReadAlarms()
+	if err != nil || len(alarms.Active()) != 0 {
+		t.Errorf("unexpected alarms %+v, %v", alarms, err)
+	}
+	esu, err := client.ReadESU(1)
+	if err != nil || len(esu.SN) == 0 || esu.RatedChargePower != 2500 {
+		t.Errorf("unexpected ESU %+v, %v", esu, err)
+	}
+	pack, err := client.ReadBatteryPack(1, 1)
+	if err != nil || len(pack.SN) == 0 {
+		t.Errorf("unexpected pack %+v, %v", pack, err)
+	}
+	// only the one pack of the simulator is there
+	pack, err = client.ReadBatteryPack(1, 2)
+	if err != nil || len(pack.SN) != 0 {
+		t.Errorf("unexpected missing pack %+v, %v", pack, err)
+	}
+
+	// the other slave, on the same session
+	client.SetSlaveID(2)
+	id, err = client.ReadIdentification()
+	if err != nil || id.SN != "SIM0000002" {
+		t.Errorf("unexpected identification of slave 2 %+v, %v", id, err)
+	}
+}
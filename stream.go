@@ -0,0 +1,228 @@
+// Copyright: 2024 Dragos Vingarzan vingarzan -at- gmail -dot- com
+// License: AGPL-3.0
+//
+// This file is part of sun2000-modbus.
+//
+// sun2000-modbus is free software: you can redistribute it and/or modify it under the terms of the GNU Affero General
+// Public License Version 3 (AGPL-3.0) as published by the Free Software Foundation.
+//
+// sun2000-modbus is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY; without even the implied
+// warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the AGPL-3.0 along with sun2000-modbus. If not,
+// see <https://www.gnu.org/licenses/>.
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// The live stream pushes an event to the subscribers (as Server-Sent Events) after each block read, with the values
+// which changed since the previous read:
+//
+//	event: block
+//	data: {"device":"sun2000","block":"Grid Data","target":"inverter","time":"...","changed":{"activePower":3.12}}
+//
+// On connecting, a subscriber first gets all the values last read, as if they had all changed. Each one has its own
+// queue, and the poller never waits for it: a subscriber which falls behind is disconnected, and gets all the values
+// again when it reconnects (which EventSource does by itself).
+
+const (
+	// the events queued per subscriber, before it is considered too slow
+	streamQueueSize = 256
+	// a comment is sent this often, so that the proxies do not close an idle stream
+	streamKeepAlive = 15 * time.Second
+)
+
+type streamEvent struct {
+	Device  string         `json:"device"`
+	Block   string         `json:"block"`
+	Target  string         `json:"target,omitempty"`
+	Time    string         `json:"time"`
+	Changed map[string]any `json:"changed"`
+}
+
+func (e *streamEvent) matches(device, target string) bool {
+	return (len(device) == 0 || device == e.Device) && (len(target) == 0 || target == e.Target)
+}
+
+type streamSubscriber struct {
+	client string
+	// the filters, empty for all
+	device, target string
+	events         chan []byte
+	// closed when the subscriber is dropped, for being too slow, or on shutdown
+	done chan struct{}
+}
+
+// streamHub sends the events of all the devices to the subscribers, as a blockListener.
+type streamHub struct {
+	sync.Mutex
+	subscribers map[*streamSubscriber]bool
+	// the last event of each block, with all its values, by device and block name
+	last      map[[2]string]*streamEvent
+	overflows uint64
+}
+
+// The live stream, fed by the pollers.
+var stream = newStreamHub()
+
+func newStreamHub() *streamHub {
+	return &streamHub{subscribers: make(map[*streamSubscriber]bool), last: make(map[[2]string]*streamEvent)}
+}
+
+// subscribe adds a subscriber, with the last values of the blocks already queued.
+func (x *streamHub) subscribe(client, device, target string) *streamSubscriber {
+	s := &streamSubscriber{client: client, device: device, target: target, events: make(chan []byte, streamQueueSize), done: make(chan struct{})}
+	x.Lock()
+	defer x.Unlock()
+	for _, e := range x.last {
+		if !e.matches(device, target) {
+			continue
+		}
+		data, _ := json.Marshal(e)
+		select {
+		case s.events <- data:
+		default:
+			// more blocks than fit in the queue, the rest comes with the next reads
+		}
+	}
+	x.subscribers[s] = true
+	return s
+}
+
+func (x *streamHub) unsubscribe(s *streamSubscriber) {
+	x.Lock()
+	defer x.Unlock()
+	x.drop(s)
+}
+
+// drop removes the subscriber, and tells its handler to stop. The caller must hold the lock.
+func (x *streamHub) drop(s *streamSubscriber) {
+	if x.subscribers[s] {
+		delete(x.subscribers, s)
+		close(s.done)
+	}
+}
+
+// close drops all the subscribers, since the HTTP server waits for their handlers on shutdown.
+func (x *streamHub) close() {
+	x.Lock()
+	defer x.Unlock()
+	for s := range x.subscribers {
+		x.drop(s)
+	}
+}
+
+// blockParsed sends the values of the block which changed since the previous read to the subscribers.
+func (x *streamHub) blockParsed(d *device, r *modbusInterval) {
+	// the registers of the battery packs which are not there are all zeroes
+	if pack, ok := r.target.(*batteryData); ok && !pack.isPresent() {
+		return
+	}
+	values := make(map[string]any)
+	r.values.RLock()
+	at := r.values.lastRead
+	for i := range r.values.values {
+		v := &r.values.values[i]
+		if d.caps.hasValue(v) {
+			values[v.key()] = v.jsonValue()
+		}
+	}
+	r.values.RUnlock()
+
+	x.Lock()
+	defer x.Unlock()
+	key := [2]string{d.name, r.name}
+	e := &streamEvent{Device: d.name, Block: r.name, Target: r.values.block.Target, Time: at.Format(time.RFC3339Nano), Changed: values}
+	previous := x.last[key]
+	x.last[key] = e
+	if len(x.subscribers) == 0 {
+		return
+	}
+	if previous != nil {
+		changed := make(map[string]any)
+		for k, v := range values {
+			if old, ok := previous.Changed[k]; !ok || old != v {
+				changed[k] = v
+			}
+		}
+		e = &streamEvent{Device: e.Device, Block: e.Block, Target: e.Target, Time: e.Time, Changed: changed}
+	}
+	data, err := json.Marshal(e)
+	if err != nil {
+		lError.Printf("Stream event of %s: %v", r.name, err)
+		return
+	}
+	for s := range x.subscribers {
+		if !e.matches(s.device, s.target) {
+			continue
+		}
+		select {
+		case s.events <- data:
+		default:
+			lWarning.Printf("Stream subscriber %s is too slow, disconnecting it", s.client)
+			x.overflows++
+			x.drop(s)
+		}
+	}
+}
+
+func (x *streamHub) collectMetrics(r *metricsRegistry) {
+	x.Lock()
+	defer x.Unlock()
+	r.gauge("sun2000_stream_subscribers", "Clients of the live stream", float64(len(x.subscribers)))
+	r.counter("sun2000_stream_overflows_total", "Clients of the live stream disconnected for falling behind", float64(x.overflows))
+}
+
+// handleStream serves the live stream as Server-Sent Events, for all the devices and blocks, or only those given with
+// ?device=name and ?target=, e.g. inverter.
+func handleStream(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming is not supported", http.StatusInternalServerError)
+		return
+	}
+	device := r.URL.Query().Get("device")
+	if len(device) > 0 {
+		if _, err := findDevice(devices, device); err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+	}
+	s := stream.subscribe(r.RemoteAddr, device, r.URL.Query().Get("target"))
+	defer stream.unsubscribe(s)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	// e.g. nginx would buffer the events otherwise
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	keepAlive := time.NewTicker(streamKeepAlive)
+	defer keepAlive.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-s.done:
+			return
+		case data := <-s.events:
+			if _, err := fmt.Fprintf(w, "event: block\ndata: %s\n\n", data); err != nil {
+				return
+			}
+			flusher.Flush()
+		case <-keepAlive.C:
+			if _, err := fmt.Fprint(w, ": keep-alive\n\n"); err != nil {
+				return
+			}
+			flusher.Flush()
+		}
+	}
+}
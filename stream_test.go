@@ -0,0 +1,118 @@
+// Copyright: 2024 Dragos Vingarzan vingarzan -at- gmail -dot- com
+// License: AGPL-3.0
+//
+// This file is part of sun2000-modbus.
+//
+// sun2000-modbus is free software: you can redistribute it and/or modify it under the terms of the GNU Affero General
+// Public License Version 3 (AGPL-3.0) as published by the Free Software Foundation.
+//
+// sun2000-modbus is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY; without even the implied
+// warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the AGPL-3.0 along with sun2000-modbus. If not,
+// see <https://www.gnu.org/licenses/>.
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// readStreamEvent returns the data of the next event, skipping the comments.
+func readStreamEvent(t *testing.T, r *bufio.Reader) (e streamEvent) {
+	t.Helper()
+	var event string
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			t.Fatalf("reading the stream: %v", err)
+		}
+		line = strings.TrimSuffix(line, "\n")
+		switch {
+		case strings.HasPrefix(line, "event: "):
+			event = strings.TrimPrefix(line, "event: ")
+		case strings.HasPrefix(line, "data: "):
+			if event != "block" {
+				t.Errorf("unexpected event %q", event)
+			}
+			if err := json.Unmarshal([]byte(strings.TrimPrefix(line, "data: ")), &e); err != nil {
+				t.Fatal(err)
+			}
+			return e
+		}
+	}
+}
+
+func TestStream(t *testing.T) {
+	server := startSimulator(t, nil)
+	d := simulatorDevices(t, server, 1)[0]
+	d.readModbusFromTo("dummy read", 30000, 30015)
+	d.readExpiredRanges(context.Background())
+	devices = []*device{d}
+	x := newStreamHub()
+	stream = x
+	defer func() { devices, stream = nil, newStreamHub() }()
+	inverter := d.findRange("inverter")
+	x.blockParsed(d, inverter)
+	x.blockParsed(d, d.findRange("meter"))
+
+	web := httptest.NewServer(http.HandlerFunc(handleStream))
+	defer web.Close()
+	defer x.close()
+	resp, err := http.Get(web.URL + "?device=sim1&target=inverter")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.Header.Get("Content-Type") != "text/event-stream" {
+		t.Errorf("unexpected content type %q", resp.Header.Get("Content-Type"))
+	}
+	events := bufio.NewReader(resp.Body)
+
+	// first all the values last read
+	e := readStreamEvent(t, events)
+	if e.Device != "sim1" || e.Block != "Grid Data" || e.Target != "inverter" || e.Changed["inverterFrequency"] != 50.0 || e.Changed["activePower"] == nil {
+		t.Errorf("unexpected first event %+v", e)
+	}
+
+	// then only what changed
+	if !d.readRange(inverter) {
+		t.Fatal("reading the inverter failed")
+	}
+	x.blockParsed(d, d.findRange("meter"))
+	x.blockParsed(d, inverter)
+	e = readStreamEvent(t, events)
+	if _, ok := e.Changed["inverterFrequency"]; ok || e.Target != "inverter" {
+		t.Errorf("unexpected event %+v", e)
+	}
+	if at, err := time.Parse(time.RFC3339Nano, e.Time); err != nil || !at.Equal(inverter.values.getLastRead()) {
+		t.Errorf("unexpected time %q: %v", e.Time, err)
+	}
+
+	// a subscriber which does not keep up is dropped, without holding up the others
+	slow := x.subscribe("slow", "", "")
+	for i := 0; i <= streamQueueSize; i++ {
+		x.blockParsed(d, inverter)
+		if i%16 == 0 {
+			readStreamEvent(t, events)
+		}
+	}
+	select {
+	case <-slow.done:
+	default:
+		t.Errorf("the slow subscriber was not dropped")
+	}
+	x.Lock()
+	subscribers, overflows := len(x.subscribers), x.overflows
+	x.Unlock()
+	if subscribers != 1 || overflows != 1 {
+		t.Errorf("%d subscribers and %d overflows, not 1 and 1", subscribers, overflows)
+	}
+}
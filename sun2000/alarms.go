@@ -0,0 +1,152 @@
+// Copyright: 2024 Dragos Vingarzan vingarzan -at- gmail -dot- com
+// License: AGPL-3.0
+//
+// This file is part of sun2000-modbus.
+//
+// sun2000-modbus is free software: you can redistribute it and/or modify it under the terms of the GNU Affero General
+// Public License Version 3 (AGPL-3.0) as published by the Free Software Foundation.
+//
+// sun2000-modbus is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY; without even the implied
+// warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the AGPL-3.0 along with sun2000-modbus. If not,
+// see <https://www.gnu.org/licenses/>.
+package sun2000
+
+import "fmt"
+
+// AlarmCount is the number of the alarm bitfields. The "Alarm Data 1" block has only the first 3, but the Alarms
+// chapter defines also Alarm 4 and Alarm 5.
+const AlarmCount = 5
+
+// Alarms is the "Alarm Data 1" block.
+type Alarms struct {
+	// 32008-32010 Bitfield16 1x3
+	Bits [AlarmCount]uint16
+}
+
+func DecodeAlarms(data []byte) (x Alarms, err error) {
+	if len(data) < 6 {
+		return x, fmt.Errorf("data length %d < 6", len(data))
+	}
+
+	var idx uint
+	for i := 0; i < 3; i++ {
+		x.Bits[i], idx, _ = GetU16(data, idx)
+	}
+
+	return x, nil
+}
+
+// Active returns the known alarms which are triggered.
+func (x Alarms) Active() []Alarm {
+	return ActiveAlarms(x.Bits)
+}
+
+type AlarmLevel uint8
+
+const (
+	AlarmLevelWarning AlarmLevel = iota
+	AlarmLevelMinor
+	AlarmLevelMajor
+)
+
+func (x AlarmLevel) String() string {
+	switch x {
+	case AlarmLevelWarning:
+		return "Warning"
+	case AlarmLevelMinor:
+		return "Minor"
+	case AlarmLevelMajor:
+		return "Major"
+	default:
+		return "Unknown"
+	}
+}
+
+type Alarm struct {
+	Mask  [AlarmCount]uint16
+	Name  string
+	ID    uint16
+	Level AlarmLevel
+}
+
+// KnownAlarms are the alarms of the bitfields, as documented.
+// TODO: figure out if bit0 is LSB, or MSB
+var KnownAlarms = []Alarm{
+	{[AlarmCount]uint16{0b1000000000000000}, "High String Input Voltage", 2001, AlarmLevelMajor},
+	{[AlarmCount]uint16{0b0100000000000000}, "DC Arc Fault", 2002, AlarmLevelMajor},
+	{[AlarmCount]uint16{0b0010000000000000}, "String Reverse Connection", 2011, AlarmLevelMajor},
+	{[AlarmCount]uint16{0b0001000000000000}, "String Current Backfeed ", 2012, AlarmLevelWarning},
+	{[AlarmCount]uint16{0b0000100000000000}, "Abnormal String Power", 2013, AlarmLevelWarning},
+	{[AlarmCount]uint16{0b0000010000000000}, "AFCI Self-Check Fail", 2021, AlarmLevelMajor},
+	{[AlarmCount]uint16{0b0000001000000000}, "Phase Wire Short-Circuited to PE", 2031, AlarmLevelMajor},
+	{[AlarmCount]uint16{0b0000000100000000}, "Grid Loss", 2032, AlarmLevelMajor},
+	{[AlarmCount]uint16{0b0000000010000000}, "Grid Undervoltage", 2033, AlarmLevelMajor},
+	{[AlarmCount]uint16{0b0000000001000000}, "Grid Overvoltage", 2034, AlarmLevelMajor},
+	{[AlarmCount]uint16{0b0000000000100000}, "Grid Volt. Imbalance", 2035, AlarmLevelMajor},
+	{[AlarmCount]uint16{0b0000000000010000}, "Grid Overfrequency", 2036, AlarmLevelMajor},
+	{[AlarmCount]uint16{0b0000000000001000}, "Grid Underfrequency", 2037, AlarmLevelMajor},
+	{[AlarmCount]uint16{0b0000000000000100}, "Unstable Grid Frequency", 2038, AlarmLevelMajor},
+	{[AlarmCount]uint16{0b0000000000000010}, "Output Overcurrent", 2039, AlarmLevelMajor},
+	{[AlarmCount]uint16{0b0000000000000001}, "Output DC Component Overhigh", 2040, AlarmLevelMajor},
+
+	{[AlarmCount]uint16{0, 0b1000000000000000}, "Abnormal Residual Current", 2051, AlarmLevelMajor},
+	{[AlarmCount]uint16{0, 0b0100000000000000}, "Abnormal Grounding", 2061, AlarmLevelMajor},
+	{[AlarmCount]uint16{0, 0b0010000000000000}, "Low Insulation Resistance", 2062, AlarmLevelMajor},
+	{[AlarmCount]uint16{0, 0b0001000000000000}, "Overtemperature", 2063, AlarmLevelMajor},
+	{[AlarmCount]uint16{0, 0b0000100000000000}, "Device Fault", 2064, AlarmLevelMajor},
+	{[AlarmCount]uint16{0, 0b0000010000000000}, "Upgrade Failed or Version Mismatch", 2065, AlarmLevelMinor},
+	{[AlarmCount]uint16{0, 0b0000001000000000}, "License Expired", 2066, AlarmLevelWarning},
+	{[AlarmCount]uint16{0, 0b0000000100000000}, "Faulty Monitoring Unit", 61440, AlarmLevelMinor},
+	{[AlarmCount]uint16{0, 0b0000000010000000}, "Faulty Power Collector", 2067, AlarmLevelMajor},
+	{[AlarmCount]uint16{0, 0b0000000001000000}, "Battery Abnormal", 2068, AlarmLevelMinor},
+	{[AlarmCount]uint16{0, 0b0000000000100000}, "Active Islanding", 2070, AlarmLevelMajor},
+	{[AlarmCount]uint16{0, 0b0000000000010000}, "Passive Islanding", 2071, AlarmLevelMajor},
+	{[AlarmCount]uint16{0, 0b0000000000001000}, "Transient AC Overvoltage", 2072, AlarmLevelMajor},
+	{[AlarmCount]uint16{0, 0b0000000000000100}, "Peripheral Port Short Circuit", 2075, AlarmLevelWarning},
+	{[AlarmCount]uint16{0, 0b0000000000000010}, "Churn Output Overload", 2077, AlarmLevelMajor},
+	{[AlarmCount]uint16{0, 0b0000000000000001}, "Abnormal PV Module Configuration", 2080, AlarmLevelMajor},
+
+	{[AlarmCount]uint16{0, 0, 0b1000000000000000}, "Optimizer Fault", 2081, AlarmLevelWarning},
+	{[AlarmCount]uint16{0, 0, 0b0100000000000000}, "Built-in PID Operation Abnormal", 2085, AlarmLevelMajor},
+	{[AlarmCount]uint16{0, 0, 0b0010000000000000}, "High Input String Voltage to Ground", 2014, AlarmLevelMajor},
+	{[AlarmCount]uint16{0, 0, 0b0001000000000000}, "External Fan Abnormal", 2086, AlarmLevelMajor},
+	{[AlarmCount]uint16{0, 0, 0b0000100000000000}, "Battery Reverse Connection", 2069, AlarmLevelMajor},
+	{[AlarmCount]uint16{0, 0, 0b0000010000000000}, "On-grid/Off-grid Controller Abnormal", 2082, AlarmLevelMajor},
+	{[AlarmCount]uint16{0, 0, 0b0000001000000000}, "PV String Loss", 2015, AlarmLevelWarning},
+	{[AlarmCount]uint16{0, 0, 0b0000000100000000}, "Internal Fan Abnormal", 2087, AlarmLevelMajor},
+	{[AlarmCount]uint16{0, 0, 0b0000000010000000}, "DC Protection Unit Abnormal", 2088, AlarmLevelMajor},
+
+	{[AlarmCount]uint16{0, 0, 0, 0b0000000000100000}, "Management System Cert Valid Time Ineffective", 2095, AlarmLevelMajor},
+	{[AlarmCount]uint16{0, 0, 0, 0b0000000000010000}, "Management System Cert Valid Time Being Overdue", 2096, AlarmLevelMajor},
+	{[AlarmCount]uint16{0, 0, 0, 0b0000000000001000}, "Management System Cert Valid Time Overdue", 2097, AlarmLevelMajor},
+
+	{[AlarmCount]uint16{0, 0, 0, 0, 0b0001000000000000}, "CT Disconnection", 2067, AlarmLevelMajor},
+	{[AlarmCount]uint16{0, 0, 0, 0, 0b0000100000000000}, "PT Disconnection", 2067, AlarmLevelMajor},
+}
+
+func (x Alarm) IsTriggered(bits [AlarmCount]uint16) bool {
+	for i := 0; i < AlarmCount; i++ {
+		if x.Mask[i]&bits[i] != 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// ActiveAlarms returns the known alarms which are triggered in the bitfields.
+func ActiveAlarms(bits [AlarmCount]uint16) (out []Alarm) {
+	out = make([]Alarm, 0, 8)
+	for _, a := range KnownAlarms {
+		if a.IsTriggered(bits) {
+			out = append(out, a)
+		}
+	}
+	return out
+}
+
+func (x Alarm) String() string {
+	return fmt.Sprintf("%s : %s id=%d", x.Level, x.Name, x.ID)
+}
@@ -12,31 +12,31 @@
 //
 // You should have received a copy of the AGPL-3.0 along with sun2000-modbus. If not,
 // see <https://www.gnu.org/licenses/>.
-package main
+package sun2000
 
 import (
 	"reflect"
 	"testing"
 )
 
-func TestGetAlarms(t *testing.T) {
+func TestActiveAlarms(t *testing.T) {
 	// Define the input data
-	id := [alarmCount]uint16{0b0110000000000000, 0b000000000000001, 0b1000000000000000, 0b0010000000000000}
+	id := [AlarmCount]uint16{0b0110000000000000, 0b000000000000001, 0b1000000000000000, 0b0010000000000000}
 
 	// Call the function under test
-	result := getAlarms(id)
+	result := ActiveAlarms(id)
 
 	// Define the expected output
-	expected := []sun2000Alarm{
-		sun2000Alarms[1],
-		sun2000Alarms[2],
-		sun2000Alarms[31],
-		sun2000Alarms[32],
+	expected := []Alarm{
+		KnownAlarms[1],
+		KnownAlarms[2],
+		KnownAlarms[31],
+		KnownAlarms[32],
 		// Add more expected alarms here if needed
 	}
 
 	// Compare the result with the expected output
 	if !reflect.DeepEqual(result, expected) {
-		t.Errorf("getAlarms() returned unexpected result, got: %v, want: %v", result, expected)
+		t.Errorf("ActiveAlarms() returned unexpected result, got: %v, want: %v", result, expected)
 	}
 }
@@ -0,0 +1,709 @@
+// Copyright: 2024 Dragos Vingarzan vingarzan -at- gmail -dot- com
+// License: AGPL-3.0
+//
+// This file is part of sun2000-modbus.
+//
+// sun2000-modbus is free software: you can redistribute it and/or modify it under the terms of the GNU Affero General
+// Public License Version 3 (AGPL-3.0) as published by the Free Software Foundation.
+//
+// sun2000-modbus is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY; without even the implied
+// warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the AGPL-3.0 along with sun2000-modbus. If not,
+// see <https://www.gnu.org/licenses/>.
+package sun2000
+
+import (
+	"fmt"
+	"time"
+)
+
+// The typed results of the register blocks. Each Decode function takes the raw bytes of its block, as read from the
+// first register of the block on. The gains are applied, so the values are in the units noted next to the fields.
+
+type Identification struct {
+	// 30000 STR 15
+	Model string
+	// 30015 STR 10
+	SN string
+	// 30025 STR 10
+	PN string
+
+	// 30035 STR 15
+	FirmwareVersion string
+	// 30050 STR 15
+	SoftwareVersion string
+
+	// 30068 U32 2
+	ProtocolVersion uint32 // modbus
+	// 30070 U16 1
+	ModelID uint16
+	// 30071 U16 1
+	NumberOfStrings uint16
+	// 30072 U16 1
+	NumberOfMPPTs uint16
+	// 30073 U32 2 gain 1000 kW
+	RatedPower float32
+	// 30075 U32 2 gain 1000 kW
+	MaxActivePowerPmax float32
+	// 30077 U32 2 gain 1000 kVA Pmax
+	MaxApparentPowerSmax float32
+	// 30079 I32 2 gain 1000 kVar Qmax
+	RealtimeMaxReactivePowerQmaxFeedToGrid float32
+	// 30081 I32 2 gain 1000 kVar -Qmax
+	RealtimeMaxReactivePowerQmaxAbsorbedFromGrid float32
+	// 30083 U32 2 gain 1000 kW Pmax_real - 0<Pmax≤Smax≤Pmax_real≤Smax_real or 0<Pmax≤Pmax_real≤Smax≤Smax_real
+	MaxActiveCapabilityPmaxReal float32
+	// 30085 U32 2 gain 1000 kVA Smax_real - 0<Pmax≤Smax≤Pmax_real≤Smax_real or 0<Pmax≤Pmax_real≤Smax≤Smax_real
+	MaxApparentCapabilitySmaxReal float32
+}
+
+func DecodeIdentification(data []byte) (x Identification, err error) {
+	if len(data) < 70 {
+		return x, fmt.Errorf("data length %d < 70", len(data))
+	}
+
+	var idx uint
+	x.Model, idx, _ = GetSTR(data, idx, 15)
+	x.SN, idx, _ = GetSTR(data, idx, 10)
+	x.PN, idx, _ = GetSTR(data, idx, 10)
+	x.FirmwareVersion, idx, _ = GetSTR(data, idx, 15)
+	x.SoftwareVersion, idx, _ = GetSTR(data, idx, 15)
+	idx, _ = SkipRecords(data, idx, 3)
+	x.ProtocolVersion, idx, _ = GetU32(data, idx)
+	x.ModelID, idx, _ = GetU16(data, idx)
+	x.NumberOfStrings, idx, _ = GetU16(data, idx)
+	x.NumberOfMPPTs, idx, _ = GetU16(data, idx)
+	u32, idx, _ := GetU32(data, idx)
+	x.RatedPower = float32(u32) / 1000
+	u32, idx, _ = GetU32(data, idx)
+	x.MaxActivePowerPmax = float32(u32) / 1000
+	u32, idx, _ = GetU32(data, idx)
+	x.MaxApparentPowerSmax = float32(u32) / 1000
+	i32, idx, _ := GetI32(data, idx)
+	x.RealtimeMaxReactivePowerQmaxFeedToGrid = float32(i32) / 1000
+	i32, idx, _ = GetI32(data, idx)
+	x.RealtimeMaxReactivePowerQmaxAbsorbedFromGrid = float32(i32) / 1000
+	u32, idx, _ = GetU32(data, idx)
+	x.MaxActiveCapabilityPmaxReal = float32(u32) / 1000
+	u32, _, _ = GetU32(data, idx)
+	x.MaxApparentCapabilitySmaxReal = float32(u32) / 1000
+
+	return x, nil
+}
+
+// Inverter is the "Grid Data" block, with the AC side of the inverter.
+type Inverter struct {
+	// 32064 I32 2 gain 1000 kW
+	DCPower float32
+
+	// 32066 U16 1 gain 10 V
+	InverterABLineVoltage float32
+	// 32067 U16 1 gain 10 V
+	InverterBCLineVoltage float32
+	// 32068 U16 1 gain 10 V
+	InverterCALineVoltage float32
+
+	// 32069 U16 1 gain 10 V
+	InverterPhaseAVoltage float32
+	// 32070 U16 1 gain 10 V
+	InverterPhaseBVoltage float32
+	// 32071 U16 1 gain 10 V
+	InverterPhaseCVoltage float32
+
+	// 32072 I32 2 gain 1000 A
+	InverterPhaseACurrent float32
+	// 32074 I32 2 gain 1000 A
+	InverterPhaseBCurrent float32
+	// 32076 I32 2 gain 1000 A
+	InverterPhaseCCurrent float32
+
+	// 32078 I32 2 gain 1000 kW
+	PeakActivePowerOfTheDay float32
+	// 32080 I32 2 gain 1000 kW
+	ActivePower float32
+	// 32082 I32 2 gain 1000 kVar
+	ReactivePower float32
+	// 32084 I16 1 gain 1000
+	PowerFactor float32
+
+	// 32085 U16 1 gain 100 Hz
+	InverterFrequency float32
+
+	// 32086 U16 1 gain 100 %
+	InverterEfficiency float32
+
+	// 32087 I16 1 gain 10 ℃
+	InternalTemperature float32
+
+	// 32088 U16 1 gain 1000 MΩ
+	InsulationImpedanceValue float32
+
+	// 32089 E16 1
+	DeviceStatus DeviceStatus
+
+	// 32090 U16 1
+	FaultCode uint16
+
+	// 32091 epoch 2
+	StartupTime time.Time
+	// 32093 epoch 2
+	ShutdownTime time.Time
+
+	// 32095 I32 2 gain 1000 kW
+	ActivePowerFast float32
+}
+
+func DecodeInverter(data []byte) (x Inverter, err error) {
+	size := 2 + 3 + 3 + 6 + 7 + 1*6 + 2*2 + 2
+	if len(data) < size {
+		return x, fmt.Errorf("data length %d < %d", len(data), size)
+	}
+
+	var i32 int32
+	var i16 int16
+	var u16 uint16
+	var epoch uint32
+	var idx uint
+
+	i32, idx, _ = GetI32(data, idx)
+	x.DCPower = float32(i32) / 1000
+
+	u16, idx, _ = GetU16(data, idx)
+	x.InverterABLineVoltage = float32(u16) / 10
+	u16, idx, _ = GetU16(data, idx)
+	x.InverterBCLineVoltage = float32(u16) / 10
+	u16, idx, _ = GetU16(data, idx)
+	x.InverterCALineVoltage = float32(u16) / 10
+
+	u16, idx, _ = GetU16(data, idx)
+	x.InverterPhaseAVoltage = float32(u16) / 10
+	u16, idx, _ = GetU16(data, idx)
+	x.InverterPhaseBVoltage = float32(u16) / 10
+	u16, idx, _ = GetU16(data, idx)
+	x.InverterPhaseCVoltage = float32(u16) / 10
+
+	i32, idx, _ = GetI32(data, idx)
+	x.InverterPhaseACurrent = float32(i32) / 1000
+	i32, idx, _ = GetI32(data, idx)
+	x.InverterPhaseBCurrent = float32(i32) / 1000
+	i32, idx, _ = GetI32(data, idx)
+	x.InverterPhaseCCurrent = float32(i32) / 1000
+
+	i32, idx, _ = GetI32(data, idx)
+	x.PeakActivePowerOfTheDay = float32(i32) / 1000
+	i32, idx, _ = GetI32(data, idx)
+	x.ActivePower = float32(i32) / 1000
+
+	i32, idx, _ = GetI32(data, idx)
+	x.ReactivePower = float32(i32) / 1000
+	i16, idx, _ = GetI16(data, idx)
+	x.PowerFactor = float32(i16) / 1000
+
+	u16, idx, _ = GetU16(data, idx)
+	x.InverterFrequency = float32(u16) / 100
+
+	u16, idx, _ = GetU16(data, idx)
+	x.InverterEfficiency = float32(u16) / 100
+
+	i16, idx, _ = GetI16(data, idx)
+	x.InternalTemperature = float32(i16) / 10
+
+	u16, idx, _ = GetU16(data, idx)
+	x.InsulationImpedanceValue = float32(u16) / 1000
+
+	u16, idx, _ = GetU16(data, idx)
+	x.DeviceStatus = DeviceStatus(u16)
+
+	x.FaultCode, idx, _ = GetU16(data, idx)
+
+	epoch, idx, _ = GetU32(data, idx)
+	x.StartupTime = time.Unix(int64(epoch), 0)
+	epoch, idx, _ = GetU32(data, idx)
+	x.ShutdownTime = time.Unix(int64(epoch), 0)
+
+	i32, _, _ = GetI32(data, idx)
+	x.ActivePowerFast = float32(i32) / 1000
+
+	return x, nil
+}
+
+type DeviceStatus uint16
+
+func (x DeviceStatus) String() string {
+	switch x {
+	case 0:
+		return "Standby: initializing"
+	case 1:
+		return "Standby: detecting insulation resistance"
+	case 2:
+		return "Standby: detecting irradiation"
+	case 3:
+		return "Standby: grid detecting"
+	case 256:
+		return "Starting"
+	case 512:
+		return "On-grid: running"
+	case 513:
+		return "Grid connection: power limited"
+	case 514:
+		return "Grid connection: self-derating"
+	case 515:
+		return "Off-grid Running"
+	case 768:
+		return "Shutdown: fault"
+	case 769:
+		return "Shutdown: command"
+	case 770:
+		return "Shutdown: OVGR"
+	case 771:
+		return "Shutdown: communication disconnected"
+	case 772:
+		return "Shutdown: power limited"
+	case 773:
+		return "Shutdown: manual startup required"
+	case 774:
+		return "Shutdown: DC switches disconnected"
+	case 775:
+		return "Shutdown: rapid cutoff"
+	case 776:
+		return "Shutdown: input underpower"
+	case 1025:
+		return "Grid scheduling: cosΦ-P curve"
+	case 1026:
+		return "Grid scheduling: Q-U curve"
+	case 1027:
+		return "Grid scheduling: PF-U curve"
+	case 1028:
+		return "Grid scheduling: dry contact"
+	case 1029:
+		return "Grid scheduling: Q-P curve"
+	case 1280:
+		return "Spot-check ready"
+	case 1281:
+		return "Spot-checking"
+	case 1536:
+		return "Inspecting"
+	case 1792:
+		return "AFCI self check"
+	case 2048:
+		return "I-V scanning"
+	case 2304:
+		return "DC input detection"
+	case 2560:
+		return "Running: off-grid charging"
+	case 40960:
+		return "Standby: no irradiation"
+	default:
+		return fmt.Sprintf("Unknown status %d %#04x\t%#016b", uint16(x), uint16(x), uint16(x))
+	}
+}
+
+// Meter is the power meter at the grid connection point, if there is one.
+type Meter struct {
+	// 37100 U16 1
+	MeterStatus uint16
+	// 37101 I32 2 gain 10 V
+	GridPhaseAVoltage float32
+	// 37103 I32 2 gain 10 V
+	GridPhaseBVoltage float32
+	// 37105 I32 2 gain 10 V
+	GridPhaseCVoltage float32
+	// 37107 I32 2 gain 100 A
+	GridPhaseACurrent float32
+	// 37109 I32 2 gain 100 A
+	GridPhaseBCurrent float32
+	// 37111 I32 2 gain 100 A
+	GridPhaseCCurrent float32
+
+	// 37113 I32 2 gain 1000 kW
+	GridActivePower float32 // >0 feed-in to the grid, <0 supply from the grid
+	// 37115 I32 2 gain 1 Var
+	GridReactivePower float32
+	// 37117 I16 1 gain 1000
+	GridPowerFactor float32
+	// 37118 I16 1 gain 100 Hz
+	GridFrequency float32
+	// 37119 I32 2 gain 100 kWh
+	GridPositiveActiveElectricity float32 // Electricity fed by the inverter to the power grid
+	// 37121 I32 2 gain 100 kWh
+	GridReverseActivePower float32 // Power supplied to a distributed system from the power grid
+	// 37123 I32 2 gain 100 kVar h
+	GridAccumulatedReactivePower float32
+
+	// 37125 U16 1
+	MeterType uint16 // 0: single-phase; 1: three-phase
+	// 37126 I32 2 gain 10 V
+	GridLineABVoltage float32
+	// 37128 I32 2 gain 10 V
+	GridLineBCVoltage float32
+	// 37130 I32 2 gain 10 V
+	GridLineCAVoltage float32
+	// 37132 I32 2 gain 1000 kW
+	GridPhaseAActivePower float32
+	// 37134 I32 2 gain 1000 kW
+	GridPhaseBActivePower float32
+	// 37136 I32 2 gain 1000 kW
+	GridPhaseCActivePower float32
+	// 37138 U16 1
+	MeterModelDetectionResult uint16 // 0: being identified; 1: The selected model is the same as the actual model of the connected meter; 2: The selected model is different from the actual model of the connected meter
+}
+
+func DecodeMeter(data []byte) (x Meter, err error) {
+	size := 1 + 6*2
+	if len(data) < size {
+		return x, fmt.Errorf("data length %d < %d", len(data), size)
+	}
+
+	var u16 uint16
+	var i16 int16
+	var i32 int32
+	var idx uint
+
+	u16, idx, _ = GetU16(data, idx)
+	x.MeterStatus = u16
+
+	i32, idx, _ = GetI32(data, idx)
+	x.GridPhaseAVoltage = float32(i32) / 10
+	i32, idx, _ = GetI32(data, idx)
+	x.GridPhaseBVoltage = float32(i32) / 10
+	i32, idx, _ = GetI32(data, idx)
+	x.GridPhaseCVoltage = float32(i32) / 10
+
+	i32, idx, _ = GetI32(data, idx)
+	x.GridPhaseACurrent = float32(i32) / 100
+	i32, idx, _ = GetI32(data, idx)
+	x.GridPhaseBCurrent = float32(i32) / 100
+	i32, idx, _ = GetI32(data, idx)
+	x.GridPhaseCCurrent = float32(i32) / 100
+
+	i32, idx, _ = GetI32(data, idx)
+	x.GridActivePower = float32(i32) / 1000
+	i32, idx, _ = GetI32(data, idx)
+	x.GridReactivePower = float32(i32)
+	i16, idx, _ = GetI16(data, idx)
+	x.GridPowerFactor = float32(i16) / 100
+
+	i16, idx, _ = GetI16(data, idx)
+	x.GridFrequency = float32(i16) / 100
+	i32, idx, _ = GetI32(data, idx)
+	x.GridPositiveActiveElectricity = float32(i32) / 100
+	i32, idx, _ = GetI32(data, idx)
+	x.GridReverseActivePower = float32(i32) / 100
+	i32, idx, _ = GetI32(data, idx)
+	x.GridAccumulatedReactivePower = float32(i32) / 100
+
+	x.MeterType, idx, _ = GetU16(data, idx)
+
+	i32, idx, _ = GetI32(data, idx)
+	x.GridLineABVoltage = float32(i32) / 10
+	i32, idx, _ = GetI32(data, idx)
+	x.GridLineBCVoltage = float32(i32) / 10
+	i32, idx, _ = GetI32(data, idx)
+	x.GridLineCAVoltage = float32(i32) / 10
+
+	i32, idx, _ = GetI32(data, idx)
+	x.GridPhaseAActivePower = float32(i32) / 1000
+	i32, idx, _ = GetI32(data, idx)
+	x.GridPhaseBActivePower = float32(i32) / 1000
+	i32, idx, _ = GetI32(data, idx)
+	x.GridPhaseCActivePower = float32(i32) / 1000
+
+	x.MeterModelDetectionResult, _, _ = GetU16(data, idx)
+
+	return x, nil
+}
+
+// ESU is an energy storage unit (a LUNA2000 battery), with up to 3 packs. The two ESUs have different register
+// layouts, and the second one has fewer values, which are left zero.
+type ESU struct {
+	// ESU1 37000 U16 1, ESU2 37741 U16 1
+	RunningStatus ESURunningStatus
+	// ESU1 37001 I32 2 gain 1000 kW, ESU2 37743 I32 2 gain 1 W
+	ChargeAndDischargePower float32 // > 0: charging < 0: discharging
+	// ESU1 37003 U16 1 gain 10 V, ESU2 37750 U16 1 gain 10 V
+	BusVoltage float32
+	// ESU1 37004 U16 1 gain 10 %, ESU2 37738 U16 1 gain 10 %
+	BatterySOC float32
+	// ESU1 37006 U16 1
+	WorkingMode ESUWorkingMode
+	// ESU1 37007 U32 2 gain 1 W
+	RatedChargePower uint32
+	// ESU1 37009 U32 2 gain 1 W
+	RatedDischargePower uint32
+	// ESU1 37014 U16 1
+	FaultID uint16
+	// ESU1 37015 U32 2 gain 100 kWh, ESU2 37746 U32 2 gain 100 kWh
+	CurrentDayChargeCapacity float32
+	// ESU1 37017 U32 2 gain 100 kWh, ESU2 37748 U32 2 gain 100 kWh
+	CurrentDayDischargeCapacity float32
+	// ESU1 37021 I16 1 gain 10 A, ESU2 37751 I16 1 gain 10 A
+	BusCurrent float32
+	// ESU1 37022 I16 1 gain 10 ℃, ESU2 37752 I16 1 gain 10 ℃
+	BatteryTemperature float32
+	// ESU1 37025 U16 1 mins
+	RemainingChargeDischargeTime uint16
+	// ESU1 37026 STR 10
+	DCDCVersion string
+	// ESU1 37036 STR 10
+	BMSVersion string
+	// ESU1 37046 U32 2 gain 1 W
+	MaximumChargePower uint32
+	// ESU1 37048 U32 2 gain 1 W
+	MaximumDischargePower uint32
+	// ESU1 37052 STR 10, ESU2 37700 STR 10
+	SN string
+	// ESU1 37066 U32 2 gain 100 kWh, ESU2 37753 U32 2 gain 100 kWh
+	TotalCharge float32
+	// ESU1 37068 U32 2 gain 100 kWh, ESU2 37755 U32 2 gain 100 kWh
+	TotalDischarge float32
+}
+
+// DecodeESU1 decodes the block of the first ESU, from 37000 on.
+func DecodeESU1(data []byte) (x ESU, err error) {
+	size := 70
+	if len(data) < size {
+		return x, fmt.Errorf("data length %d < %d", len(data), size)
+	}
+
+	var u16 uint16
+	var i16 int16
+	var i32 int32
+	var u32 uint32
+	var idx uint
+
+	u16, idx, _ = GetU16(data, idx)
+	x.RunningStatus = ESURunningStatus(u16)
+
+	i32, idx, _ = GetI32(data, idx)
+	x.ChargeAndDischargePower = float32(i32) / 1000
+
+	u16, idx, _ = GetU16(data, idx)
+	x.BusVoltage = float32(u16) / 10
+	u16, idx, _ = GetU16(data, idx)
+	x.BatterySOC = float32(u16) / 10
+
+	idx, _ = SkipRecords(data, idx, 1)
+
+	u16, idx, _ = GetU16(data, idx)
+	x.WorkingMode = ESUWorkingMode(u16)
+
+	u32, idx, _ = GetU32(data, idx)
+	x.RatedChargePower = u32
+	u32, idx, _ = GetU32(data, idx)
+	x.RatedDischargePower = u32
+
+	idx, _ = SkipRecords(data, idx, 3)
+
+	x.FaultID, idx, _ = GetU16(data, idx)
+
+	u32, idx, _ = GetU32(data, idx)
+	x.CurrentDayChargeCapacity = float32(u32) / 100
+	u32, idx, _ = GetU32(data, idx)
+	x.CurrentDayDischargeCapacity = float32(u32) / 100
+
+	idx, _ = SkipRecords(data, idx, 2)
+
+	i16, idx, _ = GetI16(data, idx)
+	x.BusCurrent = float32(i16) / 10
+	i16, idx, _ = GetI16(data, idx)
+	x.BatteryTemperature = float32(i16) / 10
+
+	idx, _ = SkipRecords(data, idx, 2)
+
+	u16, idx, _ = GetU16(data, idx)
+	x.RemainingChargeDischargeTime = u16
+
+	x.DCDCVersion, idx, _ = GetSTR(data, idx, 10)
+	x.BMSVersion, idx, _ = GetSTR(data, idx, 10)
+
+	u32, idx, _ = GetU32(data, idx)
+	x.MaximumChargePower = u32
+	u32, idx, _ = GetU32(data, idx)
+	x.MaximumDischargePower = u32
+
+	idx, _ = SkipRecords(data, idx, 2)
+
+	x.SN, idx, _ = GetSTR(data, idx, 10)
+
+	idx, _ = SkipRecords(data, idx, 4)
+
+	u32, idx, _ = GetU32(data, idx)
+	x.TotalCharge = float32(u32) / 100
+	u32, _, _ = GetU32(data, idx)
+	x.TotalDischarge = float32(u32) / 100
+
+	return x, nil
+}
+
+// DecodeESU2 decodes the block of the second ESU, from 37700 on.
+func DecodeESU2(data []byte) (x ESU, err error) {
+	size := 57
+	if len(data) < size {
+		return x, fmt.Errorf("data length %d < %d", len(data), size)
+	}
+
+	var u16 uint16
+	var i16 int16
+	var i32 int32
+	var u32 uint32
+	var idx uint
+
+	x.SN, idx, _ = GetSTR(data, idx, 10)
+
+	idx, _ = SkipRecords(data, idx, 28)
+
+	u16, idx, _ = GetU16(data, idx)
+	x.BatterySOC = float32(u16) / 10
+
+	idx, _ = SkipRecords(data, idx, 2)
+
+	u16, idx, _ = GetU16(data, idx)
+	x.RunningStatus = ESURunningStatus(u16)
+
+	idx, _ = SkipRecords(data, idx, 1)
+
+	i32, idx, _ = GetI32(data, idx)
+	x.ChargeAndDischargePower = float32(i32)
+
+	idx, _ = SkipRecords(data, idx, 1)
+
+	u32, idx, _ = GetU32(data, idx)
+	x.CurrentDayChargeCapacity = float32(u32) / 100
+	u32, idx, _ = GetU32(data, idx)
+	x.CurrentDayDischargeCapacity = float32(u32) / 100
+
+	u16, idx, _ = GetU16(data, idx)
+	x.BusVoltage = float32(u16) / 10
+	i16, idx, _ = GetI16(data, idx)
+	x.BusCurrent = float32(i16) / 10
+	i16, idx, _ = GetI16(data, idx)
+	x.BatteryTemperature = float32(i16) / 10
+
+	u32, idx, _ = GetU32(data, idx)
+	x.TotalCharge = float32(u32) / 100
+	u32, _, _ = GetU32(data, idx)
+	x.TotalDischarge = float32(u32) / 100
+
+	return x, nil
+}
+
+type ESURunningStatus uint16
+
+func (x ESURunningStatus) String() string {
+	switch x {
+	case 0:
+		return "offline"
+	case 1:
+		return "stand-by"
+	case 2:
+		return "running"
+	case 3:
+		return "fault"
+	case 4:
+		return "sleep mode"
+	default:
+		return ""
+	}
+}
+
+type ESUWorkingMode uint16
+
+func (x ESUWorkingMode) String() string {
+	switch x {
+	case 0:
+		return "none"
+	case 1:
+		return "Forcible charge/discharge"
+	case 2:
+		return "Time of Use(LG)"
+	case 3:
+		return "Fixed charge/discharge"
+	case 4:
+		return "Maximise selfconsumption"
+	case 5:
+		return "Fully fed to grid"
+	case 6:
+		return "Time of Use(LUNA2000)"
+	case 7:
+		return "remote scheduling maximum self-use"
+	case 8:
+		return "remote scheduling - full Internet access"
+	case 9:
+		return "remote scheduling - TOU"
+	case 10:
+		return "AI energy management and scheduling"
+	default:
+		return ""
+	}
+}
+
+// BatteryPack is one pack of an ESU. The registers of the packs which are not there are all zeroes, so their SN is
+// empty.
+type BatteryPack struct {
+	// 38200 STR 10
+	SN string
+	// 38210 STR 15
+	FirmwareVersion string
+	// 38228 U16 1
+	WorkingStatus uint16
+	// 38229 U16 1 gain 10 %
+	SOC float32
+	// 38233 I32 2 gain 1000 kW
+	ChargeDischargePower float32 // > 0: charging < 0: discharging
+	// 38235 U16 1 gain 10 V
+	Voltage float32
+	// 38236 I16 1 gain 10 A
+	Current float32
+	// 38238 U32 2 gain 100 kWh
+	TotalCharge float32
+	// 38240 U32 2 gain 100 kWh
+	TotalDischarge float32
+}
+
+// DecodeBatteryPack decodes the block of a pack. The addresses above are of the first pack of the first ESU, the next
+// ones follow every 42 registers.
+func DecodeBatteryPack(data []byte) (x BatteryPack, err error) {
+	size := 45
+	if len(data) < size {
+		return x, fmt.Errorf("data length %d < %d", len(data), size)
+	}
+
+	var u16 uint16
+	var i16 int16
+	var i32 int32
+	var u32 uint32
+
+	var idx uint
+
+	x.SN, idx, _ = GetSTR(data, idx, 10)
+	x.FirmwareVersion, idx, _ = GetSTR(data, idx, 15)
+
+	idx, _ = SkipRecords(data, idx, 3)
+
+	u16, idx, _ = GetU16(data, idx)
+	x.WorkingStatus = u16
+
+	u16, idx, _ = GetU16(data, idx)
+	x.SOC = float32(u16) / 10
+
+	idx, _ = SkipRecords(data, idx, 3)
+
+	i32, idx, _ = GetI32(data, idx)
+	x.ChargeDischargePower = float32(i32) / 1000
+
+	u16, idx, _ = GetU16(data, idx)
+	x.Voltage = float32(u16) / 10
+	i16, idx, _ = GetI16(data, idx)
+	x.Current = float32(i16) / 10
+
+	idx, _ = SkipRecords(data, idx, 1)
+
+	u32, idx, _ = GetU32(data, idx)
+	x.TotalCharge = float32(u32) / 100
+	u32, _, _ = GetU32(data, idx)
+	x.TotalDischarge = float32(u32) / 100
+
+	return x, nil
+}
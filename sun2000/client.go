@@ -0,0 +1,222 @@
+// Copyright: 2024 Dragos Vingarzan vingarzan -at- gmail -dot- com
+// License: AGPL-3.0
+//
+// This file is part of sun2000-modbus.
+//
+// sun2000-modbus is free software: you can redistribute it and/or modify it under the terms of the GNU Affero General
+// Public License Version 3 (AGPL-3.0) as published by the Free Software Foundation.
+//
+// sun2000-modbus is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY; without even the implied
+// warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the AGPL-3.0 along with sun2000-modbus. If not,
+// see <https://www.gnu.org/licenses/>.
+
+// Package sun2000 reads the Huawei SUN2000 inverters (and the LUNA2000 batteries behind them) over Modbus, either TCP
+// through the SDongle or the inverter's own WLAN, or RTU on the RS485 port of the inverter. The Client reads the
+// register blocks and decodes them into the typed results, while the decoding helpers are there for the other blocks.
+package sun2000
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/goburrow/modbus"
+)
+
+// The register blocks of the typed results, as [from, to).
+const (
+	identificationFrom, identificationTo = 30000, 30087
+	alarmsFrom, alarmsTo                 = 32008, 32011
+	inverterFrom, inverterTo             = 32064, 32097
+	meterFrom, meterTo                   = 37100, 37139
+	esu1From, esu1To                     = 37000, 37070
+	esu2From, esu2To                     = 37700, 37757
+	batteryPackFrom, batteryPackSize     = 38200, 42
+)
+
+// Handler is what we need from the goburrow handlers, so that the Client does not care if it talks Modbus TCP to the
+// SDongle, or Modbus RTU directly on the RS485 port of the inverter.
+type Handler interface {
+	modbus.ClientHandler
+	Connect() error
+	Close() error
+}
+
+type Config struct {
+	// "tcp" (default) or "rtu"
+	Mode string
+	// host:port, for "tcp"
+	Address string
+	// the serial line, for "rtu"
+	SerialDevice   string
+	SerialBaudRate int
+	SerialDataBits int
+	SerialParity   string
+	SerialStopBits int
+
+	SlaveID byte
+	Timeout time.Duration
+	// optional, to log the Modbus frames
+	Logger *log.Logger
+}
+
+// Client is one Modbus session towards the inverters. It is not safe for concurrent use, since the requests on the
+// session must not overlap.
+type Client struct {
+	name    string
+	handler Handler
+	client  modbus.Client
+}
+
+func NewClient(c Config) *Client {
+	var x Client
+	switch c.Mode {
+	case "rtu":
+		h := modbus.NewRTUClientHandler(c.SerialDevice)
+		h.BaudRate = c.SerialBaudRate
+		h.DataBits = c.SerialDataBits
+		h.Parity = c.SerialParity
+		h.StopBits = c.SerialStopBits
+		h.Timeout = c.Timeout
+		h.SlaveId = c.SlaveID
+		h.Logger = c.Logger
+		x.name = fmt.Sprintf("%s (%d %d%s%d)", c.SerialDevice, c.SerialBaudRate, c.SerialDataBits, c.SerialParity, c.SerialStopBits)
+		x.handler = h
+	default:
+		h := modbus.NewTCPClientHandler(c.Address)
+		h.Timeout = c.Timeout
+		h.SlaveId = c.SlaveID
+		h.Logger = c.Logger
+		x.name = c.Address
+		x.handler = h
+	}
+	x.client = modbus.NewClient(x.handler)
+	return &x
+}
+
+// Connect opens the session now, so that all the requests go over it, and fails early if the inverter is not there.
+func (x *Client) Connect() error {
+	if err := x.handler.Connect(); err != nil {
+		return fmt.Errorf("modbus failed to connect to %s: %v", x.name, err)
+	}
+	return nil
+}
+
+func (x *Client) Close() error {
+	return x.handler.Close()
+}
+
+// SetSlaveID switches the target slave for the next requests, e.g. for the cascaded inverters behind the same
+// SDongle.
+func (x *Client) SetSlaveID(slaveID byte) {
+	switch h := x.handler.(type) {
+	case *modbus.TCPClientHandler:
+		h.SlaveId = slaveID
+	case *modbus.RTUClientHandler:
+		h.SlaveId = slaveID
+	}
+}
+
+// ReadRegisters reads the holding registers in [from, to).
+func (x *Client) ReadRegisters(from, to uint16) ([]byte, error) {
+	return x.client.ReadHoldingRegisters(from, to-from)
+}
+
+// WriteRegisters writes the values from the address on, with write-multiple-registers, then reads them back to make
+// sure that the inverter took them.
+func (x *Client) WriteRegisters(address uint16, values []uint16) error {
+	if err := x.WriteMultipleRegisters(address, values); err != nil {
+		return fmt.Errorf("writing: %w", err)
+	}
+	written := make([]byte, 0, 2*len(values))
+	for _, v := range values {
+		written = binary.BigEndian.AppendUint16(written, v)
+	}
+	read, err := x.client.ReadHoldingRegisters(address, uint16(len(values)))
+	if err != nil {
+		return fmt.Errorf("reading back: %w", err)
+	}
+	if !bytes.Equal(read, written) {
+		return fmt.Errorf("reads back as % x, after writing % x", read, written)
+	}
+	return nil
+}
+
+func (x *Client) ReadIdentification() (Identification, error) {
+	data, err := x.ReadRegisters(identificationFrom, identificationTo)
+	if err != nil {
+		return Identification{}, err
+	}
+	return DecodeIdentification(data)
+}
+
+func (x *Client) ReadInverter() (Inverter, error) {
+	data, err := x.ReadRegisters(inverterFrom, inverterTo)
+	if err != nil {
+		return Inverter{}, err
+	}
+	return DecodeInverter(data)
+}
+
+func (x *Client) ReadMeter() (Meter, error) {
+	data, err := x.ReadRegisters(meterFrom, meterTo)
+	if err != nil {
+		return Meter{}, err
+	}
+	return DecodeMeter(data)
+}
+
+func (x *Client) ReadAlarms() (Alarms, error) {
+	data, err := x.ReadRegisters(alarmsFrom, alarmsTo)
+	if err != nil {
+		return Alarms{}, err
+	}
+	return DecodeAlarms(data)
+}
+
+// ReadESU reads the ESU 1 or 2.
+func (x *Client) ReadESU(esu int) (ESU, error) {
+	switch esu {
+	case 1:
+		data, err := x.ReadRegisters(esu1From, esu1To)
+		if err != nil {
+			return ESU{}, err
+		}
+		return DecodeESU1(data)
+	case 2:
+		data, err := x.ReadRegisters(esu2From, esu2To)
+		if err != nil {
+			return ESU{}, err
+		}
+		return DecodeESU2(data)
+	}
+	return ESU{}, fmt.Errorf("unknown ESU %d, not 1 or 2", esu)
+}
+
+// ReadBatteryPack reads the pack 1 to 3 of the ESU 1 or 2.
+func (x *Client) ReadBatteryPack(esu, pack int) (BatteryPack, error) {
+	if esu < 1 || esu > 2 || pack < 1 || pack > 3 {
+		return BatteryPack{}, fmt.Errorf("unknown pack %d of ESU %d", pack, esu)
+	}
+	from := uint16(batteryPackFrom + ((esu-1)*3+pack-1)*batteryPackSize)
+	data, err := x.ReadRegisters(from, from+batteryPackSize)
+	if err != nil {
+		return BatteryPack{}, err
+	}
+	return DecodeBatteryPack(data)
+}
+
+// WriteMultipleRegisters writes the values from the address on, as they are, without reading them back.
+func (x *Client) WriteMultipleRegisters(address uint16, values []uint16) error {
+	data := make([]byte, 0, 2*len(values))
+	for _, v := range values {
+		data = binary.BigEndian.AppendUint16(data, v)
+	}
+	_, err := x.client.WriteMultipleRegisters(address, uint16(len(values)), data)
+	return err
+}
@@ -12,16 +12,19 @@
 //
 // You should have received a copy of the AGPL-3.0 along with sun2000-modbus. If not,
 // see <https://www.gnu.org/licenses/>.
-package main
+package sun2000
 
 import (
 	"encoding/binary"
 	"fmt"
 )
 
-func getSTR(data []byte, idx, size uint) (out string, idxOut uint, err error) {
+// The decoding helpers take the raw bytes of a block, as returned by a read of holding registers, and the index of the
+// value in bytes. They return the value, and the index of the next one, so that a block can be decoded in sequence.
+
+// GetSTR decodes a string of size registers, trimmed of the padding NULs.
+func GetSTR(data []byte, idx, size uint) (out string, idxOut uint, err error) {
 	if len(data) < int(idx+2*size) {
-		lError.Printf("data length %d < %d", len(data), idx+2*size)
 		return "", idx, fmt.Errorf("data length %d < %d", len(data), idx+2*size)
 	}
 	in := data[idx : idx+2*size]
@@ -39,7 +42,8 @@ func getSTR(data []byte, idx, size uint) (out string, idxOut uint, err error) {
 			break
 		}
 	}
-	x := in[first:last]
+	// copied, so that the NULs are not replaced in the caller's data
+	x := []byte(string(in[first:last]))
 	for i := 0; i < len(x); i++ {
 		if x[i] == 0 {
 			x[i] = '.' // replace nulls with dots
@@ -48,49 +52,45 @@ func getSTR(data []byte, idx, size uint) (out string, idxOut uint, err error) {
 	return string(x), idx + 2*size, nil
 }
 
-func getU16(data []byte, idx uint) (out uint16, idxOut uint, err error) {
+func GetU16(data []byte, idx uint) (out uint16, idxOut uint, err error) {
 	var size uint = 1
 	if len(data) < int(idx+2*size) {
-		lError.Printf("data length %d < %d", len(data), idx+2*size)
 		return 0, idx, fmt.Errorf("data length %d < %d", len(data), idx+2*size)
 	}
 	out = binary.BigEndian.Uint16(data[idx : idx+2*size])
 	return out, idx + 2*size, nil
 }
 
-func getU32(data []byte, idx uint) (out uint32, idxOut uint, err error) {
+func GetU32(data []byte, idx uint) (out uint32, idxOut uint, err error) {
 	var size uint = 2
 	if len(data) < int(idx+2*size) {
-		lError.Printf("data length %d < %d", len(data), idx+2*size)
 		return 0, idx, fmt.Errorf("data length %d < %d", len(data), idx+2*size)
 	}
 	out = binary.BigEndian.Uint32(data[idx : idx+2*size])
 	return out, idx + 2*size, nil
 }
 
-func getI16(data []byte, idx uint) (out int16, idxOut uint, err error) {
+func GetI16(data []byte, idx uint) (out int16, idxOut uint, err error) {
 	var size uint = 1
 	if len(data) < int(idx+2*size) {
-		lError.Printf("data length %d < %d", len(data), idx+2*size)
 		return 0, idx, fmt.Errorf("data length %d < %d", len(data), idx+2*size)
 	}
 	out = int16(binary.BigEndian.Uint16(data[idx : idx+2*size]))
 	return out, idx + 2*size, nil
 }
 
-func getI32(data []byte, idx uint) (out int32, idxOut uint, err error) {
+func GetI32(data []byte, idx uint) (out int32, idxOut uint, err error) {
 	var size uint = 2
 	if len(data) < int(idx+2*size) {
-		lError.Printf("data length %d < %d", len(data), idx+2*size)
 		return 0, idx, fmt.Errorf("data length %d < %d", len(data), idx+2*size)
 	}
 	out = int32(binary.BigEndian.Uint32(data[idx : idx+2*size]))
 	return out, idx + 2*size, nil
 }
 
-func skipRecords(data []byte, idx, size uint) (idxOut uint, err error) {
+// SkipRecords skips size registers.
+func SkipRecords(data []byte, idx, size uint) (idxOut uint, err error) {
 	if len(data) < int(idx+2*size) {
-		lError.Printf("data length %d < %d", len(data), idx+2*size)
 		return idx, fmt.Errorf("data length %d < %d", len(data), idx+2*size)
 	}
 	return idx + 2*size, nil
@@ -0,0 +1,60 @@
+// Copyright: 2024 Dragos Vingarzan vingarzan -at- gmail -dot- com
+// License: AGPL-3.0
+//
+// This file is part of sun2000-modbus.
+//
+// sun2000-modbus is free software: you can redistribute it and/or modify it under the terms of the GNU Affero General
+// Public License Version 3 (AGPL-3.0) as published by the Free Software Foundation.
+//
+// sun2000-modbus is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY; without even the implied
+// warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the AGPL-3.0 along with sun2000-modbus. If not,
+// see <https://www.gnu.org/licenses/>.
+package sun2000
+
+import (
+	"testing"
+	"time"
+)
+
+func TestDecoders(t *testing.T) {
+	data := []byte{0, 'A', 0, 'B', 'C', 0, 0xff, 0xfe, 0x00, 0x01, 0x86, 0xa0}
+	s, idx, err := GetSTR(data, 0, 3)
+	if err != nil || s != "A.BC" || idx != 6 {
+		t.Errorf("GetSTR() = %q, %d, %v", s, idx, err)
+	}
+	if data[2] != 0 {
+		t.Errorf("GetSTR() changed its input")
+	}
+	i16, idx, _ := GetI16(data, idx)
+	if i16 != -2 || idx != 8 {
+		t.Errorf("GetI16() = %d, %d", i16, idx)
+	}
+	u32, idx, _ := GetU32(data, idx)
+	if u32 != 100000 || idx != 12 {
+		t.Errorf("GetU32() = %d, %d", u32, idx)
+	}
+	if _, idx, err := GetU16(data, idx); err == nil || idx != 12 {
+		t.Errorf("GetU16() past the end = %d, %v", idx, err)
+	}
+}
+
+func TestDecodeInverter(t *testing.T) {
+	data := make([]byte, 2*(inverterTo-inverterFrom))
+	// active power 32080, device status 32089, startup time 32091
+	copy(data[2*(32080-inverterFrom):], []byte{0, 0, 0x0b, 0xb8})
+	copy(data[2*(32089-inverterFrom):], []byte{0x02, 0x00})
+	copy(data[2*(32091-inverterFrom):], []byte{0x66, 0x75, 0x00, 0x00})
+	x, err := DecodeInverter(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if x.ActivePower != 3 || x.DeviceStatus.String() != "On-grid: running" || !x.StartupTime.Equal(time.Unix(0x66750000, 0)) {
+		t.Errorf("unexpected %+v", x)
+	}
+	if _, err := DecodeInverter(data[:10]); err == nil {
+		t.Errorf("no error for short data")
+	}
+}
@@ -0,0 +1,216 @@
+// Copyright: 2024 Dragos Vingarzan vingarzan -at- gmail -dot- com
+// License: AGPL-3.0
+//
+// This file is part of sun2000-modbus.
+//
+// sun2000-modbus is free software: you can redistribute it and/or modify it under the terms of the GNU Affero General
+// Public License Version 3 (AGPL-3.0) as published by the Free Software Foundation.
+//
+// sun2000-modbus is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY; without even the implied
+// warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the AGPL-3.0 along with sun2000-modbus. If not,
+// see <https://www.gnu.org/licenses/>.
+package main
+
+import (
+	"errors"
+	"io"
+	"math/rand"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/goburrow/modbus"
+)
+
+// The supervision of the Modbus connections: the errors are classified, to tell the broken connections from the
+// requests which just failed, then the broken ones are reopened with an exponential backoff, and after too many
+// failures in a row the circuit opens, to leave the SDongle alone for a while.
+
+type errorClass string
+
+const (
+	errorClassTimeout       errorClass = "timeout"
+	errorClassConnection    errorClass = "connection"
+	errorClassException     errorClass = "exception"
+	errorClassTransactionID errorClass = "transaction_id"
+	errorClassOther         errorClass = "other"
+)
+
+var errorClasses = []errorClass{errorClassTimeout, errorClassConnection, errorClassException, errorClassTransactionID, errorClassOther}
+
+// errConnectionClosed is returned for the requests while the connection is closed.
+var errConnectionClosed = errors.New("modbus connection is closed")
+
+func classifyError(err error) errorClass {
+	var mbErr *modbus.ModbusError
+	var netErr net.Error
+	switch {
+	case errors.As(err, &mbErr):
+		return errorClassException
+	case strings.Contains(err.Error(), "modbus: response transaction id"):
+		// the SUN2000 bug, after which the responses don't match the requests anymore
+		return errorClassTransactionID
+	case errors.Is(err, os.ErrDeadlineExceeded), errors.As(err, &netErr) && netErr.Timeout(),
+		strings.Contains(err.Error(), "timeout"):
+		return errorClassTimeout
+	case errors.Is(err, errConnectionClosed), errors.Is(err, io.EOF), errors.Is(err, io.ErrUnexpectedEOF),
+		errors.Is(err, net.ErrClosed), errors.Is(err, syscall.ECONNRESET), errors.Is(err, syscall.ECONNREFUSED),
+		errors.Is(err, syscall.EPIPE):
+		return errorClassConnection
+	}
+	return errorClassOther
+}
+
+type connectionState string
+
+const (
+	stateConnected  connectionState = "connected"
+	stateBackingOff connectionState = "backing_off"
+	stateOpen       connectionState = "open"
+)
+
+var connectionStates = []connectionState{stateConnected, stateBackingOff, stateOpen}
+
+type supervisorConfig struct {
+	// the first wait before reconnecting, doubled after each failure, up to backoffMax
+	backoffMin time.Duration
+	backoffMax time.Duration
+	// reconnects without a successful read in between, after which the circuit opens for circuitOpenTime; 0 for never
+	circuitFailures uint
+	circuitOpenTime time.Duration
+	// timeouts in a row, after which the connection is considered dropped
+	timeoutsBeforeReconnect uint
+}
+
+// connSupervisor is the state of a connection, and decides when to reconnect it.
+type connSupervisor struct {
+	sync.Mutex
+	cfg supervisorConfig
+	rnd *rand.Rand
+
+	state connectionState
+	// no connection attempt before this
+	retryAt time.Time
+	// the next backoff, before the jitter
+	backoff time.Duration
+	// reconnects since the last successful read, and timeouts in a row
+	failures uint
+	timeouts uint
+
+	reconnects   uint
+	circuitOpens uint
+	errors       map[errorClass]uint
+}
+
+func newConnSupervisor(c supervisorConfig) *connSupervisor {
+	return &connSupervisor{
+		cfg:     c,
+		rnd:     rand.New(rand.NewSource(time.Now().UnixNano())),
+		state:   stateBackingOff,
+		backoff: c.backoffMin,
+		errors:  make(map[errorClass]uint),
+	}
+}
+
+// readFailed counts the error, and tells if the connection should be closed and reopened.
+func (x *connSupervisor) readFailed(err error) (reconnect bool) {
+	class := classifyError(err)
+	x.Lock()
+	defer x.Unlock()
+	x.errors[class]++
+	if errors.Is(err, errConnectionClosed) {
+		// already closed, nothing more to do
+		return false
+	}
+	switch class {
+	case errorClassTimeout:
+		x.timeouts++
+		return x.timeouts >= x.cfg.timeoutsBeforeReconnect
+	case errorClassConnection, errorClassTransactionID:
+		return true
+	}
+	// the connection is fine, e.g. for an exception of a slave which is not there
+	return false
+}
+
+func (x *connSupervisor) readSucceeded() {
+	x.Lock()
+	defer x.Unlock()
+	x.timeouts = 0
+	x.failures = 0
+	x.backoff = x.cfg.backoffMin
+}
+
+// failed is called when the connection was closed because of errors, or could not be opened. It returns the wait
+// before the next attempt.
+func (x *connSupervisor) failed() time.Duration {
+	x.Lock()
+	defer x.Unlock()
+	x.failures++
+	x.timeouts = 0
+	if x.cfg.circuitFailures > 0 && x.failures >= x.cfg.circuitFailures {
+		x.state = stateOpen
+		x.circuitOpens++
+		x.failures = 0
+		x.backoff = x.cfg.backoffMin
+		x.retryAt = time.Now().Add(x.cfg.circuitOpenTime)
+		return x.cfg.circuitOpenTime
+	}
+	// equal jitter: half of the backoff, plus a random part of the other half
+	wait := x.backoff/2 + time.Duration(x.rnd.Int63n(int64(x.backoff/2)+1))
+	x.state = stateBackingOff
+	x.retryAt = time.Now().Add(wait)
+	x.backoff = min(2*x.backoff, x.cfg.backoffMax)
+	return wait
+}
+
+// mayConnect tells if a connection attempt is allowed now.
+func (x *connSupervisor) mayConnect() (bool, connectionState, time.Time) {
+	x.Lock()
+	defer x.Unlock()
+	return !time.Now().Before(x.retryAt), x.state, x.retryAt
+}
+
+func (x *connSupervisor) connected(reconnect bool) {
+	x.Lock()
+	defer x.Unlock()
+	x.state = stateConnected
+	if reconnect {
+		x.reconnects++
+	}
+}
+
+func (x *connSupervisor) collectMetrics(r *metricsRegistry, name string) {
+	x.Lock()
+	defer x.Unlock()
+	conn := metricLabel{"connection", name}
+	for _, s := range connectionStates {
+		value := 0.0
+		if s == x.state {
+			value = 1
+		}
+		r.gauge("sun2000_modbus_connection_state", "State of the Modbus connection", value, conn, metricLabel{"state", string(s)})
+	}
+	r.counter("sun2000_modbus_reconnects_total", "Modbus connections reopened", float64(x.reconnects), conn)
+	r.counter("sun2000_modbus_circuit_opens_total", "Times the circuit opened, after too many failed reconnects", float64(x.circuitOpens), conn)
+	for _, class := range errorClasses {
+		r.counter("sun2000_modbus_connection_errors_total", "Failed Modbus requests, by class of error", float64(x.errors[class]), conn, metricLabel{"class", string(class)})
+	}
+}
+
+// collectConnectionMetrics adds the metrics of the distinct connections of the devices.
+func collectConnectionMetrics(r *metricsRegistry, devices []*device) {
+	seen := make(map[*modbusConnection]bool)
+	for _, d := range devices {
+		if !seen[d.conn] {
+			seen[d.conn] = true
+			d.conn.sup.collectMetrics(r, d.conn.name)
+		}
+	}
+}
@@ -0,0 +1,116 @@
+// Copyright: 2024 Dragos Vingarzan vingarzan -at- gmail -dot- com
+// License: AGPL-3.0
+//
+// This file is part of sun2000-modbus.
+//
+// sun2000-modbus is free software: you can redistribute it and/or modify it under the terms of the GNU Affero General
+// Public License Version 3 (AGPL-3.0) as published by the Free Software Foundation.
+//
+// sun2000-modbus is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY; without even the implied
+// warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the AGPL-3.0 along with sun2000-modbus. If not,
+// see <https://www.gnu.org/licenses/>.
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/goburrow/modbus"
+)
+
+func TestClassifyError(t *testing.T) {
+	tests := []struct {
+		err  error
+		want errorClass
+	}{
+		{&modbus.ModbusError{FunctionCode: 3, ExceptionCode: modbus.ExceptionCodeIllegalDataAddress}, errorClassException},
+		{fmt.Errorf("modbus: response transaction id '3' does not match request '2'"), errorClassTransactionID},
+		{fmt.Errorf("read tcp: %w", os.ErrDeadlineExceeded), errorClassTimeout},
+		{fmt.Errorf("serial: timeout"), errorClassTimeout},
+		{io.EOF, errorClassConnection},
+		{fmt.Errorf("read tcp: %w", syscall.ECONNRESET), errorClassConnection},
+		{fmt.Errorf("sim1: %w", errConnectionClosed), errorClassConnection},
+		{errors.New("modbus: response data size '3' does not match count '4'"), errorClassOther},
+	}
+	for _, tt := range tests {
+		if got := classifyError(tt.err); got != tt.want {
+			t.Errorf("classifyError(%v) = %s, want %s", tt.err, got, tt.want)
+		}
+	}
+}
+
+func TestSupervisorReadFailed(t *testing.T) {
+	x := newConnSupervisor(supervisorConfig{backoffMin: time.Second, backoffMax: time.Minute, timeoutsBeforeReconnect: 3})
+	if x.readFailed(&modbus.ModbusError{ExceptionCode: modbus.ExceptionCodeIllegalDataAddress}) {
+		t.Error("an exception asked for a reconnect")
+	}
+	if x.readFailed(errConnectionClosed) {
+		t.Error("a closed connection asked for a reconnect")
+	}
+	if !x.readFailed(io.EOF) {
+		t.Error("an EOF did not ask for a reconnect")
+	}
+	for i := 1; i <= 3; i++ {
+		if got := x.readFailed(os.ErrDeadlineExceeded); got != (i == 3) {
+			t.Errorf("timeout %d asked for a reconnect: %v", i, got)
+		}
+	}
+	// the timeouts must be in a row
+	x.readFailed(os.ErrDeadlineExceeded)
+	x.readSucceeded()
+	if x.readFailed(os.ErrDeadlineExceeded) {
+		t.Error("the timeouts were not reset by a successful read")
+	}
+	if x.errors[errorClassTimeout] != 5 || x.errors[errorClassConnection] != 2 || x.errors[errorClassException] != 1 {
+		t.Errorf("unexpected error counts %v", x.errors)
+	}
+}
+
+func TestSupervisorBackoff(t *testing.T) {
+	x := newConnSupervisor(supervisorConfig{
+		backoffMin:      time.Second,
+		backoffMax:      4 * time.Second,
+		circuitFailures: 5,
+		circuitOpenTime: time.Hour,
+	})
+	// the waits double up to the maximum, with up to half of each one random
+	for i, backoff := range []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 4 * time.Second} {
+		wait := x.failed()
+		if wait < backoff/2 || wait > backoff {
+			t.Errorf("failure %d: wait %s not within [%s, %s]", i+1, wait, backoff/2, backoff)
+		}
+		if ok, state, _ := x.mayConnect(); ok || state != stateBackingOff {
+			t.Errorf("failure %d: mayConnect() = %v, %s", i+1, ok, state)
+		}
+	}
+
+	// then the circuit opens
+	if wait := x.failed(); wait != time.Hour {
+		t.Errorf("the circuit opened for %s", wait)
+	}
+	if ok, state, _ := x.mayConnect(); ok || state != stateOpen || x.circuitOpens != 1 {
+		t.Errorf("mayConnect() = %v, %s, after %d circuit opens", ok, state, x.circuitOpens)
+	}
+
+	// and after it, the backoff starts over
+	x.retryAt = time.Now()
+	if ok, _, _ := x.mayConnect(); !ok {
+		t.Error("no connection allowed after the circuit closed")
+	}
+	x.connected(true)
+	x.readSucceeded()
+	if wait := x.failed(); wait > time.Second {
+		t.Errorf("the backoff was not reset, wait %s", wait)
+	}
+	if x.reconnects != 1 {
+		t.Errorf("unexpected reconnects %d", x.reconnects)
+	}
+}